@@ -0,0 +1,48 @@
+// Command load-antibiotic-catalogue loads the antibiotic reference catalogue
+// from a CSV file and matches every stored antibiotic against it again:
+//
+//	go run ./cmd/load-antibiotic-catalogue -file data/antibiotic_catalogue.csv
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/services"
+)
+
+func main() {
+	path := flag.String("file", "data/antibiotic_catalogue.csv", "Catalogue CSV file")
+	apply := flag.Bool("apply", true, "Match stored antibiotics against the catalogue after loading")
+	flag.Parse()
+
+	file, err := os.Open(*path)
+	if err != nil {
+		log.Fatal("Failed to open catalogue file:", err)
+	}
+	defer file.Close()
+
+	database.InitDB()
+	db := database.GetDB()
+
+	result, err := services.ImportAntibioticCatalogue(db, file)
+	if err != nil {
+		log.Fatal("Failed to load antibiotic catalogue:", err)
+	}
+	for _, message := range result.Errors {
+		fmt.Println(message)
+	}
+	fmt.Printf("%d catalogue entries added, %d updated, %d rejected\n",
+		result.InsertedRecords, result.UpdatedRecords, result.SkippedRecords)
+
+	if !*apply {
+		return
+	}
+	matched, unmatched, err := services.EnrichAntibiotics(db)
+	if err != nil {
+		log.Fatal("Failed to match antibiotics:", err)
+	}
+	fmt.Printf("%d antibiotics matched to the catalogue, %d unmatched\n", matched, unmatched)
+}
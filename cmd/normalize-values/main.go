@@ -0,0 +1,39 @@
+// Command normalize-values rewrites the yes/no and other categorical columns
+// of rows imported before value normalisation to their canonical codes, so the
+// PPS indicators count them. Run it once after upgrading:
+//
+//	go run ./cmd/normalize-values -dry-run
+//	go run ./cmd/normalize-values
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/services"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "Only report the values that would change")
+	flag.Parse()
+
+	database.InitDB()
+
+	changes, err := services.NormalizeStoredValues(database.GetDB(), *dryRun)
+	if err != nil {
+		log.Fatal("Failed to normalise values:", err)
+	}
+
+	var rows int64
+	for _, change := range changes {
+		fmt.Printf("%s.%s: %q -> %q (%d rows)\n", change.Table, change.Column, change.From, change.To, change.Rows)
+		rows += change.Rows
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: %d rows would be updated\n", rows)
+		return
+	}
+	fmt.Printf("%d rows updated\n", rows)
+}
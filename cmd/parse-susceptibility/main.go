@@ -0,0 +1,25 @@
+// Command parse-susceptibility parses the susceptibility test results of every
+// stored specimen into the susceptibility_results table. Imports parse them as
+// specimens are written; run it once after upgrading for specimens imported
+// before:
+//
+//	go run ./cmd/parse-susceptibility
+package main
+
+import (
+	"fmt"
+	"log"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/services"
+)
+
+func main() {
+	database.InitDB()
+
+	specimens, results, err := services.RebuildSusceptibilityResults(database.GetDB())
+	if err != nil {
+		log.Fatal("Failed to parse susceptibility results:", err)
+	}
+
+	fmt.Printf("%d susceptibility results parsed from %d specimens\n", results, specimens)
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
@@ -15,6 +16,45 @@ type Config struct {
 	DBName     string
 	DBSSLMode  string
 	ServerPort string
+
+	// MappingProfilesFile is an optional JSON file with CSV column mapping profiles
+	MappingProfilesFile string
+	// QualityRulesFile is an optional JSON file adding to or replacing the
+	// default data quality rules
+	QualityRulesFile string
+	// ImportBatchSize is the number of CSV rows written per database transaction
+	ImportBatchSize int
+	// MaxUploadSizeMB limits the size of uploaded files; 0 means no limit
+	MaxUploadSizeMB int
+	// MaxDecompressedSizeMB caps gzip-compressed uploads once decompressed
+	// when MaxUploadSizeMB is not set
+	MaxDecompressedSizeMB int
+	// ImportWorkers is the number of background workers processing async imports
+	ImportWorkers int
+	// ImportQueueSize is the number of async imports that can wait for a worker
+	ImportQueueSize int
+	// ImportTempDir holds uploaded files until a worker imports them
+	ImportTempDir string
+	// UploadSessionTTLHours is how long an unfinished resumable upload is kept
+	// after its last chunk
+	UploadSessionTTLHours int
+	// DateTimezone is the IANA zone of imported dates written without one
+	DateTimezone string
+
+	// ODKBaseURL is the ODK Central server submissions are synced from, e.g.
+	// https://central.example.org; sync is disabled when empty
+	ODKBaseURL   string
+	ODKProjectID string
+	ODKFormID    string
+	// ODKUsername and ODKPassword authenticate with HTTP basic auth; ODKToken
+	// is sent as a bearer token instead when set
+	ODKUsername string
+	ODKPassword string
+	ODKToken    string
+	// ODKPageSize is the number of submissions fetched per OData request
+	ODKPageSize int
+	// ODKSyncIntervalMinutes runs the sync periodically; 0 means only on request
+	ODKSyncIntervalMinutes int
 }
 
 func LoadConfig() *Config {
@@ -32,6 +72,26 @@ func LoadConfig() *Config {
 		DBName:     getEnv("DB_NAME", "pps"),
 		DBSSLMode:  getEnv("DB_SSLMODE", "disable"),
 		ServerPort: getEnv("SERVER_PORT", "8080"),
+
+		MappingProfilesFile:   getEnv("CSV_MAPPING_FILE", ""),
+		QualityRulesFile:      getEnv("QUALITY_RULES_FILE", ""),
+		ImportBatchSize:       getEnvInt("IMPORT_BATCH_SIZE", 500),
+		MaxUploadSizeMB:       getEnvInt("MAX_UPLOAD_SIZE_MB", 0),
+		MaxDecompressedSizeMB: getEnvInt("MAX_DECOMPRESSED_SIZE_MB", 1024),
+		ImportWorkers:         getEnvInt("IMPORT_WORKERS", 2),
+		ImportQueueSize:       getEnvInt("IMPORT_QUEUE_SIZE", 100),
+		ImportTempDir:         getEnv("IMPORT_TEMP_DIR", os.TempDir()),
+		UploadSessionTTLHours: getEnvInt("UPLOAD_SESSION_TTL_HOURS", 24),
+		DateTimezone:          getEnv("DATE_TIMEZONE", "UTC"),
+
+		ODKBaseURL:             getEnv("ODK_BASE_URL", ""),
+		ODKProjectID:           getEnv("ODK_PROJECT_ID", ""),
+		ODKFormID:              getEnv("ODK_FORM_ID", ""),
+		ODKUsername:            getEnv("ODK_USERNAME", ""),
+		ODKPassword:            getEnv("ODK_PASSWORD", ""),
+		ODKToken:               getEnv("ODK_TOKEN", ""),
+		ODKPageSize:            getEnvInt("ODK_PAGE_SIZE", 250),
+		ODKSyncIntervalMinutes: getEnvInt("ODK_SYNC_INTERVAL_MINUTES", 0),
 	}
 }
 
@@ -42,6 +102,16 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+		log.Printf("Warning: invalid value %q for %s, using %d", value, key, defaultValue)
+	}
+	return defaultValue
+}
+
 func (c *Config) GetDSN() string {
 	return "host=" + c.DBHost + " port=" + c.DBPort + " user=" + c.DBUser + " password=" + c.DBPassword + " dbname=" + c.DBName + " sslmode=" + c.DBSSLMode
 }
@@ -51,6 +51,16 @@ func Migrate() {
 		&models.Indication{},
 		&models.OptionalVar{},
 		&models.Specimen{},
+		&models.SusceptibilityResult{},
+		&models.ImportJob{},
+		&models.ImportRowError{},
+		&models.UploadSession{},
+		&models.QualityFlag{},
+		&models.OrphanRow{},
+		&models.SyncState{},
+		&models.AntibioticReference{},
+		&models.AntibioticNameMapping{},
+		&models.DuplicateDismissal{},
 	)
 
 	if err != nil {
@@ -338,9 +338,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/antibiotics": {
+        "/api/v1/antibiotic-mappings": {
             "get": {
-                "description": "Get a list of antibiotics with optional filtering by class, classification, etc.",
+                "description": "Get the antibiotic names that did not match the reference catalogue exactly, with the closest catalogue entry as a suggestion. By default only names waiting for review are listed, most frequent first",
                 "consumes": [
                     "application/json"
                 ],
@@ -348,26 +348,15 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "antibiotics"
+                    "antibiotic-mappings"
                 ],
-                "summary": "Get all antibiotics with optional filtering",
+                "summary": "List antibiotic names in the review queue",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Filter by antibiotic class",
-                        "name": "class",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by antibiotic aware classification",
-                        "name": "classification",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by patient ID",
-                        "name": "patient_id",
+                        "default": "pending",
+                        "description": "pending, accepted, rejected or all",
+                        "name": "status",
                         "in": "query"
                     },
                     {
@@ -392,13 +381,73 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Remember that a free-text antibiotic name means a catalogue entry, without waiting for it in the review queue. Stored antibiotics written under the name are matched at once",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "antibiotic-mappings"
+                ],
+                "summary": "Map an antibiotic name to the catalogue",
+                "parameters": [
+                    {
+                        "description": "Name and catalogue entry",
+                        "name": "mapping",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.nameMapping"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
             }
         },
-        "/api/v1/antibiotics/patient/{patient_id}": {
-            "get": {
-                "description": "Get detailed antibiotic usage information for a specific patient",
+        "/api/v1/antibiotic-mappings/{id}": {
+            "delete": {
+                "description": "Delete a queued or reviewed antibiotic name. It is matched and queued again the next time it is imported",
                 "consumes": [
                     "application/json"
                 ],
@@ -406,32 +455,37 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "antibiotics"
+                    "antibiotic-mappings"
                 ],
-                "summary": "Get antibiotic usage by patient",
+                "summary": "Forget an antibiotic name mapping",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Patient ID",
-                        "name": "patient_id",
+                        "type": "integer",
+                        "description": "Mapping ID",
+                        "name": "id",
                         "in": "path",
                         "required": true
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": true
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     }
                 }
             }
         },
-        "/api/v1/antibiotics/stats": {
-            "get": {
-                "description": "Get aggregated statistics about antibiotics usage",
+        "/api/v1/antibiotic-mappings/{id}/accept": {
+            "post": {
+                "description": "Map a queued antibiotic name to its suggested catalogue entry, or to reference_id when given. The mapping is used by later imports, and stored antibiotics written under the name are matched at once",
                 "consumes": [
                     "application/json"
                 ],
@@ -439,9 +493,26 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "antibiotics"
+                    "antibiotic-mappings"
+                ],
+                "summary": "Accept an antibiotic name suggestion",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Mapping ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Catalogue entry overriding the suggestion, and reviewer",
+                        "name": "review",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.mappingReview"
+                        }
+                    }
                 ],
-                "summary": "Get antibiotic statistics",
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -449,13 +520,31 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
             }
         },
-        "/api/v1/antibiotics/{id}": {
-            "get": {
-                "description": "Get detailed information about a specific antibiotic",
+        "/api/v1/antibiotic-mappings/{id}/reject": {
+            "post": {
+                "description": "Mark the suggestion for a queued antibiotic name as wrong. The name stays unmatched in later imports until it is accepted with another catalogue entry",
                 "consumes": [
                     "application/json"
                 ],
@@ -463,31 +552,49 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "antibiotics"
+                    "antibiotic-mappings"
                 ],
-                "summary": "Get a specific antibiotic by ID",
+                "summary": "Reject an antibiotic name suggestion",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Antibiotic ID",
+                        "type": "integer",
+                        "description": "Mapping ID",
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "description": "Reviewer",
+                        "name": "review",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.mappingReview"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Antibiotic"
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     }
                 }
             }
         },
-        "/api/v1/optional-vars": {
+        "/api/v1/antibiotic-references": {
             "get": {
-                "description": "Get a list of optional variables with optional filtering by prescriber type, intravenous type, etc.",
+                "description": "Get the catalogue of INN names, synonyms, ATC codes, AWaRe categories and DDDs imported antibiotics are matched against",
                 "consumes": [
                     "application/json"
                 ],
@@ -495,74 +602,20 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
+                    "antibiotic-references"
                 ],
-                "summary": "Get all optional variables with optional filtering",
+                "summary": "List the antibiotic reference catalogue",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Filter by prescriber type",
-                        "name": "prescriber_type",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by intravenous type",
-                        "name": "intravenous_type",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by guidelines compliance",
-                        "name": "guidelines_compliance",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
+                        "description": "Search INN names, synonyms and ATC codes",
+                        "name": "q",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "description": "Filter by AWaRe category (access, watch, reserve, not_recommended)",
+                        "name": "aware",
                         "in": "query"
                     },
                     {
@@ -591,7 +644,7 @@ const docTemplate = `{
                 }
             },
             "post": {
-                "description": "Create a new optional variable record with the provided data",
+                "description": "Add an antibiotic to the reference catalogue. Antibiotics imported afterwards are matched against it; use the apply endpoint to match stored antibiotics again",
                 "consumes": [
                     "application/json"
                 ],
@@ -599,17 +652,17 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
+                    "antibiotic-references"
                 ],
-                "summary": "Create a new optional variable record",
+                "summary": "Add an antibiotic reference",
                 "parameters": [
                     {
-                        "description": "Optional Variable data",
-                        "name": "optional_var",
+                        "description": "Antibiotic reference",
+                        "name": "reference",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/models.OptionalVar"
+                            "$ref": "#/definitions/models.AntibioticReference"
                         }
                     }
                 ],
@@ -617,7 +670,7 @@ const docTemplate = `{
                     "201": {
                         "description": "Created",
                         "schema": {
-                            "$ref": "#/definitions/models.OptionalVar"
+                            "$ref": "#/definitions/models.AntibioticReference"
                         }
                     },
                     "400": {
@@ -629,8 +682,8 @@ const docTemplate = `{
                             }
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "409": {
+                        "description": "Conflict",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -641,9 +694,33 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/optional-vars/stats": {
+        "/api/v1/antibiotic-references/apply": {
+            "post": {
+                "description": "Match every stored antibiotic against the reference catalogue again and update its INN name, ATC code, class, AWaRe category and DDD, e.g. after the catalogue was edited",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "antibiotic-references"
+                ],
+                "summary": "Match stored antibiotics against the catalogue",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/antibiotic-references/unmatched": {
             "get": {
-                "description": "Get aggregated statistics about optional variables",
+                "description": "Get the names of stored antibiotics that did not match the reference catalogue, with the number of antibiotics under each, most frequent first",
                 "consumes": [
                     "application/json"
                 ],
@@ -651,59 +728,9 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
-                ],
-                "summary": "Get optional variables statistics",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
-                        "in": "query"
-                    }
+                    "antibiotic-references"
                 ],
+                "summary": "List antibiotic names not in the catalogue",
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -715,9 +742,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/optional-vars/upload": {
+        "/api/v1/antibiotic-references/upload": {
             "post": {
-                "description": "Upload multiple optional variables from a CSV file",
+                "description": "Load catalogue entries from a CSV file with an inn_name column and optional synonyms (separated by semicolons), atc_code, antibiotic_class, aware_category, oral_ddd, parenteral_ddd and ddd_unit columns. Entries are matched by INN name and updated, other names are added",
                 "consumes": [
                     "multipart/form-data"
                 ],
@@ -725,16 +752,22 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
+                    "antibiotic-references"
                 ],
-                "summary": "Bulk upload optional variables from CSV",
+                "summary": "Load the antibiotic reference catalogue from CSV",
                 "parameters": [
                     {
                         "type": "file",
-                        "description": "CSV file containing optional variables data",
+                        "description": "Catalogue CSV file",
                         "name": "file",
                         "in": "formData",
                         "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Match stored antibiotics against the catalogue again after loading",
+                        "name": "apply",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -749,26 +782,15 @@ const docTemplate = `{
                         "description": "Bad Request",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
-                        }
-                    },
-                    "500": {
-                        "description": "Internal Server Error",
-                        "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/v1/optional-vars/{id}": {
+        "/api/v1/antibiotic-references/{id}": {
             "get": {
-                "description": "Get detailed information about a specific optional variable",
+                "description": "Get one entry of the antibiotic reference catalogue",
                 "consumes": [
                     "application/json"
                 ],
@@ -776,13 +798,13 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
+                    "antibiotic-references"
                 ],
-                "summary": "Get a specific optional variable by ID",
+                "summary": "Get an antibiotic reference",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Optional Variable ID",
+                        "type": "integer",
+                        "description": "Reference ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -792,13 +814,22 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.OptionalVar"
+                            "$ref": "#/definitions/models.AntibioticReference"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     }
                 }
             },
             "put": {
-                "description": "Update an existing optional variable record by ID",
+                "description": "Update an entry of the antibiotic reference catalogue",
                 "consumes": [
                     "application/json"
                 ],
@@ -806,24 +837,24 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
+                    "antibiotic-references"
                 ],
-                "summary": "Update an optional variable record",
+                "summary": "Update an antibiotic reference",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Optional Variable ID",
+                        "type": "integer",
+                        "description": "Reference ID",
                         "name": "id",
                         "in": "path",
                         "required": true
                     },
                     {
-                        "description": "Updated Optional Variable data",
-                        "name": "optional_var",
+                        "description": "Antibiotic reference",
+                        "name": "reference",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/models.OptionalVar"
+                            "$ref": "#/definitions/models.AntibioticReference"
                         }
                     }
                 ],
@@ -831,7 +862,7 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.OptionalVar"
+                            "$ref": "#/definitions/models.AntibioticReference"
                         }
                     },
                     "400": {
@@ -852,8 +883,8 @@ const docTemplate = `{
                             }
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "409": {
+                        "description": "Conflict",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -864,7 +895,7 @@ const docTemplate = `{
                 }
             },
             "delete": {
-                "description": "Delete an optional variable record by ID",
+                "description": "Remove an antibiotic from the reference catalogue. Antibiotics matched to it keep their values but lose the reference, and names mapped to it go back to the review queue",
                 "consumes": [
                     "application/json"
                 ],
@@ -872,13 +903,13 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "optional-vars"
+                    "antibiotic-references"
                 ],
-                "summary": "Delete an optional variable record",
+                "summary": "Delete an antibiotic reference",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Optional Variable ID",
+                        "type": "integer",
+                        "description": "Reference ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -896,22 +927,13 @@ const docTemplate = `{
                                 "type": "string"
                             }
                         }
-                    },
-                    "500": {
-                        "description": "Internal Server Error",
-                        "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
-                        }
                     }
                 }
             }
         },
-        "/api/v1/patients": {
+        "/api/v1/antibiotics": {
             "get": {
-                "description": "Get a list of patients with optional filtering by region, district, facility, etc.",
+                "description": "Get a list of antibiotics with optional filtering by class, classification, etc.",
                 "consumes": [
                     "application/json"
                 ],
@@ -919,32 +941,26 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "patients"
+                    "antibiotics"
                 ],
-                "summary": "Get all patients with optional filtering",
+                "summary": "Get all antibiotics with optional filtering",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Filter by region",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by district",
-                        "name": "district",
+                        "description": "Filter by antibiotic class",
+                        "name": "class",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Filter by facility",
-                        "name": "facility",
+                        "description": "Filter by antibiotic aware classification",
+                        "name": "classification",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Filter by ward name",
-                        "name": "ward",
+                        "description": "Filter by patient ID",
+                        "name": "patient_id",
                         "in": "query"
                     },
                     {
@@ -973,33 +989,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/patients/stats": {
-            "get": {
-                "description": "Get aggregated statistics about patients",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "patients"
-                ],
-                "summary": "Get patient statistics",
-                "responses": {
-                    "200": {
-                        "description": "OK",
-                        "schema": {
-                            "type": "object",
-                            "additionalProperties": true
-                        }
-                    }
-                }
-            }
-        },
-        "/api/v1/patients/{id}": {
+        "/api/v1/antibiotics/patient/{patient_id}": {
             "get": {
-                "description": "Get detailed information about a specific patient including all related data",
+                "description": "Get detailed antibiotic usage information for a specific patient",
                 "consumes": [
                     "application/json"
                 ],
@@ -1007,14 +999,14 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "patients"
+                    "antibiotics"
                 ],
-                "summary": "Get a specific patient by ID",
+                "summary": "Get antibiotic usage by patient",
                 "parameters": [
                     {
                         "type": "string",
                         "description": "Patient ID",
-                        "name": "id",
+                        "name": "patient_id",
                         "in": "path",
                         "required": true
                     }
@@ -1023,15 +1015,16 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Patient"
+                            "type": "object",
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/v1/patients/{id}/antibiotics": {
+        "/api/v1/antibiotics/stats": {
             "get": {
-                "description": "Get all antibiotics associated with a specific patient",
+                "description": "Get aggregated statistics about antibiotics usage",
                 "consumes": [
                     "application/json"
                 ],
@@ -1039,34 +1032,23 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "patients"
-                ],
-                "summary": "Get antibiotics for a specific patient",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Patient ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
+                    "antibiotics"
                 ],
+                "summary": "Get antibiotic statistics",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Antibiotic"
-                            }
+                            "type": "object",
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/v1/patients/{id}/indications": {
+        "/api/v1/antibiotics/{id}": {
             "get": {
-                "description": "Get all indications associated with a specific patient",
+                "description": "Get detailed information about a specific antibiotic",
                 "consumes": [
                     "application/json"
                 ],
@@ -1074,13 +1056,13 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "patients"
+                    "antibiotics"
                 ],
-                "summary": "Get indications for a specific patient",
+                "summary": "Get a specific antibiotic by ID",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Patient ID",
+                        "description": "Antibiotic ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -1090,99 +1072,30 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Indication"
-                            }
+                            "$ref": "#/definitions/models.Antibiotic"
                         }
                     }
                 }
             }
         },
-        "/api/v1/patients/{id}/optional-vars": {
+        "/api/v1/export/fhir": {
             "get": {
-                "description": "Get all optional variables associated with a specific patient",
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Export survey patients as FHIR R4 bundles, one bundle per line (NDJSON). Each bundle holds a Patient, an Encounter for the admission, a MedicationRequest for each antibiotic, a Condition for each indication, and a Specimen with a culture Observation for each specimen. Excluded patients are left out",
                 "produces": [
-                    "application/json"
+                    "application/fhir+ndjson"
                 ],
                 "tags": [
-                    "patients"
+                    "export"
                 ],
-                "summary": "Get optional variables for a specific patient",
+                "summary": "Export patients as FHIR bundles",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Patient ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "OK",
-                        "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.OptionalVar"
-                            }
-                        }
-                    }
-                }
-            }
-        },
-        "/api/v1/patients/{id}/specimens": {
-            "get": {
-                "description": "Get all specimens associated with a specific patient",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "patients"
-                ],
-                "summary": "Get specimens for a specific patient",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Patient ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "OK",
-                        "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Specimen"
-                            }
-                        }
-                    }
-                }
-            }
-        },
-        "/api/v1/pps/appropriate-diagnosis": {
-            "get": {
-                "description": "Percentage = count of \"yes\" responses divided by total responses (yes/no) from indications.reason_in_notes",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "pps-calculations"
-                ],
-                "summary": "Get appropriate diagnosis percentage",
-                "parameters": [
+                        "default": "collection",
+                        "description": "collection, or transaction to post each bundle to a FHIR server",
+                        "name": "type",
+                        "in": "query"
+                    },
                     {
                         "type": "string",
                         "description": "Start date for filtering (YYYY-MM-DD)",
@@ -1236,12 +1149,11 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "type": "file"
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -1252,79 +1164,50 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/aware-categorization": {
+        "/api/v1/export/fhir/{id}": {
             "get": {
-                "description": "Calculate the distribution of antibiotics based on WHO AWaRe classification (Access, Watch, Reserve, Unclassified) with optional filtering",
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Export one survey patient, with its antibiotics, indications and specimens, as a FHIR R4 bundle",
                 "produces": [
-                    "application/json"
+                    "application/fhir+json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "export"
                 ],
-                "summary": "Get WHO AWaRe antibiotic categorization",
+                "summary": "Export a patient as a FHIR bundle",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     },
                     {
                         "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "default": "collection",
+                        "description": "collection, or transaction to post the bundle to a FHIR server",
+                        "name": "type",
                         "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/services.FHIRBundle"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": true
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -1335,20 +1218,36 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/basic-metrics": {
+        "/api/v1/export/whonet": {
             "get": {
-                "description": "Calculate basic Point Prevalence Survey metrics with optional filtering",
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Export specimens with their organisms, antibiotic results and resistance phenotypes as a WHONET flat file, one row per specimen and organism, with the patient's demographics. The file can be imported into WHONET with BacLink",
                 "produces": [
-                    "application/json"
+                    "text/plain"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "export"
                 ],
-                "summary": "Get basic PPS metrics",
+                "summary": "Export specimens for WHONET",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "default": "tab",
+                        "description": "tab, comma or semicolon",
+                        "name": "delimiter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by specimen type",
+                        "name": "specimen_type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by microorganism",
+                        "name": "microorganism",
+                        "in": "query"
+                    },
                     {
                         "type": "string",
                         "description": "Start date for filtering (YYYY-MM-DD)",
@@ -1402,12 +1301,11 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "type": "file"
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -1418,9 +1316,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/culture-metrics": {
+        "/api/v1/imports": {
             "get": {
-                "description": "Calculate culture and sensitivity metrics",
+                "description": "Get the history of uploads, newest first. Row errors and warnings are omitted; fetch a single job to see them",
                 "consumes": [
                     "application/json"
                 ],
@@ -1428,56 +1326,34 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "imports"
                 ],
-                "summary": "Get culture and sensitivity metrics",
+                "summary": "List import jobs",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
+                        "description": "Filter by status (queued, running, completed, failed, rolled_back)",
+                        "name": "status",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
+                        "description": "Filter by entity",
+                        "name": "entity",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number",
+                        "name": "page",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Items per page",
+                        "name": "limit",
                         "in": "query"
                     }
                 ],
@@ -1488,22 +1364,13 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
-                    },
-                    "500": {
-                        "description": "Internal Server Error",
-                        "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
-                        }
                     }
                 }
             }
         },
-        "/api/v1/pps/diagnosis-metrics": {
+        "/api/v1/imports/{id}": {
             "get": {
-                "description": "Calculate appropriate diagnosis metrics",
+                "description": "Get the status, progress counters and row errors of an import job",
                 "consumes": [
                     "application/json"
                 ],
@@ -1511,69 +1378,27 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "imports"
                 ],
-                "summary": "Get appropriate diagnosis metrics",
+                "summary": "Get an import job",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
-                        "in": "query"
+                        "type": "integer",
+                        "description": "Import job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/models.ImportJob"
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -1582,11 +1407,9 @@ const docTemplate = `{
                         }
                     }
                 }
-            }
-        },
-        "/api/v1/pps/generic-metrics": {
-            "get": {
-                "description": "Calculate generic name antibiotic prescription metrics",
+            },
+            "delete": {
+                "description": "Remove every row inserted by an import job, e.g. after a bad file was loaded. Rows the import updated keep their new values",
                 "consumes": [
                     "application/json"
                 ],
@@ -1594,69 +1417,36 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "imports"
                 ],
-                "summary": "Get generic name prescription metrics",
+                "summary": "Delete the rows of an import",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
-                        "in": "query"
+                        "type": "integer",
+                        "description": "Import job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.ImportJob"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": true
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "409": {
+                        "description": "Conflict",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -1667,79 +1457,49 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/guideline-metrics": {
+        "/api/v1/imports/{id}/errors.csv": {
             "get": {
-                "description": "Calculate treatment guideline compliance metrics",
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Download the rows an import rejected as CSV, with the original columns plus an import_error column, so they can be fixed and uploaded again",
                 "produces": [
-                    "application/json"
+                    "text/csv"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "imports"
                 ],
-                "summary": "Get treatment guideline compliance metrics",
+                "summary": "Download the rejected rows of an import",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
+                        "type": "integer",
+                        "description": "Import job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     },
                     {
                         "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "description": "File of a bundle import to report on",
+                        "name": "file",
                         "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": true
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -1750,9 +1510,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/indicators": {
+        "/api/v1/optional-vars": {
             "get": {
-                "description": "Calculate and return all Point Prevalence Survey indicators with optional filtering",
+                "description": "Get a list of optional variables with optional filtering by prescriber type, intravenous type, etc.",
                 "consumes": [
                     "application/json"
                 ],
@@ -1760,10 +1520,28 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "optional-vars"
                 ],
-                "summary": "Get all PPS indicators",
+                "summary": "Get all optional variables with optional filtering",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Filter by prescriber type",
+                        "name": "prescriber_type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by intravenous type",
+                        "name": "intravenous_type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by guidelines compliance",
+                        "name": "guidelines_compliance",
+                        "in": "query"
+                    },
                     {
                         "type": "string",
                         "description": "Start date for filtering (YYYY-MM-DD)",
@@ -1811,13 +1589,69 @@ const docTemplate = `{
                         "description": "Ownership for filtering",
                         "name": "ownership",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Items per page",
+                        "name": "limit",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/handlers.PPSIndicators"
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Create a new optional variable record with the provided data",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "optional-vars"
+                ],
+                "summary": "Create a new optional variable record",
+                "parameters": [
+                    {
+                        "description": "Optional Variable data",
+                        "name": "optional_var",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/models.OptionalVar"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/models.OptionalVar"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     },
                     "500": {
@@ -1832,9 +1666,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/injectable-metrics": {
+        "/api/v1/optional-vars/stats": {
             "get": {
-                "description": "Calculate injectable antibiotic prescription metrics",
+                "description": "Get aggregated statistics about optional variables",
                 "consumes": [
                     "application/json"
                 ],
@@ -1842,9 +1676,9 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "optional-vars"
                 ],
-                "summary": "Get injectable antibiotic metrics",
+                "summary": "Get optional variables statistics",
                 "parameters": [
                     {
                         "type": "string",
@@ -1902,80 +1736,48 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
-                    },
-                    "500": {
-                        "description": "Internal Server Error",
-                        "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
-                        }
                     }
                 }
             }
         },
-        "/api/v1/pps/long-stay-patients": {
-            "get": {
-                "description": "Calculate the number of patients who have been staying for more than 7 days based on survey date minus admission date",
+        "/api/v1/optional-vars/upload": {
+            "post": {
+                "description": "Upload multiple optional variables from a CSV file. The file is imported like POST /api/v1/upload/optional-vars with the default options, and recorded as an import job",
                 "consumes": [
-                    "application/json"
+                    "multipart/form-data"
                 ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "optional-vars"
                 ],
-                "summary": "Get patients staying longer than 7 days",
+                "summary": "Bulk upload optional variables from CSV",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
-                        "in": "query"
+                        "type": "file",
+                        "description": "CSV file containing optional variables data",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
                     }
                 ],
                 "responses": {
@@ -1986,6 +1788,29 @@ const docTemplate = `{
                             "additionalProperties": true
                         }
                     },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -1998,9 +1823,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/missed-dose-metrics": {
+        "/api/v1/optional-vars/{id}": {
             "get": {
-                "description": "Calculate missed dose metrics and reasons",
+                "description": "Get detailed information about a specific optional variable",
                 "consumes": [
                     "application/json"
                 ],
@@ -2008,65 +1833,125 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "optional-vars"
                 ],
-                "summary": "Get missed dose metrics",
+                "summary": "Get a specific optional variable by ID",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
+                        "description": "Optional Variable ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.OptionalVar"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Update an existing optional variable record by ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "optional-vars"
+                ],
+                "summary": "Update an optional variable record",
+                "parameters": [
                     {
                         "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
+                        "description": "Optional Variable ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     },
                     {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
+                        "description": "Updated Optional Variable data",
+                        "name": "optional_var",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/models.OptionalVar"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.OptionalVar"
+                        }
                     },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Delete an optional variable record by ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "optional-vars"
+                ],
+                "summary": "Delete an optional variable record",
+                "parameters": [
                     {
                         "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
-                        "in": "query"
+                        "description": "Optional Variable ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": true
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     },
                     "500": {
@@ -2081,9 +1966,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/oral-switch-metrics": {
+        "/api/v1/orphans": {
             "get": {
-                "description": "Calculate oral switch metrics",
+                "description": "Get child rows uploaded before their parent patient. They are linked automatically when the patient is imported; by default only rows still waiting are listed",
                 "consumes": [
                     "application/json"
                 ],
@@ -2091,56 +1976,47 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "orphans"
                 ],
-                "summary": "Get oral switch metrics",
+                "summary": "List staged child rows",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
+                        "default": "unresolved",
+                        "description": "unresolved, resolved or all",
+                        "name": "status",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
+                        "description": "Filter by entity (antibiotics, antibiotic-details, indications, specimens); antibiotic_details is accepted too",
+                        "name": "entity",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
+                        "description": "Filter by parent patient key",
+                        "name": "parent_key",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
+                        "type": "integer",
+                        "description": "Filter by the import the rows came from",
+                        "name": "import_id",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number",
+                        "name": "page",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Items per page",
+                        "name": "limit",
                         "in": "query"
                     }
                 ],
@@ -2152,8 +2028,8 @@ const docTemplate = `{
                             "additionalProperties": true
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -2164,9 +2040,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/pps/prescriber-metrics": {
-            "get": {
-                "description": "Calculate prescriber-related metrics",
+        "/api/v1/orphans/{id}": {
+            "delete": {
+                "description": "Delete a child row still waiting for its parent patient, e.g. when the patient will never be uploaded",
                 "consumes": [
                     "application/json"
                 ],
@@ -2174,57 +2050,16 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "pps-calculations"
+                    "orphans"
                 ],
-                "summary": "Get prescriber metrics",
+                "summary": "Discard a staged child row",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
-                        "in": "query"
+                        "type": "integer",
+                        "description": "Staged row ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
@@ -2232,11 +2067,22 @@ const docTemplate = `{
                         "description": "OK",
                         "schema": {
                             "type": "object",
-                            "additionalProperties": true
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     },
-                    "500": {
-                        "description": "Internal Server Error",
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
@@ -2247,9 +2093,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/specimens": {
+        "/api/v1/patients": {
             "get": {
-                "description": "Get a list of specimens with optional filtering by type, result, etc.",
+                "description": "Get a list of patients with optional filtering by region, district, facility, etc.",
                 "consumes": [
                     "application/json"
                 ],
@@ -2257,74 +2103,44 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "specimens"
+                    "patients"
                 ],
-                "summary": "Get all specimens with optional filtering",
+                "summary": "Get all patients with optional filtering",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Filter by specimen type",
-                        "name": "type",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by culture result",
-                        "name": "result",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Filter by patient ID",
-                        "name": "patient_id",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
+                        "description": "Filter by region",
                         "name": "region",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "District for filtering",
+                        "description": "Filter by district",
                         "name": "district",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
+                        "description": "Filter by facility",
+                        "name": "facility",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Facility for filtering",
-                        "name": "facility",
+                        "description": "Filter by ward name",
+                        "name": "ward",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
+                        "type": "boolean",
+                        "description": "Filter by exclusion from the PPS indicators",
+                        "name": "excluded",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "type": "boolean",
+                        "description": "Filter by data quality flags on the patient or its child records",
+                        "name": "flagged",
                         "in": "query"
                     },
                     {
@@ -2353,42 +2169,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/specimens/patient/{patient_id}": {
-            "get": {
-                "description": "Get all specimens associated with a specific patient",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "specimens"
-                ],
-                "summary": "Get specimens by patient",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Patient ID",
-                        "name": "patient_id",
-                        "in": "path",
-                        "required": true
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "OK",
-                        "schema": {
-                            "type": "object",
-                            "additionalProperties": true
-                        }
-                    }
-                }
-            }
-        },
-        "/api/v1/specimens/stats": {
+        "/api/v1/patients/duplicates": {
             "get": {
-                "description": "Get aggregated statistics about specimens",
+                "description": "List pairs of patients surveyed on the same date in the same facility and ward, scored from 0 to 1 on their initials, patient code, age, gender and admission date, highest score first. Excluded patients and pairs dismissed as different patients are not listed",
                 "consumes": [
                     "application/json"
                 ],
@@ -2396,56 +2179,27 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "specimens"
+                    "patients"
                 ],
-                "summary": "Get specimen statistics",
+                "summary": "List possible duplicate patients",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Start date for filtering (YYYY-MM-DD)",
-                        "name": "start_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "End date for filtering (YYYY-MM-DD)",
-                        "name": "end_date",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Region for filtering",
-                        "name": "region",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "District for filtering",
-                        "name": "district",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Subcounty for filtering",
-                        "name": "subcounty",
-                        "in": "query"
-                    },
-                    {
-                        "type": "string",
-                        "description": "Facility for filtering",
+                        "description": "Filter by facility",
                         "name": "facility",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Level of care for filtering",
-                        "name": "level",
+                        "description": "Filter by ward name",
+                        "name": "ward",
                         "in": "query"
                     },
                     {
-                        "type": "string",
-                        "description": "Ownership for filtering",
-                        "name": "ownership",
+                        "type": "number",
+                        "default": 0.7,
+                        "description": "Lowest score listed",
+                        "name": "min_score",
                         "in": "query"
                     }
                 ],
@@ -2456,13 +2210,22 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
             }
         },
-        "/api/v1/specimens/{id}": {
-            "get": {
-                "description": "Get detailed information about a specific specimen",
+        "/api/v1/patients/duplicates/dismiss": {
+            "post": {
+                "description": "Record that a pair listed as possible duplicates are different patients, so the pair is no longer listed",
                 "consumes": [
                     "application/json"
                 ],
@@ -2470,48 +2233,70 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "specimens"
+                    "patients"
                 ],
-                "summary": "Get a specific specimen by ID",
+                "summary": "Mark two patients as different patients",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Specimen ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Pair of patients",
+                        "name": "dismissal",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.duplicateDismissal"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Specimen"
+                            "$ref": "#/definitions/models.DuplicateDismissal"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     }
                 }
             }
         },
-        "/api/v1/upload/antibiotic-details": {
+        "/api/v1/patients/duplicates/merge": {
             "post": {
-                "description": "Upload a CSV file containing antibiotic details data",
+                "description": "Keep one record of a patient surveyed twice. Text and date fields blank on the kept record are filled in from the duplicate, as are the zero numeric fields listed in numeric. The duplicate is excluded from the PPS indicators together with its child rows",
                 "consumes": [
-                    "multipart/form-data"
+                    "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "upload"
+                    "patients"
                 ],
-                "summary": "Upload antibiotic details CSV file",
+                "summary": "Merge two records of the same patient",
                 "parameters": [
                     {
-                        "type": "file",
-                        "description": "CSV file containing antibiotic details data",
-                        "name": "file",
-                        "in": "formData",
-                        "required": true
+                        "description": "Patient kept and duplicate",
+                        "name": "merge",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.duplicateMerge"
+                        }
                     }
                 ],
                 "responses": {
@@ -2521,29 +2306,3401 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
-                    }
-                }
-            }
-        },
-        "/api/v1/upload/antibiotics": {
-            "post": {
-                "description": "Upload and import antibiotics data from CSV file",
-                "consumes": [
-                    "multipart/form-data"
-                ],
-                "produces": [
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/stats": {
+            "get": {
+                "description": "Get aggregated statistics about patients",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get patient statistics",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}": {
+            "get": {
+                "description": "Get detailed information about a specific patient including all related data",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get a specific patient by ID",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Patient"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/antibiotics": {
+            "get": {
+                "description": "Get all antibiotics associated with a specific patient",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get antibiotics for a specific patient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.Antibiotic"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/exclude": {
+            "post": {
+                "description": "Leave a patient and its antibiotics, indications, specimens and other child rows out of the PPS indicators and the resistance summary, e.g. a patient surveyed twice. The records are kept, and later imports do not change the exclusion",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Exclude a patient from the PPS indicators",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Reason for the exclusion",
+                        "name": "exclusion",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.exclusion"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Patient"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/include": {
+            "post": {
+                "description": "Reverse the exclusion of a patient, or its merge into another patient",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Include an excluded patient in the PPS indicators again",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Patient"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/indications": {
+            "get": {
+                "description": "Get all indications associated with a specific patient",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get indications for a specific patient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.Indication"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/optional-vars": {
+            "get": {
+                "description": "Get all optional variables associated with a specific patient",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get optional variables for a specific patient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.OptionalVar"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/quality-flags": {
+            "get": {
+                "description": "Get the data quality rules broken by a patient and its child records",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get data quality flags for a specific patient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.QualityFlag"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/patients/{id}/specimens": {
+            "get": {
+                "description": "Get all specimens associated with a specific patient",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "patients"
+                ],
+                "summary": "Get specimens for a specific patient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.Specimen"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/appropriate-diagnosis": {
+            "get": {
+                "description": "Percentage = count of \"yes\" responses divided by total responses (yes/no) from indications.reason_in_notes",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get appropriate diagnosis percentage",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/aware-categorization": {
+            "get": {
+                "description": "Calculate the distribution of antibiotics based on WHO AWaRe classification (Access, Watch, Reserve, Unclassified) with optional filtering",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get WHO AWaRe antibiotic categorization",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/basic-metrics": {
+            "get": {
+                "description": "Calculate basic Point Prevalence Survey metrics with optional filtering",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get basic PPS metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/culture-metrics": {
+            "get": {
+                "description": "Calculate culture and sensitivity metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get culture and sensitivity metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/diagnosis-metrics": {
+            "get": {
+                "description": "Calculate appropriate diagnosis metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get appropriate diagnosis metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/generic-metrics": {
+            "get": {
+                "description": "Calculate generic name antibiotic prescription metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get generic name prescription metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/guideline-metrics": {
+            "get": {
+                "description": "Calculate treatment guideline compliance metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get treatment guideline compliance metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/indicators": {
+            "get": {
+                "description": "Calculate and return all Point Prevalence Survey indicators with optional filtering",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get all PPS indicators",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.PPSIndicators"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/injectable-metrics": {
+            "get": {
+                "description": "Calculate injectable antibiotic prescription metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get injectable antibiotic metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/long-stay-patients": {
+            "get": {
+                "description": "Calculate the number of patients who have been staying for more than 7 days based on survey date minus admission date",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get patients staying longer than 7 days",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/missed-dose-metrics": {
+            "get": {
+                "description": "Calculate missed dose metrics and reasons",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get missed dose metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/oral-switch-metrics": {
+            "get": {
+                "description": "Calculate oral switch metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get oral switch metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/pps/prescriber-metrics": {
+            "get": {
+                "description": "Calculate prescriber-related metrics",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "pps-calculations"
+                ],
+                "summary": "Get prescriber metrics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/quality/evaluate": {
+            "post": {
+                "description": "Check every stored record against the current data quality rules, replacing all flags. Imports only check the records they write, so run this after the rules change",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "quality"
+                ],
+                "summary": "Re-check stored records",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/services.QualityEvaluation"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/quality/flags": {
+            "get": {
+                "description": "Get the data quality rules broken by stored records",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "quality"
+                ],
+                "summary": "List data quality flags",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Filter by entity (patients, antibiotics, antibiotic_details, indications, specimens)",
+                        "name": "entity",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by the key of the flagged record",
+                        "name": "key",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by patient, including the patient's child records",
+                        "name": "patient_key",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by rule ID",
+                        "name": "rule",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by severity (reject or warn)",
+                        "name": "severity",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Filter by the import that raised the flags",
+                        "name": "import_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Items per page",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/quality/rules": {
+            "get": {
+                "description": "Get the active data quality rules checked on every imported record: the defaults, with the rules of QUALITY_RULES_FILE added or replacing them",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "quality"
+                ],
+                "summary": "List the data quality rules",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/quality/summary": {
+            "get": {
+                "description": "Count the stored flags and flagged records per rule, and the patients with at least one flag on themselves or their child records",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "quality"
+                ],
+                "summary": "Count data quality flags",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/specimens": {
+            "get": {
+                "description": "Get a list of specimens with optional filtering by type, result, etc.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "specimens"
+                ],
+                "summary": "Get all specimens with optional filtering",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Filter by specimen type",
+                        "name": "type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by culture result",
+                        "name": "result",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by patient ID",
+                        "name": "patient_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Items per page",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/specimens/patient/{patient_id}": {
+            "get": {
+                "description": "Get all specimens associated with a specific patient",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "specimens"
+                ],
+                "summary": "Get specimens by patient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Patient ID",
+                        "name": "patient_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/specimens/stats": {
+            "get": {
+                "description": "Get aggregated statistics about specimens",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "specimens"
+                ],
+                "summary": "Get specimen statistics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/specimens/{id}": {
+            "get": {
+                "description": "Get detailed information about a specific specimen",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "specimens"
+                ],
+                "summary": "Get a specific specimen by ID",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Specimen ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Specimen"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/specimens/{id}/antibiogram": {
+            "get": {
+                "description": "Get the susceptibility results of a specimen grouped by organism, with the antibiotics each organism is susceptible, intermediate or resistant to",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "specimens"
+                ],
+                "summary": "Get the antibiogram of a specimen",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Specimen ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/specimens/{id}/susceptibility": {
+            "get": {
+                "description": "Get the organism and antibiotic results parsed from a specimen's susceptibility test results",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "specimens"
+                ],
+                "summary": "Get susceptibility results of a specimen",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Specimen ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/susceptibility-results": {
+            "get": {
+                "description": "Get the organism and antibiotic results parsed from the susceptibility test results of specimens",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "susceptibility"
+                ],
+                "summary": "Get susceptibility results",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Filter by organism",
+                        "name": "organism",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by antibiotic",
+                        "name": "antibiotic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by interpretation (S, I or R)",
+                        "name": "interpretation",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by specimen ID",
+                        "name": "specimen_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by patient ID",
+                        "name": "patient_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Items per page",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/susceptibility-results/summary": {
+            "get": {
+                "description": "Get the number of isolates tested and found susceptible, intermediate or resistant for each organism and antibiotic, with the percentage resistant",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "susceptibility"
+                ],
+                "summary": "Get resistance by organism and antibiotic",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Filter by organism",
+                        "name": "organism",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by antibiotic",
+                        "name": "antibiotic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Start date for filtering (YYYY-MM-DD)",
+                        "name": "start_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End date for filtering (YYYY-MM-DD)",
+                        "name": "end_date",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Region for filtering",
+                        "name": "region",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "District for filtering",
+                        "name": "district",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subcounty for filtering",
+                        "name": "subcounty",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Facility for filtering",
+                        "name": "facility",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Level of care for filtering",
+                        "name": "level",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Ownership for filtering",
+                        "name": "ownership",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/sync/odk": {
+            "get": {
+                "description": "Get the configured ODK Central form and the outcome and watermark of the last sync",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "sync"
+                ],
+                "summary": "Get the ODK Central sync status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Fetch the submissions created or edited since the last sync from the ODK Central OData API and import them with their repeat groups. Each sync is recorded as an import job",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "sync"
+                ],
+                "summary": "Sync submissions from ODK Central",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Fetch every submission instead of only those since the last sync",
+                        "name": "full",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "newer",
+                        "description": "How rows whose key already exists are handled: skip, overwrite or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Roll back the whole sync if any row fails",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Run the sync in the background and return its job ID at once",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person starting the sync (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/antibiotic-details": {
+            "post": {
+                "description": "Upload a CSV file containing antibiotic details data",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload antibiotic details CSV file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "CSV or XLSX file containing antibiotic details data",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/antibiotics": {
+            "post": {
+                "description": "Upload and import antibiotics data from CSV file",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload antibiotics CSV file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "CSV or XLSX file containing antibiotics data",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/bundle": {
+            "post": {
+                "description": "Import a ZIP holding the main form CSV and the repeat-group CSVs, or an XLSX workbook with one sheet per table. Files and sheets are recognised by name or header and imported parents first",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload an ODK Central ZIP export or Excel workbook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole bundle in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "ZIP file of an ODK Central CSV export, or XLSX workbook with one sheet per table",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/fhir": {
+            "post": {
+                "description": "Import survey patients from a FHIR R4 Bundle, or from one bundle per line as written by GET /api/v1/export/fhir. Patient, Encounter, MedicationRequest, Condition, Specimen and culture Observation resources are read into patients with their antibiotics, indications and specimens; other resource types are ignored. Each patient is validated and written like a JSON submission",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Import FHIR R4 bundles",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Patients written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import all bundles in one transaction, rolling back on any patient error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with patients whose key already exists: skip (default), overwrite, or newer. Overwritten patients have their child records replaced",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Validate the patients without writing anything",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person or system sending the bundles (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "description": "FHIR bundle",
+                        "name": "bundle",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/services.FHIRBundle"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/indications": {
+            "post": {
+                "description": "Upload and import indications data from CSV file",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload indications CSV file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "CSV or XLSX file containing indications data",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/json": {
+            "post": {
+                "description": "Import a JSON array of patients, or a single patient object, each with its nested antibiotics, indications, specimens and optional vars. Every record is validated on its own and valid records are written in batches, one transaction per batch. The response reports the outcome of every record",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Submit patients as JSON",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Patients written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole submission in one transaction, rolling back on any record error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with patients whose key already exists: skip (default), overwrite, or newer. Overwritten patients have their child records replaced",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Validate the records without writing anything",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person or service submitting the records (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "description": "Patients with nested child records",
+                        "name": "patients",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.Patient"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/mappings": {
+            "get": {
+                "description": "List the versioned column mapping profiles used to read upload headers",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "List CSV column mapping profiles",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/ndjson": {
+            "post": {
+                "description": "Import a stream of patients with one JSON object per line, each with its nested antibiotics, indications, specimens and optional vars. A line that cannot be read only fails its own record",
+                "consumes": [
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Submit patients as NDJSON",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Patients written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole submission in one transaction, rolling back on any record error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with patients whose key already exists: skip (default), overwrite, or newer. Overwritten patients have their child records replaced",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Validate the records without writing anything",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person or service submitting the records (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/optional-vars": {
+            "post": {
+                "description": "Upload and import optional variables data from CSV file",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload optional variables CSV file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "CSV or XLSX file containing optional variables data",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/patients": {
+            "post": {
+                "description": "Upload and import patients data from CSV file",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload patients CSV file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "CSV or XLSX file containing patients data",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/sessions": {
+            "post": {
+                "description": "Start a chunked upload of a CSV, XLSX, WHONET or bundle file over a poor connection. Send the file with PATCH requests to the returned Location, each starting at the Upload-Offset the session has reached; after a dropped connection ask for the offset with HEAD and continue from there. Once every byte has arrived the file is queued as an async import job. Follows the tus 1.0 protocol, so entity and filename can also be sent in the Upload-Metadata header",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Start a resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "What the file holds: patients, antibiotics, antibiotic-details, indications, optional-vars, specimens, whonet or bundle",
+                        "name": "entity",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the file",
+                        "name": "filename",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Size of the whole file in bytes",
+                        "name": "Upload-Length",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/upload/sessions/{id}": {
+            "get": {
+                "description": "Get the progress of a resumable upload and, once complete, the import job it was queued as",
+                "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "upload"
                 ],
-                "summary": "Upload antibiotics CSV file",
+                "summary": "Get a resumable upload",
                 "parameters": [
                     {
-                        "type": "file",
-                        "description": "CSV file containing antibiotics data",
-                        "name": "file",
-                        "in": "formData",
+                        "type": "string",
+                        "description": "Upload session ID",
+                        "name": "id",
+                        "in": "path",
                         "required": true
                     }
                 ],
@@ -2554,15 +5711,85 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
-            }
-        },
-        "/api/v1/upload/indications": {
-            "post": {
-                "description": "Upload and import indications data from CSV file",
+            },
+            "delete": {
+                "description": "Cancel an unfinished upload and discard the bytes received so far",
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Cancel a resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload session ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            },
+            "head": {
+                "description": "Returns the bytes received so far in the Upload-Offset header, which is where the next chunk must start",
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Get the offset of a resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload session ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            },
+            "patch": {
+                "description": "Append the request body to the upload. Upload-Offset must equal the bytes received so far. Partial chunks are answered with 204 and the new Upload-Offset; the chunk completing the file is answered with 200 and the queued import job. If the import queue is full the answer is 503 and the file is kept; an empty chunk at the final offset queues it again. Chunks may be gzip-compressed with Content-Encoding: gzip, offsets then count uncompressed bytes",
                 "consumes": [
-                    "multipart/form-data"
+                    "application/offset+octet-stream"
                 ],
                 "produces": [
                     "application/json"
@@ -2570,13 +5797,20 @@ const docTemplate = `{
                 "tags": [
                     "upload"
                 ],
-                "summary": "Upload indications CSV file",
+                "summary": "Send a chunk of a resumable upload",
                 "parameters": [
                     {
-                        "type": "file",
-                        "description": "CSV file containing indications data",
-                        "name": "file",
-                        "in": "formData",
+                        "type": "string",
+                        "description": "Upload session ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Offset of the chunk in the file",
+                        "name": "Upload-Offset",
+                        "in": "header",
                         "required": true
                     }
                 ],
@@ -2587,13 +5821,55 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
                     }
                 }
             }
         },
-        "/api/v1/upload/optional-vars": {
+        "/api/v1/upload/specimens": {
             "post": {
-                "description": "Upload and import optional variables data from CSV file",
+                "description": "Upload and import specimens data from CSV file",
                 "consumes": [
                     "multipart/form-data"
                 ],
@@ -2603,11 +5879,83 @@ const docTemplate = `{
                 "tags": [
                     "upload"
                 ],
-                "summary": "Upload optional variables CSV file",
+                "summary": "Upload specimens CSV file",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Rows written per database transaction",
+                        "name": "batch_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the whole file in one transaction, rolling back on any row error",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
                     {
                         "type": "file",
-                        "description": "CSV file containing optional variables data",
+                        "description": "CSV or XLSX file containing specimens data",
                         "name": "file",
                         "in": "formData",
                         "required": true
@@ -2620,13 +5968,34 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
                     }
                 }
             }
         },
-        "/api/v1/upload/patients": {
+        "/api/v1/upload/whonet": {
             "post": {
-                "description": "Upload and import patients data from CSV file",
+                "description": "Add lab-confirmed organisms, antibiotic results and resistance phenotypes from a WHONET flat file (CSV or tab-delimited text) to existing specimens, matched by SPEC_NUM. Results for an organism replace the specimen's earlier results for it",
                 "consumes": [
                     "multipart/form-data"
                 ],
@@ -2636,11 +6005,35 @@ const docTemplate = `{
                 "tags": [
                     "upload"
                 ],
-                "summary": "Upload patients CSV file",
+                "summary": "Upload a WHONET result file",
                 "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Roll back the whole file if any row fails",
+                        "name": "atomic",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Queue the import for a background worker and return 202 with the import job",
+                        "name": "async",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the person uploading the file (or X-Uploaded-By header)",
+                        "name": "uploaded_by",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import the file even if the same content was imported before",
+                        "name": "force",
+                        "in": "query"
+                    },
                     {
                         "type": "file",
-                        "description": "CSV file containing patients data",
+                        "description": "WHONET file (CSV or TXT)",
                         "name": "file",
                         "in": "formData",
                         "required": true
@@ -2653,13 +6046,34 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
                     }
                 }
             }
         },
-        "/api/v1/upload/specimens": {
+        "/api/v1/upload/{entity}/validate": {
             "post": {
-                "description": "Upload and import specimens data from CSV file",
+                "description": "Run the same parsing and checks as an upload (column count, missing key, parent patient existence, date and number parsing) without writing anything, and return a row-level report",
                 "consumes": [
                     "multipart/form-data"
                 ],
@@ -2669,11 +6083,60 @@ const docTemplate = `{
                 "tags": [
                     "upload"
                 ],
-                "summary": "Upload specimens CSV file",
+                "summary": "Validate a survey CSV file without importing it",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entity (patients, antibiotics, antibiotic-details, indications, optional-vars, specimens, whonet)",
+                        "name": "entity",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Column mapping profile version",
+                        "name": "mapping_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version",
+                        "name": "form_version",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "What to do with rows whose key already exists: skip (default), overwrite, or newer",
+                        "name": "merge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates",
+                        "name": "date_format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD",
+                        "name": "date_formats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "IANA timezone of dates written without one (default DATE_TIMEZONE)",
+                        "name": "timezone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them",
+                        "name": "allow_invalid",
+                        "in": "query"
+                    },
                     {
                         "type": "file",
-                        "description": "CSV file containing specimens data",
+                        "description": "CSV or XLSX file to validate",
                         "name": "file",
                         "in": "formData",
                         "required": true
@@ -2686,6 +6149,24 @@ const docTemplate = `{
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
             }
@@ -2763,6 +6244,84 @@ const docTemplate = `{
                 }
             }
         },
+        "handlers.duplicateDismissal": {
+            "type": "object",
+            "required": [
+                "other_id",
+                "patient_id"
+            ],
+            "properties": {
+                "other_id": {
+                    "type": "string"
+                },
+                "patient_id": {
+                    "type": "string"
+                },
+                "reviewed_by": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.duplicateMerge": {
+            "type": "object",
+            "required": [
+                "duplicate",
+                "keep"
+            ],
+            "properties": {
+                "duplicate": {
+                    "type": "string"
+                },
+                "keep": {
+                    "type": "string"
+                },
+                "numeric": {
+                    "description": "Numeric lists the numeric fields, such as weight, to fill in when zero\non the kept record; other numbers are left as they are",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "handlers.exclusion": {
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.mappingReview": {
+            "type": "object",
+            "properties": {
+                "reference_id": {
+                    "description": "ReferenceID overrides the suggested catalogue entry",
+                    "type": "integer"
+                },
+                "reviewed_by": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.nameMapping": {
+            "type": "object",
+            "required": [
+                "name",
+                "reference_id"
+            ],
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "reference_id": {
+                    "type": "integer"
+                },
+                "reviewed_by": {
+                    "type": "string"
+                }
+            }
+        },
         "models.Antibiotic": {
             "type": "object",
             "properties": {
@@ -2787,61 +6346,224 @@ const docTemplate = `{
                 "atc_code": {
                     "type": "string"
                 },
+                "ddd": {
+                    "description": "DDD is the WHO defined daily dose for the route, from the catalogue",
+                    "type": "number"
+                },
+                "ddd_unit": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "import_id": {
+                    "type": "integer"
+                },
+                "other_antibiotic": {
+                    "type": "string"
+                },
+                "parent_key": {
+                    "type": "string"
+                },
+                "reference_id": {
+                    "description": "ReferenceID is the catalogue entry the antibiotic was matched to",
+                    "type": "integer"
+                },
+                "start_date_antibiotic": {
+                    "type": "string"
+                },
+                "unit_dose": {
+                    "type": "number"
+                },
+                "unit_dose_frequency": {
+                    "type": "string"
+                },
+                "unit_dose_measure_unit": {
+                    "type": "string"
+                },
+                "unit_doses_combination": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.AntibioticDetails": {
+            "type": "object",
+            "properties": {
+                "guideline": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "import_id": {
+                    "type": "integer"
+                },
+                "intraveno": {
+                    "type": "string"
+                },
+                "missed_dose": {
+                    "type": "string"
+                },
+                "number_missed": {
+                    "type": "string"
+                },
+                "oral_switch": {
+                    "type": "string"
+                },
+                "parent_key": {
+                    "type": "string"
+                },
+                "prescriber": {
+                    "type": "string"
+                },
+                "treatment": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.AntibioticReference": {
+            "type": "object",
+            "properties": {
+                "antibiotic_class": {
+                    "type": "string"
+                },
+                "atc_code": {
+                    "type": "string"
+                },
+                "aware_category": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "ddd_unit": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "inn_name": {
+                    "type": "string"
+                },
+                "oral_ddd": {
+                    "description": "OralDDD and ParenteralDDD are the WHO defined daily doses in DDDUnit;\nzero when there is none for the route",
+                    "type": "number"
+                },
+                "parenteral_ddd": {
+                    "type": "number"
+                },
+                "synonyms": {
+                    "description": "Synonyms are other names of the antibiotic, such as brand names or\nabbreviations, separated by semicolons",
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.DuplicateDismissal": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
                 "id": {
+                    "type": "integer"
+                },
+                "other_key": {
+                    "type": "string"
+                },
+                "patient_key": {
+                    "type": "string"
+                },
+                "reviewed_by": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.ImportJob": {
+            "type": "object",
+            "properties": {
+                "async": {
+                    "type": "boolean"
+                },
+                "atomic": {
+                    "type": "boolean"
+                },
+                "checksum": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "deleted_at": {
                     "type": "string"
                 },
-                "other_antibiotic": {
+                "deleted_records": {
+                    "type": "integer"
+                },
+                "entity": {
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "filename": {
                     "type": "string"
                 },
-                "parent_key": {
+                "finished_at": {
                     "type": "string"
                 },
-                "start_date_antibiotic": {
-                    "type": "string"
+                "id": {
+                    "type": "integer"
                 },
-                "unit_dose": {
-                    "type": "number"
+                "inserted_records": {
+                    "type": "integer"
                 },
-                "unit_dose_frequency": {
-                    "type": "string"
+                "linked_records": {
+                    "type": "integer"
                 },
-                "unit_dose_measure_unit": {
+                "mapping_version": {
                     "type": "string"
                 },
-                "unit_doses_combination": {
-                    "type": "string"
-                }
-            }
-        },
-        "models.AntibioticDetails": {
-            "type": "object",
-            "properties": {
-                "guideline": {
+                "merge_strategy": {
                     "type": "string"
                 },
-                "id": {
+                "message": {
                     "type": "string"
                 },
-                "intraveno": {
-                    "type": "string"
+                "processed_records": {
+                    "type": "integer"
                 },
-                "missed_dose": {
-                    "type": "string"
+                "skipped_records": {
+                    "type": "integer"
                 },
-                "number_missed": {
-                    "type": "string"
+                "staged_records": {
+                    "type": "integer"
                 },
-                "oral_switch": {
+                "started_at": {
                     "type": "string"
                 },
-                "parent_key": {
+                "status": {
                     "type": "string"
                 },
-                "prescriber": {
-                    "type": "string"
+                "total_records": {
+                    "type": "integer"
                 },
-                "treatment": {
+                "updated_records": {
+                    "type": "integer"
+                },
+                "uploaded_by": {
                     "type": "string"
+                },
+                "warnings": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
                 }
             }
         },
@@ -2857,6 +6579,9 @@ const docTemplate = `{
                 "id": {
                     "type": "string"
                 },
+                "import_id": {
+                    "type": "integer"
+                },
                 "indication_type": {
                     "type": "string"
                 },
@@ -2886,6 +6611,9 @@ const docTemplate = `{
                 "id": {
                     "type": "string"
                 },
+                "import_id": {
+                    "type": "integer"
+                },
                 "intravenous_type": {
                     "type": "string"
                 },
@@ -2937,199 +6665,635 @@ const docTemplate = `{
                 "attachments_present": {
                     "type": "string"
                 },
-                "central_vascular_catheter": {
+                "central_vascular_catheter": {
+                    "type": "string"
+                },
+                "code": {
+                    "type": "string"
+                },
+                "comments": {
+                    "type": "string"
+                },
+                "device_id": {
+                    "type": "string"
+                },
+                "diabetes": {
+                    "type": "string"
+                },
+                "district": {
+                    "type": "string"
+                },
+                "duplicate_of": {
+                    "description": "DuplicateOf is the patient this record was merged into",
+                    "type": "string"
+                },
+                "edits": {
+                    "type": "string"
+                },
+                "excluded": {
+                    "description": "Excluded patients, such as duplicates of another submission, are left\nout of the PPS indicators. Imports do not change these fields.",
+                    "type": "boolean"
+                },
+                "exclusion_reason": {
+                    "type": "string"
+                },
+                "facility": {
+                    "type": "string"
+                },
+                "form_version": {
+                    "type": "string"
+                },
+                "gender": {
+                    "type": "string"
+                },
+                "hiv_cd4_count": {
+                    "type": "string"
+                },
+                "hiv_on_art": {
+                    "type": "string"
+                },
+                "hiv_status": {
+                    "type": "string"
+                },
+                "hiv_viral_load": {
+                    "type": "string"
+                },
+                "hospitalization_90_days": {
+                    "type": "string"
+                },
+                "hypertension": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "import_id": {
+                    "type": "integer"
+                },
+                "indications": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.Indication"
+                    }
+                },
+                "instance_id": {
+                    "type": "string"
+                },
+                "intubation": {
+                    "type": "string"
+                },
+                "is_the_patient_an_infant": {
+                    "type": "string"
+                },
+                "level_of_care": {
+                    "type": "string"
+                },
+                "malaria_status": {
+                    "type": "string"
+                },
+                "malnutrition_status": {
+                    "type": "string"
+                },
+                "optional_vars": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.OptionalVar"
+                    }
+                },
+                "ownership": {
+                    "type": "string"
+                },
+                "patient_code": {
+                    "type": "string"
+                },
+                "patient_initials": {
+                    "type": "string"
+                },
+                "patient_number_antibiotics": {
+                    "type": "integer"
+                },
+                "patient_on_antibiotic": {
+                    "type": "string"
+                },
+                "peripheral_vascular_catheter": {
+                    "type": "string"
+                },
+                "pre_term_birth": {
+                    "type": "string"
+                },
+                "rand_num": {
+                    "type": "integer"
+                },
+                "referred_from": {
+                    "type": "string"
+                },
+                "region": {
+                    "type": "string"
+                },
+                "review_state": {
+                    "type": "string"
+                },
+                "show_code": {
+                    "type": "string"
+                },
+                "specimens": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.Specimen"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                },
+                "subcounty": {
+                    "type": "string"
+                },
+                "submission_date": {
+                    "type": "string"
+                },
+                "submitter_id": {
+                    "type": "string"
+                },
+                "submitter_name": {
+                    "type": "string"
+                },
+                "surgery_since_admission": {
+                    "type": "string"
+                },
+                "survey_date": {
+                    "type": "string"
+                },
+                "tuberculosis_status": {
+                    "type": "string"
+                },
+                "type_surgery_since_admission": {
+                    "type": "string"
+                },
+                "urinary_catheter": {
+                    "type": "string"
+                },
+                "ward_eligible_patients": {
+                    "type": "integer"
+                },
+                "ward_name": {
+                    "type": "string"
+                },
+                "ward_total_patients": {
+                    "type": "integer"
+                },
+                "weight": {
+                    "type": "number"
+                },
+                "weight_birth_kg": {
+                    "type": "number"
+                }
+            }
+        },
+        "models.QualityFlag": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "entity": {
+                    "type": "string"
+                },
+                "field": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "import_id": {
+                    "type": "integer"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "patient_key": {
+                    "type": "string"
+                },
+                "record_key": {
+                    "type": "string"
+                },
+                "rule": {
+                    "type": "string"
+                },
+                "severity": {
+                    "description": "Severity is that of the rule when the flag was raised",
+                    "type": "string"
+                }
+            }
+        },
+        "models.Specimen": {
+            "type": "object",
+            "properties": {
+                "antibiotic_susceptibility_test_results": {
+                    "type": "string"
+                },
+                "culture_result": {
                     "type": "string"
                 },
-                "code": {
+                "id": {
                     "type": "string"
                 },
-                "comments": {
-                    "type": "string"
+                "import_id": {
+                    "type": "integer"
                 },
-                "device_id": {
+                "microorganism": {
                     "type": "string"
                 },
-                "diabetes": {
+                "parent_key": {
                     "type": "string"
                 },
-                "district": {
+                "resistant_phenotype": {
                     "type": "string"
                 },
-                "edits": {
+                "specimen_type": {
                     "type": "string"
                 },
-                "facility": {
+                "susceptibility_results": {
+                    "description": "Associations",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.SusceptibilityResult"
+                    }
+                }
+            }
+        },
+        "models.SusceptibilityResult": {
+            "type": "object",
+            "properties": {
+                "antibiotic": {
                     "type": "string"
                 },
-                "form_version": {
-                    "type": "string"
+                "id": {
+                    "type": "integer"
                 },
-                "gender": {
+                "interpretation": {
+                    "description": "Interpretation is S, I or R; empty when only a MIC or zone was given",
                     "type": "string"
                 },
-                "hiv_cd4_count": {
-                    "type": "string"
+                "mic": {
+                    "type": "number"
                 },
-                "hiv_on_art": {
+                "mic_comparator": {
+                    "description": "MICComparator is the sign written before the MIC, e.g. \"\u003c=\" or \"\u003e\"",
                     "type": "string"
                 },
-                "hiv_status": {
+                "organism": {
                     "type": "string"
                 },
-                "hiv_viral_load": {
+                "patient_key": {
                     "type": "string"
                 },
-                "hospitalization_90_days": {
+                "raw": {
+                    "description": "Raw is the text the result was read from",
                     "type": "string"
                 },
-                "hypertension": {
+                "specimen_key": {
                     "type": "string"
                 },
-                "id": {
+                "zone_diameter": {
+                    "type": "number"
+                }
+            }
+        },
+        "services.FHIRAnnotation": {
+            "type": "object",
+            "properties": {
+                "text": {
                     "type": "string"
-                },
-                "indications": {
+                }
+            }
+        },
+        "services.FHIRBundle": {
+            "type": "object",
+            "properties": {
+                "entry": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/models.Indication"
+                        "$ref": "#/definitions/services.FHIRBundleEntry"
                     }
                 },
-                "instance_id": {
+                "id": {
                     "type": "string"
                 },
-                "intubation": {
+                "resourceType": {
                     "type": "string"
                 },
-                "is_the_patient_an_infant": {
+                "timestamp": {
                     "type": "string"
                 },
-                "level_of_care": {
+                "type": {
                     "type": "string"
-                },
-                "malaria_status": {
+                }
+            }
+        },
+        "services.FHIRBundleEntry": {
+            "type": "object",
+            "properties": {
+                "fullUrl": {
                     "type": "string"
                 },
-                "malnutrition_status": {
+                "request": {
+                    "$ref": "#/definitions/services.FHIRBundleRequest"
+                },
+                "resource": {
+                    "$ref": "#/definitions/services.FHIRResource"
+                }
+            }
+        },
+        "services.FHIRBundleRequest": {
+            "type": "object",
+            "properties": {
+                "method": {
                     "type": "string"
                 },
-                "optional_vars": {
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "services.FHIRCodeableConcept": {
+            "type": "object",
+            "properties": {
+                "coding": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/models.OptionalVar"
+                        "$ref": "#/definitions/services.FHIRCoding"
                     }
                 },
-                "ownership": {
+                "text": {
+                    "type": "string"
+                }
+            }
+        },
+        "services.FHIRCoding": {
+            "type": "object",
+            "properties": {
+                "code": {
                     "type": "string"
                 },
-                "patient_code": {
+                "display": {
                     "type": "string"
                 },
-                "patient_initials": {
+                "system": {
                     "type": "string"
+                }
+            }
+        },
+        "services.FHIRDosage": {
+            "type": "object",
+            "properties": {
+                "doseAndRate": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRDoseAndRate"
+                    }
                 },
-                "patient_number_antibiotics": {
-                    "type": "integer"
+                "route": {
+                    "$ref": "#/definitions/services.FHIRCodeableConcept"
                 },
-                "patient_on_antibiotic": {
+                "text": {
                     "type": "string"
-                },
-                "peripheral_vascular_catheter": {
+                }
+            }
+        },
+        "services.FHIRDoseAndRate": {
+            "type": "object",
+            "properties": {
+                "doseQuantity": {
+                    "$ref": "#/definitions/services.FHIRQuantity"
+                }
+            }
+        },
+        "services.FHIREncounterLocation": {
+            "type": "object",
+            "properties": {
+                "location": {
+                    "$ref": "#/definitions/services.FHIRReference"
+                }
+            }
+        },
+        "services.FHIRExtension": {
+            "type": "object",
+            "properties": {
+                "url": {
                     "type": "string"
                 },
-                "pre_term_birth": {
+                "valueDateTime": {
                     "type": "string"
                 },
-                "rand_num": {
+                "valueDecimal": {
+                    "type": "number"
+                },
+                "valueInteger": {
                     "type": "integer"
                 },
-                "referred_from": {
+                "valueString": {
                     "type": "string"
-                },
-                "region": {
+                }
+            }
+        },
+        "services.FHIRHumanName": {
+            "type": "object",
+            "properties": {
+                "text": {
                     "type": "string"
-                },
-                "review_state": {
+                }
+            }
+        },
+        "services.FHIRIdentifier": {
+            "type": "object",
+            "properties": {
+                "system": {
                     "type": "string"
                 },
-                "show_code": {
+                "value": {
                     "type": "string"
+                }
+            }
+        },
+        "services.FHIRObservationComponent": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "$ref": "#/definitions/services.FHIRCodeableConcept"
                 },
-                "specimens": {
+                "interpretation": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/models.Specimen"
+                        "$ref": "#/definitions/services.FHIRCodeableConcept"
                     }
                 },
-                "status": {
+                "valueQuantity": {
+                    "$ref": "#/definitions/services.FHIRQuantity"
+                }
+            }
+        },
+        "services.FHIRPeriod": {
+            "type": "object",
+            "properties": {
+                "end": {
                     "type": "string"
                 },
-                "subcounty": {
+                "start": {
+                    "type": "string"
+                }
+            }
+        },
+        "services.FHIRQuantity": {
+            "type": "object",
+            "properties": {
+                "comparator": {
                     "type": "string"
                 },
-                "submission_date": {
+                "unit": {
                     "type": "string"
                 },
-                "submitter_id": {
+                "value": {
+                    "type": "number"
+                }
+            }
+        },
+        "services.FHIRReference": {
+            "type": "object",
+            "properties": {
+                "display": {
                     "type": "string"
                 },
-                "submitter_name": {
+                "reference": {
+                    "type": "string"
+                }
+            }
+        },
+        "services.FHIRResource": {
+            "type": "object",
+            "properties": {
+                "authoredOn": {
                     "type": "string"
                 },
-                "surgery_since_admission": {
+                "category": {
+                    "description": "Condition, Specimen and Observation",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRCodeableConcept"
+                    }
+                },
+                "class": {
+                    "description": "Encounter",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/services.FHIRCoding"
+                        }
+                    ]
+                },
+                "code": {
+                    "$ref": "#/definitions/services.FHIRCodeableConcept"
+                },
+                "component": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRObservationComponent"
+                    }
+                },
+                "dosageInstruction": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRDosage"
+                    }
+                },
+                "encounter": {
+                    "$ref": "#/definitions/services.FHIRReference"
+                },
+                "extension": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRExtension"
+                    }
+                },
+                "gender": {
+                    "description": "Patient",
                     "type": "string"
                 },
-                "survey_date": {
+                "id": {
                     "type": "string"
                 },
-                "tuberculosis_status": {
+                "identifier": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRIdentifier"
+                    }
+                },
+                "intent": {
+                    "description": "MedicationRequest",
                     "type": "string"
                 },
-                "type_surgery_since_admission": {
+                "location": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIREncounterLocation"
+                    }
+                },
+                "medicationCodeableConcept": {
+                    "$ref": "#/definitions/services.FHIRCodeableConcept"
+                },
+                "name": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRHumanName"
+                    }
+                },
+                "note": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/services.FHIRAnnotation"
+                    }
+                },
+                "onsetDateTime": {
                     "type": "string"
                 },
-                "urinary_catheter": {
+                "period": {
+                    "$ref": "#/definitions/services.FHIRPeriod"
+                },
+                "resourceType": {
                     "type": "string"
                 },
-                "ward_eligible_patients": {
-                    "type": "integer"
+                "serviceProvider": {
+                    "$ref": "#/definitions/services.FHIRReference"
                 },
-                "ward_name": {
+                "specimen": {
+                    "$ref": "#/definitions/services.FHIRReference"
+                },
+                "status": {
                     "type": "string"
                 },
-                "ward_total_patients": {
-                    "type": "integer"
+                "subject": {
+                    "$ref": "#/definitions/services.FHIRReference"
                 },
-                "weight": {
-                    "type": "number"
+                "type": {
+                    "$ref": "#/definitions/services.FHIRCodeableConcept"
                 },
-                "weight_birth_kg": {
-                    "type": "number"
+                "valueCodeableConcept": {
+                    "$ref": "#/definitions/services.FHIRCodeableConcept"
                 }
             }
         },
-        "models.Specimen": {
+        "services.QualityEvaluation": {
             "type": "object",
             "properties": {
-                "antibiotic_susceptibility_test_results": {
-                    "type": "string"
-                },
-                "culture_result": {
-                    "type": "string"
-                },
-                "id": {
-                    "type": "string"
-                },
-                "microorganism": {
-                    "type": "string"
-                },
-                "parent_key": {
-                    "type": "string"
+                "by_rule": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
                 },
-                "resistant_phenotype": {
-                    "type": "string"
+                "flags": {
+                    "type": "integer"
                 },
-                "specimen_type": {
-                    "type": "string"
+                "records": {
+                    "type": "integer"
                 }
             }
         }
@@ -3139,7 +7303,7 @@ const docTemplate = `{
 // SwaggerInfo holds exported Swagger Info so clients can modify it
 var SwaggerInfo = &swag.Spec{
 	Version:          "1.0",
-	Host:             "csf.health.go.ug",
+	Host:             "localhost:8080",
 	BasePath:         "/",
 	Schemes:          []string{},
 	Title:            "Point Prevalence Survey API",
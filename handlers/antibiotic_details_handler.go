@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"point-prevalence-survey/database"
 	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -107,6 +108,12 @@ func (h *AntibioticDetailsHandler) CreateAntibioticDetails(c *gin.Context) {
 		return
 	}
 
+	// Categorical values are stored as the canonical codes the indicators count
+	if err := services.NormalizeCodes(h.db, &antibioticDetails); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create antibiotic detail"})
+		return
+	}
+
 	if err := h.db.Create(&antibioticDetails).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create antibiotic detail"})
 		return
@@ -148,6 +155,11 @@ func (h *AntibioticDetailsHandler) UpdateAntibioticDetails(c *gin.Context) {
 
 	antibioticDetails.ID = id // Ensure ID doesn't change
 
+	if err := services.NormalizeCodes(h.db, &antibioticDetails); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update antibiotic detail"})
+		return
+	}
+
 	if err := h.db.Save(&antibioticDetails).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update antibiotic detail"})
 		return
@@ -119,6 +119,13 @@ func (h *AntibioticHandler) GetAntibioticStats(c *gin.Context) {
 			Frequency string `json:"frequency"`
 			Count     int64  `json:"count"`
 		} `json:"by_frequency"`
+		ByAntibiotic []struct {
+			Antibiotic string `json:"antibiotic"`
+			Count      int64  `json:"count"`
+		} `json:"by_antibiotic"`
+		// Unmatched antibiotics are not in the reference catalogue, so they
+		// are left out of by_antibiotic
+		Unmatched int64 `json:"unmatched"`
 	}
 
 	// Total antibiotics
@@ -136,6 +143,10 @@ func (h *AntibioticHandler) GetAntibioticStats(c *gin.Context) {
 	// By frequency
 	h.db.Model(&models.Antibiotic{}).Select("unit_dose_frequency as frequency, count(*) as count").Group("unit_dose_frequency").Scan(&stats.ByFrequency)
 
+	// By antibiotic, using the catalogue INN name of matched antibiotics
+	h.db.Model(&models.Antibiotic{}).Select("antibiotic_inn_name as antibiotic, count(*) as count").Where("reference_id IS NOT NULL").Group("antibiotic_inn_name").Order("count DESC").Scan(&stats.ByAntibiotic)
+	h.db.Model(&models.Antibiotic{}).Where("reference_id IS NULL").Count(&stats.Unmatched)
+
 	c.JSON(http.StatusOK, stats)
 }
 
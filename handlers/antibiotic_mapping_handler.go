@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AntibioticMappingHandler struct {
+	db *gorm.DB
+}
+
+func NewAntibioticMappingHandler() *AntibioticMappingHandler {
+	return &AntibioticMappingHandler{
+		db: database.GetDB(),
+	}
+}
+
+// mappingReview is the body of a review of an antibiotic name
+type mappingReview struct {
+	// ReferenceID overrides the suggested catalogue entry
+	ReferenceID *uint  `json:"reference_id"`
+	ReviewedBy  string `json:"reviewed_by"`
+}
+
+// nameMapping is the body of a mapping added without review
+type nameMapping struct {
+	Name        string `json:"name" binding:"required"`
+	ReferenceID uint   `json:"reference_id" binding:"required"`
+	ReviewedBy  string `json:"reviewed_by"`
+}
+
+// GetAntibioticMappings godoc
+// @Summary List antibiotic names in the review queue
+// @Description Get the antibiotic names that did not match the reference catalogue exactly, with the closest catalogue entry as a suggestion. By default only names waiting for review are listed, most frequent first
+// @Tags antibiotic-mappings
+// @Accept json
+// @Produce json
+// @Param status query string false "pending, accepted, rejected or all" default(pending)
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Items per page" default(10)
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/antibiotic-mappings [get]
+func (h *AntibioticMappingHandler) GetAntibioticMappings(c *gin.Context) {
+	var mappings []models.AntibioticNameMapping
+	query := h.db.Model(&models.AntibioticNameMapping{})
+
+	switch status := c.DefaultQuery("status", models.NameMappingPending); status {
+	case models.NameMappingPending, models.NameMappingAccepted, models.NameMappingRejected:
+		query = query.Where("status = ?", status)
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status", "message": "status must be one of pending, accepted, rejected or all"})
+		return
+	}
+
+	// Pagination
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	var total int64
+	query.Count(&total)
+
+	if err := query.Order("occurrences DESC, id").Offset(offset).Limit(limit).Find(&mappings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch antibiotic name mappings"})
+		return
+	}
+
+	// Name the suggested and mapped catalogue entries
+	ids := make([]uint, 0)
+	for _, mapping := range mappings {
+		if mapping.SuggestedReferenceID != nil {
+			ids = append(ids, *mapping.SuggestedReferenceID)
+		}
+		if mapping.ReferenceID != nil {
+			ids = append(ids, *mapping.ReferenceID)
+		}
+	}
+	names := make(map[uint]string)
+	if len(ids) > 0 {
+		var references []models.AntibioticReference
+		h.db.Select("id, inn_name").Where("id IN ?", ids).Find(&references)
+		for _, reference := range references {
+			names[reference.ID] = reference.INNName
+		}
+	}
+
+	data := make([]gin.H, 0, len(mappings))
+	for _, mapping := range mappings {
+		entry := gin.H{"mapping": mapping}
+		if mapping.SuggestedReferenceID != nil {
+			entry["suggestion"] = names[*mapping.SuggestedReferenceID]
+		}
+		if mapping.ReferenceID != nil {
+			entry["mapped_to"] = names[*mapping.ReferenceID]
+		}
+		data = append(data, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": data,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// CreateAntibioticMapping godoc
+// @Summary Map an antibiotic name to the catalogue
+// @Description Remember that a free-text antibiotic name means a catalogue entry, without waiting for it in the review queue. Stored antibiotics written under the name are matched at once
+// @Tags antibiotic-mappings
+// @Accept json
+// @Produce json
+// @Param mapping body nameMapping true "Name and catalogue entry"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/antibiotic-mappings [post]
+func (h *AntibioticMappingHandler) CreateAntibioticMapping(c *gin.Context) {
+	var body nameMapping
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mapping, matched, err := services.MapAntibioticName(h.db, body.Name, body.ReferenceID, body.ReviewedBy)
+	if err != nil {
+		h.reviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"mapping": mapping, "matched_antibiotics": matched})
+}
+
+// AcceptAntibioticMapping godoc
+// @Summary Accept an antibiotic name suggestion
+// @Description Map a queued antibiotic name to its suggested catalogue entry, or to reference_id when given. The mapping is used by later imports, and stored antibiotics written under the name are matched at once
+// @Tags antibiotic-mappings
+// @Accept json
+// @Produce json
+// @Param id path int true "Mapping ID"
+// @Param review body mappingReview false "Catalogue entry overriding the suggestion, and reviewer"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/antibiotic-mappings/{id}/accept [post]
+func (h *AntibioticMappingHandler) AcceptAntibioticMapping(c *gin.Context) {
+	id, review, ok := h.readReview(c)
+	if !ok {
+		return
+	}
+
+	mapping, matched, err := services.AcceptNameMapping(h.db, id, review.ReferenceID, review.ReviewedBy)
+	if err != nil {
+		h.reviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mapping": mapping, "matched_antibiotics": matched})
+}
+
+// RejectAntibioticMapping godoc
+// @Summary Reject an antibiotic name suggestion
+// @Description Mark the suggestion for a queued antibiotic name as wrong. The name stays unmatched in later imports until it is accepted with another catalogue entry
+// @Tags antibiotic-mappings
+// @Accept json
+// @Produce json
+// @Param id path int true "Mapping ID"
+// @Param review body mappingReview false "Reviewer"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/antibiotic-mappings/{id}/reject [post]
+func (h *AntibioticMappingHandler) RejectAntibioticMapping(c *gin.Context) {
+	id, review, ok := h.readReview(c)
+	if !ok {
+		return
+	}
+
+	mapping, err := services.RejectNameMapping(h.db, id, review.ReviewedBy)
+	if err != nil {
+		h.reviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mapping": mapping})
+}
+
+// DeleteAntibioticMapping godoc
+// @Summary Forget an antibiotic name mapping
+// @Description Delete a queued or reviewed antibiotic name. It is matched and queued again the next time it is imported
+// @Tags antibiotic-mappings
+// @Accept json
+// @Produce json
+// @Param id path int true "Mapping ID"
+// @Success 204 "No Content"
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/antibiotic-mappings/{id} [delete]
+func (h *AntibioticMappingHandler) DeleteAntibioticMapping(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	result := h.db.Delete(&models.AntibioticNameMapping{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete antibiotic name mapping"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Antibiotic name mapping not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// readReview reads the mapping ID and the optional review body
+func (h *AntibioticMappingHandler) readReview(c *gin.Context) (uint, mappingReview, bool) {
+	var review mappingReview
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return 0, review, false
+	}
+
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&review); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return 0, review, false
+		}
+	}
+
+	return uint(id), review, true
+}
+
+// reviewError writes the response for an error of a review
+func (h *AntibioticMappingHandler) reviewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrMappingNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Antibiotic name mapping not found"})
+	case errors.Is(err, services.ErrReferenceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Antibiotic reference not found"})
+	case errors.Is(err, services.ErrInvalidReference):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mapping", "message": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save antibiotic name mapping", "message": err.Error()})
+	}
+}
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AntibioticReferenceHandler struct {
+	db *gorm.DB
+}
+
+func NewAntibioticReferenceHandler() *AntibioticReferenceHandler {
+	return &AntibioticReferenceHandler{
+		db: database.GetDB(),
+	}
+}
+
+// GetAntibioticReferences godoc
+// @Summary List the antibiotic reference catalogue
+// @Description Get the catalogue of INN names, synonyms, ATC codes, AWaRe categories and DDDs imported antibiotics are matched against
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Param q query string false "Search INN names, synonyms and ATC codes"
+// @Param aware query string false "Filter by AWaRe category (access, watch, reserve, not_recommended)"
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Items per page" default(10)
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/antibiotic-references [get]
+func (h *AntibioticReferenceHandler) GetAntibioticReferences(c *gin.Context) {
+	var references []models.AntibioticReference
+	query := h.db.Model(&models.AntibioticReference{})
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := "%" + strings.ToLower(q) + "%"
+		query = query.Where("LOWER(inn_name) LIKE ? OR LOWER(synonyms) LIKE ? OR LOWER(atc_code) LIKE ?", pattern, pattern, pattern)
+	}
+	if aware := c.Query("aware"); aware != "" {
+		query = query.Where("aware_category = ?", services.NormalizeValue("antibiotic_aware_classification", aware))
+	}
+
+	// Pagination
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	var total int64
+	query.Count(&total)
+
+	if err := query.Order("inn_name").Offset(offset).Limit(limit).Find(&references).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch antibiotic references"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": references,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetAntibioticReference godoc
+// @Summary Get an antibiotic reference
+// @Description Get one entry of the antibiotic reference catalogue
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Param id path int true "Reference ID"
+// @Success 200 {object} models.AntibioticReference
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/antibiotic-references/{id} [get]
+func (h *AntibioticReferenceHandler) GetAntibioticReference(c *gin.Context) {
+	reference, ok := h.findReference(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, reference)
+}
+
+// CreateAntibioticReference godoc
+// @Summary Add an antibiotic reference
+// @Description Add an antibiotic to the reference catalogue. Antibiotics imported afterwards are matched against it; use the apply endpoint to match stored antibiotics again
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Param reference body models.AntibioticReference true "Antibiotic reference"
+// @Success 201 {object} models.AntibioticReference
+// @Failure 400 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /api/v1/antibiotic-references [post]
+func (h *AntibioticReferenceHandler) CreateAntibioticReference(c *gin.Context) {
+	var reference models.AntibioticReference
+	if err := c.ShouldBindJSON(&reference); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	reference.ID = 0
+
+	if !h.validateReference(c, &reference) {
+		return
+	}
+
+	if err := h.db.Create(&reference).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create antibiotic reference"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, reference)
+}
+
+// UpdateAntibioticReference godoc
+// @Summary Update an antibiotic reference
+// @Description Update an entry of the antibiotic reference catalogue
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Param id path int true "Reference ID"
+// @Param reference body models.AntibioticReference true "Antibiotic reference"
+// @Success 200 {object} models.AntibioticReference
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /api/v1/antibiotic-references/{id} [put]
+func (h *AntibioticReferenceHandler) UpdateAntibioticReference(c *gin.Context) {
+	reference, ok := h.findReference(c)
+	if !ok {
+		return
+	}
+
+	id, createdAt := reference.ID, reference.CreatedAt
+	if err := c.ShouldBindJSON(&reference); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	reference.ID = id // Ensure ID doesn't change
+	reference.CreatedAt = createdAt
+
+	if !h.validateReference(c, &reference) {
+		return
+	}
+
+	if err := h.db.Save(&reference).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update antibiotic reference"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reference)
+}
+
+// DeleteAntibioticReference godoc
+// @Summary Delete an antibiotic reference
+// @Description Remove an antibiotic from the reference catalogue. Antibiotics matched to it keep their values but lose the reference, and names mapped to it go back to the review queue
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Param id path int true "Reference ID"
+// @Success 204 "No Content"
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/antibiotic-references/{id} [delete]
+func (h *AntibioticReferenceHandler) DeleteAntibioticReference(c *gin.Context) {
+	reference, ok := h.findReference(c)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Antibiotic{}).Where("reference_id = ?", reference.ID).
+			Update("reference_id", nil).Error; err != nil {
+			return err
+		}
+		// Names mapped to the entry go back to the review queue
+		if err := tx.Model(&models.AntibioticNameMapping{}).Where("reference_id = ?", reference.ID).
+			Updates(map[string]interface{}{"reference_id": nil, "status": models.NameMappingPending}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.AntibioticNameMapping{}).Where("suggested_reference_id = ?", reference.ID).
+			Updates(map[string]interface{}{"suggested_reference_id": nil, "score": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&reference).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete antibiotic reference"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// UploadAntibioticReferences godoc
+// @Summary Load the antibiotic reference catalogue from CSV
+// @Description Load catalogue entries from a CSV file with an inn_name column and optional synonyms (separated by semicolons), atc_code, antibiotic_class, aware_category, oral_ddd, parenteral_ddd and ddd_unit columns. Entries are matched by INN name and updated, other names are added
+// @Tags antibiotic-references
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "Catalogue CSV file"
+// @Param apply query bool false "Match stored antibiotics against the catalogue again after loading"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/antibiotic-references/upload [post]
+func (h *AntibioticReferenceHandler) UploadAntibioticReferences(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded", "message": "Please upload a CSV file"})
+		return
+	}
+	if strings.ToLower(filepath.Ext(fileHeader.Filename)) != ".csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file", "message": "the catalogue must be a .csv file"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+		return
+	}
+	defer file.Close()
+
+	result, err := services.ImportAntibioticCatalogue(h.db, file)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrColumnMapping) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": "Failed to load catalogue", "message": err.Error(), "result": result})
+		return
+	}
+
+	response := gin.H{
+		"message":          "Catalogue loaded",
+		"filename":         fileHeader.Filename,
+		"total_records":    result.TotalRecords,
+		"inserted_records": result.InsertedRecords,
+		"updated_records":  result.UpdatedRecords,
+		"skipped_records":  result.SkippedRecords,
+		"errors":           result.Errors,
+		"row_errors":       result.RowErrors,
+	}
+
+	if c.Query("apply") == "true" {
+		matched, unmatched, err := services.EnrichAntibiotics(h.db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Catalogue loaded but antibiotics could not be matched", "message": err.Error()})
+			return
+		}
+		response["matched_antibiotics"] = matched
+		response["unmatched_antibiotics"] = unmatched
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ApplyAntibioticReferences godoc
+// @Summary Match stored antibiotics against the catalogue
+// @Description Match every stored antibiotic against the reference catalogue again and update its INN name, ATC code, class, AWaRe category and DDD, e.g. after the catalogue was edited
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/antibiotic-references/apply [post]
+func (h *AntibioticReferenceHandler) ApplyAntibioticReferences(c *gin.Context) {
+	matched, unmatched, err := services.EnrichAntibiotics(h.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match antibiotics", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"matched_antibiotics":   matched,
+		"unmatched_antibiotics": unmatched,
+	})
+}
+
+// GetUnmatchedAntibiotics godoc
+// @Summary List antibiotic names not in the catalogue
+// @Description Get the names of stored antibiotics that did not match the reference catalogue, with the number of antibiotics under each, most frequent first
+// @Tags antibiotic-references
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/antibiotic-references/unmatched [get]
+func (h *AntibioticReferenceHandler) GetUnmatchedAntibiotics(c *gin.Context) {
+	names, err := services.UnmatchedAntibiotics(h.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list unmatched antibiotics"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": names, "total": len(names)})
+}
+
+// findReference loads the reference of the id path parameter, writing the
+// error response if there is none
+func (h *AntibioticReferenceHandler) findReference(c *gin.Context) (models.AntibioticReference, bool) {
+	var reference models.AntibioticReference
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return reference, false
+	}
+
+	if err := h.db.First(&reference, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Antibiotic reference not found"})
+			return reference, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch antibiotic reference"})
+		return reference, false
+	}
+
+	return reference, true
+}
+
+// validateReference checks a reference and that no other entry has its INN
+// name, writing the error response if it is not valid
+func (h *AntibioticReferenceHandler) validateReference(c *gin.Context, reference *models.AntibioticReference) bool {
+	if err := services.ValidateAntibioticReference(reference); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid antibiotic reference", "message": err.Error()})
+		return false
+	}
+
+	var count int64
+	h.db.Model(&models.AntibioticReference{}).
+		Where("LOWER(inn_name) = LOWER(?) AND id <> ?", reference.INNName, reference.ID).
+		Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "An antibiotic reference with this INN name already exists"})
+		return false
+	}
+
+	return true
+}
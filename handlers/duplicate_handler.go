@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type DuplicateHandler struct {
+	db *gorm.DB
+}
+
+func NewDuplicateHandler() *DuplicateHandler {
+	return &DuplicateHandler{
+		db: database.GetDB(),
+	}
+}
+
+// duplicateMerge is the body of a merge of two records of the same patient
+type duplicateMerge struct {
+	Keep      string `json:"keep" binding:"required"`
+	Duplicate string `json:"duplicate" binding:"required"`
+	// Numeric lists the numeric fields, such as weight, to fill in when zero
+	// on the kept record; other numbers are left as they are
+	Numeric []string `json:"numeric"`
+}
+
+// duplicateDismissal is the body of a review of two records as different patients
+type duplicateDismissal struct {
+	PatientID  string `json:"patient_id" binding:"required"`
+	OtherID    string `json:"other_id" binding:"required"`
+	ReviewedBy string `json:"reviewed_by"`
+}
+
+// GetDuplicates godoc
+// @Summary List possible duplicate patients
+// @Description List pairs of patients surveyed on the same date in the same facility and ward, scored from 0 to 1 on their initials, patient code, age, gender and admission date, highest score first. Excluded patients and pairs dismissed as different patients are not listed
+// @Tags patients
+// @Accept json
+// @Produce json
+// @Param facility query string false "Filter by facility"
+// @Param ward query string false "Filter by ward name"
+// @Param min_score query number false "Lowest score listed" default(0.7)
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/patients/duplicates [get]
+func (h *DuplicateHandler) GetDuplicates(c *gin.Context) {
+	opts := services.DuplicateOptions{
+		Facility: c.Query("facility"),
+		Ward:     c.Query("ward"),
+	}
+	if value := c.Query("min_score"); value != "" {
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil || score < 0 || score > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_score", "message": "min_score must be a number from 0 to 1"})
+			return
+		}
+		opts.MinScore = score
+	}
+
+	candidates, err := services.FindDuplicatePatients(h.db, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find duplicate patients", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  candidates,
+		"total": len(candidates),
+	})
+}
+
+// MergeDuplicate godoc
+// @Summary Merge two records of the same patient
+// @Description Keep one record of a patient surveyed twice. Text and date fields blank on the kept record are filled in from the duplicate, as are the zero numeric fields listed in numeric. The duplicate is excluded from the PPS indicators together with its child rows
+// @Tags patients
+// @Accept json
+// @Produce json
+// @Param merge body duplicateMerge true "Patient kept and duplicate"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/patients/duplicates/merge [post]
+func (h *DuplicateHandler) MergeDuplicate(c *gin.Context) {
+	var body duplicateMerge
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	patient, filled, err := services.MergePatients(h.db, body.Keep, body.Duplicate, body.Numeric)
+	if err != nil {
+		patientReviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"patient":       patient,
+		"filled_fields": filled,
+		"excluded":      body.Duplicate,
+	})
+}
+
+// DismissDuplicate godoc
+// @Summary Mark two patients as different patients
+// @Description Record that a pair listed as possible duplicates are different patients, so the pair is no longer listed
+// @Tags patients
+// @Accept json
+// @Produce json
+// @Param dismissal body duplicateDismissal true "Pair of patients"
+// @Success 200 {object} models.DuplicateDismissal
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/patients/duplicates/dismiss [post]
+func (h *DuplicateHandler) DismissDuplicate(c *gin.Context) {
+	var body duplicateDismissal
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dismissal, err := services.DismissDuplicate(h.db, body.PatientID, body.OtherID, body.ReviewedBy)
+	if err != nil {
+		patientReviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dismissal)
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fhirBundleTypes are the bundle types FHIR exports can be written as
+var fhirBundleTypes = map[string]bool{
+	services.FHIRBundleCollection:  true,
+	services.FHIRBundleTransaction: true,
+}
+
+type ExportHandler struct {
+	db *gorm.DB
+}
+
+func NewExportHandler() *ExportHandler {
+	return &ExportHandler{
+		db: database.GetDB(),
+	}
+}
+
+// whonetDelimiters are the field separators of WHONET exports
+var whonetDelimiters = map[string]rune{
+	"tab":       '\t',
+	"comma":     ',',
+	"semicolon": ';',
+}
+
+// ExportWhonet godoc
+// @Summary Export specimens for WHONET
+// @Description Export specimens with their organisms, antibiotic results and resistance phenotypes as a WHONET flat file, one row per specimen and organism, with the patient's demographics. The file can be imported into WHONET with BacLink
+// @Tags export
+// @Produce plain
+// @Param delimiter query string false "tab, comma or semicolon" default(tab)
+// @Param specimen_type query string false "Filter by specimen type"
+// @Param microorganism query string false "Filter by microorganism"
+// @Param start_date query string false "Start date for filtering (YYYY-MM-DD)"
+// @Param end_date query string false "End date for filtering (YYYY-MM-DD)"
+// @Param region query string false "Region for filtering"
+// @Param district query string false "District for filtering"
+// @Param subcounty query string false "Subcounty for filtering"
+// @Param facility query string false "Facility for filtering"
+// @Param level query string false "Level of care for filtering"
+// @Param ownership query string false "Ownership for filtering"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/export/whonet [get]
+func (h *ExportHandler) ExportWhonet(c *gin.Context) {
+	delimiter := c.DefaultQuery("delimiter", "tab")
+	comma, ok := whonetDelimiters[delimiter]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delimiter", "message": "delimiter must be one of tab, comma or semicolon"})
+		return
+	}
+
+	query := h.db.Model(&models.Specimen{})
+	if specimenType := c.Query("specimen_type"); specimenType != "" {
+		query = query.Where("specimen_type = ?", specimenType)
+	}
+	if microorganism := c.Query("microorganism"); microorganism != "" {
+		query = query.Where("LOWER(microorganism) = LOWER(?)", microorganism)
+	}
+
+	hasPatientFilters := c.Query("start_date") != "" || c.Query("end_date") != "" ||
+		c.Query("region") != "" || c.Query("district") != "" || c.Query("subcounty") != "" ||
+		c.Query("facility") != "" || c.Query("level") != "" || c.Query("ownership") != ""
+	if hasPatientFilters {
+		patients := applyFilters(h.db.Model(&models.Patient{}).Select("key"), c, "submission_date")
+		query = query.Where("parent_key IN (?)", patients)
+	}
+
+	extension := "txt"
+	if comma == ',' {
+		extension = "csv"
+	}
+	filename := fmt.Sprintf("whonet-%s.%s", time.Now().Format("20060102"), extension)
+
+	var export bytes.Buffer
+	if _, err := services.ExportWhonet(h.db, query, &export, comma); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export specimens", "message": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", export.Bytes())
+}
+
+// ExportFHIR godoc
+// @Summary Export patients as FHIR bundles
+// @Description Export survey patients as FHIR R4 bundles, one bundle per line (NDJSON). Each bundle holds a Patient, an Encounter for the admission, a MedicationRequest for each antibiotic, a Condition for each indication, and a Specimen with a culture Observation for each specimen. Excluded patients are left out
+// @Tags export
+// @Produce application/fhir+ndjson
+// @Param type query string false "collection, or transaction to post each bundle to a FHIR server" default(collection)
+// @Param start_date query string false "Start date for filtering (YYYY-MM-DD)"
+// @Param end_date query string false "End date for filtering (YYYY-MM-DD)"
+// @Param region query string false "Region for filtering"
+// @Param district query string false "District for filtering"
+// @Param subcounty query string false "Subcounty for filtering"
+// @Param facility query string false "Facility for filtering"
+// @Param level query string false "Level of care for filtering"
+// @Param ownership query string false "Ownership for filtering"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/export/fhir [get]
+func (h *ExportHandler) ExportFHIR(c *gin.Context) {
+	bundleType := c.DefaultQuery("type", services.FHIRBundleCollection)
+	if !fhirBundleTypes[bundleType] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bundle type", "message": "type must be collection or transaction"})
+		return
+	}
+
+	query := applyFilters(h.db.Model(&models.Patient{}), c, "submission_date").Where("excluded = ?", false).Order("key")
+	filename := fmt.Sprintf("fhir-%s.ndjson", time.Now().Format("20060102"))
+
+	var export bytes.Buffer
+	if _, err := services.ExportFHIR(query, &export, bundleType); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export patients", "message": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Data(http.StatusOK, "application/fhir+ndjson", export.Bytes())
+}
+
+// ExportPatientFHIR godoc
+// @Summary Export a patient as a FHIR bundle
+// @Description Export one survey patient, with its antibiotics, indications and specimens, as a FHIR R4 bundle
+// @Tags export
+// @Produce application/fhir+json
+// @Param id path string true "Patient ID"
+// @Param type query string false "collection, or transaction to post the bundle to a FHIR server" default(collection)
+// @Success 200 {object} services.FHIRBundle
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/export/fhir/{id} [get]
+func (h *ExportHandler) ExportPatientFHIR(c *gin.Context) {
+	bundleType := c.DefaultQuery("type", services.FHIRBundleCollection)
+	if !fhirBundleTypes[bundleType] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bundle type", "message": "type must be collection or transaction"})
+		return
+	}
+
+	var patient models.Patient
+	err := h.db.Preload("Antibiotics").Preload("Indications").Preload("Specimens.SusceptibilityResults").
+		Where("key = ?", c.Param("id")).First(&patient).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch patient"})
+		return
+	}
+
+	bundle, err := json.Marshal(services.PatientBundle(&patient, bundleType))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export patient", "message": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/fhir+json", bundle)
+}
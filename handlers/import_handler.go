@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type ImportHandler struct {
+	db         *gorm.DB
+	jobService *services.ImportJobService
+}
+
+func NewImportHandler() *ImportHandler {
+	return &ImportHandler{
+		db:         database.GetDB(),
+		jobService: services.GetImportJobService(),
+	}
+}
+
+// GetImports godoc
+// @Summary List import jobs
+// @Description Get the history of uploads, newest first. Row errors and warnings are omitted; fetch a single job to see them
+// @Tags imports
+// @Accept json
+// @Produce json
+// @Param status query string false "Filter by status (queued, running, completed, failed, rolled_back)"
+// @Param entity query string false "Filter by entity"
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Items per page" default(10)
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/imports [get]
+func (h *ImportHandler) GetImports(c *gin.Context) {
+	var jobs []models.ImportJob
+	query := h.db.Model(&models.ImportJob{})
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if entity := c.Query("entity"); entity != "" {
+		query = query.Where("entity = ?", entity)
+	}
+
+	// Pagination
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	var total int64
+	query.Count(&total)
+
+	if err := query.Omit("errors", "warnings").Order("id DESC").Offset(offset).Limit(limit).Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch import jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": jobs,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetImport godoc
+// @Summary Get an import job
+// @Description Get the status, progress counters and row errors of an import job
+// @Tags imports
+// @Accept json
+// @Produce json
+// @Param id path int true "Import job ID"
+// @Success 200 {object} models.ImportJob
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/imports/{id} [get]
+func (h *ImportHandler) GetImport(c *gin.Context) {
+	var job models.ImportJob
+
+	if err := h.db.First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// DeleteImport godoc
+// @Summary Delete the rows of an import
+// @Description Remove every row inserted by an import job, e.g. after a bad file was loaded. Rows the import updated keep their new values
+// @Tags imports
+// @Accept json
+// @Produce json
+// @Param id path int true "Import job ID"
+// @Success 200 {object} models.ImportJob
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /api/v1/imports/{id} [delete]
+func (h *ImportHandler) DeleteImport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import job ID"})
+		return
+	}
+
+	job, err := h.jobService.DeleteImport(uint(id))
+	if errors.Is(err, services.ErrImportNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import job not found"})
+		return
+	}
+	if errors.Is(err, services.ErrImportInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Import cannot be deleted", "message": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete import", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Import deleted",
+		"deleted_records": job.DeletedRecords,
+		"job":             job,
+	})
+}
+
+// GetImportErrorReport godoc
+// @Summary Download the rejected rows of an import
+// @Description Download the rows an import rejected as CSV, with the original columns plus an import_error column, so they can be fixed and uploaded again
+// @Tags imports
+// @Produce text/csv
+// @Param id path int true "Import job ID"
+// @Param file query string false "File of a bundle import to report on"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/imports/{id}/errors.csv [get]
+func (h *ImportHandler) GetImportErrorReport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import job ID"})
+		return
+	}
+
+	var report bytes.Buffer
+	err = h.jobService.RowErrorReport(uint(id), c.Query("file"), &report)
+	if errors.Is(err, services.ErrImportNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import job not found"})
+		return
+	}
+	if errors.Is(err, services.ErrReportFile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file", "message": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build error report", "message": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=import-%d-errors.csv", id))
+	c.Data(http.StatusOK, "text/csv", report.Bytes())
+}
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"path/filepath"
 	"point-prevalence-survey/database"
 	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,11 +17,14 @@ import (
 
 type OptionalVarsHandler struct {
 	db *gorm.DB
+	// uploads records bulk uploads as import jobs like the upload routes
+	uploads *UploadHandler
 }
 
 func NewOptionalVarsHandler() *OptionalVarsHandler {
 	return &OptionalVarsHandler{
-		db: database.GetDB(),
+		db:      database.GetDB(),
+		uploads: NewUploadHandler(),
 	}
 }
 
@@ -179,6 +186,12 @@ func (h *OptionalVarsHandler) CreateOptionalVar(c *gin.Context) {
 		return
 	}
 
+	// Categorical values are stored as the canonical codes the indicators count
+	if err := services.NormalizeCodes(h.db, &optionalVar); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create optional variable"})
+		return
+	}
+
 	if err := h.db.Create(&optionalVar).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create optional variable"})
 		return
@@ -214,6 +227,11 @@ func (h *OptionalVarsHandler) UpdateOptionalVar(c *gin.Context) {
 		return
 	}
 
+	if err := services.NormalizeCodes(h.db, &optionalVar); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update optional variable"})
+		return
+	}
+
 	if err := h.db.Save(&optionalVar).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update optional variable"})
 		return
@@ -310,13 +328,18 @@ func (h *OptionalVarsHandler) GetOptionalVarsStats(c *gin.Context) {
 
 // BulkUploadOptionalVars godoc
 // @Summary Bulk upload optional variables from CSV
-// @Description Upload multiple optional variables from a CSV file
+// @Description Upload multiple optional variables from a CSV file. The file is imported like POST /api/v1/upload/optional-vars with the default options, and recorded as an import job
 // @Tags optional-vars
 // @Accept multipart/form-data
 // @Produce json
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
 // @Param file formData file true "CSV file containing optional variables data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
 // @Failure 400 {object} map[string]string
+// @Failure 409 {object} map[string]interface{}
 // @Failure 500 {object} map[string]string
 // @Router /api/v1/optional-vars/upload [post]
 func (h *OptionalVarsHandler) BulkUploadOptionalVars(c *gin.Context) {
@@ -328,38 +351,38 @@ func (h *OptionalVarsHandler) BulkUploadOptionalVars(c *gin.Context) {
 	}
 	defer file.Close()
 
-	// Check file type
-	if header.Header.Get("Content-Type") != "text/csv" {
+	// Check file type. Browsers and clients disagree on the content type of
+	// CSV files, so the extension is checked instead.
+	if !strings.EqualFold(filepath.Ext(header.Filename), ".csv") {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File must be a CSV"})
 		return
 	}
 
-	// Process CSV file
-	optionalVars, err := h.processOptionalVarsCSV(file)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to process CSV: " + err.Error()})
+	job := h.uploads.createJob(c, services.EntityOptionalVars, file, header, services.ImportOptions{})
+	if job == nil {
+		return
+	}
+	if job.Async {
+		h.uploads.enqueueJob(c, job, file, services.ImportOptions{})
 		return
 	}
 
-	// Bulk insert
-	if err := h.db.CreateInBatches(optionalVars, 100).Error; err != nil {
+	result, err := h.uploads.jobService.RunImport(job, file, header.Size, services.ImportOptions{})
+	if errors.Is(err, services.ErrColumnMapping) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to process CSV: " + err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload data: " + err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Optional variables uploaded successfully",
-		"count":   len(optionalVars),
+		"message":         "Optional variables uploaded successfully",
+		"job_id":          job.ID,
+		"count":           result.InsertedRecords + result.UpdatedRecords,
+		"staged_records":  result.StagedRecords,
+		"skipped_records": result.SkippedRecords,
+		"errors":          result.Errors,
 	})
 }
-
-// processOptionalVarsCSV processes the CSV file and returns a slice of OptionalVar
-func (h *OptionalVarsHandler) processOptionalVarsCSV(file interface{}) ([]models.OptionalVar, error) {
-	// This is a placeholder implementation
-	// In a real implementation, you would parse the CSV file
-	// and convert it to OptionalVar structs
-
-	// For now, return an empty slice
-	// You can implement CSV parsing using a library like encoding/csv
-	return []models.OptionalVar{}, nil
-}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type OrphanHandler struct {
+	db *gorm.DB
+}
+
+func NewOrphanHandler() *OrphanHandler {
+	return &OrphanHandler{
+		db: database.GetDB(),
+	}
+}
+
+// GetOrphans godoc
+// @Summary List staged child rows
+// @Description Get child rows uploaded before their parent patient. They are linked automatically when the patient is imported; by default only rows still waiting are listed
+// @Tags orphans
+// @Accept json
+// @Produce json
+// @Param status query string false "unresolved, resolved or all" default(unresolved)
+// @Param entity query string false "Filter by entity (antibiotics, antibiotic-details, indications, specimens); antibiotic_details is accepted too"
+// @Param parent_key query string false "Filter by parent patient key"
+// @Param import_id query int false "Filter by the import the rows came from"
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Items per page" default(10)
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/orphans [get]
+func (h *OrphanHandler) GetOrphans(c *gin.Context) {
+	var orphans []models.OrphanRow
+	query := h.db.Model(&models.OrphanRow{})
+
+	switch c.DefaultQuery("status", "unresolved") {
+	case "unresolved":
+		query = query.Where("resolved_at IS NULL")
+	case "resolved":
+		query = query.Where("resolved_at IS NOT NULL")
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status", "message": "status must be one of unresolved, resolved or all"})
+		return
+	}
+
+	if entity := c.Query("entity"); entity != "" {
+		// Accept the upload route names, e.g. antibiotic-details for the
+		// antibiotic_details rows are stored under
+		if name, ok := uploadEntities[entity]; ok {
+			entity = name
+		}
+		query = query.Where("entity = ?", entity)
+	}
+	if parentKey := c.Query("parent_key"); parentKey != "" {
+		query = query.Where("parent_key = ?", parentKey)
+	}
+	if importID := c.Query("import_id"); importID != "" {
+		id, err := strconv.ParseUint(importID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import ID"})
+			return
+		}
+		query = query.Where("import_id = ?", id)
+	}
+
+	// Pagination
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	var total int64
+	query.Count(&total)
+
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&orphans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch staged rows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": orphans,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// DeleteOrphan godoc
+// @Summary Discard a staged child row
+// @Description Delete a child row still waiting for its parent patient, e.g. when the patient will never be uploaded
+// @Tags orphans
+// @Accept json
+// @Produce json
+// @Param id path int true "Staged row ID"
+// @Success 200 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /api/v1/orphans/{id} [delete]
+func (h *OrphanHandler) DeleteOrphan(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var orphan models.OrphanRow
+	if err := h.db.First(&orphan, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Staged row not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch staged row"})
+		return
+	}
+	if orphan.ResolvedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Staged row already linked to its patient"})
+		return
+	}
+
+	if err := h.db.Delete(&orphan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete staged row"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Staged row deleted"})
+}
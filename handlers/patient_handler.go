@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"point-prevalence-survey/database"
 	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -30,6 +32,8 @@ func NewPatientHandler() *PatientHandler {
 // @Param district query string false "Filter by district"
 // @Param facility query string false "Filter by facility"
 // @Param ward query string false "Filter by ward name"
+// @Param excluded query bool false "Filter by exclusion from the PPS indicators"
+// @Param flagged query bool false "Filter by data quality flags on the patient or its child records"
 // @Param page query int false "Page number" default(1)
 // @Param limit query int false "Items per page" default(10)
 // @Success 200 {object} map[string]interface{}
@@ -60,6 +64,17 @@ func (h *PatientHandler) GetPatients(c *gin.Context) {
 	if ward := c.Query("ward"); ward != "" {
 		query = query.Where("ward_name = ?", ward)
 	}
+	if excluded, err := strconv.ParseBool(c.Query("excluded")); err == nil {
+		query = query.Where("excluded = ?", excluded)
+	}
+	if flagged, err := strconv.ParseBool(c.Query("flagged")); err == nil {
+		flaggedKeys := h.db.Model(&models.QualityFlag{}).Select("patient_key")
+		if flagged {
+			query = query.Where("key IN (?)", flaggedKeys)
+		} else {
+			query = query.Where("key NOT IN (?)", flaggedKeys)
+		}
+	}
 
 	// Pagination
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
@@ -97,7 +112,7 @@ func (h *PatientHandler) GetPatient(c *gin.Context) {
 	id := c.Param("id")
 	var patient models.Patient
 
-	if err := h.db.Preload("Antibiotics").Preload("Indications").Preload("OptionalVars").Preload("Specimens").First(&patient, "key = ?", id).Error; err != nil {
+	if err := h.db.Preload("Antibiotics").Preload("Indications").Preload("OptionalVars").Preload("Specimens.SusceptibilityResults").First(&patient, "key = ?", id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
 		return
 	}
@@ -189,6 +204,27 @@ func (h *PatientHandler) GetPatientSpecimens(c *gin.Context) {
 	c.JSON(http.StatusOK, specimens)
 }
 
+// GetPatientQualityFlags godoc
+// @Summary Get data quality flags for a specific patient
+// @Description Get the data quality rules broken by a patient and its child records
+// @Tags patients
+// @Accept json
+// @Produce json
+// @Param id path string true "Patient ID"
+// @Success 200 {object} []models.QualityFlag
+// @Router /api/v1/patients/{id}/quality-flags [get]
+func (h *PatientHandler) GetPatientQualityFlags(c *gin.Context) {
+	id := c.Param("id")
+	var flags []models.QualityFlag
+
+	if err := h.db.Where("patient_key = ?", id).Order("id").Find(&flags).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quality flags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, flags)
+}
+
 // GetPatientStats godoc
 // @Summary Get patient statistics
 // @Description Get aggregated statistics about patients
@@ -219,7 +255,7 @@ func (h *PatientHandler) GetPatientStats(c *gin.Context) {
 	h.db.Model(&models.Patient{}).Count(&stats.TotalPatients)
 
 	// Patients on antibiotic
-	h.db.Model(&models.Patient{}).Where("patient_on_antibiotic = ?", "yes").Count(&stats.PatientsOnAntibiotic)
+	h.db.Model(&models.Patient{}).Where("patient_on_antibiotic = ?", services.CodeYes).Count(&stats.PatientsOnAntibiotic)
 
 	// By region
 	h.db.Model(&models.Patient{}).Select("region, count(*) as count").Group("region").Scan(&stats.ByRegion)
@@ -232,3 +268,69 @@ func (h *PatientHandler) GetPatientStats(c *gin.Context) {
 
 	c.JSON(http.StatusOK, stats)
 }
+
+// exclusion is the body of a request to exclude a patient
+type exclusion struct {
+	Reason string `json:"reason"`
+}
+
+// ExcludePatient godoc
+// @Summary Exclude a patient from the PPS indicators
+// @Description Leave a patient and its antibiotics, indications, specimens and other child rows out of the PPS indicators and the resistance summary, e.g. a patient surveyed twice. The records are kept, and later imports do not change the exclusion
+// @Tags patients
+// @Accept json
+// @Produce json
+// @Param id path string true "Patient ID"
+// @Param exclusion body exclusion false "Reason for the exclusion"
+// @Success 200 {object} models.Patient
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/patients/{id}/exclude [post]
+func (h *PatientHandler) ExcludePatient(c *gin.Context) {
+	var body exclusion
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	patient, err := services.ExcludePatient(h.db, c.Param("id"), body.Reason)
+	if err != nil {
+		patientReviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, patient)
+}
+
+// IncludePatient godoc
+// @Summary Include an excluded patient in the PPS indicators again
+// @Description Reverse the exclusion of a patient, or its merge into another patient
+// @Tags patients
+// @Accept json
+// @Produce json
+// @Param id path string true "Patient ID"
+// @Success 200 {object} models.Patient
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/patients/{id}/include [post]
+func (h *PatientHandler) IncludePatient(c *gin.Context) {
+	patient, err := services.IncludePatient(h.db, c.Param("id"))
+	if err != nil {
+		patientReviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, patient)
+}
+
+// patientReviewError writes the response for an error of a patient exclusion or duplicate review
+func patientReviewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPatientNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found", "message": err.Error()})
+	case errors.Is(err, services.ErrInvalidDuplicate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review", "message": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update patient", "message": err.Error()})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"point-prevalence-survey/database"
 	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -68,9 +69,15 @@ func applyFilters(db *gorm.DB, c *gin.Context, dateColumn string) *gorm.DB {
 	return db
 }
 
+// excludedPatients selects the keys of patients left out of the indicators,
+// such as duplicates
+func excludedPatients(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Patient{}).Select("key").Where("excluded = ?", true)
+}
+
 // getFilteredPatientQuery returns a query for patients filtered by date and geographic/facility parameters
 func (h *PPSCalculationsHandler) getFilteredPatientQuery(c *gin.Context) *gorm.DB {
-	return applyFilters(h.db.Model(&models.Patient{}), c, "submission_date")
+	return applyFilters(h.db.Model(&models.Patient{}), c, "submission_date").Where("excluded = ?", false)
 }
 
 // getFilteredAntibioticQuery returns a query for antibiotics filtered by parent patient's parameters
@@ -128,7 +135,8 @@ func (h *PPSCalculationsHandler) getFilteredAntibioticQuery(c *gin.Context) *gor
 		}
 	}
 
-	return query
+	// Antibiotics of excluded patients are left out as well
+	return query.Where("antibiotics.parent_key NOT IN (?)", excludedPatients(h.db))
 }
 
 // applyPatientFiltersToAntibioticDetailsQuery applies comprehensive filtering to antibiotic details query
@@ -153,14 +161,15 @@ func (h *PPSCalculationsHandler) applyPatientFiltersToQuery(query *gorm.DB, c *g
 		c.Query("region") != "" || c.Query("district") != "" || c.Query("subcounty") != "" ||
 		c.Query("facility") != "" || c.Query("level") != "" || c.Query("ownership") != ""
 
+	// For optional_vars, use the key field instead of parent_key
+	patientColumn := tableName + ".parent_key"
+	if tableName == "optional_vars" {
+		patientColumn = tableName + ".key"
+	}
+
 	if hasFilters {
 		// Join with patients table to filter by patient parameters
-		// For optional_vars, use the key field instead of parent_key
-		if tableName == "optional_vars" {
-			query = query.Joins("JOIN patients ON patients.key = " + tableName + ".key")
-		} else {
-			query = query.Joins("JOIN patients ON patients.key = " + tableName + ".parent_key")
-		}
+		query = query.Joins("JOIN patients ON patients.key = " + patientColumn)
 
 		// Apply date filtering
 		startDateStr := c.Query("start_date")
@@ -204,7 +213,8 @@ func (h *PPSCalculationsHandler) applyPatientFiltersToQuery(query *gorm.DB, c *g
 		}
 	}
 
-	return query
+	// Rows of excluded patients are left out as well
+	return query.Where(patientColumn+" NOT IN (?)", excludedPatients(h.db))
 }
 
 // getFilteredAntibioticDetailsQuery returns a query for antibiotic details filtered by parent patient's parameters
@@ -228,18 +238,7 @@ func (h *PPSCalculationsHandler) getFilteredSpecimenQuery(c *gin.Context) *gorm.
 // getFilteredOptionalVarsQuery returns a query for optional_vars filtered by parent patient's parameters
 func (h *PPSCalculationsHandler) getFilteredOptionalVarsQuery(c *gin.Context) *gorm.DB {
 	query := h.db.Model(&models.OptionalVar{})
-
-	// Check if any filtering parameters are provided
-	hasFilters := c.Query("start_date") != "" || c.Query("end_date") != "" ||
-		c.Query("region") != "" || c.Query("district") != "" || c.Query("subcounty") != "" ||
-		c.Query("facility") != "" || c.Query("level") != "" || c.Query("ownership") != ""
-
-	if hasFilters {
-		return h.applyPatientFiltersToQuery(query, c, "optional_vars")
-	}
-
-	// If no filters, return the base query
-	return query
+	return h.applyPatientFiltersToQuery(query, c, "optional_vars")
 }
 
 // PPSIndicators represents all the calculated indicators
@@ -328,7 +327,7 @@ func (h *PPSCalculationsHandler) GetAllIndicators(c *gin.Context) {
 
 	// Injectable Prescriptions
 	var injectableCount int64
-	h.getFilteredAntibioticDetailsQuery(c).Where("intraveno = ? OR intraveno LIKE ?", "iv", "iv%").Count(&injectableCount)
+	h.getFilteredAntibioticDetailsQuery(c).Where("intraveno = ?", services.CodeIV).Count(&injectableCount)
 	indicators.TotalInjectablePrescriptions = int(injectableCount)
 
 	// Injectable Percentage
@@ -347,7 +346,7 @@ func (h *PPSCalculationsHandler) GetAllIndicators(c *gin.Context) {
 
 	// Treatment Guidelines (Yellow Section)
 	var guidelineCompliant int64
-	h.getFilteredAntibioticDetailsQuery(c).Where("guideline = ?", "yes").Count(&guidelineCompliant)
+	h.getFilteredAntibioticDetailsQuery(c).Where("guideline = ?", services.CodeYes).Count(&guidelineCompliant)
 	indicators.TotalGuidelineCompliant = int(guidelineCompliant)
 
 	if indicators.TotalAntibioticsPrescribed > 0 {
@@ -365,7 +364,7 @@ func (h *PPSCalculationsHandler) GetAllIndicators(c *gin.Context) {
 
 	// Culture and Sensitivity (Dark Green Section)
 	var cultureBased int64
-	h.getFilteredIndicationQuery(c).Where("culture_sample_taken = ?", "yes").Count(&cultureBased)
+	h.getFilteredIndicationQuery(c).Where("culture_sample_taken = ?", services.CodeYes).Count(&cultureBased)
 	indicators.TotalCultureBasedPrescriptions = int(cultureBased)
 
 	if indicators.TotalAntibioticsPrescribed > 0 {
@@ -469,7 +468,7 @@ func (h *PPSCalculationsHandler) GetInjectableMetrics(c *gin.Context) {
 	var totalInjectable int64
 	var totalAntibiotics int64
 
-	h.getFilteredAntibioticDetailsQuery(c).Where("intraveno = ? OR intraveno LIKE ?", "iv", "iv%").Count(&totalInjectable)
+	h.getFilteredAntibioticDetailsQuery(c).Where("intraveno = ?", services.CodeIV).Count(&totalInjectable)
 	h.getFilteredAntibioticQuery(c).Count(&totalAntibiotics)
 
 	percentageInjectable := 0.0
@@ -545,23 +544,8 @@ func (h *PPSCalculationsHandler) GetGuidelineMetrics(c *gin.Context) {
 	var totalGuidelineCompliant int64
 	var totalOptionalVars int64
 
-	// Check if any filtering parameters are provided
-	hasFilters := c.Query("start_date") != "" || c.Query("end_date") != "" ||
-		c.Query("region") != "" || c.Query("district") != "" || c.Query("subcounty") != "" ||
-		c.Query("facility") != "" || c.Query("level") != "" || c.Query("ownership") != ""
-
-	if hasFilters {
-		// Use filtered queries
-		compliantQuery := h.getFilteredOptionalVarsQuery(c)
-		compliantQuery.Where("guidelines_compliance = ?", "y").Count(&totalGuidelineCompliant)
-
-		totalQuery := h.getFilteredOptionalVarsQuery(c)
-		totalQuery.Count(&totalOptionalVars)
-	} else {
-		// Use direct queries without filters
-		h.db.Model(&models.OptionalVar{}).Where("guidelines_compliance = ?", "y").Count(&totalGuidelineCompliant)
-		h.db.Model(&models.OptionalVar{}).Count(&totalOptionalVars)
-	}
+	h.getFilteredOptionalVarsQuery(c).Where("guidelines_compliance = ?", services.CodeYes).Count(&totalGuidelineCompliant)
+	h.getFilteredOptionalVarsQuery(c).Count(&totalOptionalVars)
 
 	percentageGuideline := 0.0
 	if totalOptionalVars > 0 {
@@ -642,7 +626,7 @@ func (h *PPSCalculationsHandler) GetCultureMetrics(c *gin.Context) {
 	var totalCultureSamples int64
 	var totalAntibiotics int64
 
-	h.getFilteredIndicationQuery(c).Where("culture_sample_taken = ?", "yes").Count(&totalCultureBased)
+	h.getFilteredIndicationQuery(c).Where("culture_sample_taken = ?", services.CodeYes).Count(&totalCultureBased)
 	h.getFilteredSpecimenQuery(c).Where("specimen_type != '' AND specimen_type IS NOT NULL").Count(&totalCultureSamples)
 	h.getFilteredAntibioticQuery(c).Count(&totalAntibiotics)
 
@@ -769,7 +753,7 @@ func (h *PPSCalculationsHandler) GetOralSwitchMetrics(c *gin.Context) {
 	}
 	h.getFilteredAntibioticDetailsQuery(c).
 		Select("oral_switch, count(*) as count").
-		Where("oral_switch != '' AND oral_switch IS NOT NULL AND oral_switch = 'yes'").
+		Where("oral_switch = ?", services.CodeYes).
 		Group("oral_switch").
 		Find(&oralSwitchStats)
 
@@ -806,8 +790,10 @@ func (h *PPSCalculationsHandler) GetLongStayPatients(c *gin.Context) {
 	var longStayCount int64
 
 	// Calculate patients staying longer than 7 days
-	// Using SQL to calculate the difference between survey_date and admission_date
+	// Using SQL to calculate the difference between survey_date and admission_date.
+	// Patients without both dates are skipped.
 	err := h.getFilteredPatientQuery(c).
+		Where("survey_date > ? AND admission_date > ?", time.Time{}, time.Time{}).
 		Where("survey_date - admission_date > INTERVAL '7 days'").
 		Count(&longStayCount).Error
 
@@ -869,7 +855,7 @@ func (h *PPSCalculationsHandler) GetAWaReCategorization(c *gin.Context) {
 	// Get Access antibiotics count (first choice antibiotics) - case-insensitive, handles NULL and empty strings
 	var accessCount int64
 	err = h.getFilteredAntibioticQuery(c).
-		Where("antibiotic_aware_classification IS NOT NULL AND antibiotic_aware_classification != '' AND LOWER(TRIM(antibiotic_aware_classification)) = ?", "access").
+		Where("antibiotic_aware_classification IS NOT NULL AND antibiotic_aware_classification != '' AND LOWER(TRIM(antibiotic_aware_classification)) = ?", services.CodeAccess).
 		Count(&accessCount).Error
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Access antibiotics count"})
@@ -879,7 +865,7 @@ func (h *PPSCalculationsHandler) GetAWaReCategorization(c *gin.Context) {
 	// Get Watch antibiotics count (second choice antibiotics) - case-insensitive, handles NULL and empty strings
 	var watchCount int64
 	err = h.getFilteredAntibioticQuery(c).
-		Where("antibiotic_aware_classification IS NOT NULL AND antibiotic_aware_classification != '' AND LOWER(TRIM(antibiotic_aware_classification)) = ?", "watch").
+		Where("antibiotic_aware_classification IS NOT NULL AND antibiotic_aware_classification != '' AND LOWER(TRIM(antibiotic_aware_classification)) = ?", services.CodeWatch).
 		Count(&watchCount).Error
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Watch antibiotics count"})
@@ -889,7 +875,7 @@ func (h *PPSCalculationsHandler) GetAWaReCategorization(c *gin.Context) {
 	// Get Reserve antibiotics count (last resort antibiotics) - case-insensitive, handles NULL and empty strings
 	var reserveCount int64
 	err = h.getFilteredAntibioticQuery(c).
-		Where("antibiotic_aware_classification IS NOT NULL AND antibiotic_aware_classification != '' AND LOWER(TRIM(antibiotic_aware_classification)) = ?", "reserve").
+		Where("antibiotic_aware_classification IS NOT NULL AND antibiotic_aware_classification != '' AND LOWER(TRIM(antibiotic_aware_classification)) = ?", services.CodeReserve).
 		Count(&reserveCount).Error
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Reserve antibiotics count"})
@@ -968,7 +954,7 @@ func (h *PPSCalculationsHandler) GetAppropriateDiagnosisPercentage(c *gin.Contex
 	}
 
 	if err := h.getFilteredIndicationQuery(c).
-		Where("LOWER(reason_in_notes) = ?", "yes").
+		Where("reason_in_notes = ?", services.CodeYes).
 		Count(&yesResponses).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count yes responses"})
 		return
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type QualityHandler struct {
+	db    *gorm.DB
+	rules *services.QualityRules
+}
+
+func NewQualityHandler() *QualityHandler {
+	return &QualityHandler{
+		db:    database.GetDB(),
+		rules: services.NewCSVService().QualityRules(),
+	}
+}
+
+// GetQualityRules godoc
+// @Summary List the data quality rules
+// @Description Get the active data quality rules checked on every imported record: the defaults, with the rules of QUALITY_RULES_FILE added or replacing them
+// @Tags quality
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/quality/rules [get]
+func (h *QualityHandler) GetQualityRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rules": h.rules.Rules()})
+}
+
+// GetQualityFlags godoc
+// @Summary List data quality flags
+// @Description Get the data quality rules broken by stored records
+// @Tags quality
+// @Produce json
+// @Param entity query string false "Filter by entity (patients, antibiotics, antibiotic_details, indications, specimens)"
+// @Param key query string false "Filter by the key of the flagged record"
+// @Param patient_key query string false "Filter by patient, including the patient's child records"
+// @Param rule query string false "Filter by rule ID"
+// @Param severity query string false "Filter by severity (reject or warn)"
+// @Param import_id query int false "Filter by the import that raised the flags"
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Items per page" default(10)
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Router /api/v1/quality/flags [get]
+func (h *QualityHandler) GetQualityFlags(c *gin.Context) {
+	var flags []models.QualityFlag
+	query := h.db.Model(&models.QualityFlag{})
+
+	if entity := c.Query("entity"); entity != "" {
+		query = query.Where("entity = ?", entity)
+	}
+	if key := c.Query("key"); key != "" {
+		query = query.Where("record_key = ?", key)
+	}
+	if patientKey := c.Query("patient_key"); patientKey != "" {
+		query = query.Where("patient_key = ?", patientKey)
+	}
+	if rule := c.Query("rule"); rule != "" {
+		query = query.Where("rule = ?", rule)
+	}
+	if severity := c.Query("severity"); severity != "" {
+		query = query.Where("severity = ?", severity)
+	}
+	if importID := c.Query("import_id"); importID != "" {
+		id, err := strconv.ParseUint(importID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import ID"})
+			return
+		}
+		query = query.Where("import_id = ?", id)
+	}
+
+	// Pagination
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	var total int64
+	query.Count(&total)
+
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&flags).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quality flags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": flags,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetQualitySummary godoc
+// @Summary Count data quality flags
+// @Description Count the stored flags and flagged records per rule, and the patients with at least one flag on themselves or their child records
+// @Tags quality
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/quality/summary [get]
+func (h *QualityHandler) GetQualitySummary(c *gin.Context) {
+	var rules []struct {
+		Rule     string `json:"rule"`
+		Entity   string `json:"entity"`
+		Severity string `json:"severity"`
+		Flags    int    `json:"flags"`
+		Records  int    `json:"records"`
+	}
+	err := h.db.Model(&models.QualityFlag{}).
+		Select("rule, entity, severity, COUNT(*) AS flags, COUNT(DISTINCT record_key) AS records").
+		Group("rule, entity, severity").
+		Order("rule").
+		Scan(&rules).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count quality flags"})
+		return
+	}
+
+	var flags, patients int64
+	h.db.Model(&models.QualityFlag{}).Count(&flags)
+	h.db.Model(&models.QualityFlag{}).Distinct("patient_key").Count(&patients)
+
+	c.JSON(http.StatusOK, gin.H{
+		"flags":            flags,
+		"flagged_patients": patients,
+		"rules":            rules,
+	})
+}
+
+// EvaluateQuality godoc
+// @Summary Re-check stored records
+// @Description Check every stored record against the current data quality rules, replacing all flags. Imports only check the records they write, so run this after the rules change
+// @Tags quality
+// @Produce json
+// @Success 200 {object} services.QualityEvaluation
+// @Router /api/v1/quality/evaluate [post]
+func (h *QualityHandler) EvaluateQuality(c *gin.Context) {
+	evaluation, err := h.rules.Evaluate(h.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to evaluate quality rules",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, evaluation)
+}
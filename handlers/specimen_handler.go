@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"point-prevalence-survey/database"
 	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
 	"strconv"
 	"time"
 
@@ -247,3 +248,102 @@ func (h *SpecimenHandler) GetSpecimensByPatient(c *gin.Context) {
 		"specimens": specimens,
 	})
 }
+
+// GetSpecimenSusceptibility godoc
+// @Summary Get susceptibility results of a specimen
+// @Description Get the organism and antibiotic results parsed from a specimen's susceptibility test results
+// @Tags specimens
+// @Accept json
+// @Produce json
+// @Param id path string true "Specimen ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/specimens/{id}/susceptibility [get]
+func (h *SpecimenHandler) GetSpecimenSusceptibility(c *gin.Context) {
+	id := c.Param("id")
+
+	var specimen models.Specimen
+	if err := h.db.First(&specimen, "key = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Specimen not found"})
+		return
+	}
+
+	var results []models.SusceptibilityResult
+	if err := h.db.Where("specimen_key = ?", id).Order("id").Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch susceptibility results"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"specimen": specimen,
+		"results":  results,
+	})
+}
+
+// GetSpecimenAntibiogram godoc
+// @Summary Get the antibiogram of a specimen
+// @Description Get the susceptibility results of a specimen grouped by organism, with the antibiotics each organism is susceptible, intermediate or resistant to
+// @Tags specimens
+// @Accept json
+// @Produce json
+// @Param id path string true "Specimen ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/specimens/{id}/antibiogram [get]
+func (h *SpecimenHandler) GetSpecimenAntibiogram(c *gin.Context) {
+	id := c.Param("id")
+
+	var specimen models.Specimen
+	if err := h.db.First(&specimen, "key = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Specimen not found"})
+		return
+	}
+
+	var results []models.SusceptibilityResult
+	if err := h.db.Where("specimen_key = ?", id).Order("id").Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch susceptibility results"})
+		return
+	}
+
+	type organismResults struct {
+		Organism     string                        `json:"organism"`
+		Susceptible  []string                      `json:"susceptible"`
+		Intermediate []string                      `json:"intermediate"`
+		Resistant    []string                      `json:"resistant"`
+		Results      []models.SusceptibilityResult `json:"results"`
+	}
+
+	// Organisms are listed in the order they were reported
+	organisms := make([]*organismResults, 0)
+	byOrganism := make(map[string]*organismResults)
+	for _, result := range results {
+		entry, ok := byOrganism[result.Organism]
+		if !ok {
+			entry = &organismResults{
+				Organism:     result.Organism,
+				Susceptible:  make([]string, 0),
+				Intermediate: make([]string, 0),
+				Resistant:    make([]string, 0),
+			}
+			byOrganism[result.Organism] = entry
+			organisms = append(organisms, entry)
+		}
+
+		switch result.Interpretation {
+		case services.InterpretationSusceptible:
+			entry.Susceptible = append(entry.Susceptible, result.Antibiotic)
+		case services.InterpretationIntermediate:
+			entry.Intermediate = append(entry.Intermediate, result.Antibiotic)
+		case services.InterpretationResistant:
+			entry.Resistant = append(entry.Resistant, result.Antibiotic)
+		}
+		entry.Results = append(entry.Results, result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"specimen_id": specimen.ID,
+		"patient_id":  specimen.ParentKey,
+		"raw":         specimen.AntibioticSusceptibilityTestResults,
+		"organisms":   organisms,
+	})
+}
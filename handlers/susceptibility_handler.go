@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"net/http"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type SusceptibilityHandler struct {
+	db *gorm.DB
+}
+
+func NewSusceptibilityHandler() *SusceptibilityHandler {
+	return &SusceptibilityHandler{
+		db: database.GetDB(),
+	}
+}
+
+// filteredQuery returns susceptibility results filtered by organism,
+// antibiotic and interpretation, and by the date and facility of their patient
+func (h *SusceptibilityHandler) filteredQuery(c *gin.Context) *gorm.DB {
+	query := h.db.Model(&models.SusceptibilityResult{})
+
+	if organism := c.Query("organism"); organism != "" {
+		query = query.Where("LOWER(organism) = LOWER(?)", organism)
+	}
+	if antibiotic := c.Query("antibiotic"); antibiotic != "" {
+		query = query.Where("LOWER(antibiotic) = LOWER(?)", antibiotic)
+	}
+	if interpretation := c.Query("interpretation"); interpretation != "" {
+		query = query.Where("interpretation = ?", interpretation)
+	}
+	if specimenID := c.Query("specimen_id"); specimenID != "" {
+		query = query.Where("specimen_key = ?", specimenID)
+	}
+	if patientID := c.Query("patient_id"); patientID != "" {
+		query = query.Where("patient_key = ?", patientID)
+	}
+
+	hasPatientFilters := c.Query("start_date") != "" || c.Query("end_date") != "" ||
+		c.Query("region") != "" || c.Query("district") != "" || c.Query("subcounty") != "" ||
+		c.Query("facility") != "" || c.Query("level") != "" || c.Query("ownership") != ""
+	if hasPatientFilters {
+		patients := applyFilters(h.db.Model(&models.Patient{}).Select("key"), c, "submission_date")
+		query = query.Where("patient_key IN (?)", patients)
+	}
+
+	return query
+}
+
+// GetSusceptibilityResults godoc
+// @Summary Get susceptibility results
+// @Description Get the organism and antibiotic results parsed from the susceptibility test results of specimens
+// @Tags susceptibility
+// @Accept json
+// @Produce json
+// @Param organism query string false "Filter by organism"
+// @Param antibiotic query string false "Filter by antibiotic"
+// @Param interpretation query string false "Filter by interpretation (S, I or R)"
+// @Param specimen_id query string false "Filter by specimen ID"
+// @Param patient_id query string false "Filter by patient ID"
+// @Param start_date query string false "Start date for filtering (YYYY-MM-DD)"
+// @Param end_date query string false "End date for filtering (YYYY-MM-DD)"
+// @Param region query string false "Region for filtering"
+// @Param district query string false "District for filtering"
+// @Param subcounty query string false "Subcounty for filtering"
+// @Param facility query string false "Facility for filtering"
+// @Param level query string false "Level of care for filtering"
+// @Param ownership query string false "Ownership for filtering"
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Items per page" default(10)
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/susceptibility-results [get]
+func (h *SusceptibilityHandler) GetSusceptibilityResults(c *gin.Context) {
+	var results []models.SusceptibilityResult
+	query := h.filteredQuery(c)
+
+	// Pagination
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset := (page - 1) * limit
+
+	var total int64
+	query.Count(&total)
+
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch susceptibility results"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetResistanceSummary godoc
+// @Summary Get resistance by organism and antibiotic
+// @Description Get the number of isolates tested and found susceptible, intermediate or resistant for each organism and antibiotic, with the percentage resistant
+// @Tags susceptibility
+// @Accept json
+// @Produce json
+// @Param organism query string false "Filter by organism"
+// @Param antibiotic query string false "Filter by antibiotic"
+// @Param start_date query string false "Start date for filtering (YYYY-MM-DD)"
+// @Param end_date query string false "End date for filtering (YYYY-MM-DD)"
+// @Param region query string false "Region for filtering"
+// @Param district query string false "District for filtering"
+// @Param subcounty query string false "Subcounty for filtering"
+// @Param facility query string false "Facility for filtering"
+// @Param level query string false "Level of care for filtering"
+// @Param ownership query string false "Ownership for filtering"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/susceptibility-results/summary [get]
+func (h *SusceptibilityHandler) GetResistanceSummary(c *gin.Context) {
+	var rows []struct {
+		Organism         string  `json:"organism"`
+		Antibiotic       string  `json:"antibiotic"`
+		Tested           int64   `json:"tested"`
+		Susceptible      int64   `json:"susceptible"`
+		Intermediate     int64   `json:"intermediate"`
+		Resistant        int64   `json:"resistant"`
+		PercentResistant float64 `json:"percent_resistant" gorm:"-"`
+	}
+
+	// Results of excluded patients, such as duplicates, are not counted
+	err := h.filteredQuery(c).
+		Where("patient_key NOT IN (?)", excludedPatients(h.db)).
+		Select(`organism, antibiotic,
+			SUM(CASE WHEN interpretation <> '' THEN 1 ELSE 0 END) AS tested,
+			SUM(CASE WHEN interpretation = ? THEN 1 ELSE 0 END) AS susceptible,
+			SUM(CASE WHEN interpretation = ? THEN 1 ELSE 0 END) AS intermediate,
+			SUM(CASE WHEN interpretation = ? THEN 1 ELSE 0 END) AS resistant`,
+			services.InterpretationSusceptible, services.InterpretationIntermediate, services.InterpretationResistant).
+		Group("organism, antibiotic").
+		Order("organism, antibiotic").
+		Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate resistance summary"})
+		return
+	}
+
+	for i := range rows {
+		if rows[i].Tested > 0 {
+			rows[i].PercentResistant = float64(rows[i].Resistant) / float64(rows[i].Tested) * 100
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rows})
+}
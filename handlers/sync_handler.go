@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"point-prevalence-survey/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SyncHandler struct {
+	syncService *services.ODKSyncService
+}
+
+func NewSyncHandler() *SyncHandler {
+	return &SyncHandler{
+		syncService: services.GetODKSyncService(),
+	}
+}
+
+// GetODKSync godoc
+// @Summary Get the ODK Central sync status
+// @Description Get the configured ODK Central form and the outcome and watermark of the last sync
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/sync/odk [get]
+func (h *SyncHandler) GetODKSync(c *gin.Context) {
+	client := h.syncService.Client()
+	if !client.Configured() {
+		c.JSON(http.StatusOK, gin.H{"configured": false})
+		return
+	}
+
+	state, err := h.syncService.State()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sync status", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"configured":  true,
+		"service_url": client.ServiceURL(),
+		"state":       state,
+	})
+}
+
+// SyncODK godoc
+// @Summary Sync submissions from ODK Central
+// @Description Fetch the submissions created or edited since the last sync from the ODK Central OData API and import them with their repeat groups. Each sync is recorded as an import job
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param full query bool false "Fetch every submission instead of only those since the last sync"
+// @Param merge query string false "How rows whose key already exists are handled: skip, overwrite or newer" default(newer)
+// @Param atomic query bool false "Roll back the whole sync if any row fails"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Run the sync in the background and return its job ID at once"
+// @Param uploaded_by query string false "Name of the person starting the sync (or X-Uploaded-By header)"
+// @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]string
+// @Failure 502 {object} map[string]string
+// @Failure 503 {object} map[string]string
+// @Router /api/v1/sync/odk [post]
+func (h *SyncHandler) SyncODK(c *gin.Context) {
+	full, _ := strconv.ParseBool(c.Query("full"))
+	atomic, _ := strconv.ParseBool(c.Query("atomic"))
+	async, _ := strconv.ParseBool(c.Query("async"))
+	allowInvalid, _ := strconv.ParseBool(c.Query("allow_invalid"))
+
+	merge := c.Query("merge")
+	if !services.ValidMergeStrategy(merge) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid merge strategy",
+			"message": "merge must be one of skip, overwrite or newer",
+		})
+		return
+	}
+
+	triggeredBy := c.Query("uploaded_by")
+	if triggeredBy == "" {
+		triggeredBy = c.GetHeader("X-Uploaded-By")
+	}
+
+	job, result, err := h.syncService.Sync(services.SyncOptions{
+		Full:        full,
+		TriggeredBy: triggeredBy,
+		Async:       async,
+		Import:      services.ImportOptions{MergeStrategy: merge, Atomic: atomic, AllowInvalid: allowInvalid},
+	})
+	if errors.Is(err, services.ErrSyncNotConfigured) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "ODK sync is not configured",
+			"message": "Set ODK_BASE_URL, ODK_PROJECT_ID and ODK_FORM_ID to enable it",
+		})
+		return
+	}
+	if errors.Is(err, services.ErrSyncRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sync already running", "message": err.Error()})
+		return
+	}
+	if err != nil && job == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Sync failed", "message": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":   "Sync failed",
+			"message": err.Error(),
+			"job_id":  job.ID,
+		})
+		return
+	}
+
+	if async {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":    "Sync started",
+			"job_id":     job.ID,
+			"status_url": fmt.Sprintf("/api/v1/imports/%d", job.ID),
+			"job":        job,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Sync completed",
+		"job_id":  job.ID,
+		"status":  job.Status,
+		"result":  result,
+	})
+}
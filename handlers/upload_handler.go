@@ -1,57 +1,197 @@
 package handlers
 
 import (
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"point-prevalence-survey/config"
+	"point-prevalence-survey/models"
 	"point-prevalence-survey/services"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// uploadEntities maps the entity names used in upload URLs to import entities
+var uploadEntities = map[string]string{
+	"patients":           services.EntityPatients,
+	"antibiotics":        services.EntityAntibiotics,
+	"antibiotic-details": services.EntityAntibioticDetails,
+	"indications":        services.EntityIndications,
+	"optional-vars":      services.EntityOptionalVars,
+	"specimens":          services.EntitySpecimens,
+	"whonet":             services.JobEntityWhonet,
+}
+
 type UploadHandler struct {
-	csvService *services.CSVService
+	csvService     *services.CSVService
+	jobService     *services.ImportJobService
+	sessionService *services.UploadSessionService
+	maxUploadSize  int64
+	// maxDecompressedSize caps decompressed request bodies
+	maxDecompressedSize int64
 }
 
 func NewUploadHandler() *UploadHandler {
+	cfg := config.LoadConfig()
+
+	maxUploadSize := int64(cfg.MaxUploadSizeMB) * 1024 * 1024
+	maxDecompressedSize := int64(cfg.MaxDecompressedSizeMB) * 1024 * 1024
+	if maxUploadSize > 0 {
+		// Just above the file limit, which covers multipart overhead
+		maxDecompressedSize = maxUploadSize + 1024*1024
+	} else if maxDecompressedSize <= 0 {
+		maxDecompressedSize = 1024 * 1024 * 1024
+	}
+
 	return &UploadHandler{
-		csvService: services.NewCSVService(),
+		csvService:          services.NewCSVService(),
+		jobService:          services.GetImportJobService(),
+		sessionService:      services.NewUploadSessionService(),
+		maxUploadSize:       maxUploadSize,
+		maxDecompressedSize: maxDecompressedSize,
+	}
+}
+
+// DecompressBody lets clients on slow connections send gzip-compressed
+// uploads with Content-Encoding: gzip. The body is decompressed as it is
+// read, so handlers see the original file. The decompressed body is always
+// capped, so a small compressed request cannot expand without bound: just
+// above MAX_UPLOAD_SIZE_MB when set, else at MAX_DECOMPRESSED_SIZE_MB.
+func (h *UploadHandler) DecompressBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.EqualFold(strings.TrimSpace(c.GetHeader("Content-Encoding")), "gzip") {
+			c.Next()
+			return
+		}
+
+		gz, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid gzip body",
+				"message": err.Error(),
+			})
+			return
+		}
+		defer gz.Close()
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, gz, h.maxDecompressedSize)
+		c.Request.ContentLength = -1
+		c.Request.Header.Del("Content-Encoding")
+		c.Request.Header.Del("Content-Length")
+		c.Next()
 	}
 }
 
-// validateCSVFile validates the uploaded file
-func (h *UploadHandler) validateCSVFile(fileHeader *multipart.FileHeader) error {
-	// Check file extension
-	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-	if ext != ".csv" {
-		return fmt.Errorf("invalid file type. Only CSV files are allowed")
+// validateUploadFile validates the uploaded file of entity. WHONET exports
+// are delimited text files rather than CSV or XLSX.
+func (h *UploadHandler) validateUploadFile(entity string, fileHeader *multipart.FileHeader) error {
+	if entity == services.JobEntityWhonet {
+		return h.validateFile(fileHeader, ".csv", ".txt")
 	}
+	return h.validateFile(fileHeader, ".csv", ".xlsx")
+}
 
-	// Check file size (max 10MB)
-	const maxFileSize = 10 * 1024 * 1024 // 10MB
-	if fileHeader.Size > maxFileSize {
-		return fmt.Errorf("file too large. Maximum size allowed is 10MB")
+// validateFile checks the extension and size of an uploaded file
+func (h *UploadHandler) validateFile(fileHeader *multipart.FileHeader, allowedExts ...string) error {
+	if err := checkExtension(fileHeader.Filename, allowedExts...); err != nil {
+		return err
 	}
 
+	// Check file size. Files are streamed row by row, so the limit is only
+	// enforced when MAX_UPLOAD_SIZE_MB is configured.
+	if h.maxUploadSize > 0 && fileHeader.Size > h.maxUploadSize {
+		return fmt.Errorf("file too large. Maximum size allowed is %dMB", h.maxUploadSize/(1024*1024))
+	}
+
+	return nil
+}
+
+// checkExtension checks that filename has one of allowedExts
+func checkExtension(filename string, allowedExts ...string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	allowed := false
+	names := make([]string, 0, len(allowedExts))
+	for _, allowedExt := range allowedExts {
+		allowed = allowed || ext == allowedExt
+		names = append(names, strings.ToUpper(strings.TrimPrefix(allowedExt, ".")))
+	}
+	if !allowed {
+		return fmt.Errorf("invalid file type. Only %s files are allowed", strings.Join(names, " or "))
+	}
 	return nil
 }
 
-// processUpload handles common upload logic
-func (h *UploadHandler) processUpload(c *gin.Context, uploadFunc func(multipart.File) (*services.UploadResult, error)) {
+// importOptions reads the import options of an upload from the query string
+// or the multipart form. Invalid options are answered with 400 and ok false.
+func (h *UploadHandler) importOptions(c *gin.Context) (services.ImportOptions, bool) {
+	batchSize, _ := strconv.Atoi(formValue(c, "batch_size"))
+	atomic, _ := strconv.ParseBool(formValue(c, "atomic"))
+	allowInvalid, _ := strconv.ParseBool(formValue(c, "allow_invalid"))
+
+	opts := services.ImportOptions{
+		MappingVersion: formValue(c, "mapping_version"),
+		FormVersion:    formValue(c, "form_version"),
+		BatchSize:      batchSize,
+		Atomic:         atomic,
+		MergeStrategy:  formValue(c, "merge"),
+		DateFormat:     formValue(c, "date_format"),
+		Timezone:       formValue(c, "timezone"),
+		AllowInvalid:   allowInvalid,
+	}
+
+	if !services.ValidMergeStrategy(opts.MergeStrategy) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid merge strategy",
+			"message": "merge must be one of skip, overwrite or newer",
+		})
+		return opts, false
+	}
+
+	columnFormats, err := services.ParseDateFormats(formValue(c, "date_formats"))
+	if err == nil {
+		opts.ColumnDateFormats = columnFormats
+		err = services.ValidateDateOptions(opts)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid date options",
+			"message": err.Error(),
+		})
+		return opts, false
+	}
+
+	return opts, true
+}
+
+// formValue returns a query parameter, falling back to a form field of the same name
+func formValue(c *gin.Context, key string) string {
+	if value := c.Query(key); value != "" {
+		return value
+	}
+	return c.PostForm(key)
+}
+
+// processUpload handles common upload logic. Imports are recorded as import
+// jobs; dry runs are not.
+func (h *UploadHandler) processUpload(c *gin.Context, entity string, dryRun bool) {
 	file, fileHeader, err := c.Request.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "No file uploaded",
-			"message": "Please select a CSV file to upload",
+			"message": "Please select a CSV or XLSX file to upload",
 		})
 		return
 	}
 	defer file.Close()
 
 	// Validate file
-	if err := h.validateCSVFile(fileHeader); err != nil {
+	if err := h.validateUploadFile(entity, fileHeader); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Invalid file",
 			"message": err.Error(),
@@ -59,8 +199,39 @@ func (h *UploadHandler) processUpload(c *gin.Context, uploadFunc func(multipart.
 		return
 	}
 
-	// Process the file
-	result, err := uploadFunc(file)
+	opts, ok := h.importOptions(c)
+	if !ok {
+		return
+	}
+
+	opts.DryRun = dryRun
+
+	var job *models.ImportJob
+	var result *services.UploadResult
+	if dryRun {
+		result, err = h.csvService.ImportUpload(entity, fileHeader.Filename, file, fileHeader.Size, opts)
+	} else {
+		job = h.createJob(c, entity, file, fileHeader, opts)
+		if job == nil {
+			return
+		}
+
+		if job.Async {
+			h.enqueueJob(c, job, file, opts)
+			return
+		}
+
+		// Process the file
+		result, err = h.jobService.RunImport(job, file, fileHeader.Size, opts)
+	}
+
+	if errors.Is(err, services.ErrColumnMapping) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid CSV header",
+			"message": err.Error(),
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Upload failed",
@@ -69,16 +240,135 @@ func (h *UploadHandler) processUpload(c *gin.Context, uploadFunc func(multipart.
 		return
 	}
 
+	// In atomic mode a single failed row rolls back the whole file
+	if result.RolledBack {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":             "Import rolled back",
+			"message":           "One or more rows failed, so no rows were imported. Fix the errors and upload the file again",
+			"job_id":            job.ID,
+			"filename":          fileHeader.Filename,
+			"total_records":     result.TotalRecords,
+			"processed_records": result.ProcessedRecords,
+			"rolled_back":       true,
+			"errors":            result.Errors,
+			"row_errors":        result.RowErrors,
+		})
+		return
+	}
+
+	// A dry run returns the row-level validation report
+	if result.DryRun {
+		c.JSON(http.StatusOK, gin.H{
+			"message":         "File validated, no data was written",
+			"filename":        fileHeader.Filename,
+			"valid":           len(result.Errors) == 0,
+			"total_records":   result.TotalRecords,
+			"valid_records":   result.InsertedRecords + result.UpdatedRecords + result.StagedRecords,
+			"new_records":     result.InsertedRecords,
+			"updated_records": result.UpdatedRecords,
+			"staged_records":  result.StagedRecords,
+			"linked_records":  result.LinkedRecords,
+			"skipped_records": result.SkippedRecords,
+			"errors":          result.Errors,
+			"row_errors":      result.RowErrors,
+			"warnings":        result.Warnings,
+			"rows":            result.Rows,
+		})
+		return
+	}
+
 	// Return success response with statistics
 	c.JSON(http.StatusOK, gin.H{
 		"message":           "File uploaded and processed successfully",
+		"job_id":            job.ID,
 		"filename":          fileHeader.Filename,
 		"total_records":     result.TotalRecords,
 		"processed_records": result.ProcessedRecords,
 		"skipped_records":   result.SkippedRecords,
 		"inserted_records":  result.InsertedRecords,
 		"updated_records":   result.UpdatedRecords,
+		"staged_records":    result.StagedRecords,
+		"linked_records":    result.LinkedRecords,
 		"errors":            result.Errors,
+		"row_errors":        result.RowErrors,
+		"warnings":          result.Warnings,
+	})
+}
+
+// createJob records the import job for an upload, including who uploaded it
+// and the file's checksum. On failure it responds and returns nil.
+func (h *UploadHandler) createJob(c *gin.Context, entity string, file multipart.File, fileHeader *multipart.FileHeader, opts services.ImportOptions) *models.ImportJob {
+	checksum, err := services.FileChecksum(file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Upload failed",
+			"message": err.Error(),
+		})
+		return nil
+	}
+
+	async, _ := strconv.ParseBool(formValue(c, "async"))
+	force, _ := strconv.ParseBool(formValue(c, "force"))
+	uploadedBy := formValue(c, "uploaded_by")
+	if uploadedBy == "" {
+		uploadedBy = c.GetHeader("X-Uploaded-By")
+	}
+
+	job, err := h.jobService.CreateJob(services.JobUpload{
+		Entity:     entity,
+		Filename:   fileHeader.Filename,
+		Checksum:   checksum,
+		UploadedBy: uploadedBy,
+		Async:      async,
+		Force:      force,
+	}, opts)
+
+	var duplicate *services.DuplicateUploadError
+	if errors.As(err, &duplicate) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":              "Duplicate file",
+			"message":            duplicate.Error() + ". Add force=true to import it again",
+			"previous_import_id": duplicate.Previous.ID,
+			"previous_import":    fmt.Sprintf("/api/v1/imports/%d", duplicate.Previous.ID),
+		})
+		return nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Upload failed",
+			"message": err.Error(),
+		})
+		return nil
+	}
+
+	return job
+}
+
+// enqueueJob hands an upload to the background workers and responds with the
+// queued job, which can be polled at /api/v1/imports/{id}
+func (h *UploadHandler) enqueueJob(c *gin.Context, job *models.ImportJob, file io.Reader, opts services.ImportOptions) {
+	err := h.jobService.Enqueue(job, file, opts)
+	if errors.Is(err, services.ErrImportQueueFull) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Import queue is full",
+			"message": "Too many imports are waiting, please try again later",
+			"job_id":  job.ID,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Upload failed",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "File uploaded and queued for import",
+		"job_id":     job.ID,
+		"status_url": fmt.Sprintf("/api/v1/imports/%d", job.ID),
+		"job":        job,
 	})
 }
 
@@ -88,11 +378,26 @@ func (h *UploadHandler) processUpload(c *gin.Context, uploadFunc func(multipart.
 // @Tags upload
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV file containing patients data"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "CSV or XLSX file containing patients data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /api/v1/upload/patients [post]
 func (h *UploadHandler) UploadPatients(c *gin.Context) {
-	h.processUpload(c, h.csvService.ImportPatients)
+	h.processUpload(c, services.EntityPatients, false)
 }
 
 // UploadAntibiotics godoc
@@ -101,11 +406,26 @@ func (h *UploadHandler) UploadPatients(c *gin.Context) {
 // @Tags upload
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV file containing antibiotics data"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "CSV or XLSX file containing antibiotics data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /api/v1/upload/antibiotics [post]
 func (h *UploadHandler) UploadAntibiotics(c *gin.Context) {
-	h.processUpload(c, h.csvService.ImportAntibiotics)
+	h.processUpload(c, services.EntityAntibiotics, false)
 }
 
 // UploadIndications godoc
@@ -114,11 +434,26 @@ func (h *UploadHandler) UploadAntibiotics(c *gin.Context) {
 // @Tags upload
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV file containing indications data"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "CSV or XLSX file containing indications data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /api/v1/upload/indications [post]
 func (h *UploadHandler) UploadIndications(c *gin.Context) {
-	h.processUpload(c, h.csvService.ImportIndications)
+	h.processUpload(c, services.EntityIndications, false)
 }
 
 // UploadOptionalVars godoc
@@ -127,11 +462,46 @@ func (h *UploadHandler) UploadIndications(c *gin.Context) {
 // @Tags upload
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV file containing optional variables data"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "CSV or XLSX file containing optional variables data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /api/v1/upload/optional-vars [post]
 func (h *UploadHandler) UploadOptionalVars(c *gin.Context) {
-	h.processUpload(c, h.csvService.ImportOptionalVars)
+	h.processUpload(c, services.EntityOptionalVars, false)
+}
+
+// UploadWhonet godoc
+// @Summary Upload a WHONET result file
+// @Description Add lab-confirmed organisms, antibiotic results and resistance phenotypes from a WHONET flat file (CSV or tab-delimited text) to existing specimens, matched by SPEC_NUM. Results for an organism replace the specimen's earlier results for it
+// @Tags upload
+// @Accept multipart/form-data
+// @Produce json
+// @Param atomic query bool false "Roll back the whole file if any row fails"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "WHONET file (CSV or TXT)"
+// @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/v1/upload/whonet [post]
+func (h *UploadHandler) UploadWhonet(c *gin.Context) {
+	h.processUpload(c, services.JobEntityWhonet, false)
 }
 
 // UploadSpecimens godoc
@@ -140,11 +510,26 @@ func (h *UploadHandler) UploadOptionalVars(c *gin.Context) {
 // @Tags upload
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV file containing specimens data"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "CSV or XLSX file containing specimens data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /api/v1/upload/specimens [post]
 func (h *UploadHandler) UploadSpecimens(c *gin.Context) {
-	h.processUpload(c, h.csvService.ImportSpecimens)
+	h.processUpload(c, services.EntitySpecimens, false)
 }
 
 // UploadAntibioticDetails handles CSV file upload for antibiotic details
@@ -153,9 +538,341 @@ func (h *UploadHandler) UploadSpecimens(c *gin.Context) {
 // @Tags upload
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV file containing antibiotic details data"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "CSV or XLSX file containing antibiotic details data"
 // @Success 200 {object} map[string]interface{}
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /api/v1/upload/antibiotic-details [post]
 func (h *UploadHandler) UploadAntibioticDetails(c *gin.Context) {
-	h.processUpload(c, h.csvService.ImportAntibioticDetails)
+	h.processUpload(c, services.EntityAntibioticDetails, false)
+}
+
+// UploadBundle godoc
+// @Summary Upload an ODK Central ZIP export or Excel workbook
+// @Description Import a ZIP holding the main form CSV and the repeat-group CSVs, or an XLSX workbook with one sheet per table. Files and sheets are recognised by name or header and imported parents first
+// @Tags upload
+// @Accept multipart/form-data
+// @Produce json
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole bundle in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param async query bool false "Queue the import for a background worker and return 202 with the import job"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Param file formData file true "ZIP file of an ODK Central CSV export, or XLSX workbook with one sheet per table"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Success 202 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/v1/upload/bundle [post]
+func (h *UploadHandler) UploadBundle(c *gin.Context) {
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "No file uploaded",
+			"message": "Please select a ZIP or XLSX file to upload",
+		})
+		return
+	}
+	defer file.Close()
+
+	if err := h.validateFile(fileHeader, ".zip", ".xlsx"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid file",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	opts, ok := h.importOptions(c)
+	if !ok {
+		return
+	}
+
+	job := h.createJob(c, services.JobEntityBundle, file, fileHeader, opts)
+	if job == nil {
+		return
+	}
+
+	if job.Async {
+		h.enqueueJob(c, job, file, opts)
+		return
+	}
+
+	result, err := h.jobService.RunBundle(job, file, fileHeader.Size, opts)
+	if errors.Is(err, services.ErrInvalidBundle) || errors.Is(err, services.ErrColumnMapping) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid bundle",
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Upload failed",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if result.RolledBack {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":    "Import rolled back",
+			"message":  "One or more rows failed, so no rows were imported. Fix the errors and upload the bundle again",
+			"job_id":   job.ID,
+			"filename": fileHeader.Filename,
+			"bundle":   result,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Bundle uploaded and processed successfully",
+		"job_id":   job.ID,
+		"filename": fileHeader.Filename,
+		"bundle":   result,
+	})
+}
+
+// UploadJSON godoc
+// @Summary Submit patients as JSON
+// @Description Import a JSON array of patients, or a single patient object, each with its nested antibiotics, indications, specimens and optional vars. Every record is validated on its own and valid records are written in batches, one transaction per batch. The response reports the outcome of every record
+// @Tags upload
+// @Accept json
+// @Produce json
+// @Param batch_size query int false "Patients written per database transaction"
+// @Param atomic query bool false "Import the whole submission in one transaction, rolling back on any record error"
+// @Param merge query string false "What to do with patients whose key already exists: skip (default), overwrite, or newer. Overwritten patients have their child records replaced"
+// @Param dry_run query bool false "Validate the records without writing anything"
+// @Param uploaded_by query string false "Name of the person or service submitting the records (or X-Uploaded-By header)"
+// @Param patients body []models.Patient true "Patients with nested child records"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/v1/upload/json [post]
+func (h *UploadHandler) UploadJSON(c *gin.Context) {
+	format := services.SubmissionJSON
+	if c.ContentType() == "application/x-ndjson" {
+		format = services.SubmissionNDJSON
+	}
+	h.processJSON(c, format)
+}
+
+// UploadNDJSON godoc
+// @Summary Submit patients as NDJSON
+// @Description Import a stream of patients with one JSON object per line, each with its nested antibiotics, indications, specimens and optional vars. A line that cannot be read only fails its own record
+// @Tags upload
+// @Accept application/x-ndjson
+// @Produce json
+// @Param batch_size query int false "Patients written per database transaction"
+// @Param atomic query bool false "Import the whole submission in one transaction, rolling back on any record error"
+// @Param merge query string false "What to do with patients whose key already exists: skip (default), overwrite, or newer. Overwritten patients have their child records replaced"
+// @Param dry_run query bool false "Validate the records without writing anything"
+// @Param uploaded_by query string false "Name of the person or service submitting the records (or X-Uploaded-By header)"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/v1/upload/ndjson [post]
+func (h *UploadHandler) UploadNDJSON(c *gin.Context) {
+	h.processJSON(c, services.SubmissionNDJSON)
+}
+
+// UploadFHIR godoc
+// @Summary Import FHIR R4 bundles
+// @Description Import survey patients from a FHIR R4 Bundle, or from one bundle per line as written by GET /api/v1/export/fhir. Patient, Encounter, MedicationRequest, Condition, Specimen and culture Observation resources are read into patients with their antibiotics, indications and specimens; other resource types are ignored. Each patient is validated and written like a JSON submission
+// @Tags upload
+// @Accept json
+// @Produce json
+// @Param batch_size query int false "Patients written per database transaction"
+// @Param atomic query bool false "Import all bundles in one transaction, rolling back on any patient error"
+// @Param merge query string false "What to do with patients whose key already exists: skip (default), overwrite, or newer. Overwritten patients have their child records replaced"
+// @Param dry_run query bool false "Validate the patients without writing anything"
+// @Param uploaded_by query string false "Name of the person or system sending the bundles (or X-Uploaded-By header)"
+// @Param bundle body services.FHIRBundle true "FHIR bundle"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/v1/upload/fhir [post]
+func (h *UploadHandler) UploadFHIR(c *gin.Context) {
+	h.processJSON(c, services.SubmissionFHIR)
+}
+
+// processJSON imports a JSON, NDJSON or FHIR submission of patients.
+// Submissions are recorded as import jobs; dry runs are not.
+func (h *UploadHandler) processJSON(c *gin.Context, format string) {
+	opts, ok := h.importOptions(c)
+	if !ok {
+		return
+	}
+	opts.DryRun, _ = strconv.ParseBool(c.Query("dry_run"))
+
+	body := c.Request.Body
+	if h.maxUploadSize > 0 {
+		body = http.MaxBytesReader(c.Writer, body, h.maxUploadSize)
+	}
+
+	entity, filename := services.JobEntityJSON, "submission.json"
+	switch format {
+	case services.SubmissionNDJSON:
+		filename = "submission.ndjson"
+	case services.SubmissionFHIR:
+		entity, filename = services.JobEntityFHIR, "bundle.json"
+	}
+
+	var job *models.ImportJob
+	var result *services.IngestResult
+	var err error
+	if opts.DryRun {
+		result, err = h.csvService.IngestPatients(body, format, opts)
+	} else {
+		uploadedBy := c.Query("uploaded_by")
+		if uploadedBy == "" {
+			uploadedBy = c.GetHeader("X-Uploaded-By")
+		}
+
+		// Submissions are not checked for duplicate content: resending
+		// records is handled by the merge strategy
+		job, err = h.jobService.CreateJob(services.JobUpload{
+			Entity:     entity,
+			Filename:   filename,
+			UploadedBy: uploadedBy,
+		}, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Upload failed",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		result, err = h.jobService.RunIngest(job, body, format, opts)
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "Submission too large",
+			"message": fmt.Sprintf("Maximum size allowed is %dMB", h.maxUploadSize/(1024*1024)),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidJSON) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid submission",
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Upload failed",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	response := gin.H{
+		"total_records":    result.TotalRecords,
+		"inserted_records": result.InsertedRecords,
+		"updated_records":  result.UpdatedRecords,
+		"linked_records":   result.LinkedRecords,
+		"skipped_records":  result.SkippedRecords,
+		"errors":           result.Errors,
+		"warnings":         result.Warnings,
+		"records":          result.Records,
+	}
+	if job != nil {
+		response["job_id"] = job.ID
+	}
+
+	switch {
+	case result.RolledBack:
+		// In atomic mode a single failed record rolls back the whole submission
+		response["error"] = "Import rolled back"
+		response["message"] = "One or more records failed, so no records were imported. Fix the errors and submit them again"
+		response["rolled_back"] = true
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	case result.DryRun:
+		response["message"] = "Records validated, no data was written"
+		response["valid"] = len(result.Errors) == 0
+	default:
+		response["message"] = "Records submitted and processed successfully"
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetMappingProfiles godoc
+// @Summary List CSV column mapping profiles
+// @Description List the versioned column mapping profiles used to read upload headers
+// @Tags upload
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/upload/mappings [get]
+func (h *UploadHandler) GetMappingProfiles(c *gin.Context) {
+	registry := h.csvService.Mappings()
+
+	profiles := make([]*services.MappingProfile, 0)
+	for _, version := range registry.Versions() {
+		profile, _ := registry.Profile(version)
+		profiles = append(profiles, profile)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"default_version": registry.DefaultVersion,
+		"profiles":        profiles,
+	})
+}
+
+// ValidateUpload godoc
+// @Summary Validate a survey CSV file without importing it
+// @Description Run the same parsing and checks as an upload (column count, missing key, parent patient existence, date and number parsing) without writing anything, and return a row-level report
+// @Tags upload
+// @Accept multipart/form-data
+// @Produce json
+// @Param entity path string true "Entity (patients, antibiotics, antibiotic-details, indications, optional-vars, specimens, whonet)"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param file formData file true "CSV or XLSX file to validate"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/upload/{entity}/validate [post]
+func (h *UploadHandler) ValidateUpload(c *gin.Context) {
+	entity, ok := uploadEntities[c.Param("entity")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown upload entity: " + c.Param("entity")})
+		return
+	}
+
+	h.processUpload(c, entity, true)
 }
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"point-prevalence-survey/models"
+	"point-prevalence-survey/services"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tusVersion is the version of the tus resumable upload protocol the upload
+// session endpoints follow
+const tusVersion = "1.0.0"
+
+// uploadMetadata parses a tus Upload-Metadata header: comma separated pairs
+// of a key and its base64 encoded value
+func uploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
+
+// setSessionHeaders sets the tus headers describing the progress of session
+func setSessionHeaders(c *gin.Context, session *models.UploadSession) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Length, 10))
+}
+
+// CreateUploadSession godoc
+// @Summary Start a resumable upload
+// @Description Start a chunked upload of a CSV, XLSX, WHONET or bundle file over a poor connection. Send the file with PATCH requests to the returned Location, each starting at the Upload-Offset the session has reached; after a dropped connection ask for the offset with HEAD and continue from there. Once every byte has arrived the file is queued as an async import job. Follows the tus 1.0 protocol, so entity and filename can also be sent in the Upload-Metadata header
+// @Tags upload
+// @Produce json
+// @Param entity query string true "What the file holds: patients, antibiotics, antibiotic-details, indications, optional-vars, specimens, whonet or bundle"
+// @Param filename query string true "Name of the file"
+// @Param Upload-Length header int true "Size of the whole file in bytes"
+// @Param mapping_version query string false "Column mapping profile version"
+// @Param form_version query string false "ODK form version whose mapping profile reads the whole file, for repeat group files, which carry no form version"
+// @Param batch_size query int false "Rows written per database transaction"
+// @Param atomic query bool false "Import the whole file in one transaction, rolling back on any row error"
+// @Param merge query string false "What to do with rows whose key already exists: skip (default), overwrite, or newer"
+// @Param date_format query string false "Format of date columns, e.g. DD/MM/YYYY; auto (default) detects it and warns about ambiguous dates"
+// @Param date_formats query string false "Per-column date formats, e.g. survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+// @Param timezone query string false "IANA timezone of dates written without one (default DATE_TIMEZONE)"
+// @Param allow_invalid query bool false "Import rows with dates or numbers that cannot be parsed, leaving those fields empty, instead of rejecting them"
+// @Param uploaded_by query string false "Name of the person uploading the file (or X-Uploaded-By header)"
+// @Param force query bool false "Import the file even if the same content was imported before"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Router /api/v1/upload/sessions [post]
+func (h *UploadHandler) CreateUploadSession(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	metadata := uploadMetadata(c.GetHeader("Upload-Metadata"))
+
+	name := c.Query("entity")
+	if name == "" {
+		name = metadata["entity"]
+	}
+	filename := c.Query("filename")
+	if filename == "" {
+		filename = metadata["filename"]
+	}
+
+	entity, ok := uploadEntities[name]
+	if name == services.JobEntityBundle {
+		entity, ok = services.JobEntityBundle, true
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid entity",
+			"message": "entity must be one of patients, antibiotics, antibiotic-details, indications, optional-vars, specimens, whonet or bundle",
+		})
+		return
+	}
+
+	var err error
+	switch entity {
+	case services.JobEntityBundle:
+		err = checkExtension(filename, ".zip", ".xlsx")
+	case services.JobEntityWhonet:
+		err = checkExtension(filename, ".csv", ".txt")
+	default:
+		err = checkExtension(filename, ".csv", ".xlsx")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid file",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid Upload-Length",
+			"message": "Upload-Length must be the size of the file in bytes",
+		})
+		return
+	}
+	if h.maxUploadSize > 0 && length > h.maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "File too large",
+			"message": fmt.Sprintf("Maximum size allowed is %dMB", h.maxUploadSize/(1024*1024)),
+		})
+		return
+	}
+
+	opts, ok := h.importOptions(c)
+	if !ok {
+		return
+	}
+
+	force, _ := strconv.ParseBool(c.Query("force"))
+	uploadedBy := c.Query("uploaded_by")
+	if uploadedBy == "" {
+		uploadedBy = c.GetHeader("X-Uploaded-By")
+	}
+
+	session, err := h.sessionService.Create(services.JobUpload{
+		Entity:     entity,
+		Filename:   filename,
+		UploadedBy: uploadedBy,
+		Force:      force,
+	}, length, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to start upload",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	location := "/api/v1/upload/sessions/" + session.ID
+	setSessionHeaders(c, session)
+	c.Header("Location", location)
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Upload started. Send the file with PATCH requests to upload_url",
+		"upload_url": location,
+		"session":    session,
+	})
+}
+
+// HeadUploadSession godoc
+// @Summary Get the offset of a resumable upload
+// @Description Returns the bytes received so far in the Upload-Offset header, which is where the next chunk must start
+// @Tags upload
+// @Param id path string true "Upload session ID"
+// @Success 200
+// @Failure 404
+// @Router /api/v1/upload/sessions/{id} [head]
+func (h *UploadHandler) HeadUploadSession(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	session, err := h.sessionService.Get(c.Param("id"))
+	if errors.Is(err, services.ErrUploadSessionNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	setSessionHeaders(c, session)
+	c.Status(http.StatusOK)
+}
+
+// GetUploadSession godoc
+// @Summary Get a resumable upload
+// @Description Get the progress of a resumable upload and, once complete, the import job it was queued as
+// @Tags upload
+// @Produce json
+// @Param id path string true "Upload session ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]string
+// @Router /api/v1/upload/sessions/{id} [get]
+func (h *UploadHandler) GetUploadSession(c *gin.Context) {
+	session, err := h.sessionService.Get(c.Param("id"))
+	if errors.Is(err, services.ErrUploadSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch upload session",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	response := gin.H{"session": session}
+	if session.ImportID != nil {
+		response["status_url"] = fmt.Sprintf("/api/v1/imports/%d", *session.ImportID)
+	}
+	setSessionHeaders(c, session)
+	c.JSON(http.StatusOK, response)
+}
+
+// PatchUploadSession godoc
+// @Summary Send a chunk of a resumable upload
+// @Description Append the request body to the upload. Upload-Offset must equal the bytes received so far. Partial chunks are answered with 204 and the new Upload-Offset; the chunk completing the file is answered with 200 and the queued import job. If the import queue is full the answer is 503 and the file is kept; an empty chunk at the final offset queues it again. Chunks may be gzip-compressed with Content-Encoding: gzip, offsets then count uncompressed bytes
+// @Tags upload
+// @Accept application/offset+octet-stream
+// @Produce json
+// @Param id path string true "Upload session ID"
+// @Param Upload-Offset header int true "Offset of the chunk in the file"
+// @Success 200 {object} map[string]interface{}
+// @Success 204
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]interface{}
+// @Failure 415 {object} map[string]string
+// @Failure 503 {object} map[string]interface{}
+// @Router /api/v1/upload/sessions/{id} [patch]
+func (h *UploadHandler) PatchUploadSession(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "Chunks must be sent as application/offset+octet-stream",
+		})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid Upload-Offset",
+			"message": "Upload-Offset must be the bytes received so far, see HEAD /api/v1/upload/sessions/{id}",
+		})
+		return
+	}
+
+	session, err := h.sessionService.Append(c.Param("id"), offset, c.Request.Body)
+	if session != nil {
+		setSessionHeaders(c, session)
+	}
+
+	var duplicate *services.DuplicateUploadError
+	switch {
+	case err == nil && session.Status == models.UploadSessionCompleted:
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "File uploaded and queued for import",
+			"job_id":     *session.ImportID,
+			"status_url": fmt.Sprintf("/api/v1/imports/%d", *session.ImportID),
+			"session":    session,
+		})
+	case err == nil:
+		c.Status(http.StatusNoContent)
+	case errors.Is(err, services.ErrUploadSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+	case errors.Is(err, services.ErrUploadOffset), errors.Is(err, services.ErrUploadFinished):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Chunk rejected",
+			"message": err.Error(),
+			"session": session,
+		})
+	case errors.Is(err, services.ErrUploadLength):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Chunk rejected",
+			"message": err.Error(),
+		})
+	case errors.As(err, &duplicate):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":              "Duplicate file",
+			"message":            duplicate.Error() + ". Start a new upload with force=true to import it again",
+			"previous_import_id": duplicate.Previous.ID,
+			"previous_import":    fmt.Sprintf("/api/v1/imports/%d", duplicate.Previous.ID),
+		})
+	case errors.Is(err, services.ErrImportQueueFull):
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Import queue is full",
+			"message": "The file was uploaded but too many imports are waiting. It is kept until the session expires; send an empty PATCH at the final Upload-Offset later to queue it",
+			"job_id":  *session.ImportID,
+			"session": session,
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Upload failed",
+			"message": err.Error(),
+		})
+	}
+}
+
+// DeleteUploadSession godoc
+// @Summary Cancel a resumable upload
+// @Description Cancel an unfinished upload and discard the bytes received so far
+// @Tags upload
+// @Param id path string true "Upload session ID"
+// @Success 204
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /api/v1/upload/sessions/{id} [delete]
+func (h *UploadHandler) DeleteUploadSession(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	err := h.sessionService.Cancel(c.Param("id"))
+	if errors.Is(err, services.ErrUploadSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+		return
+	}
+	if errors.Is(err, services.ErrUploadFinished) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is already finished"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to cancel upload",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
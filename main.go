@@ -32,8 +32,9 @@ func main() {
 	// Add CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Content-Encoding, Accept-Encoding, X-CSRF-Token, Authorization, X-Uploaded-By, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		c.Header("Access-Control-Expose-Headers", "Location, Tus-Resumable, Upload-Offset, Upload-Length")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
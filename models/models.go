@@ -62,6 +62,13 @@ type Patient struct {
 	DeviceID                   string    `json:"device_id" gorm:"column:device_id"`
 	Edits                      string    `json:"edits"`
 	FormVersion                string    `json:"form_version" gorm:"column:form_version"`
+	ImportID                   *uint     `json:"import_id,omitempty" gorm:"column:import_id;index"`
+	// Excluded patients, such as duplicates of another submission, are left
+	// out of the PPS indicators. Imports do not change these fields.
+	Excluded        bool   `json:"excluded" gorm:"column:excluded;not null;default:false;index"`
+	ExclusionReason string `json:"exclusion_reason,omitempty" gorm:"column:exclusion_reason"`
+	// DuplicateOf is the patient this record was merged into
+	DuplicateOf string `json:"duplicate_of,omitempty" gorm:"column:duplicate_of"`
 
 	// Relationships
 	Antibiotics  []Antibiotic  `json:"antibiotics" gorm:"foreignKey:ParentKey;references:ID"`
@@ -86,7 +93,34 @@ type Antibiotic struct {
 	UnitDoseMeasureUnit           string    `json:"unit_dose_measure_unit" gorm:"column:unit_dose_measure_unit"`
 	UnitDoseFrequency             string    `json:"unit_dose_frequency" gorm:"column:unit_dose_frequency"`
 	AdministrationRoute           string    `json:"administration_route" gorm:"column:administration_route"`
-	ParentKey                     string    `json:"parent_key" gorm:"column:parent_key"`
+	// ReferenceID is the catalogue entry the antibiotic was matched to
+	ReferenceID *uint `json:"reference_id,omitempty" gorm:"column:reference_id;index"`
+	// DDD is the WHO defined daily dose for the route, from the catalogue
+	DDD       float64 `json:"ddd,omitempty" gorm:"column:ddd"`
+	DDDUnit   string  `json:"ddd_unit,omitempty" gorm:"column:ddd_unit"`
+	ParentKey string  `json:"parent_key" gorm:"column:parent_key"`
+	ImportID  *uint   `json:"import_id,omitempty" gorm:"column:import_id;index"`
+}
+
+// AntibioticReference is an entry of the antibiotic reference catalogue.
+// Imported antibiotics are matched to it by INN name or synonym and take
+// their ATC code, class, AWaRe category and DDD from it.
+type AntibioticReference struct {
+	ID      uint   `json:"id" gorm:"primaryKey"`
+	INNName string `json:"inn_name" gorm:"column:inn_name;uniqueIndex"`
+	// Synonyms are other names of the antibiotic, such as brand names or
+	// abbreviations, separated by semicolons
+	Synonyms        string `json:"synonyms"`
+	ATCCode         string `json:"atc_code" gorm:"column:atc_code;index"`
+	AntibioticClass string `json:"antibiotic_class" gorm:"column:antibiotic_class"`
+	AWaReCategory   string `json:"aware_category" gorm:"column:aware_category"`
+	// OralDDD and ParenteralDDD are the WHO defined daily doses in DDDUnit;
+	// zero when there is none for the route
+	OralDDD       float64   `json:"oral_ddd" gorm:"column:oral_ddd"`
+	ParenteralDDD float64   `json:"parenteral_ddd" gorm:"column:parenteral_ddd"`
+	DDDUnit       string    `json:"ddd_unit" gorm:"column:ddd_unit"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 // AntibioticDetails represents additional antibiotic details
@@ -100,6 +134,7 @@ type AntibioticDetails struct {
 	Guideline    string `json:"guideline" gorm:"column:guideline"`
 	Treatment    string `json:"treatment" gorm:"column:treatment"`
 	ParentKey    string `json:"parent_key" gorm:"column:parent_key"`
+	ImportID     *uint  `json:"import_id,omitempty" gorm:"column:import_id;index"`
 }
 
 // Indication represents indication data
@@ -113,6 +148,7 @@ type Indication struct {
 	ReasonInNotes      string    `json:"reason_in_notes" gorm:"column:reason_in_notes"`
 	CultureSampleTaken string    `json:"culture_sample_taken" gorm:"column:culture_sample_taken"`
 	ParentKey          string    `json:"parent_key" gorm:"column:parent_key"`
+	ImportID           *uint     `json:"import_id,omitempty" gorm:"column:import_id;index"`
 }
 
 // OptionalVar represents optional variables data
@@ -126,6 +162,7 @@ type OptionalVar struct {
 	GuidelinesCompliance string `json:"guidelines_compliance" gorm:"column:guidelines_compliance"`
 	TreatmentType        string `json:"treatment_type" gorm:"column:treatment_type"`
 	ParentKey            string `json:"parent_key" gorm:"column:parent_key;constraint:-"`
+	ImportID             *uint  `json:"import_id,omitempty" gorm:"column:import_id;index"`
 }
 
 // Specimen represents specimen data
@@ -137,6 +174,204 @@ type Specimen struct {
 	AntibioticSusceptibilityTestResults string `json:"antibiotic_susceptibility_test_results" gorm:"column:antibiotic_susceptibility_test_results"`
 	ResistantPhenotype                  string `json:"resistant_phenotype" gorm:"column:resistant_phenotype"`
 	ParentKey                           string `json:"parent_key" gorm:"column:parent_key"`
+	ImportID                            *uint  `json:"import_id,omitempty" gorm:"column:import_id;index"`
+
+	// Associations
+	SusceptibilityResults []SusceptibilityResult `json:"susceptibility_results,omitempty" gorm:"foreignKey:SpecimenKey;references:ID"`
+}
+
+// SusceptibilityResult is one organism and antibiotic result parsed from the
+// susceptibility test results of a specimen
+type SusceptibilityResult struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	SpecimenKey string `json:"specimen_key" gorm:"column:specimen_key;index"`
+	PatientKey  string `json:"patient_key" gorm:"column:patient_key;index"`
+	Organism    string `json:"organism" gorm:"index"`
+	Antibiotic  string `json:"antibiotic" gorm:"index"`
+	// Interpretation is S, I or R; empty when only a MIC or zone was given
+	Interpretation string `json:"interpretation" gorm:"index"`
+	// MICComparator is the sign written before the MIC, e.g. "<=" or ">"
+	MICComparator string   `json:"mic_comparator,omitempty" gorm:"column:mic_comparator"`
+	MIC           *float64 `json:"mic,omitempty" gorm:"column:mic"`
+	ZoneDiameter  *float64 `json:"zone_diameter,omitempty" gorm:"column:zone_diameter"`
+	// Raw is the text the result was read from
+	Raw string `json:"raw"`
+}
+
+// Antibiotic name mapping statuses
+const (
+	NameMappingPending  = "pending"
+	NameMappingAccepted = "accepted"
+	NameMappingRejected = "rejected"
+)
+
+// AntibioticNameMapping is a free-text antibiotic name that did not match the
+// reference catalogue exactly. Pending mappings wait in the review queue with
+// the closest catalogue entry as a suggestion; accepted ones match the name to
+// ReferenceID in later imports, and rejected ones stop it being matched.
+type AntibioticNameMapping struct {
+	ID   uint   `json:"id" gorm:"primaryKey"`
+	Name string `json:"name"`
+	// NameKey is the name ignoring case, punctuation and dose or form words
+	NameKey string `json:"name_key" gorm:"column:name_key;uniqueIndex"`
+	Status  string `json:"status" gorm:"index"`
+	// SuggestedReferenceID is the closest catalogue entry and Score how close
+	// it is, from 0 to 1; there is no suggestion when nothing was close
+	SuggestedReferenceID *uint   `json:"suggested_reference_id,omitempty" gorm:"column:suggested_reference_id"`
+	Score                float64 `json:"score"`
+	// ReferenceID is the catalogue entry the name was mapped to on review
+	ReferenceID *uint `json:"reference_id,omitempty" gorm:"column:reference_id;index"`
+	// Occurrences counts the imported antibiotics the name was seen on
+	Occurrences int        `json:"occurrences"`
+	ReviewedBy  string     `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// DuplicateDismissal records a pair of patients reviewed as different
+// patients, so the duplicate detector no longer lists it. PatientKey is the
+// smaller of the two keys.
+type DuplicateDismissal struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	PatientKey string    `json:"patient_key" gorm:"column:patient_key;uniqueIndex:idx_duplicate_dismissal_pair"`
+	OtherKey   string    `json:"other_key" gorm:"column:other_key;uniqueIndex:idx_duplicate_dismissal_pair"`
+	ReviewedBy string    `json:"reviewed_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Import job statuses
+const (
+	ImportJobQueued     = "queued"
+	ImportJobRunning    = "running"
+	ImportJobCompleted  = "completed"
+	ImportJobFailed     = "failed"
+	ImportJobRolledBack = "rolled_back"
+	ImportJobDeleted    = "deleted"
+)
+
+// ImportJob records an uploaded file and the progress of its import
+type ImportJob struct {
+	ID               uint     `json:"id" gorm:"primaryKey"`
+	Entity           string   `json:"entity" gorm:"index"`
+	Filename         string   `json:"filename"`
+	Checksum         string   `json:"checksum" gorm:"index"`
+	UploadedBy       string   `json:"uploaded_by"`
+	Status           string   `json:"status" gorm:"index"`
+	Async            bool     `json:"async"`
+	MappingVersion   string   `json:"mapping_version"`
+	MergeStrategy    string   `json:"merge_strategy"`
+	Atomic           bool     `json:"atomic"`
+	TotalRecords     int      `json:"total_records"`
+	ProcessedRecords int      `json:"processed_records"`
+	InsertedRecords  int      `json:"inserted_records"`
+	UpdatedRecords   int      `json:"updated_records"`
+	SkippedRecords   int      `json:"skipped_records"`
+	StagedRecords    int      `json:"staged_records"`
+	LinkedRecords    int      `json:"linked_records"`
+	Message          string   `json:"message,omitempty"`
+	Errors           []string `json:"errors,omitempty" gorm:"serializer:json;type:text"`
+	Warnings         []string `json:"warnings,omitempty" gorm:"serializer:json;type:text"`
+	// Headers holds the header row of each imported file, to write error reports
+	Headers        map[string][]string `json:"-" gorm:"serializer:json;type:text"`
+	CreatedAt      time.Time           `json:"created_at"`
+	StartedAt      *time.Time          `json:"started_at,omitempty"`
+	FinishedAt     *time.Time          `json:"finished_at,omitempty"`
+	DeletedRecords int                 `json:"deleted_records,omitempty"`
+	DeletedAt      *time.Time          `json:"deleted_at,omitempty"`
+}
+
+// Upload session statuses
+const (
+	UploadSessionUploading = "uploading"
+	UploadSessionCompleted = "completed"
+	UploadSessionFailed    = "failed"
+)
+
+// UploadSession is a resumable upload. The file is sent in chunks, each
+// written at the offset the previous one ended, and imported once complete.
+type UploadSession struct {
+	ID         string `json:"id" gorm:"primaryKey;size:32"`
+	Entity     string `json:"entity"`
+	Filename   string `json:"filename"`
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	// Length is the size of the whole file and Offset the bytes received so far
+	Length int64  `json:"length" gorm:"column:upload_length"`
+	Offset int64  `json:"offset" gorm:"column:upload_offset"`
+	Status string `json:"status" gorm:"index"`
+	// Force imports the file even if the same content was imported before
+	Force bool `json:"force"`
+	// Options holds the import options as JSON
+	Options   string    `json:"-" gorm:"type:text"`
+	ImportID  *uint     `json:"import_id,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// QualityFlag is a data quality rule broken by a stored record. Flags are
+// replaced whenever the record is written again.
+type QualityFlag struct {
+	ID         uint   `json:"id" gorm:"primaryKey"`
+	Entity     string `json:"entity" gorm:"index:idx_quality_flag_record"`
+	RecordKey  string `json:"record_key" gorm:"index:idx_quality_flag_record"`
+	PatientKey string `json:"patient_key" gorm:"index"`
+	Rule       string `json:"rule" gorm:"index"`
+	// Severity is that of the rule when the flag was raised
+	Severity  string    `json:"severity"`
+	Field     string    `json:"field"`
+	Message   string    `json:"message"`
+	ImportID  *uint     `json:"import_id,omitempty" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ImportRowError is an error on a row rejected by an import. The raw values
+// of the row are kept so rejected rows can be downloaded, fixed and uploaded again.
+type ImportRowError struct {
+	ID       uint     `json:"id" gorm:"primaryKey"`
+	ImportID uint     `json:"import_id" gorm:"index"`
+	File     string   `json:"file"`
+	Row      int      `json:"row" gorm:"column:row_num"`
+	Key      string   `json:"key,omitempty"`
+	Column   string   `json:"column,omitempty"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+	Record   []string `json:"record" gorm:"serializer:json;type:text"`
+}
+
+// OrphanRow is a child row whose parent patient had not been imported yet.
+// It is kept until the patient arrives and is then inserted into its table.
+type OrphanRow struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	Entity    string `json:"entity" gorm:"index"`
+	Key       string `json:"key" gorm:"index"`
+	ParentKey string `json:"parent_key" gorm:"index"`
+	// ImportID is the import the row came from; the linked row keeps it
+	ImportID uint `json:"import_id" gorm:"index"`
+	Row      int  `json:"row" gorm:"column:row_num"`
+	// Data is the parsed record as JSON, inserted as-is once the parent exists
+	Data         string     `json:"-" gorm:"type:text"`
+	Record       []string   `json:"record" gorm:"serializer:json;type:text"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty" gorm:"index"`
+	ResolvedByID *uint      `json:"resolved_by_import_id,omitempty"`
+}
+
+// SyncState remembers how far a form has been pulled from an external
+// server, so the next sync only fetches newer submissions
+type SyncState struct {
+	ID     uint   `json:"id" gorm:"primaryKey"`
+	Source string `json:"source" gorm:"uniqueIndex"`
+	// Watermark is the latest submission or edit time seen by a successful sync
+	Watermark    *time.Time `json:"watermark,omitempty"`
+	LastRunAt    *time.Time `json:"last_run_at,omitempty"`
+	LastStatus   string     `json:"last_status,omitempty"`
+	LastMessage  string     `json:"last_message,omitempty"`
+	LastImportID *uint      `json:"last_import_id,omitempty"`
+	Submissions  int        `json:"submissions"`
+	UpdatedAt    time.Time  `json:"updated_at"`
 }
 
 // TableName methods to specify table names
@@ -163,3 +398,43 @@ func (AntibioticDetails) TableName() string {
 func (Specimen) TableName() string {
 	return "specimens"
 }
+
+func (ImportJob) TableName() string {
+	return "import_jobs"
+}
+
+func (QualityFlag) TableName() string {
+	return "quality_flags"
+}
+
+func (UploadSession) TableName() string {
+	return "upload_sessions"
+}
+
+func (ImportRowError) TableName() string {
+	return "import_row_errors"
+}
+
+func (SusceptibilityResult) TableName() string {
+	return "susceptibility_results"
+}
+
+func (OrphanRow) TableName() string {
+	return "orphan_rows"
+}
+
+func (SyncState) TableName() string {
+	return "sync_states"
+}
+
+func (AntibioticReference) TableName() string {
+	return "antibiotic_references"
+}
+
+func (AntibioticNameMapping) TableName() string {
+	return "antibiotic_name_mappings"
+}
+
+func (DuplicateDismissal) TableName() string {
+	return "duplicate_dismissals"
+}
@@ -17,6 +17,15 @@ func SetupRoutes(r *gin.Engine) {
 	specimenHandler := handlers.NewSpecimenHandler()
 	optionalVarsHandler := handlers.NewOptionalVarsHandler()
 	ppsCalculationsHandler := handlers.NewPPSCalculationsHandler()
+	importHandler := handlers.NewImportHandler()
+	syncHandler := handlers.NewSyncHandler()
+	orphanHandler := handlers.NewOrphanHandler()
+	qualityHandler := handlers.NewQualityHandler()
+	susceptibilityHandler := handlers.NewSusceptibilityHandler()
+	exportHandler := handlers.NewExportHandler()
+	antibioticReferenceHandler := handlers.NewAntibioticReferenceHandler()
+	antibioticMappingHandler := handlers.NewAntibioticMappingHandler()
+	duplicateHandler := handlers.NewDuplicateHandler()
 
 	// API v1 routes
 	v1 := r.Group("/api/v1")
@@ -26,11 +35,17 @@ func SetupRoutes(r *gin.Engine) {
 		{
 			patients.GET("", patientHandler.GetPatients)
 			patients.GET("/stats", patientHandler.GetPatientStats)
+			patients.GET("/duplicates", duplicateHandler.GetDuplicates)
+			patients.POST("/duplicates/merge", duplicateHandler.MergeDuplicate)
+			patients.POST("/duplicates/dismiss", duplicateHandler.DismissDuplicate)
 			patients.GET("/:id", patientHandler.GetPatient)
 			patients.GET("/:id/antibiotics", patientHandler.GetPatientAntibiotics)
 			patients.GET("/:id/indications", patientHandler.GetPatientIndications)
 			patients.GET("/:id/optional-vars", patientHandler.GetPatientOptionalVars)
 			patients.GET("/:id/specimens", patientHandler.GetPatientSpecimens)
+			patients.GET("/:id/quality-flags", patientHandler.GetPatientQualityFlags)
+			patients.POST("/:id/exclude", patientHandler.ExcludePatient)
+			patients.POST("/:id/include", patientHandler.IncludePatient)
 		}
 
 		// Antibiotic routes
@@ -54,6 +69,29 @@ func SetupRoutes(r *gin.Engine) {
 			antibioticDetails.DELETE("/:id", antibioticDetailsHandler.DeleteAntibioticDetails)
 		}
 
+		// Antibiotic reference catalogue routes
+		antibioticReferences := v1.Group("/antibiotic-references")
+		{
+			antibioticReferences.GET("", antibioticReferenceHandler.GetAntibioticReferences)
+			antibioticReferences.GET("/unmatched", antibioticReferenceHandler.GetUnmatchedAntibiotics)
+			antibioticReferences.GET("/:id", antibioticReferenceHandler.GetAntibioticReference)
+			antibioticReferences.POST("", antibioticReferenceHandler.CreateAntibioticReference)
+			antibioticReferences.POST("/upload", antibioticReferenceHandler.UploadAntibioticReferences)
+			antibioticReferences.POST("/apply", antibioticReferenceHandler.ApplyAntibioticReferences)
+			antibioticReferences.PUT("/:id", antibioticReferenceHandler.UpdateAntibioticReference)
+			antibioticReferences.DELETE("/:id", antibioticReferenceHandler.DeleteAntibioticReference)
+		}
+
+		// Review queue of antibiotic names not in the catalogue
+		antibioticMappings := v1.Group("/antibiotic-mappings")
+		{
+			antibioticMappings.GET("", antibioticMappingHandler.GetAntibioticMappings)
+			antibioticMappings.POST("", antibioticMappingHandler.CreateAntibioticMapping)
+			antibioticMappings.POST("/:id/accept", antibioticMappingHandler.AcceptAntibioticMapping)
+			antibioticMappings.POST("/:id/reject", antibioticMappingHandler.RejectAntibioticMapping)
+			antibioticMappings.DELETE("/:id", antibioticMappingHandler.DeleteAntibioticMapping)
+		}
+
 		// Specimen routes
 		specimens := v1.Group("/specimens")
 		{
@@ -61,6 +99,15 @@ func SetupRoutes(r *gin.Engine) {
 			specimens.GET("/stats", specimenHandler.GetSpecimenStats)
 			specimens.GET("/:id", specimenHandler.GetSpecimen)
 			specimens.GET("/patient/:patient_id", specimenHandler.GetSpecimensByPatient)
+			specimens.GET("/:id/susceptibility", specimenHandler.GetSpecimenSusceptibility)
+			specimens.GET("/:id/antibiogram", specimenHandler.GetSpecimenAntibiogram)
+		}
+
+		// Susceptibility results parsed from specimens
+		susceptibility := v1.Group("/susceptibility-results")
+		{
+			susceptibility.GET("", susceptibilityHandler.GetSusceptibilityResults)
+			susceptibility.GET("/summary", susceptibilityHandler.GetResistanceSummary)
 		}
 
 		// Optional Variables routes
@@ -94,7 +141,7 @@ func SetupRoutes(r *gin.Engine) {
 		}
 
 		// Upload routes
-		upload := v1.Group("/upload")
+		upload := v1.Group("/upload", uploadHandler.DecompressBody())
 		{
 			upload.POST("/patients", uploadHandler.UploadPatients)
 			upload.POST("/antibiotics", uploadHandler.UploadAntibiotics)
@@ -102,6 +149,58 @@ func SetupRoutes(r *gin.Engine) {
 			upload.POST("/indications", uploadHandler.UploadIndications)
 			upload.POST("/optional-vars", uploadHandler.UploadOptionalVars)
 			upload.POST("/specimens", uploadHandler.UploadSpecimens)
+			upload.POST("/whonet", uploadHandler.UploadWhonet)
+			upload.POST("/bundle", uploadHandler.UploadBundle)
+			upload.POST("/json", uploadHandler.UploadJSON)
+			upload.POST("/ndjson", uploadHandler.UploadNDJSON)
+			upload.POST("/fhir", uploadHandler.UploadFHIR)
+			upload.POST("/:entity/validate", uploadHandler.ValidateUpload)
+			upload.POST("/sessions", uploadHandler.CreateUploadSession)
+			upload.HEAD("/sessions/:id", uploadHandler.HeadUploadSession)
+			upload.GET("/sessions/:id", uploadHandler.GetUploadSession)
+			upload.PATCH("/sessions/:id", uploadHandler.PatchUploadSession)
+			upload.DELETE("/sessions/:id", uploadHandler.DeleteUploadSession)
+			upload.GET("/mappings", uploadHandler.GetMappingProfiles)
+		}
+
+		// Import job routes
+		imports := v1.Group("/imports")
+		{
+			imports.GET("", importHandler.GetImports)
+			imports.GET("/:id", importHandler.GetImport)
+			imports.DELETE("/:id", importHandler.DeleteImport)
+			imports.GET("/:id/errors.csv", importHandler.GetImportErrorReport)
+		}
+
+		// Child rows staged until their patient is imported
+		orphans := v1.Group("/orphans")
+		{
+			orphans.GET("", orphanHandler.GetOrphans)
+			orphans.DELETE("/:id", orphanHandler.DeleteOrphan)
+		}
+
+		// Data quality routes
+		quality := v1.Group("/quality")
+		{
+			quality.GET("/rules", qualityHandler.GetQualityRules)
+			quality.GET("/flags", qualityHandler.GetQualityFlags)
+			quality.GET("/summary", qualityHandler.GetQualitySummary)
+			quality.POST("/evaluate", qualityHandler.EvaluateQuality)
+		}
+
+		// Export routes
+		export := v1.Group("/export")
+		{
+			export.GET("/whonet", exportHandler.ExportWhonet)
+			export.GET("/fhir", exportHandler.ExportFHIR)
+			export.GET("/fhir/:id", exportHandler.ExportPatientFHIR)
+		}
+
+		// External sync routes
+		syncRoutes := v1.Group("/sync")
+		{
+			syncRoutes.GET("/odk", syncHandler.GetODKSync)
+			syncRoutes.POST("/odk", syncHandler.SyncODK)
 		}
 	}
 
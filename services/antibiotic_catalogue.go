@@ -0,0 +1,480 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"point-prevalence-survey/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// RowErrorInvalidReference marks a catalogue row that is not a valid entry
+const RowErrorInvalidReference = "invalid_reference"
+
+// Row warning codes of antibiotic enrichment
+const (
+	// RowWarningUnmatchedAntibiotic marks an antibiotic whose name is not in
+	// the reference catalogue, so it was stored as entered
+	RowWarningUnmatchedAntibiotic = "unmatched_antibiotic"
+	// RowWarningCatalogueMismatch marks an ATC code or AWaRe category entered
+	// on the form that the catalogue replaced with a different one
+	RowWarningCatalogueMismatch = "catalogue_mismatch"
+	// RowWarningFuzzyAntibiotic marks a misspelt or decorated name matched to
+	// the closest catalogue entry
+	RowWarningFuzzyAntibiotic = "fuzzy_antibiotic_match"
+	// RowWarningAntibioticReview marks a name too far from the closest
+	// catalogue entry to match it without review
+	RowWarningAntibioticReview = "antibiotic_needs_review"
+)
+
+// ErrInvalidReference is wrapped by errors caused by an invalid catalogue entry
+var ErrInvalidReference = errors.New("invalid antibiotic reference")
+
+// atcCodePattern matches a full ATC code such as J01DD04
+var atcCodePattern = regexp.MustCompile(`^[A-Z][0-9]{2}[A-Z]{2}[0-9]{2}$`)
+
+// catalogueColumns maps the fields of a catalogue CSV to the header names
+// they may appear under
+var catalogueColumns = map[string][]string{
+	"inn_name":         {"inn_name", "inn", "name", "antibiotic"},
+	"synonyms":         {"synonyms", "synonym", "other_names"},
+	"atc_code":         {"atc_code", "atc"},
+	"antibiotic_class": {"antibiotic_class", "class"},
+	"aware_category":   {"aware_category", "aware", "aware_classification"},
+	"oral_ddd":         {"oral_ddd", "ddd_oral"},
+	"parenteral_ddd":   {"parenteral_ddd", "ddd_parenteral"},
+	"ddd_unit":         {"ddd_unit", "unit"},
+}
+
+// antibioticCatalogue looks up catalogue entries by INN name or synonym, and
+// the reviewed mappings of names that are not in it
+type antibioticCatalogue struct {
+	byName map[string]*models.AntibioticReference
+	byID   map[uint]*models.AntibioticReference
+	// mappings are the reviewed and pending names, by name key
+	mappings map[string]*models.AntibioticNameMapping
+	// queued are the names to add to the review queue, by name key
+	queued map[string]*models.AntibioticNameMapping
+}
+
+// loadAntibioticCatalogue reads the reference catalogue and the name
+// mappings. INN names take precedence over synonyms, and a synonym shared by
+// two entries matches the first one.
+func loadAntibioticCatalogue(db *gorm.DB) (*antibioticCatalogue, error) {
+	var references []models.AntibioticReference
+	if err := db.Order("id").Find(&references).Error; err != nil {
+		return nil, fmt.Errorf("error loading antibiotic catalogue: %v", err)
+	}
+	var mappings []models.AntibioticNameMapping
+	if err := db.Find(&mappings).Error; err != nil {
+		return nil, fmt.Errorf("error loading antibiotic name mappings: %v", err)
+	}
+
+	catalogue := &antibioticCatalogue{
+		byName:   make(map[string]*models.AntibioticReference),
+		byID:     make(map[uint]*models.AntibioticReference),
+		mappings: make(map[string]*models.AntibioticNameMapping),
+		queued:   make(map[string]*models.AntibioticNameMapping),
+	}
+	for i := range references {
+		catalogue.byName[valueKey(references[i].INNName)] = &references[i]
+		catalogue.byID[references[i].ID] = &references[i]
+	}
+	for i := range references {
+		for _, synonym := range splitSynonyms(references[i].Synonyms) {
+			if _, ok := catalogue.byName[valueKey(synonym)]; !ok {
+				catalogue.byName[valueKey(synonym)] = &references[i]
+			}
+		}
+	}
+	for i := range mappings {
+		catalogue.mappings[mappings[i].NameKey] = &mappings[i]
+	}
+	return catalogue, nil
+}
+
+// empty reports whether the catalogue has no entries, e.g. before it is loaded
+func (c *antibioticCatalogue) empty() bool {
+	return c == nil || len(c.byName) == 0
+}
+
+// antibioticNames returns the names an antibiotic may be matched by: the INN
+// name chosen on the form, the name written when "other" was chosen, and the
+// name as written in the notes
+func antibioticNames(antibiotic *models.Antibiotic) []string {
+	return []string{antibiotic.AntibioticINNName, antibiotic.OtherAntibiotic, antibiotic.AntibioticNotes}
+}
+
+// antibioticName returns the name an unmatched antibiotic is reported under
+func antibioticName(antibiotic *models.Antibiotic) string {
+	for _, name := range antibioticNames(antibiotic) {
+		if name = strings.TrimSpace(name); name != "" && valueKey(name) != "other" {
+			return name
+		}
+	}
+	return ""
+}
+
+// applyReference copies the catalogue values of ref onto antibiotic. The DDD
+// is taken for the antibiotic's route, or the only one the entry has when the
+// route is not known.
+func applyReference(antibiotic *models.Antibiotic, ref *models.AntibioticReference) {
+	id := ref.ID
+	antibiotic.ReferenceID = &id
+	antibiotic.AntibioticINNName = ref.INNName
+	if ref.ATCCode != "" {
+		antibiotic.ATCCode = ref.ATCCode
+	}
+	if ref.AntibioticClass != "" {
+		antibiotic.AntibioticClass = ref.AntibioticClass
+	}
+	if ref.AWaReCategory != "" {
+		antibiotic.AntibioticAwareClassification = ref.AWaReCategory
+	}
+
+	antibiotic.DDD = 0
+	switch {
+	case antibiotic.AdministrationRoute == CodeOral:
+		antibiotic.DDD = ref.OralDDD
+	case antibiotic.AdministrationRoute == CodeIV || antibiotic.AdministrationRoute == CodeIM:
+		antibiotic.DDD = ref.ParenteralDDD
+	case ref.OralDDD == 0:
+		antibiotic.DDD = ref.ParenteralDDD
+	case ref.ParenteralDDD == 0:
+		antibiotic.DDD = ref.OralDDD
+	}
+	antibiotic.DDDUnit = ""
+	if antibiotic.DDD != 0 {
+		antibiotic.DDDUnit = ref.DDDUnit
+	}
+}
+
+// enrichAntibiotic matches a parsed antibiotic row against the catalogue and
+// fills in its ATC code, class, AWaRe category and DDD. Fuzzy matches,
+// unmatched names and entered values the catalogue disagrees with are
+// recorded as warnings; names that need review are queued.
+func (r *csvRow) enrichAntibiotic(antibiotic *models.Antibiotic) {
+	if r.catalogue.empty() {
+		return
+	}
+
+	m := r.catalogue.resolve(antibiotic)
+	switch m.kind {
+	case matchNone, matchRejected:
+		if m.name == "" {
+			return
+		}
+		r.warnings = append(r.warnings, RowError{
+			Column:  r.cols.Column("antibiotic_inn_name"),
+			Code:    RowWarningUnmatchedAntibiotic,
+			Message: fmt.Sprintf("antibiotic %q is not in the reference catalogue; its ATC code, AWaRe category and DDD are kept as entered", m.name),
+		})
+		r.catalogue.queue(m)
+		return
+	case matchReview:
+		r.warnings = append(r.warnings, RowError{
+			Column:  r.cols.Column("antibiotic_inn_name"),
+			Code:    RowWarningAntibioticReview,
+			Message: fmt.Sprintf("antibiotic %q may be %s (%.0f%% similar); it is kept as entered and queued for review", m.name, m.ref.INNName, m.score*100),
+		})
+		r.catalogue.queue(m)
+		return
+	case matchFuzzy:
+		r.warnings = append(r.warnings, RowError{
+			Column:  r.cols.Column("antibiotic_inn_name"),
+			Code:    RowWarningFuzzyAntibiotic,
+			Message: fmt.Sprintf("antibiotic %q matched to %s (%.0f%% similar)", m.name, m.ref.INNName, m.score*100),
+		})
+	}
+	ref := m.ref
+
+	if entered := strings.ToUpper(strings.TrimSpace(antibiotic.ATCCode)); entered != "" && ref.ATCCode != "" && entered != ref.ATCCode {
+		r.warnings = append(r.warnings, RowError{
+			Column:  r.cols.Column("atc_code"),
+			Code:    RowWarningCatalogueMismatch,
+			Message: fmt.Sprintf("ATC code %s replaced by %s from the catalogue entry for %s", entered, ref.ATCCode, ref.INNName),
+		})
+	}
+	if entered := antibiotic.AntibioticAwareClassification; entered != "" && ref.AWaReCategory != "" && entered != ref.AWaReCategory {
+		r.warnings = append(r.warnings, RowError{
+			Column:  r.cols.Column("antibiotic_aware_classification"),
+			Code:    RowWarningCatalogueMismatch,
+			Message: fmt.Sprintf("AWaRe category %s replaced by %s from the catalogue entry for %s", entered, ref.AWaReCategory, ref.INNName),
+		})
+	}
+
+	applyReference(antibiotic, ref)
+}
+
+// splitSynonyms splits a semicolon separated list of synonyms
+func splitSynonyms(synonyms string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(synonyms, ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ValidateAntibioticReference checks a catalogue entry and normalises its
+// values: the AWaRe category to its canonical code, the ATC code to upper
+// case and the synonyms to a de-duplicated list
+func ValidateAntibioticReference(ref *models.AntibioticReference) error {
+	ref.INNName = strings.TrimSpace(ref.INNName)
+	if ref.INNName == "" {
+		return fmt.Errorf("%w: inn_name is required", ErrInvalidReference)
+	}
+
+	ref.ATCCode = strings.ToUpper(strings.TrimSpace(ref.ATCCode))
+	if ref.ATCCode != "" && !atcCodePattern.MatchString(ref.ATCCode) {
+		return fmt.Errorf("%w: %q is not a full ATC code such as J01DD04", ErrInvalidReference, ref.ATCCode)
+	}
+
+	ref.AWaReCategory = awareValues.Normalize(ref.AWaReCategory)
+	switch ref.AWaReCategory {
+	case "", CodeAccess, CodeWatch, CodeReserve, CodeNotRecommended:
+	default:
+		return fmt.Errorf("%w: unknown AWaRe category %q", ErrInvalidReference, ref.AWaReCategory)
+	}
+
+	if ref.OralDDD < 0 || ref.ParenteralDDD < 0 {
+		return fmt.Errorf("%w: DDDs cannot be negative", ErrInvalidReference)
+	}
+	ref.DDDUnit = strings.TrimSpace(ref.DDDUnit)
+	if (ref.OralDDD > 0 || ref.ParenteralDDD > 0) && ref.DDDUnit == "" {
+		return fmt.Errorf("%w: ddd_unit is required with a DDD", ErrInvalidReference)
+	}
+
+	seen := map[string]bool{valueKey(ref.INNName): true}
+	synonyms := make([]string, 0)
+	for _, synonym := range splitSynonyms(ref.Synonyms) {
+		if !seen[valueKey(synonym)] {
+			seen[valueKey(synonym)] = true
+			synonyms = append(synonyms, synonym)
+		}
+	}
+	ref.Synonyms = strings.Join(synonyms, "; ")
+	ref.AntibioticClass = strings.TrimSpace(ref.AntibioticClass)
+	return nil
+}
+
+// ImportAntibioticCatalogue loads catalogue entries from a CSV file with an
+// inn_name column and optional synonyms, atc_code, antibiotic_class,
+// aware_category, oral_ddd, parenteral_ddd and ddd_unit columns. Entries are
+// matched to existing ones by INN name and updated; new names are inserted.
+func ImportAntibioticCatalogue(db *gorm.DB, file io.Reader) (*UploadResult, error) {
+	result := newUploadResult(false)
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return result, fmt.Errorf("CSV file must have at least a header row and one data row")
+	}
+	if err != nil {
+		return result, fmt.Errorf("error reading CSV file: %v", err)
+	}
+	result.Header = header
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		key := normalizeHeader(name)
+		for field, names := range catalogueColumns {
+			for _, alias := range names {
+				if _, ok := columns[field]; !ok && key == normalizeHeader(alias) {
+					columns[field] = i
+				}
+			}
+		}
+	}
+	if _, ok := columns["inn_name"]; !ok {
+		return result, fmt.Errorf("%w: missing required column inn_name", ErrColumnMapping)
+	}
+
+	rowNum := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowNum++
+		result.TotalRecords++
+		result.ProcessedRecords++
+		if err != nil {
+			result.rowError(rowNum, "", record, RowError{Code: RowErrorMalformed, Message: fmt.Sprintf("malformed row: %v", err)})
+			continue
+		}
+
+		get := func(field string) string {
+			if i, ok := columns[field]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(field string) (float64, error) {
+			value := get(field)
+			if value == "" {
+				return 0, nil
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid number %q in column %s", value, header[columns[field]])
+			}
+			return n, nil
+		}
+
+		ref := models.AntibioticReference{
+			INNName:         get("inn_name"),
+			Synonyms:        get("synonyms"),
+			ATCCode:         get("atc_code"),
+			AntibioticClass: get("antibiotic_class"),
+			AWaReCategory:   get("aware_category"),
+			DDDUnit:         get("ddd_unit"),
+		}
+		if ref.OralDDD, err = number("oral_ddd"); err == nil {
+			ref.ParenteralDDD, err = number("parenteral_ddd")
+		}
+		if err != nil {
+			result.rowError(rowNum, ref.INNName, record, RowError{Code: RowErrorInvalidNumber, Message: err.Error()})
+			continue
+		}
+		if err := ValidateAntibioticReference(&ref); err != nil {
+			result.rowError(rowNum, ref.INNName, record, RowError{Code: RowErrorInvalidReference, Message: err.Error()})
+			continue
+		}
+
+		var existing models.AntibioticReference
+		err = db.Where("LOWER(inn_name) = LOWER(?)", ref.INNName).First(&existing).Error
+		switch {
+		case err == nil:
+			ref.ID = existing.ID
+			ref.CreatedAt = existing.CreatedAt
+			if err := db.Save(&ref).Error; err != nil {
+				result.rowError(rowNum, ref.INNName, record, RowError{Code: RowErrorDatabase, Message: fmt.Sprintf("error updating %s: %v", ref.INNName, err)})
+				continue
+			}
+			result.UpdatedRecords++
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := db.Create(&ref).Error; err != nil {
+				result.rowError(rowNum, ref.INNName, record, RowError{Code: RowErrorDatabase, Message: fmt.Sprintf("error inserting %s: %v", ref.INNName, err)})
+				continue
+			}
+			result.InsertedRecords++
+		default:
+			result.rowError(rowNum, ref.INNName, record, RowError{Code: RowErrorDatabase, Message: fmt.Sprintf("database error loading %s: %v", ref.INNName, err)})
+		}
+	}
+
+	log.Printf("Antibiotic catalogue loaded: %d inserted, %d updated, %d rejected",
+		result.InsertedRecords, result.UpdatedRecords, result.SkippedRecords)
+	return result, nil
+}
+
+// EnrichAntibiotics matches every stored antibiotic against the catalogue
+// and the reviewed name mappings again, e.g. after the catalogue was loaded or
+// edited. Antibiotics that no longer match lose their reference and their DDD,
+// which only the catalogue provides, but keep their ATC code, class and AWaRe
+// category; their names are queued for review. It returns the number of
+// antibiotics matched and left unmatched.
+func EnrichAntibiotics(db *gorm.DB) (int, int, error) {
+	catalogue, err := loadAntibioticCatalogue(db)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	matched, unmatched := 0, 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var batch []models.Antibiotic
+		if err := tx.Model(&models.Antibiotic{}).FindInBatches(&batch, 500, func(batchTx *gorm.DB, _ int) error {
+			for i := range batch {
+				antibiotic := &batch[i]
+				if m := catalogue.resolve(antibiotic); m.applies() {
+					applyReference(antibiotic, m.ref)
+					matched++
+				} else {
+					catalogue.queue(m)
+					antibiotic.ReferenceID = nil
+					antibiotic.DDD = 0
+					antibiotic.DDDUnit = ""
+					unmatched++
+				}
+				if err := tx.Omit("import_id").Save(antibiotic).Error; err != nil {
+					return fmt.Errorf("error updating antibiotic %s: %v", antibiotic.ID, err)
+				}
+			}
+			return nil
+		}).Error; err != nil {
+			return err
+		}
+		return catalogue.saveQueue(tx)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	log.Printf("Matched %d antibiotics to the catalogue, %d unmatched", matched, unmatched)
+	return matched, unmatched, nil
+}
+
+// UnmatchedAntibiotic is a name of stored antibiotics not in the catalogue
+type UnmatchedAntibiotic struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// UnmatchedAntibiotics lists the names of stored antibiotics that did not
+// match the catalogue, most frequent first
+func UnmatchedAntibiotics(db *gorm.DB) ([]UnmatchedAntibiotic, error) {
+	var rows []struct {
+		AntibioticINNName string
+		OtherAntibiotic   string
+		AntibioticNotes   string
+		Count             int64
+	}
+	err := db.Model(&models.Antibiotic{}).
+		Select("antibiotic_inn_name, other_antibiotic, antibiotic_notes, COUNT(*) AS count").
+		Where("reference_id IS NULL").
+		Group("antibiotic_inn_name, other_antibiotic, antibiotic_notes").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error listing unmatched antibiotics: %v", err)
+	}
+
+	// Rows are grouped again by the name they are reported under
+	counts := make(map[string]*UnmatchedAntibiotic)
+	names := make([]UnmatchedAntibiotic, 0)
+	for _, row := range rows {
+		name := antibioticName(&models.Antibiotic{
+			AntibioticINNName: row.AntibioticINNName,
+			OtherAntibiotic:   row.OtherAntibiotic,
+			AntibioticNotes:   row.AntibioticNotes,
+		})
+		if name == "" {
+			continue
+		}
+		key := valueKey(name)
+		if entry, ok := counts[key]; ok {
+			entry.Count += row.Count
+			continue
+		}
+		counts[key] = &UnmatchedAntibiotic{Name: name, Count: row.Count}
+	}
+	for _, entry := range counts {
+		names = append(names, *entry)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Count != names[j].Count {
+			return names[i].Count > names[j].Count
+		}
+		return names[i].Name < names[j].Name
+	})
+	return names, nil
+}
@@ -0,0 +1,451 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"point-prevalence-survey/models"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Similarity scores, from 0 to 1, at which a name that is not in the
+// catalogue is matched to the closest entry
+const (
+	// autoMatchScore matches the name without review
+	autoMatchScore = 0.85
+	// suggestMatchScore queues the closest entry as a suggestion for review
+	suggestMatchScore = 0.65
+	// tokenMatchScore is the score of a name one of whose words is in the
+	// catalogue, e.g. "Ceftriaxone Rocephin"
+	tokenMatchScore = 0.92
+)
+
+var (
+	// ErrMappingNotFound is returned for an unknown name mapping
+	ErrMappingNotFound = errors.New("antibiotic name mapping not found")
+	// ErrReferenceNotFound is returned when a mapping names an unknown catalogue entry
+	ErrReferenceNotFound = errors.New("antibiotic reference not found")
+)
+
+// nameNoiseWords are the dose, form, route and frequency words written after
+// antibiotic names, e.g. the "inj" of "ceftriaxone inj"
+var nameNoiseWords = make(map[string]bool)
+
+func init() {
+	for _, word := range []string{
+		"inj", "injection", "injectable", "infusion", "iv", "im", "ivi", "po", "oral", "by", "mouth",
+		"tab", "tabs", "tablet", "tablets", "cap", "caps", "capsule", "capsules", "syrup", "syr",
+		"susp", "suspension", "powder", "vial", "vials", "amp", "ampoule", "drops", "dispersible",
+		"sodium", "potassium", "hydrochloride", "hcl", "trihydrate",
+		"mg", "g", "gm", "gram", "grams", "ml", "mcg", "ug", "iu", "mu", "units",
+		"od", "bd", "bid", "tds", "tid", "qid", "qds", "stat", "daily", "hourly", "prn",
+	} {
+		nameNoiseWords[word] = true
+	}
+}
+
+// Kinds of antibiotic name matches
+const (
+	matchNone     = "none"
+	matchExact    = "exact"
+	matchMapping  = "mapping"
+	matchFuzzy    = "fuzzy"
+	matchReview   = "review"
+	matchRejected = "rejected"
+)
+
+// antibioticMatch is the outcome of matching an antibiotic's names
+type antibioticMatch struct {
+	kind string
+	// name is the name that matched, or the one reported when none did
+	name  string
+	ref   *models.AntibioticReference
+	score float64
+}
+
+// applies reports whether the antibiotic takes the values of the match
+func (m antibioticMatch) applies() bool {
+	return m.ref != nil && (m.kind == matchExact || m.kind == matchMapping || m.kind == matchFuzzy)
+}
+
+// nameWords splits an antibiotic name into lowercase words, dropping numbers,
+// doses and dose, form and route words
+func nameWords(name string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	words := make([]string, 0, len(fields))
+	for _, field := range fields {
+		// Doses such as "500mg" or "1g" and plain numbers
+		if field[0] >= '0' && field[0] <= '9' {
+			continue
+		}
+		if nameNoiseWords[field] {
+			continue
+		}
+		words = append(words, field)
+	}
+	return words
+}
+
+// AntibioticNameKey returns the key names are remembered under: the name
+// ignoring case, punctuation and dose or form words, so "Ceftriaxone 1g inj"
+// and "ceftriaxone" share a key
+func AntibioticNameKey(name string) string {
+	return strings.Join(nameWords(name), "")
+}
+
+// resolve matches the names of an antibiotic: exactly against the catalogue,
+// through a reviewed mapping, or to the closest catalogue entry
+func (c *antibioticCatalogue) resolve(antibiotic *models.Antibiotic) antibioticMatch {
+	best := antibioticMatch{kind: matchNone, name: antibioticName(antibiotic)}
+	if c.empty() {
+		return best
+	}
+
+	for _, name := range antibioticNames(antibiotic) {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		if ref, ok := c.byName[valueKey(name)]; ok {
+			return antibioticMatch{kind: matchExact, name: name, ref: ref, score: 1}
+		}
+	}
+
+	for _, name := range antibioticNames(antibiotic) {
+		key := AntibioticNameKey(name)
+		if key == "" || key == "other" {
+			continue
+		}
+
+		if mapping, ok := c.mappings[key]; ok {
+			switch mapping.Status {
+			case models.NameMappingAccepted:
+				if mapping.ReferenceID != nil && c.byID[*mapping.ReferenceID] != nil {
+					return antibioticMatch{kind: matchMapping, name: name, ref: c.byID[*mapping.ReferenceID], score: 1}
+				}
+			case models.NameMappingRejected:
+				return antibioticMatch{kind: matchRejected, name: strings.TrimSpace(name)}
+			}
+		}
+		if ref, ok := c.byName[key]; ok {
+			return antibioticMatch{kind: matchFuzzy, name: strings.TrimSpace(name), ref: ref, score: 1}
+		}
+
+		if ref, score := c.closest(nameWords(name)); score > best.score {
+			best = antibioticMatch{kind: matchNone, name: strings.TrimSpace(name), ref: ref, score: score}
+		}
+	}
+
+	switch {
+	case best.ref != nil && best.score >= autoMatchScore:
+		best.kind = matchFuzzy
+	case best.ref != nil && best.score >= suggestMatchScore:
+		best.kind = matchReview
+	default:
+		best.ref = nil
+		best.score = 0
+	}
+	return best
+}
+
+// closest returns the catalogue entry most similar to a name, by its words
+// together or any single word, with its similarity score
+func (c *antibioticCatalogue) closest(words []string) (*models.AntibioticReference, float64) {
+	var best *models.AntibioticReference
+	bestScore := 0.0
+
+	joined := strings.Join(words, "")
+	for key, ref := range c.byName {
+		if score := similarity(joined, key); score > bestScore || (score == bestScore && best != nil && ref.ID < best.ID) {
+			best, bestScore = ref, score
+		}
+	}
+
+	// One word of a longer name, e.g. the brand name in "ceftriaxone rocephin"
+	if len(words) > 1 {
+		for _, word := range words {
+			if len(word) < 4 {
+				continue
+			}
+			if ref, ok := c.byName[word]; ok && tokenMatchScore > bestScore {
+				best, bestScore = ref, tokenMatchScore
+			}
+		}
+	}
+	return best, bestScore
+}
+
+// similarity scores two names from 0 to 1 by their edit distance. Names
+// shorter than four letters only match exactly.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < 4 || len(rb) < 4 {
+		return 0
+	}
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein returns the number of single letter edits between a and b
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// queue records a name that did not match for the review queue, with the
+// closest catalogue entry as a suggestion. Names already reviewed are only
+// counted.
+func (c *antibioticCatalogue) queue(m antibioticMatch) {
+	key := AntibioticNameKey(m.name)
+	if key == "" || key == "other" {
+		return
+	}
+
+	if queued, ok := c.queued[key]; ok {
+		queued.Occurrences++
+		return
+	}
+
+	mapping := &models.AntibioticNameMapping{
+		Name:        m.name,
+		NameKey:     key,
+		Status:      models.NameMappingPending,
+		Score:       m.score,
+		Occurrences: 1,
+	}
+	if m.ref != nil {
+		id := m.ref.ID
+		mapping.SuggestedReferenceID = &id
+	}
+	c.queued[key] = mapping
+}
+
+// saveQueue adds the queued names to the review queue, and pending ones get
+// the new suggestion. Occurrences are recounted from the stored antibiotics,
+// so matching the same rows again does not count them twice.
+func (c *antibioticCatalogue) saveQueue(db *gorm.DB) error {
+	if c == nil || len(c.queued) == 0 {
+		return nil
+	}
+
+	counts, err := countUnmatchedNames(db)
+	if err != nil {
+		return err
+	}
+
+	for key, mapping := range c.queued {
+		// Names seen only on staged rows have no stored antibiotics yet
+		if count := counts[key]; count > 0 {
+			mapping.Occurrences = int(count)
+		}
+
+		err := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "name_key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"occurrences": mapping.Occurrences,
+				"updated_at":  time.Now(),
+			}),
+		}).Create(mapping).Error
+		if err != nil {
+			return fmt.Errorf("error queueing antibiotic name %q for review: %v", mapping.Name, err)
+		}
+
+		if existing, ok := c.mappings[key]; ok && existing.Status == models.NameMappingPending {
+			err := db.Model(&models.AntibioticNameMapping{}).Where("name_key = ?", key).
+				Updates(map[string]interface{}{"suggested_reference_id": mapping.SuggestedReferenceID, "score": mapping.Score}).Error
+			if err != nil {
+				return fmt.Errorf("error updating the suggestion for %q: %v", mapping.Name, err)
+			}
+		}
+	}
+
+	log.Printf("Queued %d antibiotic names for review", len(c.queued))
+	c.queued = make(map[string]*models.AntibioticNameMapping)
+	return nil
+}
+
+// countUnmatchedNames counts the stored antibiotics that did not match the
+// catalogue by the name keys of their names
+func countUnmatchedNames(db *gorm.DB) (map[string]int64, error) {
+	var rows []struct {
+		AntibioticINNName string
+		OtherAntibiotic   string
+		AntibioticNotes   string
+		Count             int64
+	}
+	err := db.Model(&models.Antibiotic{}).
+		Select("antibiotic_inn_name, other_antibiotic, antibiotic_notes, COUNT(*) AS count").
+		Where("reference_id IS NULL").
+		Group("antibiotic_inn_name, other_antibiotic, antibiotic_notes").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error counting unmatched antibiotics: %v", err)
+	}
+
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		antibiotic := &models.Antibiotic{
+			AntibioticINNName: row.AntibioticINNName,
+			OtherAntibiotic:   row.OtherAntibiotic,
+			AntibioticNotes:   row.AntibioticNotes,
+		}
+		seen := make(map[string]bool)
+		for _, name := range antibioticNames(antibiotic) {
+			if key := AntibioticNameKey(name); key != "" && !seen[key] {
+				counts[key] += row.Count
+				seen[key] = true
+			}
+		}
+	}
+	return counts, nil
+}
+
+// AcceptNameMapping maps the name of a mapping to a catalogue entry, the
+// suggested one when referenceID is nil, and matches the stored antibiotics
+// written under that name. It returns the mapping and the number of
+// antibiotics matched.
+func AcceptNameMapping(db *gorm.DB, id uint, referenceID *uint, reviewedBy string) (*models.AntibioticNameMapping, int, error) {
+	var mapping models.AntibioticNameMapping
+	if err := db.First(&mapping, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 0, ErrMappingNotFound
+		}
+		return nil, 0, err
+	}
+
+	if referenceID == nil {
+		referenceID = mapping.SuggestedReferenceID
+	}
+	if referenceID == nil {
+		return nil, 0, fmt.Errorf("%w: %q has no suggestion, so a reference_id is required", ErrInvalidReference, mapping.Name)
+	}
+
+	return saveAcceptedMapping(db, &mapping, *referenceID, reviewedBy)
+}
+
+// MapAntibioticName remembers that name means a catalogue entry, without it
+// going through the review queue, and matches the stored antibiotics written
+// under that name
+func MapAntibioticName(db *gorm.DB, name string, referenceID uint, reviewedBy string) (*models.AntibioticNameMapping, int, error) {
+	key := AntibioticNameKey(name)
+	if key == "" {
+		return nil, 0, fmt.Errorf("%w: name is required", ErrInvalidReference)
+	}
+
+	mapping := models.AntibioticNameMapping{Name: strings.TrimSpace(name), NameKey: key}
+	if err := db.Where("name_key = ?", key).First(&mapping).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, 0, err
+	}
+
+	return saveAcceptedMapping(db, &mapping, referenceID, reviewedBy)
+}
+
+// saveAcceptedMapping stores an accepted mapping and applies it to the
+// stored antibiotics that have not matched the catalogue
+func saveAcceptedMapping(db *gorm.DB, mapping *models.AntibioticNameMapping, referenceID uint, reviewedBy string) (*models.AntibioticNameMapping, int, error) {
+	var ref models.AntibioticReference
+	if err := db.First(&ref, referenceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 0, ErrReferenceNotFound
+		}
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	mapping.Status = models.NameMappingAccepted
+	mapping.ReferenceID = &ref.ID
+	mapping.ReviewedBy = reviewedBy
+	mapping.ReviewedAt = &now
+
+	matched := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(mapping).Error; err != nil {
+			return fmt.Errorf("error saving mapping of %q: %v", mapping.Name, err)
+		}
+
+		var batch []models.Antibiotic
+		return tx.Model(&models.Antibiotic{}).Where("reference_id IS NULL").FindInBatches(&batch, 500, func(batchTx *gorm.DB, _ int) error {
+			for i := range batch {
+				antibiotic := &batch[i]
+				if !hasNameKey(antibiotic, mapping.NameKey) {
+					continue
+				}
+				applyReference(antibiotic, &ref)
+				if err := tx.Omit("import_id").Save(antibiotic).Error; err != nil {
+					return fmt.Errorf("error updating antibiotic %s: %v", antibiotic.ID, err)
+				}
+				matched++
+			}
+			return nil
+		}).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.Printf("Mapped antibiotic name %q to %s, %d stored antibiotics matched", mapping.Name, ref.INNName, matched)
+	return mapping, matched, nil
+}
+
+// RejectNameMapping marks the suggestion of a mapping as wrong. The name is
+// no longer suggested or matched in later imports; antibiotics matched under
+// it keep their values until the catalogue is applied again.
+func RejectNameMapping(db *gorm.DB, id uint, reviewedBy string) (*models.AntibioticNameMapping, error) {
+	var mapping models.AntibioticNameMapping
+	if err := db.First(&mapping, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMappingNotFound
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	mapping.Status = models.NameMappingRejected
+	mapping.ReferenceID = nil
+	mapping.ReviewedBy = reviewedBy
+	mapping.ReviewedAt = &now
+	if err := db.Save(&mapping).Error; err != nil {
+		return nil, fmt.Errorf("error saving mapping of %q: %v", mapping.Name, err)
+	}
+	return &mapping, nil
+}
+
+// hasNameKey reports whether any name of antibiotic has the name key
+func hasNameKey(antibiotic *models.Antibiotic, key string) bool {
+	for _, name := range antibioticNames(antibiotic) {
+		if AntibioticNameKey(name) == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"math"
+	"point-prevalence-survey/models"
+	"testing"
+)
+
+// newTestCatalogue builds a catalogue like loadAntibioticCatalogue does
+func newTestCatalogue(references []models.AntibioticReference, mappings ...models.AntibioticNameMapping) *antibioticCatalogue {
+	catalogue := &antibioticCatalogue{
+		byName:   make(map[string]*models.AntibioticReference),
+		byID:     make(map[uint]*models.AntibioticReference),
+		mappings: make(map[string]*models.AntibioticNameMapping),
+		queued:   make(map[string]*models.AntibioticNameMapping),
+	}
+	for i := range references {
+		catalogue.byName[valueKey(references[i].INNName)] = &references[i]
+		catalogue.byID[references[i].ID] = &references[i]
+		for _, synonym := range splitSynonyms(references[i].Synonyms) {
+			if _, ok := catalogue.byName[valueKey(synonym)]; !ok {
+				catalogue.byName[valueKey(synonym)] = &references[i]
+			}
+		}
+	}
+	for i := range mappings {
+		catalogue.mappings[mappings[i].NameKey] = &mappings[i]
+	}
+	return catalogue
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"ceftriaxone", "ceftriaxone", 1},
+		{"ceftriaxon", "ceftriaxone", 1 - 1.0/11},
+		{"cefriaxone", "ceftriaxone", 1 - 1.0/11},
+		{"amoxicilin", "amoxicillin", 1 - 1.0/11},
+		{"kitten", "sitting", 1 - 3.0/7},
+		{"ab", "ab", 1},
+		{"abc", "abd", 0},
+		{"", "ceftriaxone", 0},
+	}
+
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAntibioticNameKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Ceftriaxone 1g inj", "ceftriaxone"},
+		{"ceftriaxone", "ceftriaxone"},
+		{"Amoxicillin/Clavulanic acid 625mg tabs BD", "amoxicillinclavulanicacid"},
+		{"Metronidazole IV 500 mg TDS", "metronidazole"},
+		{"500mg", ""},
+	}
+
+	for _, tt := range tests {
+		if got := AntibioticNameKey(tt.name); got != tt.want {
+			t.Errorf("AntibioticNameKey(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogueResolve(t *testing.T) {
+	reviewed := uint(2)
+	catalogue := newTestCatalogue(
+		[]models.AntibioticReference{
+			{ID: 1, INNName: "Ceftriaxone", Synonyms: "Rocephin"},
+			{ID: 2, INNName: "Amoxicillin"},
+			{ID: 3, INNName: "Metronidazole"},
+		},
+		models.AntibioticNameMapping{NameKey: "amoxyl", Status: models.NameMappingAccepted, ReferenceID: &reviewed},
+		models.AntibioticNameMapping{NameKey: "ceftriaxine", Status: models.NameMappingRejected},
+	)
+
+	tests := []struct {
+		name       string
+		antibiotic models.Antibiotic
+		wantKind   string
+		wantRef    uint
+	}{
+		{
+			name:       "INN name ignoring case",
+			antibiotic: models.Antibiotic{AntibioticINNName: "ceftriaxone"},
+			wantKind:   matchExact, wantRef: 1,
+		},
+		{
+			name:       "synonym",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Rocephin"},
+			wantKind:   matchExact, wantRef: 1,
+		},
+		{
+			name:       "other name when other was chosen",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Other", OtherAntibiotic: "Metronidazole"},
+			wantKind:   matchExact, wantRef: 3,
+		},
+		{
+			name:       "reviewed mapping",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Amoxyl 250mg caps"},
+			wantKind:   matchMapping, wantRef: 2,
+		},
+		{
+			name:       "rejected mapping",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Ceftriaxine"},
+			wantKind:   matchRejected,
+		},
+		{
+			name:       "dose and form words",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Ceftriaxone 1g inj"},
+			wantKind:   matchFuzzy, wantRef: 1,
+		},
+		{
+			name:       "misspelling matched without review",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Metronidazol"},
+			wantKind:   matchFuzzy, wantRef: 3,
+		},
+		{
+			name:       "brand name word of a longer name",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Inj Ceftriaxone Zinnat"},
+			wantKind:   matchFuzzy, wantRef: 1,
+		},
+		{
+			name:       "distant spelling suggested for review",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Amoxcilln"},
+			wantKind:   matchReview, wantRef: 2,
+		},
+		{
+			name:       "unknown name",
+			antibiotic: models.Antibiotic{AntibioticINNName: "Paracetamol"},
+			wantKind:   matchNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := catalogue.resolve(&tt.antibiotic)
+			var ref uint
+			if m.ref != nil {
+				ref = m.ref.ID
+			}
+			if m.kind != tt.wantKind || ref != tt.wantRef {
+				t.Errorf("resolve = %s %d (score %.2f), want %s %d", m.kind, ref, m.score, tt.wantKind, tt.wantRef)
+			}
+		})
+	}
+
+	if m := newTestCatalogue(nil).resolve(&models.Antibiotic{AntibioticINNName: "Ceftriaxone"}); m.kind != matchNone || m.name != "Ceftriaxone" {
+		t.Errorf("resolve without a catalogue = %+v, want no match reported under the name", m)
+	}
+}
+
+func TestCatalogueQueue(t *testing.T) {
+	catalogue := newTestCatalogue([]models.AntibioticReference{{ID: 2, INNName: "Amoxicillin"}})
+
+	for _, name := range []string{"Amoxcilln", "amoxcilln 500mg", "Paracetamol", "Other", ""} {
+		catalogue.queue(catalogue.resolve(&models.Antibiotic{AntibioticINNName: name}))
+	}
+
+	if len(catalogue.queued) != 2 {
+		t.Fatalf("queued = %v, want amoxcilln and paracetamol", catalogue.queued)
+	}
+	queued := catalogue.queued["amoxcilln"]
+	if queued == nil || queued.Occurrences != 2 || queued.SuggestedReferenceID == nil || *queued.SuggestedReferenceID != 2 {
+		t.Errorf("amoxcilln = %+v, want 2 occurrences suggesting Amoxicillin", queued)
+	}
+	if queued := catalogue.queued["paracetamol"]; queued == nil || queued.SuggestedReferenceID != nil {
+		t.Errorf("paracetamol = %+v, want it queued without a suggestion", queued)
+	}
+}
@@ -0,0 +1,429 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidBundle is returned when an uploaded bundle cannot be imported at all
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// bundleOrder lists entities in the order they are imported, parents first
+var bundleOrder = []string{
+	EntityPatients,
+	EntityAntibiotics,
+	EntityAntibioticDetails,
+	EntityIndications,
+	EntityOptionalVars,
+	EntitySpecimens,
+}
+
+// bundleFileNames maps normalised fragments of ODK Central repeat-group file
+// names to entities. ODK names repeat exports "<form>-<repeat group>.csv".
+// More specific fragments are checked first.
+var bundleFileNames = []struct {
+	fragment string
+	entity   string
+}{
+	{"antibioticdetails", EntityAntibioticDetails},
+	{"abdetails", EntityAntibioticDetails},
+	{"antibiotic", EntityAntibiotics},
+	{"indication", EntityIndications},
+	{"optional", EntityOptionalVars},
+	{"specimen", EntitySpecimens},
+	{"microbiology", EntitySpecimens},
+}
+
+// BundleFileResult is the outcome of importing one file of a bundle
+type BundleFileResult struct {
+	File   string        `json:"file"`
+	Entity string        `json:"entity,omitempty"`
+	Result *UploadResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// BundleResult contains the per-file results of a bundle import
+type BundleResult struct {
+	Files           []BundleFileResult `json:"files"`
+	Ignored         []string           `json:"ignored"`
+	TotalRecords    int                `json:"total_records"`
+	InsertedRecords int                `json:"inserted_records"`
+	UpdatedRecords  int                `json:"updated_records"`
+	StagedRecords   int                `json:"staged_records"`
+	LinkedRecords   int                `json:"linked_records"`
+	SkippedRecords  int                `json:"skipped_records"`
+	RolledBack      bool               `json:"rolled_back"`
+	DryRun          bool               `json:"dry_run"`
+}
+
+// HasErrors reports whether any file of the bundle failed or had row errors
+func (r *BundleResult) HasErrors() bool {
+	for _, file := range r.Files {
+		if file.Error != "" || (file.Result != nil && len(file.Result.Errors) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// Totals sums the results of the bundle's files into a single upload result.
+// Errors are prefixed with the name of the file they came from.
+func (r *BundleResult) Totals() *UploadResult {
+	totals := &UploadResult{
+		TotalRecords:    r.TotalRecords,
+		InsertedRecords: r.InsertedRecords,
+		UpdatedRecords:  r.UpdatedRecords,
+		StagedRecords:   r.StagedRecords,
+		LinkedRecords:   r.LinkedRecords,
+		SkippedRecords:  r.SkippedRecords,
+		RolledBack:      r.RolledBack,
+		DryRun:          r.DryRun,
+		Errors:          make([]string, 0),
+		RowErrors:       make([]RowError, 0),
+		Warnings:        make([]RowError, 0),
+	}
+
+	for _, file := range r.Files {
+		if file.Error != "" {
+			totals.Errors = append(totals.Errors, fmt.Sprintf("%s: %s", file.File, file.Error))
+		}
+		if file.Result == nil {
+			continue
+		}
+		totals.ProcessedRecords += file.Result.ProcessedRecords
+		for _, message := range file.Result.Errors {
+			totals.Errors = append(totals.Errors, fmt.Sprintf("%s: %s", file.File, message))
+		}
+		totals.RowErrors = append(totals.RowErrors, file.Result.RowErrors...)
+		totals.Warnings = append(totals.Warnings, file.Result.Warnings...)
+	}
+
+	return totals
+}
+
+// bundleSource is one table of a bundle: a CSV file in a ZIP or a sheet of
+// a workbook
+type bundleSource struct {
+	name string
+	open func() (rowReader, io.Closer, error)
+}
+
+// bundleFile is a table of a bundle that has been matched to an entity
+type bundleFile struct {
+	source bundleSource
+	entity string
+}
+
+// ImportBundle imports a ZIP export holding the main form CSV and the
+// repeat-group CSVs. Files are recognised by name or header and imported
+// parents first, so child rows find the patients from the same bundle.
+func (s *CSVService) ImportBundle(r io.ReaderAt, size int64, opts ImportOptions) (*BundleResult, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading ZIP file: %v", ErrInvalidBundle, err)
+	}
+
+	sources := make([]bundleSource, 0)
+	ignored := make([]string, 0)
+	for _, f := range archive.File {
+		f := f
+		name := f.Name
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, "__MACOSX/") || strings.ToLower(path.Ext(name)) != ".csv" {
+			ignored = append(ignored, name)
+			continue
+		}
+
+		sources = append(sources, bundleSource{
+			name: name,
+			open: func() (rowReader, io.Closer, error) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, nil, err
+				}
+				reader := csv.NewReader(rc)
+				reader.FieldsPerRecord = -1
+				return reader, rc, nil
+			},
+		})
+	}
+
+	return s.importBundleSources(sources, ignored, opts)
+}
+
+// UploadFile is an uploaded file that can be streamed or read at an offset,
+// as needed for ZIP and XLSX files
+type UploadFile interface {
+	io.Reader
+	io.ReaderAt
+}
+
+// IsWorkbook reports whether an uploaded file is an Excel workbook
+func IsWorkbook(filename string) bool {
+	return strings.ToLower(path.Ext(filename)) == ".xlsx"
+}
+
+// ImportUpload imports an uploaded CSV file or Excel workbook for entity, or
+// a WHONET result file
+func (s *CSVService) ImportUpload(entity, filename string, file UploadFile, size int64, opts ImportOptions) (*UploadResult, error) {
+	if entity == JobEntityWhonet {
+		return s.ImportWhonet(file, opts)
+	}
+	if IsWorkbook(filename) {
+		return s.ImportWorkbookSheet(entity, file, size, opts)
+	}
+	return s.Import(entity, file, opts)
+}
+
+// ImportUploadBundle imports an uploaded ZIP bundle or Excel workbook
+func (s *CSVService) ImportUploadBundle(filename string, file io.ReaderAt, size int64, opts ImportOptions) (*BundleResult, error) {
+	if IsWorkbook(filename) {
+		return s.ImportWorkbook(file, size, opts)
+	}
+	return s.ImportBundle(file, size, opts)
+}
+
+// ImportWorkbook imports an Excel workbook with one sheet per table, such as
+// "patients", "antibiotics" and "specimens". Sheets are recognised like the
+// files of a ZIP bundle.
+func (s *CSVService) ImportWorkbook(r io.ReaderAt, size int64, opts ImportOptions) (*BundleResult, error) {
+	wb, err := openXLSX(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+
+	return s.importBundleSources(wb.sources(), make([]string, 0), opts)
+}
+
+// ImportWorkbookSheet imports the sheet of a workbook holding entity: the only
+// sheet, or the sheet recognised as entity when there are several
+func (s *CSVService) ImportWorkbookSheet(entity string, r io.ReaderAt, size int64, opts ImportOptions) (*UploadResult, error) {
+	spec, ok := importSpecs[entity]
+	if !ok {
+		return newUploadResult(false), fmt.Errorf("unknown import entity %q", entity)
+	}
+
+	wb, err := openXLSX(r, size)
+	if err != nil {
+		return newUploadResult(false), err
+	}
+
+	sources := wb.sources()
+	source := sources[0]
+	if len(sources) > 1 {
+		found := false
+		for _, candidate := range sources {
+			if detected, err := s.detectBundleEntity(candidate, opts); err == nil && detected == entity {
+				source, found = candidate, true
+				break
+			}
+		}
+		if !found {
+			return newUploadResult(false), fmt.Errorf("%w: no sheet in the workbook holds %s", ErrColumnMapping, entity)
+		}
+	}
+
+	reader, closer, err := source.open()
+	if err != nil {
+		return newUploadResult(false), err
+	}
+	defer closer.Close()
+
+	log.Printf("Importing sheet %s as %s", source.name, entity)
+	return s.importWith(spec, opts, func(db *gorm.DB, opts ImportOptions) (*UploadResult, error) {
+		return s.importTable(db, spec, reader, opts)
+	})
+}
+
+// sources returns a bundle source for each sheet of the workbook
+func (wb *xlsxWorkbook) sources() []bundleSource {
+	sources := make([]bundleSource, 0, len(wb.sheets))
+	for _, sheet := range wb.sheets {
+		sheet := sheet
+		sources = append(sources, bundleSource{
+			name: sheet.name,
+			open: func() (rowReader, io.Closer, error) {
+				rows, err := wb.rows(sheet)
+				if err != nil {
+					return nil, nil, err
+				}
+				return rows, rows, nil
+			},
+		})
+	}
+	return sources
+}
+
+// importBundleSources recognises the tables of a bundle and imports them in order
+func (s *CSVService) importBundleSources(sources []bundleSource, ignored []string, opts ImportOptions) (*BundleResult, error) {
+	opts, err := normalizeOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BundleResult{
+		Files:   make([]BundleFileResult, 0),
+		Ignored: ignored,
+		DryRun:  opts.DryRun,
+	}
+
+	files := make(map[string]bundleSource)
+	for _, source := range sources {
+		entity, err := s.detectBundleEntity(source, opts)
+		if err != nil {
+			log.Printf("Ignoring bundle file %s: %v", source.name, err)
+			result.Ignored = append(result.Ignored, source.name)
+			continue
+		}
+		if other, ok := files[entity]; ok {
+			return nil, fmt.Errorf("%w: both %s and %s contain %s", ErrInvalidBundle, other.name, source.name, entity)
+		}
+		files[entity] = source
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: no recognised tables in bundle", ErrInvalidBundle)
+	}
+
+	return s.importEntitySources(files, result, opts)
+}
+
+// importEntitySources imports tables already matched to their entities,
+// parents first, adding the outcome of each to result
+func (s *CSVService) importEntitySources(files map[string]bundleSource, result *BundleResult, opts ImportOptions) (*BundleResult, error) {
+	ordered := make([]bundleFile, 0, len(files))
+	for _, entity := range bundleOrder {
+		if source, ok := files[entity]; ok {
+			ordered = append(ordered, bundleFile{source: source, entity: entity})
+		}
+	}
+
+	if !opts.Atomic || opts.DryRun {
+		s.importBundleFiles(s.db, ordered, opts, result)
+		return result, nil
+	}
+
+	// Atomic mode covers the whole bundle: if any file fails nothing is kept
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		s.importBundleFiles(tx, ordered, opts, result)
+		if result.HasErrors() {
+			return errRollbackImport
+		}
+		return nil
+	})
+	if err == errRollbackImport {
+		log.Printf("Rolled back bundle import")
+		result.RolledBack = true
+		result.SkippedRecords = result.TotalRecords
+		result.InsertedRecords = 0
+		result.UpdatedRecords = 0
+		result.StagedRecords = 0
+		result.LinkedRecords = 0
+		return result, nil
+	}
+
+	return result, err
+}
+
+// importBundleFiles imports the files of a bundle in order through db
+func (s *CSVService) importBundleFiles(db *gorm.DB, files []bundleFile, opts ImportOptions, result *BundleResult) {
+	// Files are imported one by one, so atomic rollback is handled by the
+	// bundle transaction instead of per file
+	opts.Atomic = false
+	progress := opts.Progress
+
+	for _, bf := range files {
+		fileResult := BundleFileResult{File: bf.source.name, Entity: bf.entity}
+
+		// Report progress as totals across the files imported so far
+		fileOpts := opts
+		if progress != nil {
+			fileOpts.Progress = func(current *UploadResult) {
+				totals := result.Totals()
+				totals.merge(current)
+				totals.TotalRecords += current.TotalRecords
+				totals.ProcessedRecords += current.ProcessedRecords
+				progress(totals)
+			}
+		}
+
+		uploadResult, err := s.importBundleFile(db, bf, fileOpts)
+		if err != nil {
+			fileResult.Error = err.Error()
+		} else {
+			fileResult.Result = uploadResult
+			result.TotalRecords += uploadResult.TotalRecords
+			result.InsertedRecords += uploadResult.InsertedRecords
+			result.UpdatedRecords += uploadResult.UpdatedRecords
+			result.StagedRecords += uploadResult.StagedRecords
+			result.LinkedRecords += uploadResult.LinkedRecords
+			result.SkippedRecords += uploadResult.SkippedRecords
+		}
+
+		result.Files = append(result.Files, fileResult)
+	}
+}
+
+// importBundleFile imports one file of a bundle
+func (s *CSVService) importBundleFile(db *gorm.DB, bf bundleFile, opts ImportOptions) (*UploadResult, error) {
+	reader, closer, err := bf.source.open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", bf.source.name, err)
+	}
+	defer closer.Close()
+
+	log.Printf("Importing %s from bundle as %s", bf.source.name, bf.entity)
+	return s.importTable(db, importSpecs[bf.entity], reader, opts)
+}
+
+// detectBundleEntity works out which entity a bundle file holds. The main
+// form file is the one whose header maps onto patients and has no parent key
+// column; repeat-group files are recognised by name.
+func (s *CSVService) detectBundleEntity(source bundleSource, opts ImportOptions) (string, error) {
+	reader, closer, err := source.open()
+	if err != nil {
+		return "", err
+	}
+	header, err := reader.Read()
+	closer.Close()
+	if err != nil {
+		return "", fmt.Errorf("error reading header: %v", err)
+	}
+
+	profile, err := s.importProfile(opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Every repeat group has a parent key, so optional vars resolve on any of them
+	if _, err := profile.Resolve(EntityOptionalVars, header); err != nil {
+		if _, err := profile.Resolve(EntityPatients, header); err != nil {
+			return "", err
+		}
+		return EntityPatients, nil
+	}
+
+	// Only the part after the form name identifies a repeat group
+	base := strings.TrimSuffix(path.Base(source.name), path.Ext(source.name))
+	if i := strings.LastIndex(base, "-"); i >= 0 {
+		base = base[i+1:]
+	}
+	name := normalizeHeader(base)
+	for _, candidate := range bundleFileNames {
+		if strings.Contains(name, candidate.fragment) {
+			return candidate.entity, nil
+		}
+	}
+
+	return "", fmt.Errorf("unrecognised repeat group file name")
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// recordingDB is a database that stores nothing: every query returns no rows
+// and every statement succeeds. It records the statements it was sent, so a
+// test can check what an import wrote and whether it was committed.
+type recordingDB struct {
+	mu         sync.Mutex
+	statements []string
+}
+
+func (db *recordingDB) record(statement string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.statements = append(db.statements, statement)
+}
+
+// Statements returns the recorded statements starting with one of prefixes
+func (db *recordingDB) Statements(prefixes ...string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	found := make([]string, 0)
+	for _, statement := range db.statements {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(statement, prefix) {
+				found = append(found, statement)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func (db *recordingDB) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{db: db}, nil
+}
+func (db *recordingDB) Driver() driver.Driver { return nil }
+
+type recordingConn struct {
+	db *recordingDB
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c *recordingConn) Close() error                             { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error)                { c.db.record("BEGIN"); return c, nil }
+func (c *recordingConn) Commit() error                            { c.db.record("COMMIT"); return nil }
+func (c *recordingConn) Rollback() error                          { c.db.record("ROLLBACK"); return nil }
+func (c *recordingConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query)
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string         { return nil }
+func (emptyRows) Close() error              { return nil }
+func (emptyRows) Next([]driver.Value) error { return io.EOF }
+
+// newRecordingService returns a CSVService with the default mappings writing
+// to a recordingDB
+func newRecordingService(t *testing.T) (*CSVService, *recordingDB) {
+	t.Helper()
+
+	recorder := &recordingDB{}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(recorder)}), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+
+	mappings, err := LoadMappingRegistry("")
+	if err != nil {
+		t.Fatalf("LoadMappingRegistry: %v", err)
+	}
+	return &CSVService{db: db, mappings: mappings, batchSize: 100, timezone: "UTC"}, recorder
+}
+
+// buildZip returns a ZIP holding files, in the order given
+func buildZip(t *testing.T, files ...[2]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := archive.Create(file[0])
+		if err != nil {
+			t.Fatalf("create %s: %v", file[0], err)
+		}
+		if _, err := io.WriteString(w, file[1]); err != nil {
+			t.Fatalf("write %s: %v", file[0], err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("close ZIP: %v", err)
+	}
+	return buf.Bytes()
+}
+
+const (
+	bundlePatients    = "KEY,facility,survey_date\nuuid:p1,Mulago,2024-05-01\nuuid:p2,Mulago,2024-05-01\n"
+	bundleAntibiotics = "KEY,PARENT_KEY,antibiotic_inn_name\nuuid:p1/Antibioticform[1],uuid:p1,Ceftriaxone\nuuid:p2/Antibioticform[1],uuid:p2,Amoxicillin\n"
+	bundleSpecimens   = "KEY,PARENT_KEY,specimen_type\nuuid:p1/Specimens[1],uuid:p1,Blood\n"
+	bundleOptional    = "PARENT_KEY,prescriber_type\nuuid:p1/Antibioticform[1],Doctor\n"
+)
+
+func TestDetectBundleEntity(t *testing.T) {
+	s, _ := newRecordingService(t)
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "main form by header", file: "PPS_Form.csv", content: bundlePatients, want: EntityPatients},
+		{name: "main form with any name", file: "export/data.csv", content: bundlePatients, want: EntityPatients},
+		{name: "antibiotic repeat", file: "PPS_Form-Antibioticform.csv", content: bundleAntibiotics, want: EntityAntibiotics},
+		{name: "antibiotic details before antibiotics", file: "PPS_Form-AB_details.csv", content: bundleOptional, want: EntityAntibioticDetails},
+		{name: "optional variables", file: "PPS_Form-Optional_vars.csv", content: bundleOptional, want: EntityOptionalVars},
+		{name: "microbiology repeat", file: "PPS_Form-Microbiology.csv", content: bundleSpecimens, want: EntitySpecimens},
+		{name: "indications", file: "PPS_Form-Indications.csv", content: "KEY,PARENT_KEY\nuuid:p1/Indications[1],uuid:p1\n", want: EntityIndications},
+		{name: "only the repeat part of the name counts", file: "Antibiotic_PPS-Specimens.csv", content: bundleSpecimens, want: EntitySpecimens},
+		{name: "unknown repeat group", file: "PPS_Form-Vitals.csv", content: "KEY,PARENT_KEY\nuuid:p1/Vitals[1],uuid:p1\n", wantErr: true},
+		{name: "no key column", file: "notes.csv", content: "note\nhello\n", wantErr: true},
+		{name: "empty file", file: "empty.csv", content: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := bundleSource{
+				name: tt.file,
+				open: func() (rowReader, io.Closer, error) {
+					reader := csv.NewReader(strings.NewReader(tt.content))
+					reader.FieldsPerRecord = -1
+					return reader, io.NopCloser(nil), nil
+				},
+			}
+			got, err := s.detectBundleEntity(source, ImportOptions{})
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("detectBundleEntity(%s) = %q, %v, want %q", tt.file, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportBundle(t *testing.T) {
+	bundle := buildZip(t,
+		[2]string{"PPS_Form-Microbiology.csv", bundleSpecimens},
+		[2]string{"PPS_Form-Antibioticform.csv", bundleAntibiotics},
+		[2]string{"README.txt", "exported from ODK Central"},
+		[2]string{"PPS_Form-Vitals.csv", "KEY,PARENT_KEY\nuuid:p1/Vitals[1],uuid:p1\n"},
+		[2]string{"PPS_Form.csv", bundlePatients},
+	)
+
+	s, db := newRecordingService(t)
+	result, err := s.ImportBundle(bytes.NewReader(bundle), int64(len(bundle)), ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportBundle: %v", err)
+	}
+
+	// Parents are imported first, whatever the order of the ZIP
+	files := make([]string, 0, len(result.Files))
+	for _, file := range result.Files {
+		files = append(files, file.Entity)
+		if file.Error != "" || file.Result == nil {
+			t.Errorf("%s: %s", file.File, file.Error)
+		}
+	}
+	if want := []string{EntityPatients, EntityAntibiotics, EntitySpecimens}; !reflect.DeepEqual(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+	if want := []string{"README.txt", "PPS_Form-Vitals.csv"}; !reflect.DeepEqual(result.Ignored, want) {
+		t.Errorf("ignored = %v, want %v", result.Ignored, want)
+	}
+
+	inserts := db.Statements("INSERT INTO")
+	tables := make([]string, 0)
+	for _, statement := range inserts {
+		table := strings.Fields(statement)[2]
+		if len(tables) == 0 || tables[len(tables)-1] != table {
+			tables = append(tables, table)
+		}
+	}
+	if want := []string{`"patients"`, `"orphan_rows"`}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("tables written = %v, want %v", tables, want)
+	}
+
+	// The database stores nothing, so child rows do not find their patients
+	// and are staged until they arrive
+	if result.TotalRecords != 5 || result.InsertedRecords != 2 || result.StagedRecords != 3 || result.SkippedRecords != 0 {
+		t.Errorf("totals = %d total, %d inserted, %d staged, %d skipped, want 5, 2, 3, 0",
+			result.TotalRecords, result.InsertedRecords, result.StagedRecords, result.SkippedRecords)
+	}
+	totals := result.Totals()
+	if totals.TotalRecords != 5 || totals.ProcessedRecords != 5 || totals.InsertedRecords != 2 || len(totals.Errors) != 0 {
+		t.Errorf("Totals() = %+v", totals)
+	}
+	if result.HasErrors() || result.RolledBack {
+		t.Errorf("result has errors or was rolled back: %+v", result)
+	}
+}
+
+func TestImportBundleDuplicateEntity(t *testing.T) {
+	bundle := buildZip(t,
+		[2]string{"PPS_Form.csv", bundlePatients},
+		[2]string{"PPS_Form-Antibioticform.csv", bundleAntibiotics},
+		[2]string{"copy/PPS_Form-Antibiotics.csv", bundleAntibiotics},
+	)
+
+	s, db := newRecordingService(t)
+	_, err := s.ImportBundle(bytes.NewReader(bundle), int64(len(bundle)), ImportOptions{})
+	if !errors.Is(err, ErrInvalidBundle) || !strings.Contains(err.Error(), "both PPS_Form-Antibioticform.csv and copy/PPS_Form-Antibiotics.csv") {
+		t.Errorf("error = %v, want both antibiotic files named", err)
+	}
+	if len(db.Statements("INSERT")) != 0 {
+		t.Errorf("a rejected bundle wrote %v", db.Statements("INSERT"))
+	}
+
+	if _, err := s.ImportBundle(bytes.NewReader([]byte("not a zip")), 9, ImportOptions{}); !errors.Is(err, ErrInvalidBundle) {
+		t.Errorf("error for a file that is not a ZIP = %v, want ErrInvalidBundle", err)
+	}
+	empty := buildZip(t, [2]string{"README.txt", "nothing here"})
+	if _, err := s.ImportBundle(bytes.NewReader(empty), int64(len(empty)), ImportOptions{}); !errors.Is(err, ErrInvalidBundle) {
+		t.Errorf("error for a bundle without tables = %v, want ErrInvalidBundle", err)
+	}
+}
+
+func TestImportBundleAtomic(t *testing.T) {
+	// The second antibiotic has no key, which fails the whole bundle
+	antibiotics := "KEY,PARENT_KEY,antibiotic_inn_name\nuuid:p1/Antibioticform[1],uuid:p1,Ceftriaxone\n,uuid:p2,Amoxicillin\n"
+	bundle := buildZip(t,
+		[2]string{"PPS_Form.csv", bundlePatients},
+		[2]string{"PPS_Form-Antibioticform.csv", antibiotics},
+	)
+
+	s, db := newRecordingService(t)
+	result, err := s.ImportBundle(bytes.NewReader(bundle), int64(len(bundle)), ImportOptions{Atomic: true})
+	if err != nil {
+		t.Fatalf("ImportBundle: %v", err)
+	}
+
+	if !result.RolledBack || !result.HasErrors() {
+		t.Errorf("result = %+v, want it rolled back with errors", result)
+	}
+	if result.TotalRecords != 4 || result.SkippedRecords != 4 || result.InsertedRecords != 0 || result.StagedRecords != 0 {
+		t.Errorf("totals = %d total, %d skipped, %d inserted, %d staged, want every row skipped",
+			result.TotalRecords, result.SkippedRecords, result.InsertedRecords, result.StagedRecords)
+	}
+	totals := result.Totals()
+	if len(totals.Errors) != 1 || !strings.HasPrefix(totals.Errors[0], "PPS_Form-Antibioticform.csv: Row 3") {
+		t.Errorf("errors = %q, want the antibiotic row prefixed with its file", totals.Errors)
+	}
+
+	// The patients were written inside the bundle transaction, which was
+	// rolled back rather than committed
+	transaction := db.Statements("BEGIN", "COMMIT", "ROLLBACK")
+	if len(transaction) == 0 || transaction[0] != "BEGIN" || transaction[len(transaction)-1] != "ROLLBACK" {
+		t.Errorf("transaction = %v, want it rolled back", transaction)
+	}
+	if commits := db.Statements("COMMIT"); len(commits) != 0 {
+		t.Errorf("atomic bundle committed %d times", len(commits))
+	}
+	if len(db.Statements(`INSERT INTO "patients"`)) == 0 {
+		t.Error("patients were not written before the rollback")
+	}
+}
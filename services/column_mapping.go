@@ -0,0 +1,529 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Entity names used to look up column mappings. They match the table names.
+const (
+	EntityPatients          = "patients"
+	EntityAntibiotics       = "antibiotics"
+	EntityAntibioticDetails = "antibiotic_details"
+	EntityIndications       = "indications"
+	EntityOptionalVars      = "optional_vars"
+	EntitySpecimens         = "specimens"
+)
+
+// DefaultMappingVersion is the version of the built-in mapping profile
+const DefaultMappingVersion = "default"
+
+// AnyFormVersion in a profile's form versions matches rows of any ODK form
+// version that no other profile lists
+const AnyFormVersion = "*"
+
+// ErrColumnMapping is wrapped by errors caused by a header row that does not
+// satisfy the selected mapping profile
+var ErrColumnMapping = errors.New("column mapping error")
+
+// EntityMapping maps model fields (database column names) to the header
+// names they may appear under in an export
+type EntityMapping struct {
+	Columns  map[string][]string `json:"columns"`
+	Required []string            `json:"required"`
+}
+
+// MappingProfile is a versioned set of column mappings, one per entity
+type MappingProfile struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+	// FormVersions are the ODK form versions whose rows are read with this
+	// profile
+	FormVersions []string                 `json:"form_versions,omitempty"`
+	Entities     map[string]EntityMapping `json:"entities"`
+	// Values maps the raw values of categorical fields, as coded by the form
+	// versions of this profile, to canonical codes
+	Values map[string]map[string]string `json:"values,omitempty"`
+
+	// codings holds Values by field and value key
+	codings map[string]map[string]string
+}
+
+// MappingRegistry holds all mapping profiles known to the importer
+type MappingRegistry struct {
+	DefaultVersion string
+	profiles       map[string]*MappingProfile
+}
+
+// mappingFile is the on-disk format of a mapping profiles config file
+type mappingFile struct {
+	DefaultVersion string           `json:"default_version"`
+	Profiles       []MappingProfile `json:"profiles"`
+}
+
+// ColumnMap resolves field names to column indexes for one header row
+type ColumnMap struct {
+	Entity   string
+	Version  string
+	Header   []string
+	Unmapped []string
+	index    map[string]int
+	profile  *MappingProfile
+}
+
+// defaultEntityMappings lists every field the importers understand together
+// with the header names used by the ODK Central exports of the PPS form.
+// Header names are matched case-insensitively, ignoring punctuation and any
+// ODK group prefix (e.g. "Core_variables-region" matches "region").
+var defaultEntityMappings = map[string]EntityMapping{
+	EntityPatients: {
+		Columns: map[string][]string{
+			"submission_date":              {"SubmissionDate"},
+			"region":                       {"region"},
+			"district":                     {"district"},
+			"subcounty":                    {"subcounty", "sub_county"},
+			"facility":                     {"facility"},
+			"level_of_care":                {"level_of_care", "LevelOfCare"},
+			"ownership":                    {"ownership"},
+			"ward_name":                    {"ward_name", "ward"},
+			"ward_total_patients":          {"ward_total_patients"},
+			"ward_eligible_patients":       {"ward_eligible_patients"},
+			"survey_date":                  {"survey_date"},
+			"patient_initials":             {"patient_initials"},
+			"code":                         {"code"},
+			"rand_num":                     {"rand_num"},
+			"patient_code":                 {"patient_code"},
+			"show_code":                    {"show_code"},
+			"is_the_patient_an_infant":     {"is_the_patient_an_infant"},
+			"age_months":                   {"age_months"},
+			"age_years":                    {"age_years"},
+			"pre_term_birth":               {"pre_term_birth"},
+			"gender":                       {"gender", "sex"},
+			"weight":                       {"weight"},
+			"weight_birth_kg":              {"weight_birth_kg"},
+			"admission_date":               {"admission_date"},
+			"surgery_since_admission":      {"surgery_since_admission"},
+			"urinary_catheter":             {"urinary_catheter"},
+			"peripheral_vascular_catheter": {"peripheral_vascular_catheter"},
+			"central_vascular_catheter":    {"central_vascular_catheter"},
+			"intubation":                   {"intubation"},
+			"patient_on_antibiotic":        {"patient_on_antibiotic"},
+			"patient_number_antibiotics":   {"patient_number_antibiotics"},
+			"malaria_status":               {"malaria_status"},
+			"tuberculosis_status":          {"tuberculosis_status"},
+			"hiv_status":                   {"hiv_status"},
+			"hiv_on_art":                   {"hiv_on_art"},
+			"hiv_cd4_count":                {"hiv_cd4_count"},
+			"hiv_viral_load":               {"hiv_viral_load"},
+			"diabetes":                     {"diabetes"},
+			"malnutrition_status":          {"malnutrition_status"},
+			"hypertension":                 {"hypertension"},
+			"referred_from":                {"referred_from"},
+			"hospitalization_90_days":      {"hospitalization_90_days"},
+			"type_surgery_since_admission": {"type_surgery_since_admission"},
+			"additional_comment":           {"additional_comment"},
+			"comments":                     {"comments"},
+			"instance_id":                  {"instanceID", "instance_id", "KEY"},
+			"submitter_id":                 {"SubmitterID"},
+			"submitter_name":               {"SubmitterName"},
+			"attachments_present":          {"AttachmentsPresent"},
+			"attachments_expected":         {"AttachmentsExpected"},
+			"status":                       {"Status"},
+			"review_state":                 {"ReviewState"},
+			"device_id":                    {"DeviceID"},
+			"edits":                        {"Edits"},
+			"form_version":                 {"FormVersion"},
+		},
+		Required: []string{"instance_id"},
+	},
+	EntityAntibiotics: {
+		Columns: map[string][]string{
+			"antibiotic_notes":                {"antibiotic_notes", "AntibioticNotes"},
+			"antibiotic_inn_name":             {"antibiotic_inn_name", "AntibioticINNName", "inn_name"},
+			"other_antibiotic":                {"other_antibiotic"},
+			"atc_code":                        {"atc_code"},
+			"antibiotic_class":                {"antibiotic_class"},
+			"antibiotic_aware_classification": {"antibiotic_aware_classification", "aware_classification"},
+			"antibiotic_written_in_inn":       {"antibiotic_written_in_inn"},
+			"start_date_antibiotic":           {"start_date_antibiotic"},
+			"unit_dose":                       {"unit_dose"},
+			"unit_doses_combination":          {"unit_doses_combination"},
+			"unit_dose_measure_unit":          {"unit_dose_measure_unit"},
+			"unit_dose_frequency":             {"unit_dose_frequency"},
+			"administration_route":            {"administration_route", "route"},
+			"parent_key":                      {"PARENT_KEY"},
+			"key":                             {"KEY"},
+		},
+		Required: []string{"key", "parent_key"},
+	},
+	EntityAntibioticDetails: {
+		Columns: map[string][]string{
+			"prescriber":    {"prescriber"},
+			"intraveno":     {"intraveno"},
+			"oral_switch":   {"oral_switch"},
+			"number_missed": {"number_missed"},
+			"missed_dose":   {"missed_dose"},
+			"guideline":     {"guideline"},
+			"treatment":     {"treatment"},
+			"parent_key":    {"PARENT_KEY"},
+		},
+		Required: []string{"parent_key"},
+	},
+	EntityIndications: {
+		Columns: map[string][]string{
+			"indication_type":      {"indication_type", "indication"},
+			"surg_proph_duration":  {"surg_proph_duration"},
+			"surg_proph_site":      {"surg_proph_site"},
+			"diagnosis":            {"diagnosis"},
+			"start_date_treatment": {"start_date_treatment"},
+			"reason_in_notes":      {"reason_in_notes"},
+			"culture_sample_taken": {"culture_sample_taken"},
+			"parent_key":           {"PARENT_KEY"},
+			"key":                  {"KEY"},
+		},
+		Required: []string{"key", "parent_key"},
+	},
+	EntityOptionalVars: {
+		Columns: map[string][]string{
+			"prescriber_type":       {"prescriber_type", "prescriber"},
+			"intravenous_type":      {"intravenous_type", "intraveno"},
+			"oral_switch":           {"oral_switch"},
+			"number_missed_doses":   {"number_missed_doses", "number_missed"},
+			"missed_doses_reason":   {"missed_doses_reason", "missed_dose"},
+			"guidelines_compliance": {"guidelines_compliance", "guideline"},
+			"treatment_type":        {"treatment_type", "treatment"},
+			"parent_key":            {"PARENT_KEY"},
+		},
+		Required: []string{"parent_key"},
+	},
+	EntitySpecimens: {
+		Columns: map[string][]string{
+			"specimen_type":                          {"specimen_type", "specimen"},
+			"culture_result":                         {"culture_result"},
+			"microorganism":                          {"microorganism"},
+			"antibiotic_susceptibility_test_results": {"antibiotic_susceptibility_test_results", "antibiotic_susceptibility"},
+			"resistant_phenotype":                    {"resistant_phenotype"},
+			"parent_key":                             {"PARENT_KEY"},
+			"key":                                    {"KEY"},
+		},
+		Required: []string{"key", "parent_key"},
+	},
+}
+
+// DefaultMappingProfile returns the built-in mapping profile
+func DefaultMappingProfile() *MappingProfile {
+	return &MappingProfile{
+		Version:      DefaultMappingVersion,
+		Description:  "Built-in mapping for the ODK Central PPS form exports",
+		FormVersions: []string{AnyFormVersion},
+		Entities:     defaultEntityMappings,
+	}
+}
+
+// LoadMappingRegistry returns the built-in profile plus any profiles defined
+// in the JSON file at path. An empty path loads only the built-in profile.
+func LoadMappingRegistry(path string) (*MappingRegistry, error) {
+	registry := &MappingRegistry{
+		DefaultVersion: DefaultMappingVersion,
+		profiles: map[string]*MappingProfile{
+			DefaultMappingVersion: DefaultMappingProfile(),
+		},
+	}
+
+	if path == "" {
+		return registry, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mapping profiles file: %v", err)
+	}
+
+	var file mappingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing mapping profiles file %s: %v", path, err)
+	}
+
+	for i := range file.Profiles {
+		profile := file.Profiles[i]
+		if err := registry.Register(&profile); err != nil {
+			return nil, err
+		}
+	}
+
+	if file.DefaultVersion != "" {
+		if _, ok := registry.profiles[file.DefaultVersion]; !ok {
+			return nil, fmt.Errorf("default mapping version %q is not defined", file.DefaultVersion)
+		}
+		registry.DefaultVersion = file.DefaultVersion
+	}
+
+	return registry, nil
+}
+
+// Register validates a profile and adds it to the registry. Entities the
+// profile does not mention fall back to the built-in mapping.
+func (r *MappingRegistry) Register(profile *MappingProfile) error {
+	if profile.Version == "" {
+		return fmt.Errorf("mapping profile is missing a version")
+	}
+
+	for entity, mapping := range profile.Entities {
+		defaults, ok := defaultEntityMappings[entity]
+		if !ok {
+			return fmt.Errorf("mapping profile %s: unknown entity %q", profile.Version, entity)
+		}
+		for field := range mapping.Columns {
+			if _, ok := defaults.Columns[field]; !ok {
+				return fmt.Errorf("mapping profile %s: unknown column %q for %s", profile.Version, field, entity)
+			}
+		}
+		for _, field := range mapping.Required {
+			if _, ok := defaults.Columns[field]; !ok {
+				return fmt.Errorf("mapping profile %s: unknown required column %q for %s", profile.Version, field, entity)
+			}
+			if _, ok := mapping.Columns[field]; !ok {
+				return fmt.Errorf("mapping profile %s: required column %q for %s has no header names", profile.Version, field, entity)
+			}
+		}
+	}
+
+	profile.codings = make(map[string]map[string]string)
+	for field, values := range profile.Values {
+		if _, ok := categoricalFields[field]; !ok {
+			return fmt.Errorf("mapping profile %s: value coding for %q, which is not a categorical column", profile.Version, field)
+		}
+		coding := make(map[string]string)
+		for value, code := range values {
+			coding[valueKey(value)] = code
+		}
+		profile.codings[field] = coding
+	}
+
+	for _, formVersion := range profile.FormVersions {
+		if formVersion == "" {
+			return fmt.Errorf("mapping profile %s: empty form version", profile.Version)
+		}
+		if formVersion == AnyFormVersion {
+			continue
+		}
+		for _, other := range r.profiles {
+			if other.Version != profile.Version && other.hasFormVersion(formVersion) {
+				return fmt.Errorf("mapping profile %s: form version %q is already read by profile %s", profile.Version, formVersion, other.Version)
+			}
+		}
+	}
+
+	if profile.Entities == nil {
+		profile.Entities = make(map[string]EntityMapping)
+	}
+	for entity, mapping := range defaultEntityMappings {
+		if _, ok := profile.Entities[entity]; !ok {
+			profile.Entities[entity] = mapping
+		}
+	}
+
+	r.profiles[profile.Version] = profile
+	return nil
+}
+
+// Profile returns the profile for version, or the default profile when
+// version is empty
+func (r *MappingRegistry) Profile(version string) (*MappingProfile, error) {
+	if version == "" {
+		version = r.DefaultVersion
+	}
+	profile, ok := r.profiles[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown mapping version %q", ErrColumnMapping, version)
+	}
+	return profile, nil
+}
+
+// ForFormVersion returns the profile that reads rows of an ODK form version:
+// the profile listing it, or else a profile listing AnyFormVersion, the
+// default profile first. Rows without a form version use the default profile.
+func (r *MappingRegistry) ForFormVersion(formVersion string) (*MappingProfile, error) {
+	if formVersion == "" {
+		return r.Profile("")
+	}
+
+	for _, version := range r.Versions() {
+		if r.profiles[version].hasFormVersion(formVersion) {
+			return r.profiles[version], nil
+		}
+	}
+
+	if r.profiles[r.DefaultVersion].hasFormVersion(AnyFormVersion) {
+		return r.profiles[r.DefaultVersion], nil
+	}
+	for _, version := range r.Versions() {
+		if r.profiles[version].hasFormVersion(AnyFormVersion) {
+			return r.profiles[version], nil
+		}
+	}
+
+	return nil, fmt.Errorf("form version %q has no mapping profile (registered form versions: %s)", formVersion, strings.Join(r.FormVersions(), ", "))
+}
+
+// FormVersions returns the form versions listed by any profile, in sorted order
+func (r *MappingRegistry) FormVersions() []string {
+	versions := make([]string, 0)
+	for _, profile := range r.profiles {
+		for _, formVersion := range profile.FormVersions {
+			if formVersion != AnyFormVersion {
+				versions = append(versions, formVersion)
+			}
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Versions returns the registered profile versions in sorted order
+func (r *MappingRegistry) Versions() []string {
+	versions := make([]string, 0, len(r.profiles))
+	for version := range r.profiles {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// hasFormVersion reports whether the profile lists formVersion
+func (p *MappingProfile) hasFormVersion(formVersion string) bool {
+	for _, v := range p.FormVersions {
+		if v == formVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve matches the header row of an export against the profile's mapping
+// for entity and returns the resulting column map
+func (p *MappingProfile) Resolve(entity string, header []string) (*ColumnMap, error) {
+	cols, err := p.match(entity, header)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := p.Entities[entity]
+	var missing []string
+	for _, field := range mapping.Required {
+		if _, ok := cols.index[field]; !ok {
+			missing = append(missing, fmt.Sprintf("%s (accepted headers: %s)", field, strings.Join(mapping.Columns[field], ", ")))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: missing required columns for %s: %s", ErrColumnMapping, entity, strings.Join(missing, "; "))
+	}
+
+	return cols, nil
+}
+
+// match maps the columns of a header row onto the fields of entity without
+// checking that the required ones are present
+func (p *MappingProfile) match(entity string, header []string) (*ColumnMap, error) {
+	mapping, ok := p.Entities[entity]
+	if !ok {
+		return nil, fmt.Errorf("mapping profile %s has no mapping for %s", p.Version, entity)
+	}
+
+	cols := &ColumnMap{
+		Entity:  entity,
+		Version: p.Version,
+		Header:  header,
+		index:   make(map[string]int),
+		profile: p,
+	}
+
+	// Build a lookup from normalised header name to field
+	aliases := make(map[string]string)
+	for field, names := range mapping.Columns {
+		aliases[normalizeHeader(field)] = field
+		for _, name := range names {
+			aliases[normalizeHeader(name)] = field
+		}
+	}
+
+	for i, name := range header {
+		field, ok := aliases[normalizeHeader(name)]
+		if !ok {
+			// Fall back to the field name without its ODK group prefix
+			field, ok = aliases[normalizeHeader(headerTail(name))]
+		}
+		if !ok {
+			cols.Unmapped = append(cols.Unmapped, name)
+			continue
+		}
+		if _, exists := cols.index[field]; !exists {
+			cols.index[field] = i
+		}
+	}
+
+	return cols, nil
+}
+
+// Has reports whether the header contained a column for field
+func (m *ColumnMap) Has(field string) bool {
+	_, ok := m.index[field]
+	return ok
+}
+
+// Column returns the header name the file uses for field, or field itself
+// when the column is absent
+func (m *ColumnMap) Column(field string) string {
+	i, ok := m.index[field]
+	if !ok {
+		return field
+	}
+	return m.Header[i]
+}
+
+// Value returns the trimmed value of field in record, or "" when the column
+// is absent from the header or the record is too short
+func (m *ColumnMap) Value(record []string, field string) string {
+	i, ok := m.index[field]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// Code returns the canonical code of a value of a categorical field, first
+// applying the value coding of the profile the columns were resolved with
+func (m *ColumnMap) Code(field, value string) string {
+	if m.profile != nil {
+		if code, ok := m.profile.codings[field][valueKey(value)]; ok {
+			value = code
+		}
+	}
+	return NormalizeValue(field, value)
+}
+
+// normalizeHeader lowercases a header name and strips everything that is not
+// a letter or digit, so "PARENT_KEY", "parent-key" and "ParentKey" compare equal
+func normalizeHeader(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimPrefix(name, "\ufeff")) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// headerTail drops the ODK group path from a header, e.g.
+// "Core_variables-patient_initials" becomes "patient_initials"
+func headerTail(name string) string {
+	if i := strings.LastIndexAny(name, "-/"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
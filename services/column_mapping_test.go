@@ -0,0 +1,93 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestMappings(t *testing.T) *CSVService {
+	t.Helper()
+
+	mappings, err := LoadMappingRegistry("")
+	if err != nil {
+		t.Fatalf("LoadMappingRegistry: %v", err)
+	}
+	err = mappings.Register(&MappingProfile{
+		Version:      "2023",
+		FormVersions: []string{"2023031501"},
+		Entities: map[string]EntityMapping{
+			EntityPatients: {
+				Columns:  map[string][]string{"instance_id": {"uuid"}, "form_version": {"FormVersion"}},
+				Required: []string{"instance_id"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return &CSVService{mappings: mappings}
+}
+
+func TestImportProfile(t *testing.T) {
+	s := newTestMappings(t)
+
+	tests := []struct {
+		name    string
+		opts    ImportOptions
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: DefaultMappingVersion},
+		{name: "mapping version", opts: ImportOptions{MappingVersion: "2023"}, want: "2023"},
+		{name: "form version", opts: ImportOptions{FormVersion: "2023031501"}, want: "2023"},
+		{name: "unlisted form version", opts: ImportOptions{FormVersion: "2024061201"}, want: DefaultMappingVersion},
+		{name: "both", opts: ImportOptions{MappingVersion: "2023", FormVersion: "2023031501"}, wantErr: true},
+		{name: "unknown mapping version", opts: ImportOptions{MappingVersion: "1999"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := s.importProfile(tt.opts)
+			if tt.wantErr {
+				if !errors.Is(err, ErrColumnMapping) {
+					t.Errorf("error = %v, want ErrColumnMapping", err)
+				}
+				return
+			}
+			if err != nil || profile.Version != tt.want {
+				t.Errorf("profile = %v, %v, want %s", profile, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormVersionColumns(t *testing.T) {
+	s := newTestMappings(t)
+
+	// The header of an export holding only 2023 rows lacks the column the
+	// default profile requires, but still selects profiles by form version
+	header := []string{"uuid", "FormVersion", "Core_variables-facility"}
+	if _, err := s.resolveColumns(EntityPatients, header, ImportOptions{}); !errors.Is(err, ErrColumnMapping) {
+		t.Errorf("default profile error = %v, want ErrColumnMapping", err)
+	}
+	cols, ok := s.formVersionColumns(EntityPatients, header)
+	if !ok || cols.Column("form_version") != "FormVersion" {
+		t.Fatalf("formVersionColumns = %v, %v, want the FormVersion column", cols, ok)
+	}
+
+	profile, err := s.mappings.ForFormVersion("2023031501")
+	if err != nil {
+		t.Fatalf("ForFormVersion: %v", err)
+	}
+	resolved, err := profile.Resolve(EntityPatients, header)
+	if err != nil {
+		t.Fatalf("Resolve with the 2023 profile: %v", err)
+	}
+	if got := resolved.Value([]string{"uuid:1", "2023031501", "F1"}, "instance_id"); got != "uuid:1" {
+		t.Errorf("instance_id = %q, want uuid:1", got)
+	}
+
+	if _, ok := s.formVersionColumns(EntityPatients, []string{"KEY", "Core_variables-facility"}); ok {
+		t.Error("formVersionColumns found a form version column in a header without one")
+	}
+}
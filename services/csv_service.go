@@ -1,10 +1,11 @@
 package services
 
 import (
-	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"mime/multipart"
+	"point-prevalence-survey/config"
 	"point-prevalence-survey/database"
 	"point-prevalence-survey/models"
 	"strconv"
@@ -15,1091 +16,719 @@ import (
 )
 
 type CSVService struct {
-	db *gorm.DB
+	db        *gorm.DB
+	mappings  *MappingRegistry
+	rules     *QualityRules
+	batchSize int
+	// timezone is the default zone of dates written without one
+	timezone string
 }
 
-// UploadResult contains statistics about the upload process
-type UploadResult struct {
-	TotalRecords     int      `json:"total_records"`
-	ProcessedRecords int      `json:"processed_records"`
-	SkippedRecords   int      `json:"skipped_records"`
-	InsertedRecords  int      `json:"inserted_records"`
-	UpdatedRecords   int      `json:"updated_records"`
-	Errors           []string `json:"errors"`
-}
-
-func NewCSVService() *CSVService {
-	return &CSVService{
-		db: database.GetDB(),
-	}
+// ImportOptions controls how an uploaded file is imported
+type ImportOptions struct {
+	// MappingVersion selects the column mapping profile; empty uses the default
+	MappingVersion string
+	// FormVersion selects the mapping profile of an ODK form version for the
+	// whole file. Repeat group files carry no form version column, so this is
+	// how their rows get the columns and value codings of their form version.
+	FormVersion string
+	// BatchSize is the number of rows written per transaction; zero uses the configured default
+	BatchSize int
+	// Atomic imports the whole file in a single transaction that is rolled
+	// back if any row fails
+	Atomic bool
+	// DryRun runs every parse and check without writing to the database
+	DryRun bool
+	// MergeStrategy decides what happens to rows whose key already exists;
+	// empty means MergeSkip
+	MergeStrategy string
+	// Progress, if set, is called with the running totals after each batch
+	Progress func(*UploadResult) `json:"-"`
+	// ImportID tags inserted rows with the import job that created them
+	ImportID uint `json:"-"`
+	// DateFormat is the format of date columns, such as "DD/MM/YYYY" or a Go
+	// layout; empty or "auto" detects the day and month order of each value
+	DateFormat string
+	// ColumnDateFormats overrides DateFormat for single columns, by mapping
+	// field or header name
+	ColumnDateFormats map[string]string
+	// Timezone is the IANA zone of dates written without one; empty uses the
+	// configured default
+	Timezone string
+	// AllowInvalid imports rows with dates or numbers that could not be
+	// parsed, leaving those fields zero and reporting them as warnings.
+	// By default such rows are rejected.
+	AllowInvalid bool
 }
 
-func (s *CSVService) ImportPatients(file multipart.File) (*UploadResult, error) {
-	result := &UploadResult{
-		Errors: make([]string, 0),
-	}
+// Merge strategies for rows whose key already exists
+const (
+	// MergeSkip keeps the existing record and skips the row
+	MergeSkip = "skip"
+	// MergeOverwrite replaces the existing record with the row
+	MergeOverwrite = "overwrite"
+	// MergeNewer replaces the existing record only if the row is newer
+	MergeNewer = "newer"
+)
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return result, fmt.Errorf("error reading CSV file: %v", err)
+// ValidMergeStrategy reports whether strategy is a known merge strategy
+func ValidMergeStrategy(strategy string) bool {
+	switch strategy {
+	case "", MergeSkip, MergeOverwrite, MergeNewer:
+		return true
 	}
+	return false
+}
 
-	if len(records) < 2 {
-		return result, fmt.Errorf("CSV file must have at least a header row and one data row")
-	}
+// UploadResult contains statistics about the upload process
+type UploadResult struct {
+	TotalRecords     int `json:"total_records"`
+	ProcessedRecords int `json:"processed_records"`
+	SkippedRecords   int `json:"skipped_records"`
+	InsertedRecords  int `json:"inserted_records"`
+	UpdatedRecords   int `json:"updated_records"`
+	// StagedRecords are child rows kept until their parent patient arrives
+	StagedRecords int `json:"staged_records"`
+	// LinkedRecords are previously staged child rows linked to patients in this file
+	LinkedRecords int         `json:"linked_records"`
+	RolledBack    bool        `json:"rolled_back"`
+	DryRun        bool        `json:"dry_run"`
+	Errors        []string    `json:"errors"`
+	RowErrors     []RowError  `json:"row_errors"`
+	Warnings      []RowError  `json:"warnings"`
+	Rows          []RowReport `json:"rows,omitempty"`
+
+	// Header is the header row of the file, kept to write error reports
+	Header []string `json:"-"`
+}
 
-	result.TotalRecords = len(records) - 1 // Exclude header row
+// Row error codes
+const (
+	RowErrorMalformed          = "malformed_row"
+	RowErrorMissingColumns     = "missing_columns"
+	RowErrorMissingKey         = "missing_key"
+	RowErrorInvalidDate        = "invalid_date"
+	RowErrorInvalidNumber      = "invalid_number"
+	RowErrorDatabase           = "database_error"
+	RowErrorUnknownFormVersion = "unknown_form_version"
+)
 
-	// Skip header row
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Account for header row
-		result.ProcessedRecords++
+// Row warning codes. Rows with warnings are imported, but some of their
+// values may not mean what the file meant.
+const (
+	RowWarningAmbiguousDate = "ambiguous_date"
+)
 
-		if len(record) < 56 { // Ensure we have enough columns (56 fields total)
-			errorMsg := fmt.Sprintf("Row %d: insufficient columns (expected at least 56, got %d)", rowNum, len(record))
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// RowError describes why a row was rejected
+type RowError struct {
+	Row     int    `json:"row"`
+	Key     string `json:"key,omitempty"`
+	Column  string `json:"column,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 
-		patient := s.parsePatientRecord(record)
-		if patient.ID == "" {
-			errorMsg := fmt.Sprintf("Row %d: missing patient ID", rowNum)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+	// Record holds the raw values of the row so it can be written back out
+	Record []string `json:"-"`
+}
 
-		// Check if patient already exists
-		var existingPatient models.Patient
-		err := s.db.Where("key = ?", patient.ID).First(&existingPatient).Error
-		if err == nil {
-			// Patient exists, skip
-			result.SkippedRecords++
-			log.Printf("Skipping patient %s: already exists", patient.ID)
-			continue
-		} else if err != gorm.ErrRecordNotFound {
-			// Database error
-			errorMsg := fmt.Sprintf("Row %d: database error checking patient %s: %v", rowNum, patient.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// Row statuses reported by a dry run
+const (
+	RowStatusInvalid = "invalid"
+	RowStatusSkipped = "skipped"
+	RowStatusStaged  = "staged"
+)
 
-		// Create new patient
-		if err := s.db.Create(&patient).Error; err != nil {
-			errorMsg := fmt.Sprintf("Row %d: error creating patient %s: %v", rowNum, patient.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// RowReport describes a row that would not be imported cleanly
+type RowReport struct {
+	Row      int      `json:"row"`
+	Key      string   `json:"key,omitempty"`
+	Status   string   `json:"status"`
+	Messages []string `json:"messages"`
+}
 
-		result.InsertedRecords++
-		log.Printf("Successfully created patient %s", patient.ID)
-	}
+// errRollbackImport aborts the transaction of an atomic import
+var errRollbackImport = errors.New("import rolled back")
 
-	return result, nil
-}
+func NewCSVService() *CSVService {
+	cfg := config.LoadConfig()
 
-func (s *CSVService) ImportAntibiotics(file multipart.File) (*UploadResult, error) {
-	result := &UploadResult{
-		Errors: make([]string, 0),
+	mappings, err := LoadMappingRegistry(cfg.MappingProfilesFile)
+	if err != nil {
+		log.Fatal("Failed to load CSV mapping profiles:", err)
 	}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	rules, err := LoadQualityRules(cfg.QualityRulesFile)
 	if err != nil {
-		return result, fmt.Errorf("error reading CSV file: %v", err)
+		log.Fatal("Failed to load data quality rules:", err)
 	}
 
-	if len(records) < 2 {
-		return result, fmt.Errorf("CSV file must have at least a header row and one data row")
+	return &CSVService{
+		db:        database.GetDB(),
+		mappings:  mappings,
+		rules:     rules,
+		batchSize: cfg.ImportBatchSize,
+		timezone:  cfg.DateTimezone,
 	}
+}
 
-	result.TotalRecords = len(records) - 1 // Exclude header row
-
-	// Skip header row
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Account for header row
-		result.ProcessedRecords++
-
-		if len(record) < 15 {
-			errorMsg := fmt.Sprintf("Row %d: insufficient columns (expected at least 15, got %d)", rowNum, len(record))
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
-
-		antibiotic := s.parseAntibioticRecord(record)
-		if antibiotic.ID == "" {
-			errorMsg := fmt.Sprintf("Row %d: missing antibiotic ID", rowNum)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
-
-		// Check if antibiotic already exists
-		var existingAntibiotic models.Antibiotic
-		err := s.db.Where("key = ?", antibiotic.ID).First(&existingAntibiotic).Error
-		if err == nil {
-			// Antibiotic exists, skip
-			result.SkippedRecords++
-			log.Printf("Skipping antibiotic %s: already exists", antibiotic.ID)
-			continue
-		} else if err != gorm.ErrRecordNotFound {
-			// Database error
-			errorMsg := fmt.Sprintf("Row %d: database error checking antibiotic %s: %v", rowNum, antibiotic.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
-
-		// Check if parent patient exists
-		if antibiotic.ParentKey != "" {
-			var parentPatient models.Patient
-			err := s.db.Where("key = ?", antibiotic.ParentKey).First(&parentPatient).Error
-			if err != nil {
-				// Log the ParentKey being searched for debugging
-				log.Printf("Looking for parent patient with key: '%s'", antibiotic.ParentKey)
-
-				// Also log a few existing patient keys for comparison
-				var samplePatients []models.Patient
-				s.db.Select("key").Limit(3).Find(&samplePatients)
-				log.Printf("Sample patient keys in database: %v", samplePatients)
-
-				errorMsg := fmt.Sprintf("Row %d: parent patient %s not found for antibiotic %s", rowNum, antibiotic.ParentKey, antibiotic.ID)
-				result.Errors = append(result.Errors, errorMsg)
-				result.SkippedRecords++
-				continue
-			}
-		}
+// QualityRules returns the data quality rules checked on imported records
+func (s *CSVService) QualityRules() *QualityRules {
+	return s.rules
+}
 
-		// Create new antibiotic
-		if err := s.db.Create(&antibiotic).Error; err != nil {
-			errorMsg := fmt.Sprintf("Row %d: error creating antibiotic %s: %v", rowNum, antibiotic.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// Mappings returns the registry of column mapping profiles
+func (s *CSVService) Mappings() *MappingRegistry {
+	return s.mappings
+}
 
-		result.InsertedRecords++
-		log.Printf("Successfully created antibiotic %s", antibiotic.ID)
+// resolveColumns maps the header row of an upload onto the fields of entity
+// using the mapping profile selected in opts
+func (s *CSVService) resolveColumns(entity string, header []string, opts ImportOptions) (*ColumnMap, error) {
+	profile, err := s.importProfile(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	return resolveProfileColumns(profile, entity, header)
 }
 
-func (s *CSVService) ImportAntibioticDetails(file multipart.File) (*UploadResult, error) {
-	result := &UploadResult{
-		Errors: make([]string, 0),
+// importProfile returns the mapping profile selected for a whole file: the
+// profile of opts.MappingVersion or opts.FormVersion, or else the default
+func (s *CSVService) importProfile(opts ImportOptions) (*MappingProfile, error) {
+	if opts.FormVersion == "" {
+		return s.mappings.Profile(opts.MappingVersion)
+	}
+	if opts.MappingVersion != "" {
+		return nil, fmt.Errorf("%w: select either a mapping version or a form version", ErrColumnMapping)
 	}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	profile, err := s.mappings.ForFormVersion(opts.FormVersion)
 	if err != nil {
-		result.Errors = append(result.Errors, fmt.Sprintf("Failed to read CSV file: %v", err))
-		return result, err
+		return nil, fmt.Errorf("%w: %v", ErrColumnMapping, err)
 	}
+	return profile, nil
+}
 
-	if len(records) < 2 {
-		result.Errors = append(result.Errors, "CSV file must contain at least a header row and one data row")
-		return result, nil
+// resolveProfileColumns maps a header row onto the fields of entity using profile
+func resolveProfileColumns(profile *MappingProfile, entity string, header []string) (*ColumnMap, error) {
+	cols, err := profile.Resolve(entity, header)
+	if err != nil {
+		return nil, err
 	}
 
-	// Skip header row
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Account for header row
-
-		if len(record) < 8 {
-			errorMsg := fmt.Sprintf("Row %d: insufficient columns (expected at least 8, got %d)", rowNum, len(record))
-			result.Errors = append(result.Errors, errorMsg)
-			continue
-		}
-
-		antibioticDetails := s.parseAntibioticDetailsRecord(record)
-		if antibioticDetails.ID == "" {
-			errorMsg := fmt.Sprintf("Row %d: missing antibiotic details ID", rowNum)
-			result.Errors = append(result.Errors, errorMsg)
-			continue
-		}
-
-		// Check if parent patient exists
-		if antibioticDetails.ParentKey != "" {
-			var parentPatient models.Patient
-			err := s.db.Where("key = ?", antibioticDetails.ParentKey).First(&parentPatient).Error
-			if err != nil {
-				// Log the ParentKey being searched for debugging
-				log.Printf("Looking for parent patient with key: '%s'", antibioticDetails.ParentKey)
-
-				// Also log a few existing patient keys for comparison
-				var samplePatients []models.Patient
-				s.db.Select("key").Limit(3).Find(&samplePatients)
-				log.Printf("Sample patient keys in database: %v", samplePatients)
-
-				errorMsg := fmt.Sprintf("Row %d: parent patient %s not found for antibiotic details %s", rowNum, antibioticDetails.ParentKey, antibioticDetails.ID)
-				result.Errors = append(result.Errors, errorMsg)
-				continue
-			}
-		}
-
-		// Check if record already exists
-		var existingRecord models.AntibioticDetails
-		err = s.db.Where("key = ?", antibioticDetails.ID).First(&existingRecord).Error
-		if err == nil {
-			// Record exists, skip it
-			continue
-		}
-
-		// Create new record
-		if err := s.db.Create(&antibioticDetails).Error; err != nil {
-			errorMsg := fmt.Sprintf("Row %d: failed to create antibiotic details record: %v", rowNum, err)
-			result.Errors = append(result.Errors, errorMsg)
-			continue
-		}
+	if len(cols.Unmapped) > 0 {
+		log.Printf("Ignoring unmapped %s columns (mapping %s): %v", entity, cols.Version, cols.Unmapped)
 	}
 
-	return result, nil
+	return cols, nil
 }
 
-func (s *CSVService) ImportIndications(file multipart.File) (*UploadResult, error) {
-	result := &UploadResult{
-		Errors: make([]string, 0),
-	}
-
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return result, fmt.Errorf("error reading CSV file: %v", err)
-	}
+// importSpec describes how the rows of one entity are parsed and stored
+type importSpec struct {
+	entity string
+	label  string // singular name used in messages, e.g. "patient"
+	// keyField is the mapped column the record key is read from
+	keyField string
+	model    func() interface{}
+	parse    func(s *CSVService, row *csvRow) importRecord
+	// checkParent rejects rows whose parent patient does not exist
+	checkParent bool
+	// allowDuplicates inserts rows even when their key already exists
+	allowDuplicates bool
+	// isNewer reports whether the incoming record supersedes the current one;
+	// without it the newer strategy updates any record that changed
+	isNewer func(current, incoming interface{}) bool
+	// keep copies the values set through the API, rather than by imports,
+	// from the current record onto an incoming one that replaces it
+	keep func(current, incoming interface{})
+	// afterWrite stores rows derived from a record once it is inserted or
+	// updated, in the same savepoint
+	afterWrite func(tx *gorm.DB, model interface{}) error
+}
 
-	if len(records) < 2 {
-		return result, fmt.Errorf("CSV file must have at least a header row and one data row")
-	}
+// importRecord is a parsed row waiting to be written
+type importRecord struct {
+	rowNum    int
+	key       string
+	parentKey string
+	model     interface{}
+	record    []string
+}
 
-	result.TotalRecords = len(records) - 1 // Exclude header row
+var importSpecs = map[string]importSpec{
+	EntityPatients: {
+		entity:   EntityPatients,
+		label:    "patient",
+		keyField: "instance_id",
+		model:    func() interface{} { return &models.Patient{} },
+		parse: func(s *CSVService, row *csvRow) importRecord {
+			patient := s.parsePatientRecord(row)
+			return importRecord{key: patient.ID, model: &patient}
+		},
+		isNewer: func(current, incoming interface{}) bool {
+			return patientIsNewer(current.(*models.Patient), incoming.(*models.Patient))
+		},
+		keep: func(current, incoming interface{}) {
+			keepPatientReview(current.(*models.Patient), incoming.(*models.Patient))
+		},
+	},
+	EntityAntibiotics: {
+		entity:   EntityAntibiotics,
+		label:    "antibiotic",
+		keyField: "key",
+		model:    func() interface{} { return &models.Antibiotic{} },
+		parse: func(s *CSVService, row *csvRow) importRecord {
+			antibiotic := s.parseAntibioticRecord(row)
+			row.enrichAntibiotic(&antibiotic)
+			return importRecord{key: antibiotic.ID, parentKey: antibiotic.ParentKey, model: &antibiotic}
+		},
+		checkParent: true,
+	},
+	EntityAntibioticDetails: {
+		entity:   EntityAntibioticDetails,
+		label:    "antibiotic details",
+		keyField: "parent_key",
+		model:    func() interface{} { return &models.AntibioticDetails{} },
+		parse: func(s *CSVService, row *csvRow) importRecord {
+			details := s.parseAntibioticDetailsRecord(row)
+			return importRecord{key: details.ID, parentKey: details.ParentKey, model: &details}
+		},
+		checkParent: true,
+	},
+	EntityIndications: {
+		entity:   EntityIndications,
+		label:    "indication",
+		keyField: "key",
+		model:    func() interface{} { return &models.Indication{} },
+		parse: func(s *CSVService, row *csvRow) importRecord {
+			indication := s.parseIndicationRecord(row)
+			return importRecord{key: indication.ID, parentKey: indication.ParentKey, model: &indication}
+		},
+		checkParent: true,
+	},
+	EntityOptionalVars: {
+		entity:   EntityOptionalVars,
+		label:    "optional var",
+		keyField: "parent_key",
+		model:    func() interface{} { return &models.OptionalVar{} },
+		parse: func(s *CSVService, row *csvRow) importRecord {
+			optionalVar := s.ParseOptionalVarRecord(row)
+			return importRecord{key: optionalVar.ID, parentKey: optionalVar.ParentKey, model: &optionalVar}
+		},
+		// Allow duplicate keys since different details may exist for the same key.
+		// The parent key is the same value as the key, so it is not checked either.
+		allowDuplicates: true,
+	},
+	EntitySpecimens: {
+		entity:   EntitySpecimens,
+		label:    "specimen",
+		keyField: "key",
+		model:    func() interface{} { return &models.Specimen{} },
+		parse: func(s *CSVService, row *csvRow) importRecord {
+			specimen := s.parseSpecimenRecord(row)
+			row.susceptibilityWarnings(&specimen)
+			return importRecord{key: specimen.ID, parentKey: specimen.ParentKey, model: &specimen}
+		},
+		checkParent: true,
+		afterWrite: func(tx *gorm.DB, model interface{}) error {
+			_, err := replaceSusceptibilityResults(tx, model.(*models.Specimen))
+			return err
+		},
+	},
+}
 
-	// Skip header row
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Account for header row
-		result.ProcessedRecords++
+func (s *CSVService) ImportPatients(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	return s.Import(EntityPatients, file, opts)
+}
 
-		if len(record) < 8 {
-			errorMsg := fmt.Sprintf("Row %d: insufficient columns (expected at least 8, got %d)", rowNum, len(record))
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+func (s *CSVService) ImportAntibiotics(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	return s.Import(EntityAntibiotics, file, opts)
+}
 
-		indication := s.parseIndicationRecord(record)
-		if indication.ID == "" {
-			errorMsg := fmt.Sprintf("Row %d: missing indication ID", rowNum)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+func (s *CSVService) ImportAntibioticDetails(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	return s.Import(EntityAntibioticDetails, file, opts)
+}
 
-		// Check if indication already exists
-		var existingIndication models.Indication
-		err := s.db.Where("key = ?", indication.ID).First(&existingIndication).Error
-		if err == nil {
-			// Indication exists, skip
-			result.SkippedRecords++
-			log.Printf("Skipping indication %s: already exists", indication.ID)
-			continue
-		} else if err != gorm.ErrRecordNotFound {
-			// Database error
-			errorMsg := fmt.Sprintf("Row %d: database error checking indication %s: %v", rowNum, indication.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+func (s *CSVService) ImportIndications(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	return s.Import(EntityIndications, file, opts)
+}
 
-		// Check if parent patient exists
-		if indication.ParentKey != "" {
-			var parentPatient models.Patient
-			err := s.db.Where("key = ?", indication.ParentKey).First(&parentPatient).Error
-			if err != nil {
-				errorMsg := fmt.Sprintf("Row %d: parent patient %s not found for indication %s", rowNum, indication.ParentKey, indication.ID)
-				result.Errors = append(result.Errors, errorMsg)
-				result.SkippedRecords++
-				continue
-			}
-		}
+func (s *CSVService) ImportOptionalVars(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	return s.Import(EntityOptionalVars, file, opts)
+}
 
-		// Create new indication
-		if err := s.db.Create(&indication).Error; err != nil {
-			errorMsg := fmt.Sprintf("Row %d: error creating indication %s: %v", rowNum, indication.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+func (s *CSVService) ImportSpecimens(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	return s.Import(EntitySpecimens, file, opts)
+}
 
-		result.InsertedRecords++
-		log.Printf("Successfully created indication %s", indication.ID)
+// normalizeOptions checks opts and fills in defaults
+func normalizeOptions(opts ImportOptions) (ImportOptions, error) {
+	if !ValidMergeStrategy(opts.MergeStrategy) {
+		return opts, fmt.Errorf("unknown merge strategy %q", opts.MergeStrategy)
 	}
-
-	return result, nil
+	if opts.MergeStrategy == "" {
+		opts.MergeStrategy = MergeSkip
+	}
+	if err := ValidateDateOptions(opts); err != nil {
+		return opts, err
+	}
+	return opts, nil
 }
 
-func (s *CSVService) ImportOptionalVars(file multipart.File) (*UploadResult, error) {
-	result := &UploadResult{
-		Errors: make([]string, 0),
+// Import streams a CSV file for entity into the database. Rows are read one
+// at a time and written in batches, so memory use does not grow with the
+// size of the file.
+func (s *CSVService) Import(entity string, file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	spec, ok := importSpecs[entity]
+	if !ok {
+		return newUploadResult(false), fmt.Errorf("unknown import entity %q", entity)
 	}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	return s.importWith(spec, opts, func(db *gorm.DB, opts ImportOptions) (*UploadResult, error) {
+		return s.importRows(db, spec, file, opts)
+	})
+}
+
+// importWith runs an import of one table through s.db, or in atomic mode
+// through a transaction that is rolled back if any row failed
+func (s *CSVService) importWith(spec importSpec, opts ImportOptions, run func(db *gorm.DB, opts ImportOptions) (*UploadResult, error)) (*UploadResult, error) {
+	opts, err := normalizeOptions(opts)
 	if err != nil {
-		return result, fmt.Errorf("error reading CSV file: %v", err)
+		return newUploadResult(false), err
 	}
 
-	if len(records) < 2 {
-		return result, fmt.Errorf("CSV file must have at least a header row and one data row")
+	if !opts.Atomic || opts.DryRun {
+		return run(s.db, opts)
 	}
 
-	result.TotalRecords = len(records) - 1 // Exclude header row
-
-	// Skip header row
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Account for header row
-		result.ProcessedRecords++
-
-		if len(record) < 8 {
-			errorMsg := fmt.Sprintf("Row %d: insufficient columns (expected at least 8, got %d)", rowNum, len(record))
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
+	// Atomic mode: run the whole file in one transaction and roll it back
+	// if any row failed, so the file can be fixed and uploaded again
+	var result *UploadResult
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = run(tx, opts)
+		if err != nil {
+			return err
 		}
-
-		optionalVar := s.ParseOptionalVarRecord(record)
-		if optionalVar.ID == "" {
-			errorMsg := fmt.Sprintf("Row %d: missing optional var ID", rowNum)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
+		if len(result.Errors) > 0 {
+			return errRollbackImport
 		}
+		return nil
+	})
 
-		// Allow duplicate keys since different details may exist for the same key
-
-		// For optional_vars, we don't need to check for parent patient existence
-		// since parent_key is set to the same value as the key (ID)
-
-		// Create new optional var
-		if err := s.db.Create(&optionalVar).Error; err != nil {
-			errorMsg := fmt.Sprintf("Row %d: error creating optional var %s: %v", rowNum, optionalVar.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
-
-		result.InsertedRecords++
-		log.Printf("Successfully created optional var %s", optionalVar.ID)
+	if err == errRollbackImport {
+		log.Printf("Rolled back %s import: %d rows failed", spec.entity, len(result.Errors))
+		result.RolledBack = true
+		result.SkippedRecords = result.TotalRecords
+		result.InsertedRecords = 0
+		result.UpdatedRecords = 0
+		result.StagedRecords = 0
+		result.LinkedRecords = 0
+		return result, nil
+	}
+	if err != nil && result == nil {
+		result = newUploadResult(false)
 	}
 
-	return result, nil
+	return result, err
 }
 
-func (s *CSVService) ImportSpecimens(file multipart.File) (*UploadResult, error) {
-	result := &UploadResult{
-		Errors: make([]string, 0),
+// newUploadResult returns an empty result
+func newUploadResult(dryRun bool) *UploadResult {
+	return &UploadResult{
+		DryRun:    dryRun,
+		Errors:    make([]string, 0),
+		RowErrors: make([]RowError, 0),
+		Warnings:  make([]RowError, 0),
 	}
+}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return result, fmt.Errorf("error reading CSV file: %v", err)
+// rowError records a row that was rejected, with one or more errors
+func (r *UploadResult) rowError(rowNum int, key string, record []string, errs ...RowError) {
+	messages := make([]string, 0, len(errs))
+	for _, rowErr := range errs {
+		rowErr.Row = rowNum
+		rowErr.Key = key
+		rowErr.Record = record
+		r.RowErrors = append(r.RowErrors, rowErr)
+		r.Errors = append(r.Errors, fmt.Sprintf("Row %d: %s", rowNum, rowErr.Message))
+		messages = append(messages, rowErr.Message)
+	}
+	r.SkippedRecords++
+	if r.DryRun {
+		r.Rows = append(r.Rows, RowReport{Row: rowNum, Key: key, Status: RowStatusInvalid, Messages: messages})
 	}
+}
 
-	if len(records) < 2 {
-		return result, fmt.Errorf("CSV file must have at least a header row and one data row")
+// rowSkipped records a valid row that was not imported, e.g. because its key already exists
+func (r *UploadResult) rowSkipped(rowNum int, key string, message string) {
+	r.SkippedRecords++
+	if r.DryRun {
+		r.Rows = append(r.Rows, RowReport{Row: rowNum, Key: key, Status: RowStatusSkipped, Messages: []string{message}})
 	}
+}
 
-	result.TotalRecords = len(records) - 1 // Exclude header row
-
-	// Skip header row
-	for i, record := range records[1:] {
-		rowNum := i + 2 // Account for header row
-		result.ProcessedRecords++
+// rowStaged records a child row kept until its parent patient is imported
+func (r *UploadResult) rowStaged(rowNum int, key string, message string) {
+	r.StagedRecords++
+	if r.DryRun {
+		r.Rows = append(r.Rows, RowReport{Row: rowNum, Key: key, Status: RowStatusStaged, Messages: []string{message}})
+	}
+}
 
-		if len(record) < 7 {
-			errorMsg := fmt.Sprintf("Row %d: insufficient columns (expected at least 7, got %d)", rowNum, len(record))
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// rowWarning records warnings on a row that was still imported
+func (r *UploadResult) rowWarning(rowNum int, key string, warnings ...RowError) {
+	for _, warning := range warnings {
+		warning.Row = rowNum
+		warning.Key = key
+		r.Warnings = append(r.Warnings, warning)
+	}
+}
 
-		specimen := s.parseSpecimenRecord(record)
-		if specimen.ID == "" {
-			errorMsg := fmt.Sprintf("Row %d: missing specimen ID", rowNum)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// merge adds the outcomes of a batch to the overall result
+func (r *UploadResult) merge(batch *UploadResult) {
+	r.SkippedRecords += batch.SkippedRecords
+	r.InsertedRecords += batch.InsertedRecords
+	r.UpdatedRecords += batch.UpdatedRecords
+	r.StagedRecords += batch.StagedRecords
+	r.LinkedRecords += batch.LinkedRecords
+	r.Errors = append(r.Errors, batch.Errors...)
+	r.RowErrors = append(r.RowErrors, batch.RowErrors...)
+	r.Warnings = append(r.Warnings, batch.Warnings...)
+	r.Rows = append(r.Rows, batch.Rows...)
+}
 
-		// Check if specimen already exists
-		var existingSpecimen models.Specimen
-		err := s.db.Where("key = ?", specimen.ID).First(&existingSpecimen).Error
-		if err == nil {
-			// Specimen exists, skip
-			result.SkippedRecords++
-			log.Printf("Skipping specimen %s: already exists", specimen.ID)
-			continue
-		} else if err != gorm.ErrRecordNotFound {
-			// Database error
-			errorMsg := fmt.Sprintf("Row %d: database error checking specimen %s: %v", rowNum, specimen.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
+// stripRepeatPath extracts the UUID part of an ODK repeat group key
+// (removes /Antibioticform/Core_variables[X])
+func stripRepeatPath(key string) string {
+	if strings.Contains(key, "/Antibioticform/") {
+		parts := strings.Split(key, "/Antibioticform/")
+		if len(parts) > 0 {
+			return parts[0]
 		}
+	}
+	return key
+}
 
-		// Check if parent patient exists
-		if specimen.ParentKey != "" {
-			var parentPatient models.Patient
-			err := s.db.Where("key = ?", specimen.ParentKey).First(&parentPatient).Error
-			if err != nil {
-				errorMsg := fmt.Sprintf("Row %d: parent patient %s not found for specimen %s", rowNum, specimen.ParentKey, specimen.ID)
-				result.Errors = append(result.Errors, errorMsg)
-				result.SkippedRecords++
-				continue
-			}
-		}
+// csvRow reads the fields of one CSV record through a ColumnMap and collects
+// the values that could not be parsed
+type csvRow struct {
+	cols   *ColumnMap
+	dates  *dateParser
+	record []string
+	issues []RowError
+	// warnings are values that were read but may not mean what the file meant
+	warnings []RowError
+	// catalogue is the antibiotic reference catalogue, loaded for antibiotic imports
+	catalogue *antibioticCatalogue
+}
 
-		// Create new specimen
-		if err := s.db.Create(&specimen).Error; err != nil {
-			errorMsg := fmt.Sprintf("Row %d: error creating specimen %s: %v", rowNum, specimen.ID, err)
-			result.Errors = append(result.Errors, errorMsg)
-			result.SkippedRecords++
-			continue
-		}
+// issue records a value of field that could not be parsed
+func (r *csvRow) issue(code, field, message string) {
+	r.issues = append(r.issues, RowError{Column: r.cols.Column(field), Code: code, Message: message})
+}
 
-		result.InsertedRecords++
-		log.Printf("Successfully created specimen %s", specimen.ID)
-	}
+// get returns the value of field, or "" if the column is absent
+func (r *csvRow) get(field string) string {
+	return r.cols.Value(r.record, field)
+}
 
-	return result, nil
+// code returns the value of a categorical field as its canonical code
+func (r *csvRow) code(field string) string {
+	return r.cols.Code(field, r.get(field))
 }
 
-// Helper function to parse dates with multiple format support
-func (s *CSVService) parseDate(dateStr string) time.Time {
-	if dateStr == "" {
+// date parses field as a date, recording an issue if it is not a valid date
+func (r *csvRow) date(field string) time.Time {
+	value := r.get(field)
+	if value == "" {
 		return time.Time{}
 	}
-
-	// Try different date formats
-	formats := []string{
-		"2006-01-02T15:04:05.000Z",    // ISO 8601 with milliseconds
-		"2006-01-02T15:04:05Z",        // ISO 8601 without milliseconds
-		"2006-01-02T15:04:05",         // ISO 8601 without timezone
-		"2006-01-02 15:04:05",         // Standard datetime
-		"2006-01-02",                  // Date only
-		"01/02/2006",                  // US format
-		"02/01/2006",                  // European format
-		"2006/01/02",                  // Alternative format
-		"2006-01-02 15:04:05.000",     // With milliseconds
-		"2006-01-02 15:04:05.000000",  // With microseconds
-		"2006-01-02T15:04:05.000000Z", // ISO with microseconds
-		"2006-01-02T15:04:05.000000",  // ISO with microseconds no timezone
+	t, warning, err := r.dates.parse(field, r.cols.Column(field), value)
+	if err != nil {
+		r.issue(RowErrorInvalidDate, field, fmt.Sprintf("invalid date %q in column %s: %v", value, r.cols.Column(field), err))
 	}
-
-	for _, format := range formats {
-		if t, err := time.Parse(format, dateStr); err == nil {
-			return t
-		}
+	if warning != "" {
+		r.warnings = append(r.warnings, RowError{Column: r.cols.Column(field), Code: RowWarningAmbiguousDate, Message: warning})
 	}
-
-	// If all formats fail, return zero time
-	return time.Time{}
+	return t
 }
 
-// Helper functions to parse CSV records
-func (s *CSVService) parsePatientRecord(record []string) models.Patient {
-	patient := models.Patient{}
-
-	// CSV Column 0 = submission_date
-	if len(record) > 0 && record[0] != "" {
-		patient.SubmissionDate = s.parseDate(record[0])
-	}
-	// CSV Column 1 = region
-	if len(record) > 1 && record[1] != "" {
-		patient.Region = record[1]
-	}
-	// CSV Column 2 = district
-	if len(record) > 2 && record[2] != "" {
-		patient.District = record[2]
-	}
-	// CSV Column 3 = subcounty
-	if len(record) > 3 && record[3] != "" {
-		patient.Subcounty = record[3]
-	}
-	// CSV Column 4 = facility
-	if len(record) > 4 && record[4] != "" {
-		patient.Facility = record[4]
-	}
-	// CSV Column 5 = level_of_care
-	if len(record) > 5 && record[5] != "" {
-		patient.LevelOfCare = record[5]
+// intValue parses field as an integer, recording an issue if it is not a number
+func (r *csvRow) intValue(field string) int {
+	value := r.get(field)
+	if value == "" {
+		return 0
 	}
-	// CSV Column 6 = ownership
-	if len(record) > 6 && record[6] != "" {
-		patient.Ownership = record[6]
-	}
-	// CSV Column 7 = ward_name
-	if len(record) > 7 && record[7] != "" {
-		patient.WardName = record[7]
-	}
-	// CSV Column 8 = ward_total_patients
-	if len(record) > 8 && record[8] != "" {
-		if val, err := strconv.Atoi(record[8]); err == nil {
-			patient.WardTotalPatients = val
-		}
-	}
-	// CSV Column 9 = ward_eligible_patients
-	if len(record) > 9 && record[9] != "" {
-		if val, err := strconv.Atoi(record[9]); err == nil {
-			patient.WardEligiblePatients = val
-		}
-	}
-	// CSV Column 10 = survey_date
-	if len(record) > 10 && record[10] != "" {
-		patient.SurveyDate = s.parseDate(record[10])
-	}
-	// CSV Column 11 = patient_initials
-	if len(record) > 11 && record[11] != "" {
-		patient.PatientInitials = record[11]
-	}
-	// CSV Column 12 = code
-	if len(record) > 12 && record[12] != "" {
-		patient.Code = record[12]
-	}
-	// CSV Column 13 = rand_num
-	if len(record) > 13 && record[13] != "" {
-		if val, err := strconv.Atoi(record[13]); err == nil {
-			patient.RandNum = val
-		}
-	}
-	// CSV Column 14 = patient_code
-	if len(record) > 14 && record[14] != "" {
-		patient.PatientCode = record[14]
-	}
-	// CSV Column 15 = show_code
-	if len(record) > 15 && record[15] != "" {
-		patient.ShowCode = record[15]
-	}
-	// CSV Column 16 = is_the_patient_an_infant
-	if len(record) > 16 && record[16] != "" {
-		patient.IsThePatientAnInfant = record[16]
-	}
-	// CSV Column 17 = age_months
-	if len(record) > 17 && record[17] != "" {
-		if val, err := strconv.Atoi(record[17]); err == nil {
-			patient.AgeMonths = val
-		}
-	}
-	// CSV Column 18 = age_years
-	if len(record) > 18 && record[18] != "" {
-		if val, err := strconv.Atoi(record[18]); err == nil {
-			patient.AgeYears = val
-		}
-	}
-	// CSV Column 19 = pre_term_birth
-	if len(record) > 19 && record[19] != "" {
-		patient.PreTermBirth = record[19]
-	}
-	// CSV Column 20 = gender
-	if len(record) > 20 && record[20] != "" {
-		patient.Gender = record[20]
-	}
-	// CSV Column 21 = weight
-	if len(record) > 21 && record[21] != "" {
-		if val, err := strconv.ParseFloat(record[21], 64); err == nil {
-			patient.Weight = val
-		}
-	}
-	// CSV Column 22 = weight_birth_kg
-	if len(record) > 22 && record[22] != "" {
-		if val, err := strconv.ParseFloat(record[22], 64); err == nil {
-			patient.WeightBirthKg = val
-		}
-	}
-	// CSV Column 23 = admission_date
-	if len(record) > 23 && record[23] != "" {
-		patient.AdmissionDate = s.parseDate(record[23])
-	}
-	// CSV Column 24 = surgery_since_admission
-	if len(record) > 24 && record[24] != "" {
-		patient.SurgerySinceAdmission = record[24]
-	}
-	// CSV Column 25 = urinary_catheter
-	if len(record) > 25 && record[25] != "" {
-		patient.UrinaryCatheter = record[25]
-	}
-	// CSV Column 26 = peripheral_vascular_catheter
-	if len(record) > 26 && record[26] != "" {
-		patient.PeripheralVascularCatheter = record[26]
-	}
-	// CSV Column 27 = central_vascular_catheter
-	if len(record) > 27 && record[27] != "" {
-		patient.CentralVascularCatheter = record[27]
-	}
-	// CSV Column 28 = intubation
-	if len(record) > 28 && record[28] != "" {
-		patient.Intubation = record[28]
-	}
-	// CSV Column 29 = patient_on_antibiotic
-	if len(record) > 29 && record[29] != "" {
-		patient.PatientOnAntibiotic = record[29]
-	}
-	// CSV Column 30 = patient_number_antibiotics
-	if len(record) > 30 && record[30] != "" {
-		if val, err := strconv.Atoi(record[30]); err == nil {
-			patient.PatientNumberAntibiotics = val
-		}
-	}
-	// CSV Column 31 = malaria_status
-	if len(record) > 31 && record[31] != "" {
-		patient.MalariaStatus = record[31]
-	}
-	// CSV Column 32 = tuberculosis_status
-	if len(record) > 32 && record[32] != "" {
-		patient.TuberculosisStatus = record[32]
-	}
-	// CSV Column 33 = hiv_status
-	if len(record) > 33 && record[33] != "" {
-		patient.HIVStatus = record[33]
-	}
-	// CSV Column 34 = hiv_on_art
-	if len(record) > 34 && record[34] != "" {
-		patient.HIVOnART = record[34]
-	}
-	// CSV Column 35 = hiv_cd4_count
-	if len(record) > 35 && record[35] != "" {
-		patient.HIVCD4Count = record[35]
-	}
-	// CSV Column 36 = hiv_viral_load
-	if len(record) > 36 && record[36] != "" {
-		patient.HIVViralLoad = record[36]
-	}
-	// CSV Column 37 = diabetes
-	if len(record) > 37 && record[37] != "" {
-		patient.Diabetes = record[37]
-	}
-	// CSV Column 38 = malnutrition_status
-	if len(record) > 38 && record[38] != "" {
-		patient.MalnutritionStatus = record[38]
-	}
-	// CSV Column 39 = hypertension
-	if len(record) > 39 && record[39] != "" {
-		patient.Hypertension = record[39]
-	}
-	// CSV Column 40 = referred_from
-	if len(record) > 40 && record[40] != "" {
-		patient.ReferredFrom = record[40]
-	}
-	// CSV Column 41 = hospitalization_90_days
-	if len(record) > 41 && record[41] != "" {
-		patient.Hospitalization90Days = record[41]
-	}
-	// CSV Column 42 = type_surgery_since_admission
-	if len(record) > 42 && record[42] != "" {
-		patient.TypeSurgerySinceAdmission = record[42]
-	}
-	// CSV Column 43 = additional_comment
-	if len(record) > 43 && record[43] != "" {
-		patient.AdditionalComment = record[43]
-	}
-	// CSV Column 44 = comments
-	if len(record) > 44 && record[44] != "" {
-		patient.Comments = record[44]
-	}
-	// CSV Column 45 = instance_id (this is the key field!)
-	if len(record) > 45 && record[45] != "" {
-		patient.ID = record[45]
-		patient.InstanceID = record[45]
-	}
-	// CSV Column 46 = submitter_id
-	if len(record) > 46 && record[46] != "" {
-		patient.SubmitterID = record[46]
-	}
-	// CSV Column 47 = submitter_name
-	if len(record) > 47 && record[47] != "" {
-		patient.SubmitterName = record[47]
-	}
-	// CSV Column 48 = attachments_present
-	if len(record) > 48 && record[48] != "" {
-		patient.AttachmentsPresent = record[48]
-	}
-	// CSV Column 49 = attachments_expected
-	if len(record) > 49 && record[49] != "" {
-		patient.AttachmentsExpected = record[49]
-	}
-	// CSV Column 50 = status
-	if len(record) > 50 && record[50] != "" {
-		patient.Status = record[50]
-	}
-	// CSV Column 51 = review_state
-	if len(record) > 51 && record[51] != "" {
-		patient.ReviewState = record[51]
-	}
-	// CSV Column 52 = device_id
-	if len(record) > 52 && record[52] != "" {
-		patient.DeviceID = record[52]
+	val, err := strconv.Atoi(value)
+	if err != nil {
+		r.issue(RowErrorInvalidNumber, field, fmt.Sprintf("invalid integer %q in column %s", value, r.cols.Column(field)))
 	}
-	// CSV Column 53 = edits
-	if len(record) > 53 && record[53] != "" {
-		patient.Edits = record[53]
+	return val
+}
+
+// floatValue parses field as a number, recording an issue if it is not a number
+func (r *csvRow) floatValue(field string) float64 {
+	value := r.get(field)
+	if value == "" {
+		return 0
 	}
-	// CSV Column 54 = form_version
-	if len(record) > 54 && record[54] != "" {
-		patient.FormVersion = record[54]
+	val, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		r.issue(RowErrorInvalidNumber, field, fmt.Sprintf("invalid number %q in column %s", value, r.cols.Column(field)))
 	}
-
-	return patient
+	return val
 }
 
-func (s *CSVService) parseAntibioticRecord(record []string) models.Antibiotic {
-	antibiotic := models.Antibiotic{}
+// Helper functions to parse CSV records. Fields are looked up by column name
+// through the ColumnMap, so the column order of the export does not matter.
+func (s *CSVService) parsePatientRecord(row *csvRow) models.Patient {
+
+	patient := models.Patient{
+		SubmissionDate:             row.date("submission_date"),
+		Region:                     row.get("region"),
+		District:                   row.get("district"),
+		Subcounty:                  row.get("subcounty"),
+		Facility:                   row.get("facility"),
+		LevelOfCare:                row.get("level_of_care"),
+		Ownership:                  row.get("ownership"),
+		WardName:                   row.get("ward_name"),
+		WardTotalPatients:          row.intValue("ward_total_patients"),
+		WardEligiblePatients:       row.intValue("ward_eligible_patients"),
+		SurveyDate:                 row.date("survey_date"),
+		PatientInitials:            row.get("patient_initials"),
+		Code:                       row.get("code"),
+		RandNum:                    row.intValue("rand_num"),
+		PatientCode:                row.get("patient_code"),
+		ShowCode:                   row.get("show_code"),
+		IsThePatientAnInfant:       row.code("is_the_patient_an_infant"),
+		AgeMonths:                  row.intValue("age_months"),
+		AgeYears:                   row.intValue("age_years"),
+		PreTermBirth:               row.code("pre_term_birth"),
+		Gender:                     row.code("gender"),
+		Weight:                     row.floatValue("weight"),
+		WeightBirthKg:              row.floatValue("weight_birth_kg"),
+		AdmissionDate:              row.date("admission_date"),
+		SurgerySinceAdmission:      row.code("surgery_since_admission"),
+		UrinaryCatheter:            row.code("urinary_catheter"),
+		PeripheralVascularCatheter: row.code("peripheral_vascular_catheter"),
+		CentralVascularCatheter:    row.code("central_vascular_catheter"),
+		Intubation:                 row.code("intubation"),
+		PatientOnAntibiotic:        row.code("patient_on_antibiotic"),
+		PatientNumberAntibiotics:   row.intValue("patient_number_antibiotics"),
+		MalariaStatus:              row.code("malaria_status"),
+		TuberculosisStatus:         row.code("tuberculosis_status"),
+		HIVStatus:                  row.code("hiv_status"),
+		HIVOnART:                   row.code("hiv_on_art"),
+		HIVCD4Count:                row.get("hiv_cd4_count"),
+		HIVViralLoad:               row.get("hiv_viral_load"),
+		Diabetes:                   row.code("diabetes"),
+		MalnutritionStatus:         row.get("malnutrition_status"),
+		Hypertension:               row.code("hypertension"),
+		ReferredFrom:               row.get("referred_from"),
+		Hospitalization90Days:      row.code("hospitalization_90_days"),
+		TypeSurgerySinceAdmission:  row.get("type_surgery_since_admission"),
+		AdditionalComment:          row.get("additional_comment"),
+		Comments:                   row.get("comments"),
+		SubmitterID:                row.get("submitter_id"),
+		SubmitterName:              row.get("submitter_name"),
+		AttachmentsPresent:         row.get("attachments_present"),
+		AttachmentsExpected:        row.get("attachments_expected"),
+		Status:                     row.get("status"),
+		ReviewState:                row.get("review_state"),
+		DeviceID:                   row.get("device_id"),
+		Edits:                      row.get("edits"),
+		FormVersion:                row.get("form_version"),
+	}
+
+	// instance_id is the key field
+	patient.InstanceID = row.get("instance_id")
+	patient.ID = patient.InstanceID
 
-	// Debug: Log the first few columns to understand the structure
-	first10 := record
-	if len(record) > 10 {
-		first10 = record[:10]
-	}
-	log.Printf("Antibiotic CSV Record structure - First 10 columns: %v", first10)
-	log.Printf("Antibiotic Total columns: %d", len(record))
-
-	// Based on your CSV structure:
-	// Column 14 (index 13): PARENT_K
-	// Column 15 (index 14): KEY (this should be the antibiotic ID)
-
-	// Set the antibiotic ID from the KEY column (column 15, index 14)
-	if len(record) > 14 && record[14] != "" {
-		// Extract the UUID part from the KEY (remove /Antibioticform/Core_variables[X])
-		key := record[14]
-		if strings.Contains(key, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(key, "/Antibioticform/")
-			if len(parts) > 0 {
-				antibiotic.ID = parts[0]
-			}
-		} else {
-			antibiotic.ID = key
-		}
-	}
+	return patient
+}
 
-	// Set the ParentKey from the PARENT_K column (column 14, index 13)
-	if len(record) > 13 && record[13] != "" {
-		// Extract the UUID part from the ParentKey (remove /Antibioticform/Core_variables[X])
-		parentKey := record[13]
-		if strings.Contains(parentKey, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(parentKey, "/Antibioticform/")
-			if len(parts) > 0 {
-				antibiotic.ParentKey = parts[0]
-			}
-		} else {
-			antibiotic.ParentKey = parentKey
-		}
-	}
-	// Based on the actual CSV structure from logs:
-	// Column 1: Antibiotic notes/name (e.g., "Ampicillin")
-	// Column 2: Antibiotic INN name (e.g., "Ampicillin")
-	// Column 3: Other antibiotic info (e.g., "yes")
-	// Column 4: ATC code/classification (e.g., "yes")
-	// Column 5: Start date (e.g., "2024-08-20")
-	// Column 6: Unit dose (e.g., "1g")
-	// Column 7: Unit doses combination
-	// Column 8: Unit dose measure unit
-	// Column 9: Unit dose frequency
-	// Column 10: Administration route
-	// Column 11: Additional field
-	// Column 12: Additional field
-	// Column 13: Additional field
-	// Column 14: PARENT_K
-	// Column 15: KEY
-
-	if len(record) > 0 && record[0] != "" {
-		antibiotic.AntibioticNotes = record[0] // Column 1: Antibiotic notes/name
-	}
-	if len(record) > 1 && record[1] != "" {
-		antibiotic.AntibioticINNName = record[1] // Column 2: Antibiotic INN name
-	}
-	if len(record) > 2 && record[2] != "" {
-		antibiotic.OtherAntibiotic = record[2] // Column 3: Other antibiotic info
-	}
-	if len(record) > 3 && record[3] != "" {
-		antibiotic.AntibioticClass = record[3] // Column 4: ATC code/classification
-	}
-	if len(record) > 4 && record[4] != "" {
-		antibiotic.StartDateAntibiotic = s.parseDate(record[4]) // Column 5: Start date
-	}
-	if len(record) > 5 && record[5] != "" {
-		if val, err := strconv.ParseFloat(record[5], 64); err == nil {
-			antibiotic.UnitDose = val // Column 6: Unit dose
-		}
-	}
-	if len(record) > 6 && record[6] != "" {
-		antibiotic.UnitDosesCombination = record[6] // Column 7: Unit doses combination
-	}
-	if len(record) > 7 && record[7] != "" {
-		antibiotic.UnitDoseMeasureUnit = record[7] // Column 8: Unit dose measure unit
+func (s *CSVService) parseAntibioticRecord(row *csvRow) models.Antibiotic {
+
+	return models.Antibiotic{
+		ID:                            stripRepeatPath(row.get("key")),
+		ParentKey:                     stripRepeatPath(row.get("parent_key")),
+		AntibioticNotes:               row.get("antibiotic_notes"),
+		AntibioticINNName:             row.get("antibiotic_inn_name"),
+		OtherAntibiotic:               row.get("other_antibiotic"),
+		ATCCode:                       row.get("atc_code"),
+		AntibioticClass:               row.get("antibiotic_class"),
+		AntibioticAwareClassification: row.code("antibiotic_aware_classification"),
+		AntibioticWrittenInINN:        row.code("antibiotic_written_in_inn"),
+		StartDateAntibiotic:           row.date("start_date_antibiotic"),
+		UnitDose:                      row.floatValue("unit_dose"),
+		UnitDosesCombination:          row.get("unit_doses_combination"),
+		UnitDoseMeasureUnit:           row.get("unit_dose_measure_unit"),
+		UnitDoseFrequency:             row.get("unit_dose_frequency"),
+		AdministrationRoute:           row.code("administration_route"),
 	}
-	if len(record) > 8 && record[8] != "" {
-		antibiotic.UnitDoseFrequency = record[8] // Column 9: Unit dose frequency
-	}
-	if len(record) > 9 && record[9] != "" {
-		antibiotic.AdministrationRoute = record[9] // Column 10: Administration route
-	}
-	// ParentKey is now set as the ID above, so we don't need to set it again
-
-	return antibiotic
 }
 
-func (s *CSVService) parseAntibioticDetailsRecord(record []string) models.AntibioticDetails {
-	antibioticDetails := models.AntibioticDetails{}
+func (s *CSVService) parseAntibioticDetailsRecord(row *csvRow) models.AntibioticDetails {
 
-	// Debug: Log the first few columns to understand the structure
-	first10 := record
-	if len(record) > 10 {
-		first10 = record[:10]
-	}
-	log.Printf("AntibioticDetails CSV Record structure - First 10 columns: %v", first10)
-	log.Printf("AntibioticDetails Total columns: %d", len(record))
-
-	// Based on the image, the fields are in these positions:
-	// Column 1: Prescriber
-	// Column 2: Intraveno
-	// Column 3: OralSwitch
-	// Column 4: NumberMissed
-	// Column 5: MissedDose
-	// Column 6: Guideline
-	// Column 7: Treatment
-	// Column 8: ParentKey (used as ID)
-
-	if len(record) > 0 && record[0] != "" {
-		antibioticDetails.Prescriber = record[0]
-	}
-	if len(record) > 1 && record[1] != "" {
-		antibioticDetails.Intraveno = record[1]
-	}
-	if len(record) > 2 && record[2] != "" {
-		antibioticDetails.OralSwitch = record[2]
-	}
-	if len(record) > 3 && record[3] != "" {
-		antibioticDetails.NumberMissed = record[3]
-	}
-	if len(record) > 4 && record[4] != "" {
-		antibioticDetails.MissedDose = record[4]
-	}
-	if len(record) > 5 && record[5] != "" {
-		antibioticDetails.Guideline = record[5]
-	}
-	if len(record) > 6 && record[6] != "" {
-		antibioticDetails.Treatment = record[6]
-	}
-	if len(record) > 7 && record[7] != "" {
-		// Extract the UUID part from the ParentKey (remove /Antibioticform/Core_variables[X])
-		parentKey := record[7]
-		if strings.Contains(parentKey, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(parentKey, "/Antibioticform/")
-			if len(parts) > 0 {
-				antibioticDetails.ID = parts[0]
-				antibioticDetails.ParentKey = parts[0]
-			}
-		} else {
-			antibioticDetails.ID = parentKey
-			antibioticDetails.ParentKey = parentKey
-		}
-	}
+	// The parent key doubles as the record ID
+	parentKey := stripRepeatPath(row.get("parent_key"))
 
-	return antibioticDetails
+	return models.AntibioticDetails{
+		ID:           parentKey,
+		ParentKey:    parentKey,
+		Prescriber:   row.get("prescriber"),
+		Intraveno:    row.code("intraveno"),
+		OralSwitch:   row.code("oral_switch"),
+		NumberMissed: row.get("number_missed"),
+		MissedDose:   row.get("missed_dose"),
+		Guideline:    row.code("guideline"),
+		Treatment:    row.get("treatment"),
+	}
 }
 
-func (s *CSVService) parseIndicationRecord(record []string) models.Indication {
-	indication := models.Indication{}
+func (s *CSVService) parseIndicationRecord(row *csvRow) models.Indication {
 
-	// Debug: Log the first few columns to understand the structure
-	first10 := record
-	if len(record) > 10 {
-		first10 = record[:10]
-	}
-	log.Printf("Indication CSV Record structure - First 10 columns: %v", first10)
-	log.Printf("Indication Total columns: %d", len(record))
-
-	// Based on the CSV structure:
-	// Column 1 (index 0): Indication
-	// Column 2 (index 1): Surg.Prop (empty)
-	// Column 3 (index 2): Surg.Prop (empty)
-	// Column 4 (index 3): Diagnosis
-	// Column 5 (index 4): StartDateTreatment
-	// Column 6 (index 5): ReasonIn!
-	// Column 7 (index 6): CultureSa
-	// Column 8 (index 7): PARENT_k
-	// Column 9 (index 8): KEY
-
-	if len(record) > 0 && record[0] != "" {
-		indication.IndicationType = record[0] // Indication field
+	return models.Indication{
+		ID:                 stripRepeatPath(row.get("key")),
+		ParentKey:          stripRepeatPath(row.get("parent_key")),
+		IndicationType:     row.get("indication_type"),
+		SurgProphDuration:  row.get("surg_proph_duration"),
+		SurgProphSite:      row.get("surg_proph_site"),
+		Diagnosis:          row.get("diagnosis"),
+		StartDateTreatment: row.date("start_date_treatment"),
+		ReasonInNotes:      row.code("reason_in_notes"),
+		CultureSampleTaken: row.code("culture_sample_taken"),
 	}
-	if len(record) > 1 && record[1] != "" {
-		indication.SurgProphDuration = record[1] // First Surg.Prop
-	}
-	if len(record) > 2 && record[2] != "" {
-		indication.SurgProphSite = record[2] // Second Surg.Prop
-	}
-	if len(record) > 3 && record[3] != "" {
-		indication.Diagnosis = record[3]
-	}
-	if len(record) > 4 && record[4] != "" {
-		indication.StartDateTreatment = s.parseDate(record[4])
-	}
-	if len(record) > 5 && record[5] != "" {
-		indication.ReasonInNotes = record[5] // ReasonIn!
-	}
-	if len(record) > 6 && record[6] != "" {
-		indication.CultureSampleTaken = record[6] // CultureSa
-	}
-	if len(record) > 7 && record[7] != "" {
-		// Extract the UUID part from the ParentKey (remove /Antibioticform/Core_variables[X])
-		parentKey := record[7]
-		if strings.Contains(parentKey, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(parentKey, "/Antibioticform/")
-			if len(parts) > 0 {
-				indication.ParentKey = parts[0]
-			}
-		} else {
-			indication.ParentKey = parentKey
-		}
-	}
-	if len(record) > 8 && record[8] != "" {
-		// Extract the UUID part from the KEY (remove /Antibioticform/Core_variables[X])
-		key := record[8]
-		if strings.Contains(key, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(key, "/Antibioticform/")
-			if len(parts) > 0 {
-				indication.ID = parts[0]
-			}
-		} else {
-			indication.ID = key
-		}
-	}
-
-	return indication
 }
 
-func (s *CSVService) ParseOptionalVarRecord(record []string) models.OptionalVar {
-	optionalVar := models.OptionalVar{}
-
-	// Column order based on CSV structure (8 columns):
-	// 0: Prescriber (should go to prescriber_type)
-	// 1: Intraveno
-	// 2: OralSwitcl (OralSwitch)
-	// 3: NumberM (Number Missed Doses)
-	// 4: MissedDo (Missed Doses Reason)
-	// 5: Guideline (Guidelines Compliance)
-	// 6: Treatmen (Treatment Type)
-	// 7: PARENT_k KEY (UUIDs, should be used for both key and parent_key)
-
-	// Get parent_key from column 7 first
-	parentKey := ""
-	if len(record) > 7 && record[7] != "" {
-		parentKey = record[7] // PARENT_k KEY
-	}
+func (s *CSVService) ParseOptionalVarRecord(row *csvRow) models.OptionalVar {
 
-	// Set key to be the same as parent_key
-	optionalVar.ID = parentKey
-	optionalVar.ParentKey = parentKey
+	// The parent key is used for both key and parent_key
+	parentKey := row.get("parent_key")
 
-	// Map other columns
-	if len(record) > 0 && record[0] != "" {
-		optionalVar.PrescriberType = record[0] // Prescriber goes to prescriber_type
-	}
-	if len(record) > 1 && record[1] != "" {
-		optionalVar.IntravenousType = record[1] // Intraveno
-	}
-	if len(record) > 2 && record[2] != "" {
-		optionalVar.OralSwitch = record[2] // OralSwitcl
-	}
-	if len(record) > 3 && record[3] != "" {
-		if val, err := strconv.Atoi(record[3]); err == nil {
-			optionalVar.NumberMissedDoses = val // NumberM
-		}
-	}
-	if len(record) > 4 && record[4] != "" {
-		optionalVar.MissedDosesReason = record[4] // MissedDo
-	}
-	if len(record) > 5 && record[5] != "" {
-		optionalVar.GuidelinesCompliance = record[5] // Guideline
-	}
-	if len(record) > 6 && record[6] != "" {
-		optionalVar.TreatmentType = record[6] // Treatmen
+	return models.OptionalVar{
+		ID:                   parentKey,
+		ParentKey:            parentKey,
+		PrescriberType:       row.get("prescriber_type"),
+		IntravenousType:      row.code("intravenous_type"),
+		OralSwitch:           row.code("oral_switch"),
+		NumberMissedDoses:    row.intValue("number_missed_doses"),
+		MissedDosesReason:    row.get("missed_doses_reason"),
+		GuidelinesCompliance: row.code("guidelines_compliance"),
+		TreatmentType:        row.get("treatment_type"),
 	}
-
-	return optionalVar
 }
 
-func (s *CSVService) parseSpecimenRecord(record []string) models.Specimen {
-	specimen := models.Specimen{}
+func (s *CSVService) parseSpecimenRecord(row *csvRow) models.Specimen {
 
-	// Debug: Log the first few columns to understand the structure
-	first10 := record
-	if len(record) > 10 {
-		first10 = record[:10]
-	}
-	log.Printf("Specimen CSV Record structure - First 10 columns: %v", first10)
-	log.Printf("Specimen Total columns: %d", len(record))
-
-	// Based on the CSV structure:
-	// Column 1 (index 0): Specimen
-	// Column 2 (index 1): CultureRe
-	// Column 3 (index 2): Microorga
-	// Column 4 (index 3): Antibiotic
-	// Column 5 (index 4): Resistant
-	// Column 6 (index 5): PARENT_k
-	// Column 7 (index 6): KEY
-
-	if len(record) > 0 && record[0] != "" {
-		specimen.SpecimenType = record[0] // Specimen field
-	}
-	if len(record) > 1 && record[1] != "" {
-		specimen.CultureResult = record[1] // CultureRe
-	}
-	if len(record) > 2 && record[2] != "" {
-		specimen.Microorganism = record[2] // Microorga
+	return models.Specimen{
+		ID:                                  stripRepeatPath(row.get("key")),
+		ParentKey:                           stripRepeatPath(row.get("parent_key")),
+		SpecimenType:                        row.get("specimen_type"),
+		CultureResult:                       row.code("culture_result"),
+		Microorganism:                       row.get("microorganism"),
+		AntibioticSusceptibilityTestResults: row.get("antibiotic_susceptibility_test_results"),
+		ResistantPhenotype:                  row.get("resistant_phenotype"),
 	}
-	if len(record) > 3 && record[3] != "" {
-		specimen.AntibioticSusceptibilityTestResults = record[3] // Antibiotic
-	}
-	if len(record) > 4 && record[4] != "" {
-		specimen.ResistantPhenotype = record[4] // Resistant
-	}
-	if len(record) > 5 && record[5] != "" {
-		// Extract the UUID part from the ParentKey (remove /Antibioticform/Core_variables[X])
-		parentKey := record[5]
-		if strings.Contains(parentKey, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(parentKey, "/Antibioticform/")
-			if len(parts) > 0 {
-				specimen.ParentKey = parts[0]
-			}
-		} else {
-			specimen.ParentKey = parentKey
-		}
-	}
-	if len(record) > 6 && record[6] != "" {
-		// Extract the UUID part from the KEY (remove /Antibioticform/Core_variables[X])
-		key := record[6]
-		if strings.Contains(key, "/Antibioticform/") {
-			// Extract just the UUID part before /Antibioticform/
-			parts := strings.Split(key, "/Antibioticform/")
-			if len(parts) > 0 {
-				specimen.ID = parts[0]
-			}
-		} else {
-			specimen.ID = key
-		}
-	}
-
-	return specimen
 }
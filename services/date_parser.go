@@ -0,0 +1,241 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDateOptions is returned for an invalid date format or timezone
+var ErrDateOptions = errors.New("invalid date options")
+
+// Date formats accepted for ImportOptions.DateFormat, besides Go layouts
+const (
+	DateFormatAuto     = "auto"
+	DateFormatDayFirst = "DD/MM/YYYY"
+	DateFormatUS       = "MM/DD/YYYY"
+	DateFormatISO      = "YYYY-MM-DD"
+)
+
+// isoDateLayouts are tried before any configured format, so ISO dates, as
+// written by ODK and by the XLSX reader, are read the same in every import.
+// Layouts with a zone keep it; the others are read in the import's timezone.
+var isoDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.000000",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05.000000",
+	"2006-01-02",
+	"2006/01/02",
+}
+
+// numericDate matches day and month dates such as 03/04/2024 or 3-4-2024 12:30
+var numericDate = regexp.MustCompile(`^(\d{1,2})[/.-](\d{1,2})[/.-](\d{4})(?:[ T](\d{1,2}):(\d{2})(?::(\d{2}))?)?$`)
+
+// dateFormatTokens converts the parts of a format such as "DD/MM/YYYY HH:mm"
+// to Go layout elements. Longer tokens are matched first. Days and months
+// map to the unpadded elements, which also accept padded values.
+var dateFormatTokens = []struct {
+	token  string
+	layout string
+}{
+	{"YYYY", "2006"},
+	{"YY", "06"},
+	{"MMMM", "January"},
+	{"MMM", "Jan"},
+	{"MM", "1"},
+	{"DD", "2"},
+	{"HH", "15"},
+	{"mm", "04"},
+	{"ss", "05"},
+	{"M", "1"},
+	{"D", "2"},
+}
+
+// dateLayout converts a date format to a Go layout. Formats that already
+// are Go layouts, recognised by their "2006" year, are returned unchanged.
+func dateLayout(format string) (string, error) {
+	if strings.Contains(format, "2006") {
+		return format, nil
+	}
+
+	var layout strings.Builder
+	hasYear, hasMonth, hasDay := false, false, false
+	for i := 0; i < len(format); {
+		matched := false
+		for _, t := range dateFormatTokens {
+			if strings.HasPrefix(format[i:], t.token) {
+				layout.WriteString(t.layout)
+				switch t.token[0] {
+				case 'Y':
+					hasYear = true
+				case 'M':
+					hasMonth = true
+				case 'D':
+					hasDay = true
+				}
+				i += len(t.token)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			layout.WriteByte(format[i])
+			i++
+		}
+	}
+
+	if !hasYear || !hasMonth || !hasDay {
+		return "", fmt.Errorf("%w: date format %q must contain a year (YYYY), month (MM) and day (DD)", ErrDateOptions, format)
+	}
+	return layout.String(), nil
+}
+
+// dateParser reads the date columns of an import with its configured
+// formats and timezone
+type dateParser struct {
+	// layout is the Go layout of every date column; empty detects the format
+	layout string
+	// columns holds per-column layouts by normalised field or header name
+	columns map[string]string
+	loc     *time.Location
+}
+
+// newDateParser builds the date parser for opts. defaultTimezone is used
+// when opts does not name one.
+func newDateParser(opts ImportOptions, defaultTimezone string) (*dateParser, error) {
+	p := &dateParser{columns: make(map[string]string), loc: time.UTC}
+
+	timezone := opts.Timezone
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown timezone %q", ErrDateOptions, timezone)
+		}
+		p.loc = loc
+	}
+
+	if opts.DateFormat != "" && !strings.EqualFold(opts.DateFormat, DateFormatAuto) {
+		layout, err := dateLayout(opts.DateFormat)
+		if err != nil {
+			return nil, err
+		}
+		p.layout = layout
+	}
+
+	for column, format := range opts.ColumnDateFormats {
+		layout := ""
+		if !strings.EqualFold(format, DateFormatAuto) {
+			var err error
+			if layout, err = dateLayout(format); err != nil {
+				return nil, fmt.Errorf("%w (column %s)", err, column)
+			}
+		}
+		p.columns[normalizeHeader(column)] = layout
+	}
+
+	return p, nil
+}
+
+// ValidateDateOptions checks the date format, column formats and timezone
+// of opts
+func ValidateDateOptions(opts ImportOptions) error {
+	_, err := newDateParser(opts, "")
+	return err
+}
+
+// ParseDateFormats parses per-column date formats written as
+// "survey_date=DD/MM/YYYY,admission_date=YYYY-MM-DD"
+func ParseDateFormats(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	formats := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		column, format, ok := strings.Cut(part, "=")
+		column, format = strings.TrimSpace(column), strings.TrimSpace(format)
+		if !ok || column == "" || format == "" {
+			return nil, fmt.Errorf("%w: column date format %q must be written as column=format", ErrDateOptions, part)
+		}
+		formats[column] = format
+	}
+	return formats, nil
+}
+
+// layoutFor returns the layout configured for a field, or the import's
+// layout; empty means the format is detected
+func (p *dateParser) layoutFor(field, column string) string {
+	if layout, ok := p.columns[normalizeHeader(field)]; ok {
+		return layout
+	}
+	if layout, ok := p.columns[normalizeHeader(column)]; ok {
+		return layout
+	}
+	return p.layout
+}
+
+// parse reads a date value of field. ISO dates are always accepted; other
+// values must match the configured layout or, without one, are detected.
+// A non-empty warning is returned when a detected date could be read with
+// day and month either way round.
+func (p *dateParser) parse(field, column, value string) (time.Time, string, error) {
+	value = strings.TrimSpace(value)
+
+	for _, layout := range isoDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, p.loc); err == nil {
+			return t, "", nil
+		}
+	}
+
+	if layout := p.layoutFor(field, column); layout != "" {
+		t, err := time.ParseInLocation(layout, value, p.loc)
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("does not match the configured date format")
+		}
+		return t, "", nil
+	}
+
+	return p.detect(column, value)
+}
+
+// detect reads a day and month date whose order is not configured. When
+// only one order gives a valid date it is used; otherwise the month is read
+// first, as before formats were configurable, and a warning is returned.
+func (p *dateParser) detect(column, value string) (time.Time, string, error) {
+	m := numericDate.FindStringSubmatch(value)
+	if m == nil {
+		return time.Time{}, "", fmt.Errorf("unrecognised date format")
+	}
+
+	first, _ := strconv.Atoi(m[1])
+	second, _ := strconv.Atoi(m[2])
+	year, _ := strconv.Atoi(m[3])
+	hour, _ := strconv.Atoi(m[4])
+	minute, _ := strconv.Atoi(m[5])
+	sec, _ := strconv.Atoi(m[6])
+
+	month, day := first, second
+	warning := ""
+	switch {
+	case first > 12 && second <= 12:
+		month, day = second, first
+	case first <= 12 && second <= 12 && first != second:
+		warning = fmt.Sprintf("ambiguous date %q in column %s was read as month first (%s); set date_format to read it as day first",
+			value, column, time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Format("2 January 2006"))
+	}
+
+	t := time.Date(year, time.Month(month), day, hour, minute, sec, 0, p.loc)
+	if t.Month() != time.Month(month) || t.Day() != day || hour > 23 || minute > 59 || sec > 59 {
+		return time.Time{}, "", fmt.Errorf("no such day")
+	}
+	return t, warning, nil
+}
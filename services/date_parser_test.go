@@ -0,0 +1,161 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDateLayout(t *testing.T) {
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{format: DateFormatDayFirst, want: "2/1/2006"},
+		{format: DateFormatUS, want: "1/2/2006"},
+		{format: DateFormatISO, want: "2006-1-2"},
+		{format: "DD MMM YYYY HH:mm", want: "2 Jan 2006 15:04"},
+		{format: "02.01.2006", want: "02.01.2006"},
+		{format: "MM/YYYY", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := dateLayout(tt.format)
+		if tt.wantErr {
+			if !errors.Is(err, ErrDateOptions) {
+				t.Errorf("dateLayout(%q) error = %v, want ErrDateOptions", tt.format, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("dateLayout(%q) = %q, %v, want %q", tt.format, got, err, tt.want)
+		}
+	}
+}
+
+func TestDateParserParse(t *testing.T) {
+	kampala, err := time.LoadLocation("Africa/Kampala")
+	if err != nil {
+		t.Skipf("timezone data not available: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		opts        ImportOptions
+		field       string
+		value       string
+		want        time.Time
+		wantWarning bool
+		wantErr     bool
+	}{
+		{
+			name:  "iso date",
+			value: "2024-04-03",
+			want:  time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "iso date with zone keeps it",
+			value: "2024-04-03T10:00:00.000+03:00",
+			want:  time.Date(2024, 4, 3, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "day first detected",
+			value: "25/04/2024",
+			want:  time.Date(2024, 4, 25, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "ambiguous date read month first",
+			value:       "03/04/2024",
+			want:        time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			wantWarning: true,
+		},
+		{
+			name:  "same day and month is not ambiguous",
+			value: "04/04/2024",
+			want:  time.Date(2024, 4, 4, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "configured day first format",
+			opts:  ImportOptions{DateFormat: DateFormatDayFirst},
+			value: "03/04/2024",
+			want:  time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "column format overrides the import format",
+			opts:  ImportOptions{DateFormat: DateFormatUS, ColumnDateFormats: map[string]string{"Survey Date": DateFormatDayFirst}},
+			field: "survey_date",
+			value: "03/04/2024",
+			want:  time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "timezone of dates without one",
+			opts:  ImportOptions{Timezone: "Africa/Kampala"},
+			value: "2024-04-03 10:00:00",
+			want:  time.Date(2024, 4, 3, 10, 0, 0, 0, kampala),
+		},
+		{
+			name:    "value not matching the configured format",
+			opts:    ImportOptions{DateFormat: DateFormatDayFirst},
+			value:   "April 3rd",
+			wantErr: true,
+		},
+		{
+			name:    "no such day",
+			value:   "31/02/2024",
+			wantErr: true,
+		},
+		{
+			name:    "unrecognised value",
+			value:   "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newDateParser(tt.opts, "UTC")
+			if err != nil {
+				t.Fatalf("newDateParser: %v", err)
+			}
+
+			field := tt.field
+			if field == "" {
+				field = "admission_date"
+			}
+			got, warning, err := p.parse(field, field, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse(%q): %v", tt.value, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parse(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+			if (warning != "") != tt.wantWarning {
+				t.Errorf("parse(%q) warning = %q, want warning %v", tt.value, warning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestNewDateParserOptions(t *testing.T) {
+	if _, err := newDateParser(ImportOptions{Timezone: "Mars/Olympus"}, ""); !errors.Is(err, ErrDateOptions) {
+		t.Errorf("unknown timezone error = %v, want ErrDateOptions", err)
+	}
+	if _, err := ParseDateFormats("survey_date"); !errors.Is(err, ErrDateOptions) {
+		t.Errorf("column format without a format error = %v, want ErrDateOptions", err)
+	}
+
+	formats, err := ParseDateFormats("survey_date=DD/MM/YYYY, admission_date = YYYY-MM-DD")
+	if err != nil {
+		t.Fatalf("ParseDateFormats: %v", err)
+	}
+	if formats["survey_date"] != DateFormatDayFirst || formats["admission_date"] != DateFormatISO {
+		t.Errorf("ParseDateFormats = %v", formats)
+	}
+}
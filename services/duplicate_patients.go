@@ -0,0 +1,429 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"point-prevalence-survey/models"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Weights of the fields compared between two patients of the same ward and
+// survey date. They add up to 1.
+const (
+	duplicateWeightInitials  = 0.25
+	duplicateWeightCode      = 0.3
+	duplicateWeightAge       = 0.15
+	duplicateWeightGender    = 0.1
+	duplicateWeightAdmission = 0.2
+)
+
+// DefaultDuplicateScore is the score from 0 to 1 at which a pair of patients
+// is listed as a possible duplicate
+const DefaultDuplicateScore = 0.7
+
+// minDuplicateEvidence is the total weight of the fields both patients must
+// have filled in for the pair to be scored, so two records that only share a
+// gender are not listed
+const minDuplicateEvidence = 0.5
+
+var (
+	// ErrPatientNotFound is returned for an unknown patient key
+	ErrPatientNotFound = errors.New("patient not found")
+	// ErrInvalidDuplicate is wrapped by errors in the review of a duplicate pair
+	ErrInvalidDuplicate = errors.New("invalid duplicate review")
+)
+
+// DuplicateOptions narrows the search for duplicate patients
+type DuplicateOptions struct {
+	Facility string
+	Ward     string
+	// MinScore is the lowest score listed; zero uses DefaultDuplicateScore
+	MinScore float64
+}
+
+// DuplicateCandidate is a pair of patients of the same facility, ward and
+// survey date that may be the same patient surveyed twice
+type DuplicateCandidate struct {
+	// Score is the share of the compared fields that agree, from 0 to 1
+	Score      float64   `json:"score"`
+	Facility   string    `json:"facility"`
+	WardName   string    `json:"ward_name"`
+	SurveyDate time.Time `json:"survey_date"`
+	// Matching and Differing list the compared fields that agree and differ;
+	// fields blank on either patient are not compared
+	Matching  []string       `json:"matching"`
+	Differing []string       `json:"differing"`
+	Patient   models.Patient `json:"patient"`
+	Other     models.Patient `json:"other"`
+}
+
+// FindDuplicatePatients scores every pair of patients surveyed on the same
+// date in the same facility and ward on their initials, patient code, age,
+// gender and admission date. Excluded patients and pairs reviewed as
+// different patients are skipped.
+func FindDuplicatePatients(db *gorm.DB, opts DuplicateOptions) ([]DuplicateCandidate, error) {
+	if opts.MinScore <= 0 {
+		opts.MinScore = DefaultDuplicateScore
+	}
+
+	query := db.Model(&models.Patient{}).Where("excluded = ?", false)
+	if opts.Facility != "" {
+		query = query.Where("facility = ?", opts.Facility)
+	}
+	if opts.Ward != "" {
+		query = query.Where("ward_name = ?", opts.Ward)
+	}
+
+	var patients []models.Patient
+	if err := query.Order("facility, ward_name, survey_date, key").Find(&patients).Error; err != nil {
+		return nil, fmt.Errorf("error loading patients: %v", err)
+	}
+
+	var dismissals []models.DuplicateDismissal
+	if err := db.Find(&dismissals).Error; err != nil {
+		return nil, fmt.Errorf("error loading dismissed duplicates: %v", err)
+	}
+	dismissed := make(map[[2]string]bool, len(dismissals))
+	for _, dismissal := range dismissals {
+		dismissed[[2]string{dismissal.PatientKey, dismissal.OtherKey}] = true
+	}
+
+	// Only patients of the same ward on the same survey date are compared
+	groups := make(map[string][]int)
+	order := make([]string, 0)
+	for i, patient := range patients {
+		group := patient.Facility + "\x00" + patient.WardName + "\x00" + patient.SurveyDate.Format("2006-01-02")
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], i)
+	}
+
+	candidates := make([]DuplicateCandidate, 0)
+	for _, group := range order {
+		members := groups[group]
+		for i := 0; i < len(members); i++ {
+			for j := i + 1; j < len(members); j++ {
+				a, b := &patients[members[i]], &patients[members[j]]
+				if dismissed[duplicatePair(a.ID, b.ID)] {
+					continue
+				}
+
+				candidate, ok := scoreDuplicate(a, b)
+				if !ok || candidate.Score < opts.MinScore {
+					continue
+				}
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	return candidates, nil
+}
+
+// scoreDuplicate compares two patients, reporting false when too few fields
+// are filled in on both to tell
+func scoreDuplicate(a, b *models.Patient) (DuplicateCandidate, bool) {
+	candidate := DuplicateCandidate{
+		Facility:   a.Facility,
+		WardName:   a.WardName,
+		SurveyDate: a.SurveyDate,
+		Matching:   make([]string, 0),
+		Differing:  make([]string, 0),
+		Patient:    *a,
+		Other:      *b,
+	}
+
+	var compared, agreed float64
+	compare := func(field string, weight float64, present, same bool) {
+		if !present {
+			return
+		}
+		compared += weight
+		if same {
+			agreed += weight
+			candidate.Matching = append(candidate.Matching, field)
+		} else {
+			candidate.Differing = append(candidate.Differing, field)
+		}
+	}
+
+	initialsA, initialsB := valueKey(a.PatientInitials), valueKey(b.PatientInitials)
+	compare("patient_initials", duplicateWeightInitials, initialsA != "" && initialsB != "", initialsA == initialsB)
+
+	codeA, codeB := valueKey(a.PatientCode), valueKey(b.PatientCode)
+	compare("patient_code", duplicateWeightCode, codeA != "" && codeB != "", codeA == codeB)
+
+	ageA, ageB := a.AgeYears*12+a.AgeMonths, b.AgeYears*12+b.AgeMonths
+	compare("age", duplicateWeightAge, ageA > 0 && ageB > 0, sameAge(ageA, ageB))
+
+	genderA, genderB := NormalizeValue("gender", a.Gender), NormalizeValue("gender", b.Gender)
+	compare("gender", duplicateWeightGender, knownCode(genderA) && knownCode(genderB), genderA == genderB)
+
+	compare("admission_date", duplicateWeightAdmission, !a.AdmissionDate.IsZero() && !b.AdmissionDate.IsZero(),
+		a.AdmissionDate.Format("2006-01-02") == b.AdmissionDate.Format("2006-01-02"))
+
+	if compared < minDuplicateEvidence {
+		return candidate, false
+	}
+	candidate.Score = math.Round(agreed/compared*100) / 100
+	return candidate, true
+}
+
+// sameAge compares ages in months, allowing a year between adult ages since
+// collectors round them differently, and a month between infant ages
+func sameAge(a, b int) bool {
+	tolerance := 1
+	if a >= 24 && b >= 24 {
+		tolerance = 12
+	}
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= tolerance
+}
+
+// knownCode reports whether a categorical code holds an answer
+func knownCode(code string) bool {
+	return code != "" && code != CodeUnknown
+}
+
+// duplicatePair orders the keys of a pair of patients, smaller key first
+func duplicatePair(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// unmergedFields are the patient fields a merge never copies: the keys, the
+// import and the exclusion
+var unmergedFields = map[string]bool{
+	"ID":              true,
+	"InstanceID":      true,
+	"ImportID":        true,
+	"Excluded":        true,
+	"ExclusionReason": true,
+	"DuplicateOf":     true,
+}
+
+// MergePatients keeps one of two records of the same patient. Text and date
+// fields blank on the kept record are filled in from the duplicate, and the
+// duplicate is excluded from the indicators together with its antibiotics
+// and other child rows. A zero number may be a real answer, such as the age
+// in months of an adult, so numeric fields are only filled in when named in
+// numeric. It returns the kept patient and the fields filled in.
+func MergePatients(db *gorm.DB, keepKey, duplicateKey string, numeric []string) (*models.Patient, []string, error) {
+	if keepKey == duplicateKey {
+		return nil, nil, fmt.Errorf("%w: a patient cannot be merged into itself", ErrInvalidDuplicate)
+	}
+
+	fillNumeric := make(map[string]bool, len(numeric))
+	for _, name := range numeric {
+		if !numericPatientFields()[name] {
+			return nil, nil, fmt.Errorf("%w: %s is not a numeric patient field", ErrInvalidDuplicate, name)
+		}
+		fillNumeric[name] = true
+	}
+
+	var keep, duplicate models.Patient
+	if err := findPatient(db, keepKey, &keep); err != nil {
+		return nil, nil, err
+	}
+	if err := findPatient(db, duplicateKey, &duplicate); err != nil {
+		return nil, nil, err
+	}
+	if keep.Excluded {
+		return nil, nil, fmt.Errorf("%w: patient %s is excluded, so it cannot be kept", ErrInvalidDuplicate, keep.ID)
+	}
+
+	filled := fillBlankFields(&keep, &duplicate, fillNumeric)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(filled) > 0 {
+			if err := tx.Omit("import_id").Save(&keep).Error; err != nil {
+				return fmt.Errorf("error updating patient %s: %v", keep.ID, err)
+			}
+		}
+
+		if err := tx.Model(&models.Patient{}).Where("key = ?", duplicate.ID).Updates(map[string]interface{}{
+			"excluded":         true,
+			"exclusion_reason": "duplicate of " + keep.ID,
+			"duplicate_of":     keep.ID,
+		}).Error; err != nil {
+			return fmt.Errorf("error excluding patient %s: %v", duplicate.ID, err)
+		}
+
+		// Records merged into the duplicate earlier now point at the kept one
+		if err := tx.Model(&models.Patient{}).Where("duplicate_of = ?", duplicate.ID).Updates(map[string]interface{}{
+			"exclusion_reason": "duplicate of " + keep.ID,
+			"duplicate_of":     keep.ID,
+		}).Error; err != nil {
+			return fmt.Errorf("error updating duplicates of patient %s: %v", duplicate.ID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Merged patient %s into %s, filled %d fields", duplicate.ID, keep.ID, len(filled))
+	return &keep, filled, nil
+}
+
+// fillBlankFields copies the values of from into the blank text and date
+// columns of to, and into the zero numeric columns named in numeric, and
+// returns their JSON names
+func fillBlankFields(to, from *models.Patient, numeric map[string]bool) []string {
+	filled := make([]string, 0)
+
+	vt := reflect.ValueOf(to).Elem()
+	vf := reflect.ValueOf(from).Elem()
+	for i := 0; i < vt.NumField(); i++ {
+		field := vt.Type().Field(i)
+		if unmergedFields[field.Name] {
+			continue
+		}
+		switch {
+		case field.Type.Kind() == reflect.String, field.Type == reflect.TypeOf(time.Time{}):
+		case isNumeric(field.Type) && numeric[jsonName(field)]:
+		default:
+			continue
+		}
+		if !vt.Field(i).IsZero() || vf.Field(i).IsZero() {
+			continue
+		}
+		vt.Field(i).Set(vf.Field(i))
+		filled = append(filled, jsonName(field))
+	}
+
+	return filled
+}
+
+// numericPatientFields returns the JSON names of the numeric patient fields
+// a merge can be asked to fill in
+func numericPatientFields() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(models.Patient{})
+	for i := 0; i < t.NumField(); i++ {
+		if isNumeric(t.Field(i).Type) && !unmergedFields[t.Field(i).Name] {
+			fields[jsonName(t.Field(i))] = true
+		}
+	}
+	return fields
+}
+
+// isNumeric reports whether t is an integer or float type
+func isNumeric(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// jsonName returns the JSON name of a struct field
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// ExcludePatient leaves a patient and its child rows out of the indicators
+func ExcludePatient(db *gorm.DB, key, reason string) (*models.Patient, error) {
+	var patient models.Patient
+	if err := findPatient(db, key, &patient); err != nil {
+		return nil, err
+	}
+
+	if reason == "" {
+		reason = "excluded"
+	}
+	patient.Excluded = true
+	patient.ExclusionReason = reason
+
+	if err := db.Model(&patient).Updates(map[string]interface{}{
+		"excluded":         true,
+		"exclusion_reason": reason,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("error excluding patient %s: %v", key, err)
+	}
+
+	log.Printf("Excluded patient %s: %s", key, reason)
+	return &patient, nil
+}
+
+// IncludePatient reverses an exclusion or merge, counting the patient in the
+// indicators again
+func IncludePatient(db *gorm.DB, key string) (*models.Patient, error) {
+	var patient models.Patient
+	if err := findPatient(db, key, &patient); err != nil {
+		return nil, err
+	}
+
+	patient.Excluded = false
+	patient.ExclusionReason = ""
+	patient.DuplicateOf = ""
+
+	if err := db.Model(&patient).Updates(map[string]interface{}{
+		"excluded":         false,
+		"exclusion_reason": "",
+		"duplicate_of":     "",
+	}).Error; err != nil {
+		return nil, fmt.Errorf("error including patient %s: %v", key, err)
+	}
+
+	log.Printf("Included patient %s", key)
+	return &patient, nil
+}
+
+// DismissDuplicate records that two patients are different patients, so
+// the pair is no longer listed as a possible duplicate
+func DismissDuplicate(db *gorm.DB, patientKey, otherKey, reviewedBy string) (*models.DuplicateDismissal, error) {
+	if patientKey == otherKey {
+		return nil, fmt.Errorf("%w: a patient cannot be compared with itself", ErrInvalidDuplicate)
+	}
+
+	var patient, other models.Patient
+	if err := findPatient(db, patientKey, &patient); err != nil {
+		return nil, err
+	}
+	if err := findPatient(db, otherKey, &other); err != nil {
+		return nil, err
+	}
+
+	pair := duplicatePair(patientKey, otherKey)
+	dismissal := models.DuplicateDismissal{PatientKey: pair[0], OtherKey: pair[1]}
+	if err := db.Where(&dismissal).Attrs(models.DuplicateDismissal{ReviewedBy: reviewedBy}).FirstOrCreate(&dismissal).Error; err != nil {
+		return nil, fmt.Errorf("error dismissing duplicate pair: %v", err)
+	}
+
+	return &dismissal, nil
+}
+
+// findPatient loads a patient by key, without its child rows
+func findPatient(db *gorm.DB, key string, patient *models.Patient) error {
+	if err := db.First(patient, "key = ?", key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: %s", ErrPatientNotFound, key)
+		}
+		return err
+	}
+	return nil
+}
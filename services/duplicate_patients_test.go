@@ -0,0 +1,187 @@
+package services
+
+import (
+	"point-prevalence-survey/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScoreDuplicate(t *testing.T) {
+	admitted := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	base := models.Patient{
+		PatientInitials: "J.D.",
+		PatientCode:     "P-001",
+		AgeYears:        42,
+		Gender:          "Male",
+		AdmissionDate:   admitted,
+	}
+
+	tests := []struct {
+		name      string
+		other     func(p *models.Patient)
+		ok        bool
+		score     float64
+		differing []string
+	}{
+		{
+			name:  "identical",
+			other: func(p *models.Patient) {},
+			ok:    true,
+			score: 1,
+		},
+		{
+			name: "spelling and rounding differences",
+			other: func(p *models.Patient) {
+				p.PatientInitials = "jd"
+				p.PatientCode = "p 001"
+				p.AgeYears = 43
+				p.Gender = "M"
+			},
+			ok:    true,
+			score: 1,
+		},
+		{
+			name: "different admission date",
+			other: func(p *models.Patient) {
+				p.AdmissionDate = admitted.AddDate(0, 0, 3)
+			},
+			ok:        true,
+			score:     0.8,
+			differing: []string{"admission_date"},
+		},
+		{
+			name: "blank fields are not compared",
+			other: func(p *models.Patient) {
+				p.PatientCode = ""
+				p.AgeYears = 0
+			},
+			ok:    true,
+			score: 1,
+		},
+		{
+			name: "too little to compare",
+			other: func(p *models.Patient) {
+				*p = models.Patient{Gender: "Male", AgeYears: 42}
+			},
+			ok: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := base, base
+			tt.other(&b)
+
+			candidate, ok := scoreDuplicate(&a, &b)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if candidate.Score != tt.score {
+				t.Errorf("score = %v, want %v", candidate.Score, tt.score)
+			}
+			if len(tt.differing) > 0 && !reflect.DeepEqual(candidate.Differing, tt.differing) {
+				t.Errorf("differing = %v, want %v", candidate.Differing, tt.differing)
+			}
+		})
+	}
+}
+
+func TestSameAge(t *testing.T) {
+	tests := []struct {
+		a, b int
+		want bool
+	}{
+		{a: 42 * 12, b: 43 * 12, want: true},
+		{a: 42 * 12, b: 44 * 12, want: false},
+		{a: 6, b: 7, want: true},
+		{a: 6, b: 8, want: false},
+		{a: 12, b: 24, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := sameAge(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameAge(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFillBlankFields(t *testing.T) {
+	admitted := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	duplicate := models.Patient{
+		ID:                       "uuid:2",
+		PatientCode:              "P-001",
+		Gender:                   "Female",
+		AdmissionDate:            admitted,
+		AgeMonths:                5,
+		PatientNumberAntibiotics: 2,
+		WardEligiblePatients:     12,
+		Weight:                   61.5,
+		RandNum:                  7,
+		Excluded:                 true,
+	}
+
+	tests := []struct {
+		name    string
+		numeric map[string]bool
+		want    []string
+		check   func(t *testing.T, p *models.Patient)
+	}{
+		{
+			name: "text and dates only",
+			want: []string{"patient_code", "admission_date"},
+			check: func(t *testing.T, p *models.Patient) {
+				if p.AgeMonths != 0 || p.PatientNumberAntibiotics != 0 || p.WardEligiblePatients != 0 ||
+					p.Weight != 0 || p.RandNum != 0 {
+					t.Errorf("numeric fields were filled in: %+v", p)
+				}
+			},
+		},
+		{
+			name:    "numeric fields asked for",
+			numeric: map[string]bool{"weight": true},
+			want:    []string{"patient_code", "weight", "admission_date"},
+			check: func(t *testing.T, p *models.Patient) {
+				if p.Weight != 61.5 {
+					t.Errorf("weight = %v, want 61.5", p.Weight)
+				}
+				if p.AgeMonths != 0 {
+					t.Errorf("age_months = %v, want 0", p.AgeMonths)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := models.Patient{ID: "uuid:1", Gender: "Male", AgeYears: 40}
+			dup := duplicate
+
+			filled := fillBlankFields(&keep, &dup, tt.numeric)
+			if !reflect.DeepEqual(filled, tt.want) {
+				t.Errorf("filled = %v, want %v", filled, tt.want)
+			}
+			if keep.ID != "uuid:1" || keep.Gender != "Male" || keep.Excluded {
+				t.Errorf("kept fields were overwritten: %+v", keep)
+			}
+			tt.check(t, &keep)
+		})
+	}
+}
+
+func TestNumericPatientFields(t *testing.T) {
+	fields := numericPatientFields()
+	for _, name := range []string{"age_months", "weight", "rand_num", "patient_number_antibiotics"} {
+		if !fields[name] {
+			t.Errorf("%s is not a numeric field", name)
+		}
+	}
+	for _, name := range []string{"gender", "admission_date", "import_id"} {
+		if fields[name] {
+			t.Errorf("%s is a numeric field", name)
+		}
+	}
+}
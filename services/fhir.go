@@ -0,0 +1,908 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"point-prevalence-survey/models"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// JobEntityFHIR is the entity recorded on import jobs for FHIR bundles
+const JobEntityFHIR = "fhir"
+
+// Identifier systems of the survey records in FHIR resources. Every exported
+// resource carries the key of its record, so importing it again finds the
+// same record.
+const (
+	FHIRSystemPatient    = "urn:pps:patient"
+	FHIRSystemAntibiotic = "urn:pps:antibiotic"
+	FHIRSystemIndication = "urn:pps:indication"
+	FHIRSystemSpecimen   = "urn:pps:specimen"
+)
+
+// FHIRExtensionBase prefixes the URL of the extensions holding survey fields
+// that have no FHIR element, followed by the field's JSON name, e.g.
+// urn:pps:field:ward_total_patients
+const FHIRExtensionBase = "urn:pps:field:"
+
+// Types of exported bundles. Transaction bundles can be posted to a FHIR
+// server as they are.
+const (
+	FHIRBundleCollection  = "collection"
+	FHIRBundleTransaction = "transaction"
+)
+
+const (
+	fhirSystemATC            = "http://www.whocc.no/atc"
+	fhirSystemActCode        = "http://terminology.hl7.org/CodeSystem/v3-ActCode"
+	fhirSystemInterpretation = "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation"
+)
+
+// FHIRBundle is a FHIR R4 Bundle
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id,omitempty"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry"`
+}
+
+// FHIRBundleEntry is a resource of a bundle. Entries of transaction bundles
+// carry the request that writes the resource.
+type FHIRBundleEntry struct {
+	FullURL  string             `json:"fullUrl,omitempty"`
+	Resource *FHIRResource      `json:"resource"`
+	Request  *FHIRBundleRequest `json:"request,omitempty"`
+}
+
+// FHIRBundleRequest is the request of a transaction bundle entry
+type FHIRBundleRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// FHIRResource holds the elements of the resource types a survey patient is
+// exported as: Patient, Encounter, MedicationRequest, Condition, Specimen and
+// Observation. Each resource only sets the elements of its own type.
+type FHIRResource struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id,omitempty"`
+	Extension    []FHIRExtension  `json:"extension,omitempty"`
+	Identifier   []FHIRIdentifier `json:"identifier,omitempty"`
+	Status       string           `json:"status,omitempty"`
+
+	// Patient
+	Gender string          `json:"gender,omitempty"`
+	Name   []FHIRHumanName `json:"name,omitempty"`
+
+	// Encounter
+	Class           *FHIRCoding             `json:"class,omitempty"`
+	Period          *FHIRPeriod             `json:"period,omitempty"`
+	Location        []FHIREncounterLocation `json:"location,omitempty"`
+	ServiceProvider *FHIRReference          `json:"serviceProvider,omitempty"`
+
+	// MedicationRequest
+	Intent                    string               `json:"intent,omitempty"`
+	MedicationCodeableConcept *FHIRCodeableConcept `json:"medicationCodeableConcept,omitempty"`
+	AuthoredOn                string               `json:"authoredOn,omitempty"`
+	DosageInstruction         []FHIRDosage         `json:"dosageInstruction,omitempty"`
+
+	// Condition, Specimen and Observation
+	Category             []FHIRCodeableConcept      `json:"category,omitempty"`
+	Code                 *FHIRCodeableConcept       `json:"code,omitempty"`
+	Type                 *FHIRCodeableConcept       `json:"type,omitempty"`
+	OnsetDateTime        string                     `json:"onsetDateTime,omitempty"`
+	Specimen             *FHIRReference             `json:"specimen,omitempty"`
+	ValueCodeableConcept *FHIRCodeableConcept       `json:"valueCodeableConcept,omitempty"`
+	Component            []FHIRObservationComponent `json:"component,omitempty"`
+
+	Subject   *FHIRReference   `json:"subject,omitempty"`
+	Encounter *FHIRReference   `json:"encounter,omitempty"`
+	Note      []FHIRAnnotation `json:"note,omitempty"`
+}
+
+// FHIRExtension is an extension holding one value
+type FHIRExtension struct {
+	URL           string  `json:"url"`
+	ValueString   string  `json:"valueString,omitempty"`
+	ValueInteger  int     `json:"valueInteger,omitempty"`
+	ValueDecimal  float64 `json:"valueDecimal,omitempty"`
+	ValueDateTime string  `json:"valueDateTime,omitempty"`
+}
+
+// FHIRIdentifier is a FHIR Identifier
+type FHIRIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+// FHIRCoding is a FHIR Coding
+type FHIRCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// FHIRCodeableConcept is a FHIR CodeableConcept
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+// FHIRReference is a FHIR Reference
+type FHIRReference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+// FHIRHumanName is a FHIR HumanName; survey patients only have initials
+type FHIRHumanName struct {
+	Text string `json:"text,omitempty"`
+}
+
+// FHIRPeriod is a FHIR Period
+type FHIRPeriod struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// FHIREncounterLocation is a location of an Encounter
+type FHIREncounterLocation struct {
+	Location FHIRReference `json:"location"`
+}
+
+// FHIRQuantity is a FHIR Quantity
+type FHIRQuantity struct {
+	Value      float64 `json:"value"`
+	Comparator string  `json:"comparator,omitempty"`
+	Unit       string  `json:"unit,omitempty"`
+}
+
+// FHIRDosage is a FHIR Dosage
+type FHIRDosage struct {
+	Text        string               `json:"text,omitempty"`
+	Route       *FHIRCodeableConcept `json:"route,omitempty"`
+	DoseAndRate []FHIRDoseAndRate    `json:"doseAndRate,omitempty"`
+}
+
+// FHIRDoseAndRate is the dose of a Dosage
+type FHIRDoseAndRate struct {
+	DoseQuantity *FHIRQuantity `json:"doseQuantity,omitempty"`
+}
+
+// FHIRAnnotation is a FHIR Annotation
+type FHIRAnnotation struct {
+	Text string `json:"text"`
+}
+
+// FHIRObservationComponent is a component of an Observation
+type FHIRObservationComponent struct {
+	Code           FHIRCodeableConcept   `json:"code"`
+	ValueQuantity  *FHIRQuantity         `json:"valueQuantity,omitempty"`
+	Interpretation []FHIRCodeableConcept `json:"interpretation,omitempty"`
+}
+
+// Survey fields written to FHIR elements, or never exported, rather than to
+// extensions
+var (
+	fhirPatientElements = map[string]bool{
+		"id": true, "instance_id": true, "gender": true, "patient_initials": true,
+		"exclusion_reason": true, "duplicate_of": true,
+	}
+	fhirEncounterFields = map[string]bool{
+		"region": true, "district": true, "subcounty": true, "facility": true,
+		"level_of_care": true, "ownership": true, "ward_name": true, "ward_total_patients": true,
+		"ward_eligible_patients": true, "survey_date": true, "admission_date": true,
+	}
+	fhirEncounterElements = map[string]bool{
+		"facility": true, "ward_name": true, "admission_date": true,
+	}
+	fhirAntibioticElements = map[string]bool{
+		"id": true, "parent_key": true, "antibiotic_inn_name": true, "atc_code": true,
+		"start_date_antibiotic": true, "unit_dose": true, "unit_dose_measure_unit": true,
+		"unit_dose_frequency": true, "administration_route": true, "antibiotic_notes": true,
+		"ddd": true, "ddd_unit": true,
+	}
+	fhirIndicationElements = map[string]bool{
+		"id": true, "parent_key": true, "indication_type": true, "diagnosis": true,
+		"start_date_treatment": true,
+	}
+	fhirSpecimenElements = map[string]bool{
+		"id": true, "parent_key": true, "specimen_type": true,
+	}
+	fhirCultureFields = map[string]bool{
+		"culture_result": true, "resistant_phenotype": true,
+	}
+)
+
+// fhirGenders are the genders FHIR Patient.gender allows
+var fhirGenders = map[string]bool{"male": true, "female": true, "other": true, "unknown": true}
+
+// fhirIDInvalid matches the characters FHIR resource IDs may not hold
+var fhirIDInvalid = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// ExportFHIR writes every patient selected by query as a FHIR bundle, one
+// bundle per line (NDJSON), and returns the number of bundles written
+func ExportFHIR(query *gorm.DB, w io.Writer, bundleType string) (int, error) {
+	count := 0
+	encoder := json.NewEncoder(w)
+
+	var patients []models.Patient
+	err := query.Preload("Antibiotics").Preload("Indications").Preload("Specimens.SusceptibilityResults").
+		FindInBatches(&patients, 100, func(tx *gorm.DB, batch int) error {
+			for i := range patients {
+				if err := encoder.Encode(PatientBundle(&patients[i], bundleType)); err != nil {
+					return fmt.Errorf("error writing bundle: %v", err)
+				}
+				count++
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return count, fmt.Errorf("error exporting patients: %v", err)
+	}
+
+	return count, nil
+}
+
+// PatientBundle returns the FHIR bundle of a survey patient: a Patient, an
+// Encounter for the admission, a MedicationRequest for each antibiotic, a
+// Condition for each indication, and a Specimen with an Observation of its
+// culture for each specimen. Transaction bundles PUT every resource by ID,
+// so posting a bundle again updates the same resources.
+func PatientBundle(patient *models.Patient, bundleType string) *FHIRBundle {
+	patientID := fhirID(patient.ID)
+	subject := &FHIRReference{Reference: "Patient/" + patientID}
+	encounterID := fhirID(patient.ID + "-encounter")
+	encounter := &FHIRReference{Reference: "Encounter/" + encounterID}
+
+	bundle := &FHIRBundle{
+		ResourceType: "Bundle",
+		ID:           patientID,
+		Type:         bundleType,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		Entry:        make([]FHIRBundleEntry, 0),
+	}
+
+	bundle.add(fhirPatient(patient, patientID))
+	bundle.add(fhirEncounter(patient, encounterID, subject))
+	for i := range patient.Antibiotics {
+		bundle.add(fhirMedicationRequest(&patient.Antibiotics[i], subject, encounter))
+	}
+	for i := range patient.Indications {
+		bundle.add(fhirCondition(&patient.Indications[i], subject, encounter))
+	}
+	for i := range patient.Specimens {
+		specimen, culture := fhirSpecimen(&patient.Specimens[i], subject, encounter)
+		bundle.add(specimen)
+		bundle.add(culture)
+	}
+
+	return bundle
+}
+
+// add appends resource to the bundle
+func (b *FHIRBundle) add(resource *FHIRResource) {
+	entry := FHIRBundleEntry{Resource: resource}
+	if b.Type == FHIRBundleTransaction {
+		entry.Request = &FHIRBundleRequest{Method: "PUT", URL: resource.ResourceType + "/" + resource.ID}
+	}
+	b.Entry = append(b.Entry, entry)
+}
+
+// fhirPatient returns the Patient resource of a survey patient
+func fhirPatient(patient *models.Patient, id string) *FHIRResource {
+	resource := &FHIRResource{
+		ResourceType: "Patient",
+		ID:           id,
+		Identifier:   []FHIRIdentifier{{System: FHIRSystemPatient, Value: patient.ID}},
+	}
+	if patient.PatientInitials != "" {
+		resource.Name = []FHIRHumanName{{Text: patient.PatientInitials}}
+	}
+
+	// Genders FHIR has no code for are kept in an extension
+	fields := fhirPatientElements
+	if fhirGenders[patient.Gender] {
+		resource.Gender = patient.Gender
+	} else if patient.Gender != "" {
+		resource.Gender = "unknown"
+		fields = withoutField(fields, "gender")
+	}
+	resource.Extension = fhirFieldExtensions(patient, func(name string) bool {
+		return !fields[name] && !fhirEncounterFields[name]
+	})
+
+	return resource
+}
+
+// fhirEncounter returns the Encounter of a survey patient's admission, with
+// the facility and ward
+func fhirEncounter(patient *models.Patient, id string, subject *FHIRReference) *FHIRResource {
+	resource := &FHIRResource{
+		ResourceType: "Encounter",
+		ID:           id,
+		Status:       "in-progress",
+		Class:        &FHIRCoding{System: fhirSystemActCode, Code: "IMP", Display: "inpatient encounter"},
+		Subject:      subject,
+	}
+	if !patient.AdmissionDate.IsZero() {
+		resource.Period = &FHIRPeriod{Start: fhirDateTime(patient.AdmissionDate)}
+	}
+	if patient.Facility != "" {
+		resource.ServiceProvider = &FHIRReference{Display: patient.Facility}
+	}
+	if patient.WardName != "" {
+		resource.Location = []FHIREncounterLocation{{Location: FHIRReference{Display: patient.WardName}}}
+	}
+	resource.Extension = fhirFieldExtensions(patient, func(name string) bool {
+		return fhirEncounterFields[name] && !fhirEncounterElements[name]
+	})
+
+	return resource
+}
+
+// fhirMedicationRequest returns the MedicationRequest of an antibiotic
+func fhirMedicationRequest(antibiotic *models.Antibiotic, subject, encounter *FHIRReference) *FHIRResource {
+	medication := &FHIRCodeableConcept{Text: antibiotic.AntibioticINNName}
+	if antibiotic.ATCCode != "" {
+		medication.Coding = []FHIRCoding{{System: fhirSystemATC, Code: antibiotic.ATCCode, Display: antibiotic.AntibioticINNName}}
+	}
+
+	resource := &FHIRResource{
+		ResourceType:              "MedicationRequest",
+		ID:                        fhirID(antibiotic.ID),
+		Identifier:                []FHIRIdentifier{{System: FHIRSystemAntibiotic, Value: antibiotic.ID}},
+		Status:                    "active",
+		Intent:                    "order",
+		MedicationCodeableConcept: medication,
+		Subject:                   subject,
+		Encounter:                 encounter,
+	}
+	if !antibiotic.StartDateAntibiotic.IsZero() {
+		resource.AuthoredOn = fhirDateTime(antibiotic.StartDateAntibiotic)
+	}
+
+	dosage := FHIRDosage{Text: antibiotic.UnitDoseFrequency}
+	if antibiotic.AdministrationRoute != "" {
+		dosage.Route = &FHIRCodeableConcept{Text: antibiotic.AdministrationRoute}
+	}
+	if antibiotic.UnitDose != 0 {
+		dosage.DoseAndRate = []FHIRDoseAndRate{{DoseQuantity: &FHIRQuantity{Value: antibiotic.UnitDose, Unit: antibiotic.UnitDoseMeasureUnit}}}
+	}
+	if dosage.Text != "" || dosage.Route != nil || dosage.DoseAndRate != nil {
+		resource.DosageInstruction = []FHIRDosage{dosage}
+	}
+	if antibiotic.AntibioticNotes != "" {
+		resource.Note = []FHIRAnnotation{{Text: antibiotic.AntibioticNotes}}
+	}
+	resource.Extension = fhirFieldExtensions(antibiotic, func(name string) bool {
+		return !fhirAntibioticElements[name]
+	})
+
+	return resource
+}
+
+// fhirCondition returns the Condition an antibiotic was prescribed for
+func fhirCondition(indication *models.Indication, subject, encounter *FHIRReference) *FHIRResource {
+	resource := &FHIRResource{
+		ResourceType: "Condition",
+		ID:           fhirID(indication.ID),
+		Identifier:   []FHIRIdentifier{{System: FHIRSystemIndication, Value: indication.ID}},
+		Subject:      subject,
+		Encounter:    encounter,
+	}
+	if indication.IndicationType != "" {
+		resource.Category = []FHIRCodeableConcept{{Text: indication.IndicationType}}
+	}
+	if indication.Diagnosis != "" {
+		resource.Code = &FHIRCodeableConcept{Text: indication.Diagnosis}
+	}
+	if !indication.StartDateTreatment.IsZero() {
+		resource.OnsetDateTime = fhirDateTime(indication.StartDateTreatment)
+	}
+	resource.Extension = fhirFieldExtensions(indication, func(name string) bool {
+		return !fhirIndicationElements[name]
+	})
+
+	return resource
+}
+
+// fhirSpecimen returns the Specimen resource of a specimen and the
+// Observation of its culture, with the organism and a component for each
+// susceptibility result. The results are also kept as text in a note, which
+// an import reads them from.
+func fhirSpecimen(specimen *models.Specimen, subject, encounter *FHIRReference) (*FHIRResource, *FHIRResource) {
+	id := fhirID(specimen.ID)
+
+	resource := &FHIRResource{
+		ResourceType: "Specimen",
+		ID:           id,
+		Identifier:   []FHIRIdentifier{{System: FHIRSystemSpecimen, Value: specimen.ID}},
+		Status:       "available",
+		Subject:      subject,
+	}
+	if specimen.SpecimenType != "" {
+		resource.Type = &FHIRCodeableConcept{Text: specimen.SpecimenType}
+	}
+	resource.Extension = fhirFieldExtensions(specimen, func(name string) bool {
+		return !fhirSpecimenElements[name] && !fhirCultureFields[name] && name != "microorganism" &&
+			name != "antibiotic_susceptibility_test_results"
+	})
+
+	culture := &FHIRResource{
+		ResourceType: "Observation",
+		ID:           fhirID(specimen.ID + "-culture"),
+		Status:       "final",
+		Code:         &FHIRCodeableConcept{Text: "Microbial culture"},
+		Subject:      subject,
+		Encounter:    encounter,
+		Specimen:     &FHIRReference{Reference: "Specimen/" + id},
+	}
+	if specimen.Microorganism != "" {
+		culture.ValueCodeableConcept = &FHIRCodeableConcept{Text: specimen.Microorganism}
+	}
+	if specimen.AntibioticSusceptibilityTestResults != "" {
+		culture.Note = []FHIRAnnotation{{Text: specimen.AntibioticSusceptibilityTestResults}}
+	}
+	for _, result := range specimen.SusceptibilityResults {
+		culture.Component = append(culture.Component, fhirSusceptibility(result))
+	}
+	culture.Extension = fhirFieldExtensions(specimen, func(name string) bool {
+		return fhirCultureFields[name]
+	})
+
+	return resource, culture
+}
+
+// fhirSusceptibility returns the Observation component of a susceptibility
+// result, with its MIC in mg/L or its zone diameter in mm
+func fhirSusceptibility(result models.SusceptibilityResult) FHIRObservationComponent {
+	text := result.Antibiotic
+	if result.Organism != "" {
+		text = result.Organism + ": " + result.Antibiotic
+	}
+	component := FHIRObservationComponent{Code: FHIRCodeableConcept{Text: text}}
+
+	if result.Interpretation != "" {
+		component.Interpretation = []FHIRCodeableConcept{{
+			Coding: []FHIRCoding{{System: fhirSystemInterpretation, Code: result.Interpretation}},
+		}}
+	}
+	switch {
+	case result.MIC != nil:
+		component.ValueQuantity = &FHIRQuantity{Value: *result.MIC, Unit: "mg/L"}
+		if result.MICComparator != "=" {
+			component.ValueQuantity.Comparator = result.MICComparator
+		}
+	case result.ZoneDiameter != nil:
+		component.ValueQuantity = &FHIRQuantity{Value: *result.ZoneDiameter, Unit: "mm"}
+	}
+
+	return component
+}
+
+// fhirID turns a survey key into a FHIR resource ID, which may only hold
+// letters, digits, '-' and '.', and at most 64 of them
+func fhirID(key string) string {
+	id := fhirIDInvalid.ReplaceAllString(key, "-")
+	if len(id) > 64 {
+		sum := sha256.Sum256([]byte(key))
+		id = "pps-" + hex.EncodeToString(sum[:16])
+	}
+	return id
+}
+
+// fhirDateTime writes a time as a FHIR date when it has no time of day, and
+// as a FHIR dateTime otherwise
+func fhirDateTime(t time.Time) string {
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseFHIRDateTime reads a FHIR date or dateTime, which may be partial
+func parseFHIRDateTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid FHIR date %q", value)
+}
+
+// withoutField returns a copy of fields without name
+func withoutField(fields map[string]bool, name string) map[string]bool {
+	copied := make(map[string]bool, len(fields))
+	for field, ok := range fields {
+		copied[field] = ok && field != name
+	}
+	return copied
+}
+
+// fhirFieldExtensions returns an extension for each set text, number or date
+// field of model that include accepts, by JSON name
+func fhirFieldExtensions(model interface{}, include func(name string) bool) []FHIRExtension {
+	value := reflect.Indirect(reflect.ValueOf(model))
+	extensions := make([]FHIRExtension, 0)
+
+	for i := 0; i < value.NumField(); i++ {
+		name := jsonName(value.Type().Field(i))
+		if !include(name) {
+			continue
+		}
+
+		extension := FHIRExtension{URL: FHIRExtensionBase + name}
+		switch field := value.Field(i).Interface().(type) {
+		case string:
+			extension.ValueString = field
+		case int:
+			extension.ValueInteger = field
+		case float64:
+			extension.ValueDecimal = field
+		case time.Time:
+			if !field.IsZero() {
+				extension.ValueDateTime = fhirDateTime(field)
+			}
+		}
+		if extension.ValueString != "" || extension.ValueInteger != 0 || extension.ValueDecimal != 0 || extension.ValueDateTime != "" {
+			extensions = append(extensions, extension)
+		}
+	}
+
+	if len(extensions) == 0 {
+		return nil
+	}
+	return extensions
+}
+
+// applyFHIRExtensions sets the fields of model held in survey field
+// extensions. Other extensions, and fields model does not have, are ignored.
+func applyFHIRExtensions(model interface{}, extensions []FHIRExtension) []string {
+	value := reflect.Indirect(reflect.ValueOf(model))
+	errs := make([]string, 0)
+
+	for _, extension := range extensions {
+		name, ok := strings.CutPrefix(extension.URL, FHIRExtensionBase)
+		if !ok {
+			continue
+		}
+
+		for i := 0; i < value.NumField(); i++ {
+			if jsonName(value.Type().Field(i)) != name {
+				continue
+			}
+
+			field := value.Field(i)
+			switch field.Interface().(type) {
+			case string:
+				field.SetString(extension.ValueString)
+			case int:
+				field.SetInt(int64(extension.ValueInteger))
+			case float64:
+				field.SetFloat(extension.ValueDecimal)
+			case time.Time:
+				t, err := parseFHIRDateTime(extension.ValueDateTime)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("extension %s: %v", name, err))
+					continue
+				}
+				field.Set(reflect.ValueOf(t))
+			}
+		}
+	}
+
+	return errs
+}
+
+// readFHIRBundles calls fn with each patient of the FHIR bundles read from r:
+// a single bundle, or one bundle per line (NDJSON)
+func readFHIRBundles(r io.Reader, fn func(submittedRecord)) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var bundle FHIRBundle
+		err := dec.Decode(&bundle)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: bundle %d: %v", ErrInvalidJSON, n, err)
+		}
+		if bundle.ResourceType != "Bundle" {
+			return fmt.Errorf("%w: bundle %d is a %q resource, not a Bundle", ErrInvalidJSON, n, bundle.ResourceType)
+		}
+
+		for _, record := range fhirBundleRecords(&bundle) {
+			fn(record)
+		}
+	}
+}
+
+// fhirPatientRecord is a survey patient being read from a bundle
+type fhirPatientRecord struct {
+	patient   *models.Patient
+	specimens []*models.Specimen
+	errs      []string
+}
+
+// fhirSpecimenRecord is a specimen being read from a bundle, with its patient
+type fhirSpecimenRecord struct {
+	specimen *models.Specimen
+	record   *fhirPatientRecord
+}
+
+// fhirBundleRecords converts the resources of a bundle to survey patients
+// with their child records. Resources whose subject is not a Patient of the
+// bundle are returned as invalid records; resource types that are not part
+// of a survey patient are ignored.
+func fhirBundleRecords(bundle *FHIRBundle) []submittedRecord {
+	records := make([]submittedRecord, 0)
+	patients := make([]*fhirPatientRecord, 0)
+	byReference := make(map[string]*fhirPatientRecord)
+	specimens := make(map[string]*fhirSpecimenRecord)
+
+	// Orphan resources are reported on their own
+	orphan := func(resource *FHIRResource, message string) {
+		raw, _ := json.Marshal(resource)
+		records = append(records, submittedRecord{
+			raw:  raw,
+			key:  resource.ResourceType + "/" + resource.ID,
+			errs: []string{fmt.Sprintf("%s/%s: %s", resource.ResourceType, resource.ID, message)},
+		})
+	}
+
+	// Patients come first, so the other resources can refer to them
+	for _, entry := range bundle.Entry {
+		resource := entry.Resource
+		if resource == nil || resource.ResourceType != "Patient" {
+			continue
+		}
+
+		key := fhirIdentifier(resource, FHIRSystemPatient)
+		record := &fhirPatientRecord{patient: &models.Patient{ID: key, InstanceID: key, Gender: resource.Gender}}
+		if len(resource.Name) > 0 {
+			record.patient.PatientInitials = resource.Name[0].Text
+		}
+		record.addErrs(resource, applyFHIRExtensions(record.patient, resource.Extension))
+
+		patients = append(patients, record)
+		byReference["Patient/"+resource.ID] = record
+		if entry.FullURL != "" {
+			byReference[entry.FullURL] = record
+		}
+	}
+
+	// Observations come last, so their specimen is known
+	observations := make([]*FHIRResource, 0)
+	for _, entry := range bundle.Entry {
+		resource := entry.Resource
+		if resource == nil {
+			continue
+		}
+
+		switch resource.ResourceType {
+		case "Encounter", "MedicationRequest", "Condition", "Specimen":
+		case "Observation":
+			observations = append(observations, resource)
+			continue
+		default:
+			continue
+		}
+
+		record := byReference[fhirReference(resource.Subject)]
+		if record == nil {
+			orphan(resource, "subject is not a Patient of the bundle")
+			continue
+		}
+		patient := record.patient
+
+		switch resource.ResourceType {
+		case "Encounter":
+			if resource.Period != nil && resource.Period.Start != "" {
+				record.setDate(resource, &patient.AdmissionDate, resource.Period.Start)
+			}
+			if resource.ServiceProvider != nil {
+				patient.Facility = resource.ServiceProvider.Display
+			}
+			if len(resource.Location) > 0 {
+				patient.WardName = resource.Location[0].Location.Display
+			}
+			record.addErrs(resource, applyFHIRExtensions(patient, resource.Extension))
+		case "MedicationRequest":
+			patient.Antibiotics = append(patient.Antibiotics, record.antibiotic(resource))
+		case "Condition":
+			patient.Indications = append(patient.Indications, record.indication(resource))
+		case "Specimen":
+			specimen := &models.Specimen{ID: fhirIdentifier(resource, FHIRSystemSpecimen), ParentKey: patient.ID}
+			if resource.Type != nil {
+				specimen.SpecimenType = fhirText(resource.Type)
+			}
+			record.addErrs(resource, applyFHIRExtensions(specimen, resource.Extension))
+
+			record.specimens = append(record.specimens, specimen)
+			specimens["Specimen/"+resource.ID] = &fhirSpecimenRecord{specimen: specimen, record: record}
+			if entry.FullURL != "" {
+				specimens[entry.FullURL] = specimens["Specimen/"+resource.ID]
+			}
+		}
+	}
+
+	// Observations without a specimen, such as vital signs, are not cultures
+	for _, resource := range observations {
+		if resource.Specimen == nil {
+			continue
+		}
+		owner := specimens[fhirReference(resource.Specimen)]
+		if owner == nil {
+			orphan(resource, "specimen is not a Specimen of the bundle")
+			continue
+		}
+		fhirCulture(resource, owner.specimen)
+		owner.record.addErrs(resource, applyFHIRExtensions(owner.specimen, resource.Extension))
+	}
+
+	for _, record := range patients {
+		for _, specimen := range record.specimens {
+			record.patient.Specimens = append(record.patient.Specimens, *specimen)
+		}
+		raw, err := json.Marshal(record.patient)
+		if err != nil {
+			record.errs = append(record.errs, fmt.Sprintf("error converting patient: %v", err))
+		}
+		records = append(records, submittedRecord{raw: raw, key: record.patient.ID, errs: record.errs})
+	}
+
+	return records
+}
+
+// antibiotic converts a MedicationRequest to an antibiotic of the patient
+func (record *fhirPatientRecord) antibiotic(resource *FHIRResource) models.Antibiotic {
+	antibiotic := models.Antibiotic{ID: fhirIdentifier(resource, FHIRSystemAntibiotic), ParentKey: record.patient.ID}
+
+	if medication := resource.MedicationCodeableConcept; medication != nil {
+		antibiotic.AntibioticINNName = fhirText(medication)
+		for _, coding := range medication.Coding {
+			if coding.System == fhirSystemATC {
+				antibiotic.ATCCode = coding.Code
+			}
+		}
+	}
+	if resource.AuthoredOn != "" {
+		record.setDate(resource, &antibiotic.StartDateAntibiotic, resource.AuthoredOn)
+	}
+	if len(resource.DosageInstruction) > 0 {
+		dosage := resource.DosageInstruction[0]
+		antibiotic.UnitDoseFrequency = dosage.Text
+		if dosage.Route != nil {
+			antibiotic.AdministrationRoute = fhirText(dosage.Route)
+		}
+		if len(dosage.DoseAndRate) > 0 && dosage.DoseAndRate[0].DoseQuantity != nil {
+			antibiotic.UnitDose = dosage.DoseAndRate[0].DoseQuantity.Value
+			antibiotic.UnitDoseMeasureUnit = dosage.DoseAndRate[0].DoseQuantity.Unit
+		}
+	}
+	if len(resource.Note) > 0 {
+		antibiotic.AntibioticNotes = resource.Note[0].Text
+	}
+	record.addErrs(resource, applyFHIRExtensions(&antibiotic, resource.Extension))
+
+	return antibiotic
+}
+
+// indication converts a Condition to an indication of the patient
+func (record *fhirPatientRecord) indication(resource *FHIRResource) models.Indication {
+	indication := models.Indication{ID: fhirIdentifier(resource, FHIRSystemIndication), ParentKey: record.patient.ID}
+
+	if len(resource.Category) > 0 {
+		indication.IndicationType = fhirText(&resource.Category[0])
+	}
+	if resource.Code != nil {
+		indication.Diagnosis = fhirText(resource.Code)
+	}
+	if resource.OnsetDateTime != "" {
+		record.setDate(resource, &indication.StartDateTreatment, resource.OnsetDateTime)
+	}
+	record.addErrs(resource, applyFHIRExtensions(&indication, resource.Extension))
+
+	return indication
+}
+
+// fhirCulture sets the organism and susceptibility results of a specimen
+// from the Observation of its culture. Results are read from the note, or
+// written from the components when there is none.
+func fhirCulture(resource *FHIRResource, specimen *models.Specimen) {
+	if resource.ValueCodeableConcept != nil {
+		specimen.Microorganism = fhirText(resource.ValueCodeableConcept)
+	}
+	if len(resource.Note) > 0 {
+		specimen.AntibioticSusceptibilityTestResults = resource.Note[0].Text
+		return
+	}
+
+	results := make([]models.SusceptibilityResult, 0, len(resource.Component))
+	for _, component := range resource.Component {
+		result := models.SusceptibilityResult{Antibiotic: fhirText(&component.Code)}
+		if organism, antibiotic, ok := strings.Cut(result.Antibiotic, ": "); ok {
+			result.Organism, result.Antibiotic = organism, antibiotic
+		}
+		for _, interpretation := range component.Interpretation {
+			for _, coding := range interpretation.Coding {
+				if coding.System == fhirSystemInterpretation {
+					result.Interpretation = coding.Code
+				}
+			}
+		}
+		if quantity := component.ValueQuantity; quantity != nil {
+			value := quantity.Value
+			if quantity.Unit == "mm" {
+				result.ZoneDiameter = &value
+			} else {
+				result.MIC = &value
+				result.MICComparator = quantity.Comparator
+			}
+		}
+		results = append(results, result)
+	}
+	specimen.AntibioticSusceptibilityTestResults = formatSusceptibilityText(results)
+}
+
+// setDate reads a FHIR date into a survey date field
+func (record *fhirPatientRecord) setDate(resource *FHIRResource, field *time.Time, value string) {
+	t, err := parseFHIRDateTime(value)
+	if err != nil {
+		record.addErrs(resource, []string{err.Error()})
+		return
+	}
+	*field = t
+}
+
+// addErrs records errors found converting resource
+func (record *fhirPatientRecord) addErrs(resource *FHIRResource, errs []string) {
+	for _, err := range errs {
+		record.errs = append(record.errs, fmt.Sprintf("%s/%s: %s", resource.ResourceType, resource.ID, err))
+	}
+}
+
+// fhirIdentifier returns the survey key of a resource: its identifier in
+// system, or its resource ID when it has none
+func fhirIdentifier(resource *FHIRResource, system string) string {
+	for _, identifier := range resource.Identifier {
+		if identifier.System == system && identifier.Value != "" {
+			return identifier.Value
+		}
+	}
+	return resource.ID
+}
+
+// fhirReference returns the target of a reference, or "" for none
+func fhirReference(reference *FHIRReference) string {
+	if reference == nil {
+		return ""
+	}
+	return reference.Reference
+}
+
+// fhirText returns the text of a concept, falling back to its first coding
+func fhirText(concept *FHIRCodeableConcept) string {
+	if concept.Text != "" {
+		return concept.Text
+	}
+	for _, coding := range concept.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+		if coding.Code != "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
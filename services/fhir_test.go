@@ -0,0 +1,120 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"point-prevalence-survey/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPatientBundleRoundTrip(t *testing.T) {
+	survey := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	patient := models.Patient{
+		ID:                       "uuid:p1",
+		InstanceID:               "uuid:p1",
+		SubmissionDate:           time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC),
+		Region:                   "Central",
+		Facility:                 "Mulago",
+		WardName:                 "Medical",
+		WardTotalPatients:        20,
+		WardEligiblePatients:     18,
+		SurveyDate:               survey,
+		PatientInitials:          "AB",
+		AgeYears:                 42,
+		Gender:                   CodeFemale,
+		Weight:                   61.5,
+		AdmissionDate:            survey.AddDate(0, 0, -4),
+		UrinaryCatheter:          CodeYes,
+		PatientOnAntibiotic:      CodeYes,
+		PatientNumberAntibiotics: 1,
+		HIVStatus:                CodeNegative,
+		FormVersion:              "2024061201",
+		Antibiotics: []models.Antibiotic{{
+			ID:                            "uuid:p1/Antibioticform[1]",
+			AntibioticINNName:             "Ceftriaxone",
+			ATCCode:                       "J01DD04",
+			AntibioticAwareClassification: CodeWatch,
+			StartDateAntibiotic:           survey.AddDate(0, 0, -2),
+			UnitDose:                      1,
+			UnitDoseMeasureUnit:           "g",
+			UnitDoseFrequency:             "24",
+			AdministrationRoute:           CodeIV,
+			AntibioticNotes:               "ceftriaxone 1g iv od",
+			ParentKey:                     "uuid:p1",
+		}},
+		Indications: []models.Indication{{
+			ID:                 "uuid:p1/Indications[1]",
+			IndicationType:     "CAI",
+			Diagnosis:          "Pneumonia",
+			StartDateTreatment: survey.AddDate(0, 0, -2),
+			CultureSampleTaken: CodeYes,
+			ParentKey:          "uuid:p1",
+		}},
+		Specimens: []models.Specimen{{
+			ID:                                  "uuid:p1/Specimens[1]",
+			SpecimenType:                        "Blood",
+			CultureResult:                       CodePositive,
+			Microorganism:                       "Escherichia coli",
+			AntibioticSusceptibilityTestResults: "Escherichia coli: ceftriaxone R",
+			ParentKey:                           "uuid:p1",
+		}},
+	}
+
+	for _, bundleType := range []string{FHIRBundleCollection, FHIRBundleTransaction} {
+		t.Run(bundleType, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := json.NewEncoder(&buf).Encode(PatientBundle(&patient, bundleType)); err != nil {
+				t.Fatalf("encode bundle: %v", err)
+			}
+
+			var records []submittedRecord
+			if err := readFHIRBundles(&buf, func(record submittedRecord) { records = append(records, record) }); err != nil {
+				t.Fatalf("readFHIRBundles: %v", err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("records = %d, want the patient only", len(records))
+			}
+			if records[0].key != patient.ID || len(records[0].errs) != 0 {
+				t.Fatalf("record %q errors = %v", records[0].key, records[0].errs)
+			}
+
+			var got models.Patient
+			if err := json.Unmarshal(records[0].raw, &got); err != nil {
+				t.Fatalf("decode patient: %v", err)
+			}
+			got.OptionalVars = patient.OptionalVars
+			if !reflect.DeepEqual(got, patient) {
+				gotJSON, _ := json.MarshalIndent(got, "", "  ")
+				wantJSON, _ := json.MarshalIndent(patient, "", "  ")
+				t.Errorf("patient after round trip:\n%s\nwant:\n%s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestFHIRBundleRecordsOrphans(t *testing.T) {
+	bundle := &FHIRBundle{
+		ResourceType: "Bundle",
+		Type:         FHIRBundleCollection,
+		Entry: []FHIRBundleEntry{
+			{Resource: &FHIRResource{ResourceType: "Condition", ID: "c1", Subject: &FHIRReference{Reference: "Patient/missing"}}},
+			{Resource: &FHIRResource{ResourceType: "Observation", ID: "o1", Specimen: &FHIRReference{Reference: "Specimen/missing"}}},
+			{Resource: &FHIRResource{ResourceType: "Observation", ID: "vitals"}},
+			{Resource: &FHIRResource{ResourceType: "Practitioner", ID: "dr"}},
+		},
+	}
+
+	records := fhirBundleRecords(bundle)
+	keys := make([]string, 0, len(records))
+	for _, record := range records {
+		if len(record.errs) != 1 {
+			t.Errorf("record %s errors = %v, want one", record.key, record.errs)
+		}
+		keys = append(keys, record.key)
+	}
+	if want := []string{"Condition/c1", "Observation/o1"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid records = %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,586 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"point-prevalence-survey/config"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// JobEntityBundle is the entity recorded on import jobs for ZIP bundles
+const JobEntityBundle = "bundle"
+
+// ErrImportQueueFull is returned when no more async imports can be queued
+var ErrImportQueueFull = errors.New("import queue is full")
+
+// Errors returned when deleting an import or reading its error report
+var (
+	ErrImportNotFound = errors.New("import job not found")
+	ErrImportInUse    = errors.New("import cannot be deleted")
+	ErrReportFile     = errors.New("invalid error report file")
+)
+
+// importTables lists the tables holding imported rows, children first so
+// deleting an import never leaves rows pointing at a removed patient
+var importTables = []struct {
+	entity string
+	model  interface{}
+}{
+	{EntitySpecimens, &models.Specimen{}},
+	{EntityOptionalVars, &models.OptionalVar{}},
+	{EntityIndications, &models.Indication{}},
+	{EntityAntibioticDetails, &models.AntibioticDetails{}},
+	{EntityAntibiotics, &models.Antibiotic{}},
+	{EntityPatients, &models.Patient{}},
+}
+
+// JobUpload describes the uploaded file an import job is created for
+type JobUpload struct {
+	Entity     string
+	Filename   string
+	Checksum   string
+	UploadedBy string
+	Async      bool
+	// Force imports the file even if the same content was imported before
+	Force bool
+}
+
+// DuplicateUploadError is returned when a file with the same content has
+// already been imported
+type DuplicateUploadError struct {
+	Previous *models.ImportJob
+}
+
+func (e *DuplicateUploadError) Error() string {
+	return fmt.Sprintf("the same file was already imported as import %d (%s, %s)",
+		e.Previous.ID, e.Previous.Filename, e.Previous.CreatedAt.Format(time.RFC3339))
+}
+
+// importTask is an async import waiting for a worker
+type importTask struct {
+	jobID uint
+	path  string
+	size  int64
+	opts  ImportOptions
+}
+
+// ImportJobService records uploads as import jobs and runs async imports on
+// a pool of background workers
+type ImportJobService struct {
+	db         *gorm.DB
+	csvService *CSVService
+	queue      chan importTask
+	tempDir    string
+}
+
+var (
+	importJobService     *ImportJobService
+	importJobServiceOnce sync.Once
+)
+
+// GetImportJobService returns the shared import job service, starting its
+// worker pool on first use
+func GetImportJobService() *ImportJobService {
+	importJobServiceOnce.Do(func() {
+		importJobService = newImportJobService()
+	})
+	return importJobService
+}
+
+func newImportJobService() *ImportJobService {
+	cfg := config.LoadConfig()
+
+	s := &ImportJobService{
+		db:         database.GetDB(),
+		csvService: NewCSVService(),
+		queue:      make(chan importTask, cfg.ImportQueueSize),
+		tempDir:    cfg.ImportTempDir,
+	}
+
+	s.failInterruptedJobs()
+
+	workers := cfg.ImportWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+
+	return s
+}
+
+// failInterruptedJobs marks jobs left queued or running by a previous process
+// as failed; their uploaded files were not kept
+func (s *ImportJobService) failInterruptedJobs() {
+	now := time.Now()
+	err := s.db.Model(&models.ImportJob{}).
+		Where("status IN ?", []string{models.ImportJobQueued, models.ImportJobRunning}).
+		Updates(map[string]interface{}{
+			"status":      models.ImportJobFailed,
+			"message":     "import was interrupted by a server restart",
+			"finished_at": &now,
+		}).Error
+	if err != nil {
+		log.Printf("Error marking interrupted import jobs: %v", err)
+	}
+}
+
+// FileChecksum returns the hex SHA-256 of an uploaded file and rewinds it
+func FileChecksum(file io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error reading upload: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("error reading upload: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CreateJob records a new import job for an uploaded file
+func (s *ImportJobService) CreateJob(upload JobUpload, opts ImportOptions) (*models.ImportJob, error) {
+	opts, err := normalizeOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !upload.Force && upload.Checksum != "" {
+		previous, err := s.findImportedChecksum(upload.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			return nil, &DuplicateUploadError{Previous: previous}
+		}
+	}
+
+	job := &models.ImportJob{
+		Entity:         upload.Entity,
+		Filename:       upload.Filename,
+		Checksum:       upload.Checksum,
+		UploadedBy:     upload.UploadedBy,
+		Status:         models.ImportJobQueued,
+		Async:          upload.Async,
+		MappingVersion: opts.MappingVersion,
+		MergeStrategy:  opts.MergeStrategy,
+		Atomic:         opts.Atomic,
+	}
+
+	if err := s.db.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("error creating import job: %v", err)
+	}
+
+	return job, nil
+}
+
+// findImportedChecksum returns the latest import of a file with checksum whose
+// rows are, or will be, in the database. Failed, rolled back and deleted
+// imports left no rows behind, so uploading their file again is allowed.
+func (s *ImportJobService) findImportedChecksum(checksum string) (*models.ImportJob, error) {
+	var jobs []models.ImportJob
+	err := s.db.Omit("errors", "warnings").
+		Where("checksum = ? AND status IN ?", checksum, []string{models.ImportJobQueued, models.ImportJobRunning, models.ImportJobCompleted}).
+		Order("id DESC").Limit(1).Find(&jobs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error checking previous imports: %v", err)
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return &jobs[0], nil
+}
+
+// RunImport imports a CSV file or workbook for job in the current goroutine
+func (s *ImportJobService) RunImport(job *models.ImportJob, file UploadFile, size int64, opts ImportOptions) (*UploadResult, error) {
+	s.startJob(job, &opts)
+	result, err := s.csvService.ImportUpload(job.Entity, job.Filename, file, size, opts)
+	s.saveRowErrors(job, job.Filename, result)
+	s.finishJob(job, result, err)
+	return result, err
+}
+
+// RunBundle imports a ZIP bundle or workbook for job in the current goroutine
+func (s *ImportJobService) RunBundle(job *models.ImportJob, file io.ReaderAt, size int64, opts ImportOptions) (*BundleResult, error) {
+	s.startJob(job, &opts)
+	result, err := s.csvService.ImportUploadBundle(job.Filename, file, size, opts)
+
+	var totals *UploadResult
+	if result != nil {
+		for _, file := range result.Files {
+			s.saveRowErrors(job, file.File, file.Result)
+		}
+		totals = result.Totals()
+	}
+	s.finishJob(job, totals, err)
+
+	return result, err
+}
+
+// RunIngest imports a JSON, NDJSON or FHIR submission of patients for job in
+// the current goroutine
+func (s *ImportJobService) RunIngest(job *models.ImportJob, body io.Reader, format string, opts ImportOptions) (*IngestResult, error) {
+	s.startJob(job, &opts)
+	result, err := s.csvService.IngestPatients(body, format, opts)
+	s.saveRowErrors(job, job.Filename, result.UploadResult)
+	s.finishJob(job, result.UploadResult, err)
+	return result, err
+}
+
+// Enqueue copies the uploaded file to the temp directory and queues job for a
+// background worker
+func (s *ImportJobService) Enqueue(job *models.ImportJob, file io.Reader, opts ImportOptions) error {
+	tmp, err := os.CreateTemp(s.tempDir, fmt.Sprintf("import-%d-*", job.ID))
+	if err != nil {
+		return fmt.Errorf("error storing upload: %v", err)
+	}
+
+	size, err := io.Copy(tmp, file)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error storing upload: %v", err)
+	}
+
+	return s.EnqueueFile(job, tmp.Name(), size, opts)
+}
+
+// EnqueueFile queues job to import a file already stored on disk. The file
+// is removed once the worker is done with it, or straight away if the queue
+// is full.
+func (s *ImportJobService) EnqueueFile(job *models.ImportJob, path string, size int64, opts ImportOptions) error {
+	if err := s.queueFile(job, path, size, opts); err != nil {
+		os.Remove(path)
+		s.finishJob(job, nil, err)
+		return err
+	}
+	return nil
+}
+
+// queueFile hands a stored upload to the workers without waiting for room in
+// the queue, leaving the file and job alone if there is none
+func (s *ImportJobService) queueFile(job *models.ImportJob, path string, size int64, opts ImportOptions) error {
+	select {
+	case s.queue <- importTask{jobID: job.ID, path: path, size: size, opts: opts}:
+		log.Printf("Queued import job %d (%s %s)", job.ID, job.Entity, job.Filename)
+		return nil
+	default:
+		return ErrImportQueueFull
+	}
+}
+
+// failUnqueuedJob marks a job that never made it into the queue as failed
+func (s *ImportJobService) failUnqueuedJob(id uint) {
+	now := time.Now()
+	err := s.db.Model(&models.ImportJob{}).
+		Where("id = ? AND status = ?", id, models.ImportJobQueued).
+		Updates(map[string]interface{}{
+			"status":      models.ImportJobFailed,
+			"message":     ErrImportQueueFull.Error() + ", and the upload expired before it was queued again",
+			"finished_at": &now,
+		}).Error
+	if err != nil {
+		log.Printf("Error failing import job %d: %v", id, err)
+	}
+}
+
+// worker runs queued imports until the process exits
+func (s *ImportJobService) worker() {
+	for task := range s.queue {
+		s.runTask(task)
+	}
+}
+
+// runTask imports the stored file of a queued job
+func (s *ImportJobService) runTask(task importTask) {
+	defer os.Remove(task.path)
+
+	var job models.ImportJob
+	if err := s.db.First(&job, task.jobID).Error; err != nil {
+		log.Printf("Error loading import job %d: %v", task.jobID, err)
+		return
+	}
+
+	file, err := os.Open(task.path)
+	if err != nil {
+		s.finishJob(&job, nil, fmt.Errorf("error opening stored upload: %v", err))
+		return
+	}
+	defer file.Close()
+
+	if job.Entity == JobEntityBundle {
+		s.RunBundle(&job, file, task.size, task.opts)
+		return
+	}
+	s.RunImport(&job, file, task.size, task.opts)
+}
+
+// startJob marks job as running and hooks its progress counters into opts
+func (s *ImportJobService) startJob(job *models.ImportJob, opts *ImportOptions) {
+	now := time.Now()
+	job.Status = models.ImportJobRunning
+	job.StartedAt = &now
+	if err := s.db.Model(job).Select("status", "started_at").Updates(job).Error; err != nil {
+		log.Printf("Error updating import job %d: %v", job.ID, err)
+	}
+
+	opts.ImportID = job.ID
+	opts.Progress = func(result *UploadResult) {
+		err := s.db.Model(&models.ImportJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+			"total_records":     result.TotalRecords,
+			"processed_records": result.ProcessedRecords,
+			"inserted_records":  result.InsertedRecords,
+			"updated_records":   result.UpdatedRecords,
+			"staged_records":    result.StagedRecords,
+			"linked_records":    result.LinkedRecords,
+			"skipped_records":   result.SkippedRecords,
+		}).Error
+		if err != nil {
+			log.Printf("Error updating progress of import job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// saveRowErrors keeps the header and rejected rows of an imported file so an
+// error report can be downloaded later
+func (s *ImportJobService) saveRowErrors(job *models.ImportJob, file string, result *UploadResult) {
+	if result == nil {
+		return
+	}
+
+	if result.Header != nil {
+		if job.Headers == nil {
+			job.Headers = make(map[string][]string)
+		}
+		job.Headers[file] = result.Header
+	}
+
+	rowErrors := make([]models.ImportRowError, 0, len(result.RowErrors))
+	for _, rowErr := range result.RowErrors {
+		rowErrors = append(rowErrors, models.ImportRowError{
+			ImportID: job.ID,
+			File:     file,
+			Row:      rowErr.Row,
+			Key:      rowErr.Key,
+			Column:   rowErr.Column,
+			Code:     rowErr.Code,
+			Message:  rowErr.Message,
+			Record:   rowErr.Record,
+		})
+	}
+	if len(rowErrors) == 0 {
+		return
+	}
+
+	if err := s.db.CreateInBatches(rowErrors, 500).Error; err != nil {
+		log.Printf("Error saving row errors of import job %d: %v", job.ID, err)
+	}
+}
+
+// RowErrorReport writes the rejected rows of a file of an import as CSV: the
+// original header and values plus an import_error column, so the rows can be
+// fixed in a spreadsheet and uploaded again. file may be empty when the
+// import holds a single file.
+func (s *ImportJobService) RowErrorReport(id uint, file string, w io.Writer) error {
+	var job models.ImportJob
+	if err := s.db.First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrImportNotFound
+		}
+		return err
+	}
+
+	if file == "" {
+		if len(job.Headers) != 1 {
+			files := make([]string, 0, len(job.Headers))
+			for name := range job.Headers {
+				files = append(files, name)
+			}
+			sort.Strings(files)
+			return fmt.Errorf("%w: choose a file, one of %v", ErrReportFile, files)
+		}
+		for name := range job.Headers {
+			file = name
+		}
+	}
+
+	header, ok := job.Headers[file]
+	if !ok {
+		return fmt.Errorf("%w: import %d has no file %q", ErrReportFile, id, file)
+	}
+
+	var rowErrors []models.ImportRowError
+	if err := s.db.Where("import_id = ? AND file = ?", id, file).Order("row_num, id").Find(&rowErrors).Error; err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append(append([]string{}, header...), "import_error")); err != nil {
+		return err
+	}
+
+	// A row with several errors is written once with its messages joined
+	for i := 0; i < len(rowErrors); {
+		j := i
+		messages := make([]string, 0)
+		for ; j < len(rowErrors) && rowErrors[j].Row == rowErrors[i].Row; j++ {
+			messages = append(messages, rowErrors[j].Message)
+		}
+
+		record := make([]string, len(header), len(header)+1)
+		copy(record, rowErrors[i].Record)
+		if err := writer.Write(append(record, strings.Join(messages, "; "))); err != nil {
+			return err
+		}
+		i = j
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// finishJob stores the outcome of an import on its job
+func (s *ImportJobService) finishJob(job *models.ImportJob, result *UploadResult, importErr error) {
+	now := time.Now()
+	job.FinishedAt = &now
+
+	if result != nil {
+		job.TotalRecords = result.TotalRecords
+		job.ProcessedRecords = result.ProcessedRecords
+		job.InsertedRecords = result.InsertedRecords
+		job.UpdatedRecords = result.UpdatedRecords
+		job.StagedRecords = result.StagedRecords
+		job.LinkedRecords = result.LinkedRecords
+		job.SkippedRecords = result.SkippedRecords
+		job.Errors = result.Errors
+		job.Warnings = make([]string, 0, len(result.Warnings))
+		for _, warning := range result.Warnings {
+			job.Warnings = append(job.Warnings, fmt.Sprintf("Row %d: %s", warning.Row, warning.Message))
+		}
+	}
+
+	switch {
+	case importErr != nil:
+		job.Status = models.ImportJobFailed
+		job.Message = importErr.Error()
+	case result != nil && result.RolledBack:
+		job.Status = models.ImportJobRolledBack
+		job.Message = "one or more rows failed, so no rows were imported"
+	default:
+		job.Status = models.ImportJobCompleted
+	}
+
+	if err := s.db.Save(job).Error; err != nil {
+		log.Printf("Error saving import job %d: %v", job.ID, err)
+		return
+	}
+	log.Printf("Import job %d %s: %d inserted, %d updated, %d staged, %d linked, %d skipped", job.ID, job.Status,
+		job.InsertedRecords, job.UpdatedRecords, job.StagedRecords, job.LinkedRecords, job.SkippedRecords)
+}
+
+// DeleteImport removes the rows inserted by an import job. Rows it updated
+// keep their new values, since they belong to the import that created them.
+func (s *ImportJobService) DeleteImport(id uint) (*models.ImportJob, error) {
+	var job models.ImportJob
+	if err := s.db.First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrImportNotFound
+		}
+		return nil, err
+	}
+
+	switch job.Status {
+	case models.ImportJobQueued, models.ImportJobRunning:
+		return nil, fmt.Errorf("%w: import is still %s", ErrImportInUse, job.Status)
+	case models.ImportJobDeleted:
+		return nil, fmt.Errorf("%w: import was already deleted", ErrImportInUse)
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Children from other imports would be left without their patient
+		patients := tx.Model(&models.Patient{}).Select("key").Where("import_id = ?", id)
+		for _, table := range importTables[:len(importTables)-1] {
+			var count int64
+			err := tx.Model(table.model).
+				Where("parent_key IN (?)", patients).
+				Where("import_id IS NULL OR import_id <> ?", id).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return fmt.Errorf("%w: %d %s rows from other imports belong to its patients", ErrImportInUse, count, table.entity)
+			}
+		}
+
+		// Susceptibility results are derived from the specimens and go with them
+		specimens := tx.Model(&models.Specimen{}).Select("key").Where("import_id = ?", id)
+		if err := tx.Where("specimen_key IN (?)", specimens).Delete(&models.SusceptibilityResult{}).Error; err != nil {
+			return fmt.Errorf("error deleting susceptibility results: %v", err)
+		}
+
+		// Quality flags go with the rows they were raised on, and patients
+		// losing child rows have their count rules checked again
+		parents := make([]string, 0)
+		for _, table := range importTables {
+			if qualityModels[table.entity] != nil {
+				rows := tx.Model(table.model).Select("key").Where("import_id = ?", id)
+				if err := tx.Where("entity = ? AND record_key IN (?)", table.entity, rows).Delete(&models.QualityFlag{}).Error; err != nil {
+					return fmt.Errorf("error deleting quality flags: %v", err)
+				}
+			}
+			if table.entity != EntityPatients {
+				var keys []string
+				if err := tx.Model(table.model).Where("import_id = ?", id).Distinct().Pluck("parent_key", &keys).Error; err != nil {
+					return err
+				}
+				parents = append(parents, keys...)
+			}
+		}
+
+		deleted := 0
+		for _, table := range importTables {
+			result := tx.Where("import_id = ?", id).Delete(table.model)
+			if result.Error != nil {
+				return fmt.Errorf("error deleting %s: %v", table.entity, result.Error)
+			}
+			deleted += int(result.RowsAffected)
+		}
+
+		// Rows still waiting for their patient go with the import too
+		staged := tx.Where("import_id = ? AND resolved_at IS NULL", id).Delete(&models.OrphanRow{})
+		if staged.Error != nil {
+			return fmt.Errorf("error deleting staged rows: %v", staged.Error)
+		}
+		deleted += int(staged.RowsAffected)
+
+		if err := s.csvService.QualityRules().RefreshCounts(tx, parents, 0); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		job.Status = models.ImportJobDeleted
+		job.DeletedRecords = deleted
+		job.DeletedAt = &now
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Deleted import job %d: %d rows removed", job.ID, job.DeletedRecords)
+	return &job, nil
+}
@@ -0,0 +1,581 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"point-prevalence-survey/models"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// importRun holds the state of one file being imported
+type importRun struct {
+	s      *CSVService
+	db     *gorm.DB
+	spec   importSpec
+	opts   ImportOptions
+	cols   *ColumnMap
+	result *UploadResult
+
+	// replaced records keys of duplicate-key entities whose existing rows
+	// have already been replaced during this run
+	replaced map[string]bool
+	// pending records keys a dry run would have inserted, since they are
+	// not in the database for later batches to find
+	pending map[string]bool
+	// formColumns caches the header resolved with each mapping profile
+	// selected by the form version of a row
+	formColumns map[string]resolvedColumns
+}
+
+// resolvedColumns is the outcome of resolving a header with one profile
+type resolvedColumns struct {
+	cols *ColumnMap
+	err  error
+}
+
+func (s *CSVService) newImportRun(db *gorm.DB, spec importSpec, opts ImportOptions) *importRun {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = s.batchSize
+	}
+
+	return &importRun{
+		s:           s,
+		db:          db,
+		spec:        spec,
+		opts:        opts,
+		result:      newUploadResult(opts.DryRun),
+		replaced:    make(map[string]bool),
+		pending:     make(map[string]bool),
+		formColumns: make(map[string]resolvedColumns),
+	}
+}
+
+// importRows reads the CSV file and writes its rows through db
+func (s *CSVService) importRows(db *gorm.DB, spec importSpec, file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1 // Column counts are checked per row against the header
+
+	return s.importTable(db, spec, reader, opts)
+}
+
+// importTable reads the rows of a CSV file or worksheet and writes them through db
+func (s *CSVService) importTable(db *gorm.DB, spec importSpec, reader rowReader, opts ImportOptions) (*UploadResult, error) {
+	run := s.newImportRun(db, spec, opts)
+	err := run.readRows(reader)
+	return run.result, err
+}
+
+// readRows streams the rows of a table into batches
+func (run *importRun) readRows(reader rowReader) error {
+	result := run.result
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("CSV file must have at least a header row and one data row")
+	}
+	if err != nil {
+		return fmt.Errorf("error reading CSV file: %v", err)
+	}
+
+	// Without a selected profile, rows are read with the profile of the form
+	// version they were entered on. A form version may rename required
+	// columns, so the header is then only checked against each row's profile.
+	cols, err := run.s.resolveColumns(run.spec.entity, header, run.opts)
+	byFormVersion := false
+	if run.opts.MappingVersion == "" && run.opts.FormVersion == "" {
+		if base, ok := run.s.formVersionColumns(run.spec.entity, header); ok {
+			run.formColumns[base.Version] = resolvedColumns{cols: cols, err: err}
+			cols, err, byFormVersion = base, nil, true
+		}
+	}
+	if err != nil {
+		return err
+	}
+	run.cols = cols
+	result.Header = header
+
+	dates, err := newDateParser(run.opts, run.s.timezone)
+	if err != nil {
+		return err
+	}
+
+	var catalogue *antibioticCatalogue
+	if run.spec.entity == EntityAntibiotics {
+		if catalogue, err = loadAntibioticCatalogue(run.db); err != nil {
+			return err
+		}
+	}
+
+	batch := make([]importRecord, 0, run.opts.BatchSize)
+	rowNum := 1 // Account for header row
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowNum++
+		result.TotalRecords++
+		result.ProcessedRecords++
+
+		if err != nil {
+			result.rowError(rowNum, "", record, RowError{Code: RowErrorMalformed, Message: fmt.Sprintf("malformed row: %v", err)})
+			continue
+		}
+
+		if len(record) < len(cols.Header) {
+			result.rowError(rowNum, "", record, RowError{
+				Code:    RowErrorMissingColumns,
+				Message: fmt.Sprintf("insufficient columns (expected %d, got %d)", len(cols.Header), len(record)),
+			})
+			continue
+		}
+
+		rowCols := cols
+		if byFormVersion {
+			var rowErr *RowError
+			if rowCols, rowErr = run.columnsForForm(cols.Value(record, "form_version")); rowErr != nil {
+				rowErr.Column = cols.Column("form_version")
+				result.rowError(rowNum, cols.Value(record, run.spec.keyField), record, *rowErr)
+				continue
+			}
+		}
+
+		row := &csvRow{cols: rowCols, dates: dates, record: record, catalogue: catalogue}
+		rec := run.spec.parse(run.s, row)
+		rec.rowNum = rowNum
+		rec.record = record
+		if rec.key == "" {
+			result.rowError(rowNum, "", record, RowError{
+				Column:  cols.Column(run.spec.keyField),
+				Code:    RowErrorMissingKey,
+				Message: fmt.Sprintf("missing %s ID", run.spec.label),
+			})
+			continue
+		}
+
+		// Rows with values that could not be parsed are rejected by dry runs
+		// and imports alike, unless AllowInvalid imports them with those
+		// fields left zero and reported as warnings
+		result.rowWarning(rowNum, rec.key, row.warnings...)
+		ruleErrs, ruleWarnings := rowErrors(run.s.rules.Check(run.spec.entity, rec.model, nil, nil), rowCols.Column)
+		if len(row.issues) > 0 && !run.opts.AllowInvalid {
+			result.rowError(rowNum, rec.key, record, append(row.issues, ruleErrs...)...)
+			continue
+		}
+
+		// Rows breaking a reject rule are not imported; broken warn rules are
+		// reported and stored as quality flags once the row is written
+		if len(ruleErrs) > 0 {
+			result.rowError(rowNum, rec.key, record, ruleErrs...)
+			continue
+		}
+		result.rowWarning(rowNum, rec.key, row.issues...)
+		result.rowWarning(rowNum, rec.key, ruleWarnings...)
+
+		batch = append(batch, rec)
+		if len(batch) >= run.opts.BatchSize {
+			run.writeBatch(batch)
+			run.reportProgress()
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		run.writeBatch(batch)
+		run.reportProgress()
+	}
+
+	// Antibiotic names that did not match the catalogue wait for review
+	if !run.opts.DryRun {
+		if err := catalogue.saveQueue(run.db); err != nil {
+			return err
+		}
+	}
+
+	if result.TotalRecords == 0 {
+		return fmt.Errorf("CSV file must have at least a header row and one data row")
+	}
+
+	// Batched rows are reported after rows rejected while reading
+	sort.Slice(result.Rows, func(i, j int) bool {
+		return result.Rows[i].Row < result.Rows[j].Row
+	})
+	sort.SliceStable(result.RowErrors, func(i, j int) bool {
+		return result.RowErrors[i].Row < result.RowErrors[j].Row
+	})
+	sort.SliceStable(result.Warnings, func(i, j int) bool {
+		return result.Warnings[i].Row < result.Warnings[j].Row
+	})
+
+	return nil
+}
+
+// columnsForForm returns the header resolved with the mapping profile of a
+// form version, or the row error rejecting rows of that version
+func (run *importRun) columnsForForm(formVersion string) (*ColumnMap, *RowError) {
+	profile, err := run.s.mappings.ForFormVersion(formVersion)
+	if err != nil {
+		return nil, &RowError{Code: RowErrorUnknownFormVersion, Message: err.Error()}
+	}
+
+	resolved, ok := run.formColumns[profile.Version]
+	if !ok {
+		resolved.cols, resolved.err = resolveProfileColumns(profile, run.spec.entity, run.cols.Header)
+		run.formColumns[profile.Version] = resolved
+	}
+	if resolved.err != nil {
+		return nil, &RowError{
+			Code:    RowErrorMissingColumns,
+			Message: fmt.Sprintf("form version %q is read with mapping profile %s: %v", formVersion, profile.Version, resolved.err),
+		}
+	}
+	return resolved.cols, nil
+}
+
+// formVersionColumns matches a header with the default profile, without
+// requiring its required columns, reporting whether it has a form version
+// column to select each row's profile by
+func (s *CSVService) formVersionColumns(entity string, header []string) (*ColumnMap, bool) {
+	profile, err := s.mappings.Profile("")
+	if err != nil {
+		return nil, false
+	}
+	cols, err := profile.match(entity, header)
+	if err != nil || !cols.Has("form_version") {
+		return nil, false
+	}
+	return cols, true
+}
+
+// reportProgress passes the running totals to the progress callback, if any
+func (run *importRun) reportProgress() {
+	if run.opts.Progress != nil {
+		run.opts.Progress(run.result)
+	}
+}
+
+// writeBatch writes a batch of parsed rows in a single transaction. Each row
+// is written under its own savepoint so one bad row does not abort the batch.
+// When db is already a transaction the batch runs as a nested savepoint.
+// In dry-run mode the same checks run but nothing is written.
+func (run *importRun) writeBatch(batch []importRecord) {
+	spec, result := run.spec, run.result
+
+	keys := make([]string, 0, len(batch))
+	parentKeys := make([]string, 0, len(batch))
+	for _, rec := range batch {
+		keys = append(keys, rec.key)
+		if rec.parentKey != "" {
+			parentKeys = append(parentKeys, rec.parentKey)
+		}
+	}
+
+	// Look up existing keys and parent patients for the whole batch at once
+	existing := make(map[string]bool)
+	var found []string
+	if err := run.db.Model(spec.model()).Where("key IN ?", keys).Distinct().Pluck("key", &found).Error; err != nil {
+		for _, rec := range batch {
+			result.rowError(rec.rowNum, rec.key, rec.record, RowError{
+				Code:    RowErrorDatabase,
+				Message: fmt.Sprintf("database error checking %s %s: %v", spec.label, rec.key, err),
+			})
+		}
+		return
+	}
+	for _, key := range found {
+		existing[key] = true
+	}
+	for _, key := range keys {
+		if run.pending[key] {
+			existing[key] = true
+		}
+	}
+
+	parents := make(map[string]bool)
+	if spec.checkParent && len(parentKeys) > 0 {
+		var found []string
+		if err := run.db.Model(&models.Patient{}).Where("key IN ?", parentKeys).Pluck("key", &found).Error; err != nil {
+			for _, rec := range batch {
+				result.rowError(rec.rowNum, rec.key, rec.record, RowError{
+					Code:    RowErrorDatabase,
+					Message: fmt.Sprintf("database error checking parent patient %s: %v", rec.parentKey, err),
+				})
+			}
+			return
+		}
+		for _, key := range found {
+			parents[key] = true
+		}
+	}
+
+	// Outcomes are applied to the result only once the batch has committed
+	batchResult := &UploadResult{DryRun: result.DryRun}
+	replaced := make(map[string]bool)
+
+	write := func(tx *gorm.DB) error {
+		for _, rec := range batch {
+			if spec.checkParent && rec.parentKey != "" && !parents[rec.parentKey] {
+				// Child rows may arrive before their patient; they are kept
+				// and linked when the patient is imported
+				run.stageOrphan(tx, rec, batchResult)
+				continue
+			}
+
+			run.writeRecord(tx, rec, existing, replaced, batchResult)
+		}
+
+		patientKeys := parentKeys
+		if spec.entity == EntityPatients {
+			if err := run.resolveOrphans(tx, keys, batchResult); err != nil {
+				return err
+			}
+			patientKeys = keys
+		}
+
+		// Count rules compare patients with their child rows, which may
+		// arrive in a later file
+		if result.DryRun {
+			return nil
+		}
+		return run.s.rules.RefreshCounts(tx, patientKeys, run.opts.ImportID)
+	}
+
+	var err error
+	if result.DryRun {
+		err = write(run.db)
+	} else {
+		err = run.db.Transaction(write)
+	}
+
+	if err != nil {
+		for _, rec := range batch {
+			result.rowError(rec.rowNum, rec.key, rec.record, RowError{
+				Code:    RowErrorDatabase,
+				Message: fmt.Sprintf("error writing batch: %v", err),
+			})
+		}
+		return
+	}
+
+	for key := range replaced {
+		run.replaced[key] = true
+	}
+	if result.DryRun {
+		for key := range existing {
+			run.pending[key] = true
+		}
+	}
+	result.merge(batchResult)
+	log.Printf("Imported batch of %d %s rows (%d inserted, %d updated, %d staged, %d skipped)", len(batch), spec.entity,
+		batchResult.InsertedRecords, batchResult.UpdatedRecords, batchResult.StagedRecords, batchResult.SkippedRecords)
+}
+
+// writeRecord inserts, updates or skips one row according to the merge
+// strategy. Row failures are recorded in batchResult.
+func (run *importRun) writeRecord(tx *gorm.DB, rec importRecord, existing, replaced map[string]bool, batchResult *UploadResult) {
+	spec := run.spec
+	strategy := run.opts.MergeStrategy
+
+	// Duplicate-key entities (optional vars) keep every row. Overwriting
+	// replaces all existing rows for the key with the rows in this file.
+	if spec.allowDuplicates {
+		if strategy == MergeSkip || !(existing[rec.key] || replaced[rec.key] || run.replaced[rec.key]) {
+			run.insert(tx, rec, batchResult)
+			return
+		}
+
+		if !replaced[rec.key] && !run.replaced[rec.key] && !run.opts.DryRun {
+			if err := run.savepoint(tx, func() error {
+				return tx.Where("key = ?", rec.key).Delete(spec.model()).Error
+			}); err != nil {
+				batchResult.rowError(rec.rowNum, rec.key, rec.record, RowError{
+					Code:    RowErrorDatabase,
+					Message: fmt.Sprintf("error replacing %s %s: %v", spec.label, rec.key, err),
+				})
+				return
+			}
+		}
+		replaced[rec.key] = true
+
+		if run.insert(tx, rec, batchResult) {
+			batchResult.InsertedRecords--
+			batchResult.UpdatedRecords++
+		}
+		return
+	}
+
+	if !existing[rec.key] {
+		if run.insert(tx, rec, batchResult) {
+			existing[rec.key] = true
+		}
+		return
+	}
+
+	if strategy == MergeSkip {
+		// Record exists (in the database or earlier in this file), skip
+		batchResult.rowSkipped(rec.rowNum, rec.key, "already exists")
+		log.Printf("Skipping %s %s: already exists", spec.label, rec.key)
+		return
+	}
+
+	current := spec.model()
+	err := tx.Where("key = ?", rec.key).First(current).Error
+	if err == gorm.ErrRecordNotFound && run.opts.DryRun {
+		// Dry run: the key was inserted earlier in this file, so the row
+		// would overwrite it
+		batchResult.UpdatedRecords++
+		return
+	}
+	if err != nil {
+		batchResult.rowError(rec.rowNum, rec.key, rec.record, RowError{
+			Code:    RowErrorDatabase,
+			Message: fmt.Sprintf("database error loading %s %s: %v", spec.label, rec.key, err),
+		})
+		return
+	}
+
+	if strategy == MergeNewer && spec.isNewer != nil && !spec.isNewer(current, rec.model) {
+		batchResult.rowSkipped(rec.rowNum, rec.key, "existing record is as new or newer")
+		return
+	}
+
+	if spec.keep != nil {
+		spec.keep(current, rec.model)
+	}
+
+	if sameContent(current, rec.model) {
+		batchResult.rowSkipped(rec.rowNum, rec.key, "unchanged")
+		return
+	}
+
+	if !run.opts.DryRun {
+		if err := run.savepoint(tx, func() error {
+			// Updated rows keep the import that created them
+			if err := tx.Omit("import_id").Save(rec.model).Error; err != nil {
+				return err
+			}
+			return run.afterWrite(tx, rec.model)
+		}); err != nil {
+			batchResult.rowError(rec.rowNum, rec.key, rec.record, RowError{
+				Code:    RowErrorDatabase,
+				Message: fmt.Sprintf("error updating %s %s: %v", spec.label, rec.key, err),
+			})
+			return
+		}
+	}
+
+	batchResult.UpdatedRecords++
+	log.Printf("Updated %s %s", spec.label, rec.key)
+}
+
+// insert creates a new row, recording a row error if the insert fails
+func (run *importRun) insert(tx *gorm.DB, rec importRecord, batchResult *UploadResult) bool {
+	if run.opts.ImportID != 0 {
+		setImportID(rec.model, run.opts.ImportID)
+	}
+
+	if !run.opts.DryRun {
+		if err := run.savepoint(tx, func() error {
+			if err := tx.Create(rec.model).Error; err != nil {
+				return err
+			}
+			return run.afterWrite(tx, rec.model)
+		}); err != nil {
+			batchResult.rowError(rec.rowNum, rec.key, rec.record, RowError{
+				Code:    RowErrorDatabase,
+				Message: fmt.Sprintf("error creating %s %s: %v", run.spec.label, rec.key, err),
+			})
+			return false
+		}
+	}
+
+	batchResult.InsertedRecords++
+	return true
+}
+
+// afterWrite runs the spec's afterWrite hook, if any, for a written record
+// and stores the quality flags of the rules it breaks
+func (run *importRun) afterWrite(tx *gorm.DB, model interface{}) error {
+	if run.spec.afterWrite != nil {
+		if err := run.spec.afterWrite(tx, model); err != nil {
+			return err
+		}
+	}
+	return run.s.rules.StoreFlags(tx, run.spec.entity, model, run.opts.ImportID)
+}
+
+// savepoint runs fn under a savepoint, rolling back to it if fn fails
+func (run *importRun) savepoint(tx *gorm.DB, fn func() error) error {
+	if err := tx.SavePoint("import_row").Error; err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		tx.RollbackTo("import_row")
+		return err
+	}
+	return nil
+}
+
+// patientIsNewer compares ODK edit counts, falling back to the submission
+// date when both submissions have been edited the same number of times
+func patientIsNewer(current, incoming *models.Patient) bool {
+	currentEdits, _ := strconv.Atoi(strings.TrimSpace(current.Edits))
+	incomingEdits, _ := strconv.Atoi(strings.TrimSpace(incoming.Edits))
+	if incomingEdits != currentEdits {
+		return incomingEdits > currentEdits
+	}
+	return incoming.SubmissionDate.After(current.SubmissionDate)
+}
+
+// keepPatientReview carries the exclusion of a patient over to a newer
+// version of its submission
+func keepPatientReview(current, incoming *models.Patient) {
+	incoming.Excluded = current.Excluded
+	incoming.ExclusionReason = current.ExclusionReason
+	incoming.DuplicateOf = current.DuplicateOf
+}
+
+// setImportID tags a model with the import that created it
+func setImportID(model interface{}, id uint) {
+	field := reflect.Indirect(reflect.ValueOf(model)).FieldByName("ImportID")
+	if field.IsValid() && field.CanSet() {
+		field.Set(reflect.ValueOf(&id))
+	}
+}
+
+// sameContent reports whether two records of the same model hold the same
+// column values. Association slices and the import ID are ignored.
+func sameContent(a, b interface{}) bool {
+	va := reflect.Indirect(reflect.ValueOf(a))
+	vb := reflect.Indirect(reflect.ValueOf(b))
+	if va.Type() != vb.Type() {
+		return false
+	}
+
+	for i := 0; i < va.NumField(); i++ {
+		fa, fb := va.Field(i), vb.Field(i)
+		if fa.Kind() == reflect.Slice || va.Type().Field(i).Name == "ImportID" {
+			continue
+		}
+
+		if ta, ok := fa.Interface().(time.Time); ok {
+			if !ta.Equal(fb.Interface().(time.Time)) {
+				return false
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			return false
+		}
+	}
+	return true
+}
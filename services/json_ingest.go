@@ -0,0 +1,634 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"point-prevalence-survey/models"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// JobEntityJSON is the entity recorded on import jobs for JSON submissions
+const JobEntityJSON = "json"
+
+// ErrInvalidJSON is wrapped by errors for a JSON body that cannot be read at
+// all; single malformed records are reported on the record instead
+var ErrInvalidJSON = errors.New("invalid JSON submission")
+
+// Row error and warning codes of JSON records
+const (
+	RowErrorInvalidRecord = "invalid_record"
+	RowWarningRecord      = "record_warning"
+)
+
+// Outcomes of a submitted patient record
+const (
+	RecordInserted   = "inserted"
+	RecordUpdated    = "updated"
+	RecordSkipped    = "skipped"
+	RecordInvalid    = "invalid"
+	RecordFailed     = "failed"
+	RecordRolledBack = "rolled_back"
+)
+
+// RecordResult is the outcome of one submitted patient and its child records
+type RecordResult struct {
+	// Record is the position of the record in the submission, from 1
+	Record int    `json:"record"`
+	Key    string `json:"key,omitempty"`
+	Status string `json:"status"`
+	// Message says why a valid record was skipped
+	Message string `json:"message,omitempty"`
+	// Children counts the child records written with the patient, by table
+	Children map[string]int `json:"children,omitempty"`
+	Errors   []string       `json:"errors,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// IngestResult is the outcome of a JSON submission. The totals count patients.
+type IngestResult struct {
+	*UploadResult
+	Records []*RecordResult `json:"records"`
+}
+
+// ingestRecord is a submitted patient waiting to be written
+type ingestRecord struct {
+	index   int
+	raw     []byte
+	patient *models.Patient
+	result  *RecordResult
+}
+
+// ingestRun holds the state of one JSON submission being written
+type ingestRun struct {
+	s      *CSVService
+	db     *gorm.DB
+	opts   ImportOptions
+	result *IngestResult
+	// pending records keys a dry run would have written, since they are not
+	// in the database for later batches to find
+	pending map[string]*models.Patient
+}
+
+// Formats of patient submissions
+const (
+	SubmissionJSON   = "json"
+	SubmissionNDJSON = "ndjson"
+	SubmissionFHIR   = "fhir"
+)
+
+// submittedRecord is a record read from a submission. Errs holds the errors
+// found converting it from another format, such as a FHIR bundle.
+type submittedRecord struct {
+	raw  []byte
+	key  string
+	errs []string
+}
+
+// IngestPatients reads patients with their nested antibiotics, indications,
+// specimens and optional vars from a JSON array or a single JSON object, from
+// one JSON object per line (NDJSON), or from FHIR bundles. Each record is
+// validated on its own, and valid records are written in batches, one
+// transaction per batch.
+func (s *CSVService) IngestPatients(r io.Reader, format string, opts ImportOptions) (*IngestResult, error) {
+	read := func(fn func(submittedRecord)) error {
+		switch format {
+		case SubmissionFHIR:
+			return readFHIRBundles(r, fn)
+		case SubmissionNDJSON:
+			return readJSONRecords(r, true, fn)
+		default:
+			return readJSONRecords(r, false, fn)
+		}
+	}
+
+	ingest := &IngestResult{UploadResult: newUploadResult(opts.DryRun), Records: make([]*RecordResult, 0)}
+	ingest.Header = []string{"record"}
+
+	result, err := s.importWith(importSpecs[EntityPatients], opts, func(db *gorm.DB, opts ImportOptions) (*UploadResult, error) {
+		if opts.BatchSize <= 0 {
+			opts.BatchSize = s.batchSize
+		}
+		ingest.DryRun = opts.DryRun
+
+		run := &ingestRun{s: s, db: db, opts: opts, result: ingest, pending: make(map[string]*models.Patient)}
+		return ingest.UploadResult, run.readRecords(read)
+	})
+	if result != nil {
+		ingest.UploadResult = result
+	}
+
+	// An atomic submission with a failed record wrote nothing
+	if ingest.RolledBack {
+		for _, record := range ingest.Records {
+			if record.Status == RecordInserted || record.Status == RecordUpdated {
+				record.Status = RecordRolledBack
+				record.Children = nil
+			}
+		}
+	}
+
+	return ingest, err
+}
+
+// readRecords parses the records read by read and writes them in batches
+func (run *ingestRun) readRecords(read func(fn func(submittedRecord)) error) error {
+	catalogue, err := loadAntibioticCatalogue(run.db)
+	if err != nil {
+		return err
+	}
+
+	batch := make([]*ingestRecord, 0, run.opts.BatchSize)
+	err = read(func(record submittedRecord) {
+		result := run.result
+		result.TotalRecords++
+		result.ProcessedRecords++
+		rec := &ingestRecord{index: result.TotalRecords, raw: record.raw, result: &RecordResult{Record: result.TotalRecords, Key: record.key}}
+		result.Records = append(result.Records, rec.result)
+		if len(record.errs) > 0 {
+			run.invalid(rec, record.errs...)
+			return
+		}
+		if !run.parseRecord(rec, catalogue) {
+			return
+		}
+
+		batch = append(batch, rec)
+		if len(batch) >= run.opts.BatchSize {
+			run.writeBatch(batch)
+			batch = batch[:0]
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		run.writeBatch(batch)
+	}
+
+	if !run.opts.DryRun {
+		if err := catalogue.saveQueue(run.db); err != nil {
+			return err
+		}
+	}
+
+	if run.result.TotalRecords == 0 {
+		return fmt.Errorf("%w: no records", ErrInvalidJSON)
+	}
+	return nil
+}
+
+// readJSONRecords calls fn with the raw JSON of every record of a JSON array,
+// a single JSON object or an NDJSON stream
+func readJSONRecords(r io.Reader, ndjson bool, fn func(submittedRecord)) error {
+	reader := bufio.NewReader(r)
+
+	if ndjson {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				fn(submittedRecord{raw: line})
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading submission: %v", err)
+			}
+		}
+	}
+
+	dec := json.NewDecoder(reader)
+	token, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+
+	switch token {
+	case json.Delim('['):
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+			}
+			fn(submittedRecord{raw: raw})
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+		}
+		return nil
+	case json.Delim('{'):
+		// A single record: read it again from the start
+		rest, err := io.ReadAll(io.MultiReader(dec.Buffered(), reader))
+		if err != nil {
+			return fmt.Errorf("error reading submission: %v", err)
+		}
+		fn(submittedRecord{raw: append([]byte("{"), rest...)})
+		return nil
+	}
+
+	return fmt.Errorf("%w: expected an array of patients or a patient object", ErrInvalidJSON)
+}
+
+// parseRecord decodes and validates a submitted patient, reporting false
+// when the record is invalid
+func (run *ingestRun) parseRecord(rec *ingestRecord, catalogue *antibioticCatalogue) bool {
+	var patient models.Patient
+	dec := json.NewDecoder(bytes.NewReader(rec.raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patient); err != nil {
+		return run.invalid(rec, fmt.Sprintf("invalid patient record: %v", err))
+	}
+	rec.patient = &patient
+	rec.result.Key = patient.ID
+
+	// The exclusion and import are set by this service, never by a submission
+	patient.Excluded = false
+	patient.ExclusionReason = ""
+	patient.DuplicateOf = ""
+	patient.ImportID = nil
+
+	errs := make([]string, 0)
+	if patient.ID == "" {
+		patient.ID = patient.InstanceID
+	}
+	if patient.InstanceID == "" {
+		patient.InstanceID = patient.ID
+	}
+	rec.result.Key = patient.ID
+	switch {
+	case patient.ID == "":
+		errs = append(errs, "missing patient ID: set id or instance_id")
+	case patient.InstanceID != patient.ID:
+		errs = append(errs, fmt.Sprintf("id %q and instance_id %q differ", patient.ID, patient.InstanceID))
+	}
+	run.normalizeCodes(&patient)
+
+	seen := make(map[string]bool)
+	for i := range patient.Antibiotics {
+		antibiotic := &patient.Antibiotics[i]
+		errs = append(errs, childErrors("antibiotics", i, &antibiotic.ID, &antibiotic.ParentKey, patient.ID, seen)...)
+		antibiotic.ImportID = nil
+		run.normalizeCodes(antibiotic)
+
+		row := &csvRow{cols: &ColumnMap{}, catalogue: catalogue}
+		row.enrichAntibiotic(antibiotic)
+		for _, warning := range row.warnings {
+			rec.result.Warnings = append(rec.result.Warnings, fmt.Sprintf("antibiotics[%d]: %s", i, warning.Message))
+		}
+	}
+	for i := range patient.Indications {
+		indication := &patient.Indications[i]
+		errs = append(errs, childErrors("indications", i, &indication.ID, &indication.ParentKey, patient.ID, seen)...)
+		indication.ImportID = nil
+		run.normalizeCodes(indication)
+	}
+	for i := range patient.Specimens {
+		specimen := &patient.Specimens[i]
+		errs = append(errs, childErrors("specimens", i, &specimen.ID, &specimen.ParentKey, patient.ID, seen)...)
+		specimen.ImportID = nil
+		// Susceptibility results are parsed from the specimen, not submitted
+		specimen.SusceptibilityResults = nil
+		run.normalizeCodes(specimen)
+
+		row := &csvRow{cols: &ColumnMap{}}
+		row.susceptibilityWarnings(specimen)
+		for _, warning := range row.warnings {
+			rec.result.Warnings = append(rec.result.Warnings, fmt.Sprintf("specimens[%d]: %s", i, warning.Message))
+		}
+	}
+	for i := range patient.OptionalVars {
+		// Optional vars are keyed by their patient, like in the CSV exports
+		optionalVar := &patient.OptionalVars[i]
+		if optionalVar.ID == "" {
+			optionalVar.ID = patient.ID
+		}
+		if optionalVar.ParentKey == "" {
+			optionalVar.ParentKey = patient.ID
+		}
+		if optionalVar.ID != patient.ID || optionalVar.ParentKey != patient.ID {
+			errs = append(errs, fmt.Sprintf("optional_vars[%d]: id and parent_key must be the patient ID %q", i, patient.ID))
+		}
+		optionalVar.ImportID = nil
+		run.normalizeCodes(optionalVar)
+	}
+
+	// Data quality rules see the child records as submitted, so count rules
+	// can reject a record too
+	flags := run.s.rules.Check(EntityPatients, &patient, nil, map[string]int{
+		EntityAntibiotics:  len(patient.Antibiotics),
+		EntityIndications:  len(patient.Indications),
+		EntitySpecimens:    len(patient.Specimens),
+		EntityOptionalVars: len(patient.OptionalVars),
+	})
+	for _, child := range patientChildren(&patient, nil) {
+		flags = append(flags, run.s.rules.Check(child.entity, child.model, &patient, nil)...)
+	}
+	for _, flag := range flags {
+		message := fmt.Sprintf("%s: %s", flag.Rule, flag.Message)
+		if flag.Entity != EntityPatients {
+			message = fmt.Sprintf("%s %s: %s", flag.Entity, flag.RecordKey, message)
+		}
+		if flag.Severity == SeverityReject {
+			errs = append(errs, message)
+		} else {
+			rec.result.Warnings = append(rec.result.Warnings, message)
+		}
+	}
+
+	if len(errs) > 0 {
+		return run.invalid(rec, errs...)
+	}
+
+	for _, warning := range rec.result.Warnings {
+		run.result.rowWarning(rec.index, patient.ID, RowError{Code: RowWarningRecord, Message: warning})
+	}
+	return true
+}
+
+// childErrors validates the key of the i-th child record of a patient and
+// sets its parent key
+func childErrors(table string, i int, id, parentKey *string, patientKey string, seen map[string]bool) []string {
+	errs := make([]string, 0)
+
+	*id = stripRepeatPath(*id)
+	switch {
+	case *id == "":
+		errs = append(errs, fmt.Sprintf("%s[%d]: missing id", table, i))
+	case seen[table+"\x00"+*id]:
+		errs = append(errs, fmt.Sprintf("%s[%d]: id %q is used twice", table, i, *id))
+	}
+	seen[table+"\x00"+*id] = true
+
+	*parentKey = stripRepeatPath(*parentKey)
+	if *parentKey == "" {
+		*parentKey = patientKey
+	}
+	if *parentKey != patientKey {
+		errs = append(errs, fmt.Sprintf("%s[%d]: parent_key %q is not the patient ID %q", table, i, *parentKey, patientKey))
+	}
+
+	return errs
+}
+
+// normalizeCodes rewrites the categorical columns of a submitted model to
+// their canonical codes, like the CSV importers do
+func (run *ingestRun) normalizeCodes(model interface{}) {
+	if err := NormalizeCodes(run.db, model); err != nil {
+		log.Printf("Error normalising submitted record: %v", err)
+	}
+}
+
+// invalid records a record that failed validation
+func (run *ingestRun) invalid(rec *ingestRecord, errs ...string) bool {
+	rec.result.Status = RecordInvalid
+	rec.result.Errors = errs
+
+	rowErrs := make([]RowError, 0, len(errs))
+	for _, message := range errs {
+		rowErrs = append(rowErrs, RowError{Code: RowErrorInvalidRecord, Message: message})
+	}
+	run.result.rowError(rec.index, rec.result.Key, []string{string(rec.raw)}, rowErrs...)
+	return false
+}
+
+// writeBatch writes a batch of valid records in one transaction, each under
+// its own savepoint so one bad record does not abort the batch. In a dry run
+// the same checks run but nothing is written.
+func (run *ingestRun) writeBatch(batch []*ingestRecord) {
+	result := run.result
+
+	keys := make([]string, 0, len(batch))
+	for _, rec := range batch {
+		keys = append(keys, rec.patient.ID)
+	}
+
+	var found []models.Patient
+	if err := run.db.Omit(clause.Associations).Where("key IN ?", keys).Find(&found).Error; err != nil {
+		for _, rec := range batch {
+			run.failed(rec, fmt.Sprintf("database error checking patient %s: %v", rec.patient.ID, err))
+		}
+		run.countBatch(batch)
+		return
+	}
+	existing := make(map[string]*models.Patient, len(found))
+	for i := range found {
+		existing[found[i].ID] = &found[i]
+	}
+	for _, key := range keys {
+		if patient, ok := run.pending[key]; ok {
+			existing[key] = patient
+		}
+	}
+
+	// Orphan rows staged by CSV imports are linked to new patients
+	orphans := &importRun{s: run.s, opts: run.opts}
+	linked := &UploadResult{DryRun: result.DryRun}
+
+	write := func(tx *gorm.DB) error {
+		inserted := make([]string, 0)
+		for _, rec := range batch {
+			if run.writeRecord(tx, rec, existing) == RecordInserted {
+				inserted = append(inserted, rec.patient.ID)
+			}
+		}
+		if len(inserted) == 0 {
+			return nil
+		}
+		if err := orphans.resolveOrphans(tx, inserted, linked); err != nil {
+			return err
+		}
+
+		// Staged rows linked to the new patients count towards their count rules
+		if result.DryRun || linked.LinkedRecords == 0 {
+			return nil
+		}
+		return run.s.rules.RefreshCounts(tx, inserted, run.opts.ImportID)
+	}
+
+	var err error
+	if result.DryRun {
+		err = write(run.db)
+	} else {
+		err = run.db.Transaction(write)
+	}
+
+	if err != nil {
+		// The batch was rolled back: nothing in it was written
+		for _, rec := range batch {
+			if rec.result.Status != RecordSkipped {
+				rec.result.Children = nil
+				run.failed(rec, fmt.Sprintf("error writing batch: %v", err))
+			}
+		}
+	} else {
+		result.LinkedRecords += linked.LinkedRecords
+	}
+
+	run.countBatch(batch)
+	log.Printf("Ingested batch of %d patient records", len(batch))
+}
+
+// countBatch adds the outcomes of a written batch to the totals
+func (run *ingestRun) countBatch(batch []*ingestRecord) {
+	result := run.result
+
+	for _, rec := range batch {
+		switch rec.result.Status {
+		case RecordInserted:
+			result.InsertedRecords++
+		case RecordUpdated:
+			result.UpdatedRecords++
+		case RecordSkipped:
+			result.rowSkipped(rec.index, rec.patient.ID, rec.result.Message)
+		case RecordFailed:
+			result.rowError(rec.index, rec.patient.ID, []string{string(rec.raw)}, RowError{Code: RowErrorDatabase, Message: rec.result.Errors[0]})
+		}
+		if result.DryRun && (rec.result.Status == RecordInserted || rec.result.Status == RecordUpdated) {
+			run.pending[rec.patient.ID] = rec.patient
+		}
+	}
+
+	if run.opts.Progress != nil {
+		run.opts.Progress(result.UploadResult)
+	}
+}
+
+// writeRecord inserts, updates or skips one patient according to the merge
+// strategy, replacing the child records of an updated patient with the
+// submitted ones. It returns the record's status.
+func (run *ingestRun) writeRecord(tx *gorm.DB, rec *ingestRecord, existing map[string]*models.Patient) string {
+	patient := rec.patient
+	current, exists := existing[patient.ID]
+
+	if exists {
+		switch {
+		case run.opts.MergeStrategy == MergeSkip:
+			return run.skipped(rec, "already exists")
+		case run.opts.MergeStrategy == MergeNewer && !patientIsNewer(current, patient):
+			return run.skipped(rec, "existing record is as new or newer")
+		}
+		keepPatientReview(current, patient)
+	}
+
+	status := RecordInserted
+	if exists {
+		status = RecordUpdated
+	}
+
+	rec.result.Children = map[string]int{
+		EntityAntibiotics:  len(patient.Antibiotics),
+		EntityIndications:  len(patient.Indications),
+		EntitySpecimens:    len(patient.Specimens),
+		EntityOptionalVars: len(patient.OptionalVars),
+	}
+
+	if !run.opts.DryRun {
+		importID := run.opts.ImportID
+		err := (&importRun{}).savepoint(tx, func() error {
+			if exists {
+				if err := tx.Omit(clause.Associations, "import_id").Save(patient).Error; err != nil {
+					return fmt.Errorf("error updating patient %s: %v", patient.ID, err)
+				}
+				if err := deletePatientChildren(tx, patient.ID); err != nil {
+					return err
+				}
+			} else {
+				if importID != 0 {
+					setImportID(patient, importID)
+				}
+				if err := tx.Omit(clause.Associations).Create(patient).Error; err != nil {
+					return fmt.Errorf("error creating patient %s: %v", patient.ID, err)
+				}
+			}
+			if err := createPatientChildren(tx, patient, importID); err != nil {
+				return err
+			}
+			return run.s.rules.FlagPatient(tx, patient, importID)
+		})
+		if err != nil {
+			rec.result.Children = nil
+			run.failed(rec, err.Error())
+			return RecordFailed
+		}
+	}
+
+	rec.result.Status = status
+	existing[patient.ID] = patient
+	return status
+}
+
+// skipped records a valid record that was not written
+func (run *ingestRun) skipped(rec *ingestRecord, message string) string {
+	rec.result.Status = RecordSkipped
+	rec.result.Message = message
+	return RecordSkipped
+}
+
+// failed records a valid record that could not be written
+func (run *ingestRun) failed(rec *ingestRecord, message string) {
+	rec.result.Status = RecordFailed
+	rec.result.Errors = []string{message}
+}
+
+// deletePatientChildren removes the child records a submission replaces.
+// Antibiotic details are not part of submissions and are kept.
+func deletePatientChildren(tx *gorm.DB, key string) error {
+	if err := tx.Where("patient_key = ?", key).Delete(&models.SusceptibilityResult{}).Error; err != nil {
+		return fmt.Errorf("error removing susceptibility results of patient %s: %v", key, err)
+	}
+	for _, model := range []interface{}{&models.Specimen{}, &models.OptionalVar{}, &models.Indication{}, &models.Antibiotic{}} {
+		if err := tx.Where("parent_key = ?", key).Delete(model).Error; err != nil {
+			return fmt.Errorf("error removing child records of patient %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// createPatientChildren inserts the submitted child records of a patient and
+// parses the susceptibility results of its specimens
+func createPatientChildren(tx *gorm.DB, patient *models.Patient, importID uint) error {
+	children := []struct {
+		table string
+		rows  interface{}
+		count int
+	}{
+		{EntityAntibiotics, &patient.Antibiotics, len(patient.Antibiotics)},
+		{EntityIndications, &patient.Indications, len(patient.Indications)},
+		{EntitySpecimens, &patient.Specimens, len(patient.Specimens)},
+		{EntityOptionalVars, &patient.OptionalVars, len(patient.OptionalVars)},
+	}
+
+	for _, child := range children {
+		if child.count == 0 {
+			continue
+		}
+		if importID != 0 {
+			rows := reflect.ValueOf(child.rows).Elem()
+			for i := 0; i < rows.Len(); i++ {
+				setImportID(rows.Index(i).Addr().Interface(), importID)
+			}
+		}
+		if err := tx.Omit(clause.Associations).Create(child.rows).Error; err != nil {
+			return fmt.Errorf("error creating %s of patient %s: %v", child.table, patient.ID, err)
+		}
+	}
+
+	for i := range patient.Specimens {
+		if _, err := replaceSusceptibilityResults(tx, &patient.Specimens[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"errors"
+	"point-prevalence-survey/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJSONRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		ndjson  bool
+		want    []string
+		wantErr bool
+	}{
+		{name: "array", input: `[{"id":"p1"}, {"id":"p2"}]`, want: []string{`{"id":"p1"}`, `{"id":"p2"}`}},
+		{name: "single object", input: ` {"id":"p1","antibiotics":[]}`, want: []string{`{"id":"p1","antibiotics":[]}`}},
+		{name: "empty array", input: `[]`, want: []string{}},
+		{name: "empty body", input: ``, want: []string{}},
+		{name: "NDJSON", input: "{\"id\":\"p1\"}\n\n  {\"id\":\"p2\"}  \r\n{\"id\":\"p3\"}", ndjson: true, want: []string{`{"id":"p1"}`, `{"id":"p2"}`, `{"id":"p3"}`}},
+		// A malformed line is a record of its own, reported when it is decoded
+		{name: "NDJSON with a malformed line", input: "{\"id\":\"p1\"}\n{\"id\":\n", ndjson: true, want: []string{`{"id":"p1"}`, `{"id":`}},
+		{name: "truncated array", input: `[{"id":"p1"}, {"id":`, want: []string{`{"id":"p1"}`}, wantErr: true},
+		{name: "unclosed array", input: `[{"id":"p1"}`, want: []string{`{"id":"p1"}`}, wantErr: true},
+		{name: "not a record", input: `"patients"`, want: []string{}, wantErr: true},
+		{name: "not JSON", input: `patients`, want: []string{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			err := readJSONRecords(strings.NewReader(tt.input), tt.ndjson, func(record submittedRecord) {
+				got = append(got, string(record.raw))
+			})
+			if tt.wantErr != errors.Is(err, ErrInvalidJSON) {
+				t.Errorf("error = %v, want ErrInvalidJSON %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngestPatients(t *testing.T) {
+	submission := `[
+		{"id": "uuid:p1", "facility": "Mulago",
+		 "antibiotics": [{"id": "uuid:p1/Antibioticform[1]", "antibiotic_inn_name": "Ceftriaxone"}],
+		 "indications": [{"id": "uuid:p1/Indications[1]", "parent_key": "uuid:p1"}],
+		 "specimens": [{"id": "uuid:p1/Specimens[1]", "specimen_type": "Blood", "antibiotic_susceptibility_test_results": "CIP S, pending"}],
+		 "optional_vars": [{}]},
+		{"id": "uuid:p2", "facility": "Mulago", "ward": "Medical"},
+		{"instance_id": "uuid:p3", "antibiotics": [{"antibiotic_inn_name": "Amoxicillin"}]},
+		{"id": "uuid:p4", "instance_id": "uuid:other"},
+		{"id": "uuid:p5",
+		 "indications": [{"id": "uuid:p5/Indications[1]"}, {"id": "uuid:p5/Indications[1]"}],
+		 "specimens": [{"id": "uuid:p5/Specimens[1]", "parent_key": "uuid:p1"}],
+		 "optional_vars": [{"id": "uuid:p1"}]},
+		{"facility": "Mulago"}
+	]`
+
+	s, db := newRecordingService(t)
+	result, err := s.IngestPatients(strings.NewReader(submission), SubmissionJSON, ImportOptions{})
+	if err != nil {
+		t.Fatalf("IngestPatients: %v", err)
+	}
+
+	tests := []struct {
+		key    string
+		status string
+		errors []string
+	}{
+		{key: "uuid:p1", status: RecordInserted},
+		// A record that cannot be decoded is reported by its position only
+		{key: "", status: RecordInvalid, errors: []string{`unknown field "ward"`}},
+		{key: "uuid:p3", status: RecordInvalid, errors: []string{"antibiotics[0]: missing id"}},
+		{key: "uuid:p4", status: RecordInvalid, errors: []string{`id "uuid:p4" and instance_id "uuid:other" differ`}},
+		{key: "uuid:p5", status: RecordInvalid, errors: []string{
+			`indications[1]: id "uuid:p5/Indications[1]" is used twice`,
+			`specimens[0]: parent_key "uuid:p1" is not the patient ID "uuid:p5"`,
+			`optional_vars[0]: id and parent_key must be the patient ID "uuid:p5"`,
+		}},
+		{key: "", status: RecordInvalid, errors: []string{"missing patient ID: set id or instance_id"}},
+	}
+	if len(result.Records) != len(tests) {
+		t.Fatalf("records = %d, want %d", len(result.Records), len(tests))
+	}
+	for i, tt := range tests {
+		record := result.Records[i]
+		if record.Record != i+1 || record.Key != tt.key || record.Status != tt.status {
+			t.Errorf("record %d = %d %q %s, want %q %s", i, record.Record, record.Key, record.Status, tt.key, tt.status)
+		}
+		if len(record.Errors) != len(tt.errors) {
+			t.Errorf("record %q errors = %q, want %q", tt.key, record.Errors, tt.errors)
+			continue
+		}
+		for j, want := range tt.errors {
+			if !strings.Contains(record.Errors[j], want) {
+				t.Errorf("record %q error %d = %q, want %q", tt.key, j, record.Errors[j], want)
+			}
+		}
+	}
+
+	// Child keys are checked against the patient, which sets missing parent keys
+	inserted := result.Records[0]
+	want := map[string]int{EntityAntibiotics: 1, EntityIndications: 1, EntitySpecimens: 1, EntityOptionalVars: 1}
+	if !reflect.DeepEqual(inserted.Children, want) {
+		t.Errorf("children = %v, want %v", inserted.Children, want)
+	}
+	if len(inserted.Warnings) != 1 || !strings.Contains(inserted.Warnings[0], `specimens[0]: could not read susceptibility result "pending"`) {
+		t.Errorf("warnings = %q, want the unread susceptibility result", inserted.Warnings)
+	}
+	if result.TotalRecords != 6 || result.InsertedRecords != 1 || result.SkippedRecords != 5 || len(result.Errors) != 7 {
+		t.Errorf("totals = %d total, %d inserted, %d skipped, %d errors", result.TotalRecords, result.InsertedRecords, result.SkippedRecords, len(result.Errors))
+	}
+
+	for _, table := range []string{"patients", "antibiotics", "indications", "specimens", "optional_vars", "susceptibility_results"} {
+		if len(db.Statements(`INSERT INTO "`+table+`"`)) != 1 {
+			t.Errorf("%s inserted %d times, want once", table, len(db.Statements(`INSERT INTO "`+table+`"`)))
+		}
+	}
+
+	// NDJSON is read the same way, and a bad line fails only its record
+	ndjson := "{\"id\":\"uuid:p1\"}\n{\"id\":\n{\"id\":\"uuid:p2\"}\n"
+	result, err = s.IngestPatients(strings.NewReader(ndjson), SubmissionNDJSON, ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("IngestPatients NDJSON: %v", err)
+	}
+	statuses := make([]string, 0, len(result.Records))
+	for _, record := range result.Records {
+		statuses = append(statuses, record.Status)
+	}
+	if want := []string{RecordInserted, RecordInvalid, RecordInserted}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("NDJSON statuses = %v, want %v", statuses, want)
+	}
+
+	if _, err := s.IngestPatients(strings.NewReader("[]"), SubmissionJSON, ImportOptions{}); !errors.Is(err, ErrInvalidJSON) {
+		t.Errorf("error for an empty submission = %v, want ErrInvalidJSON", err)
+	}
+}
+
+func TestIngestWriteRecordMerge(t *testing.T) {
+	newRecord := func(edits string) *ingestRecord {
+		return &ingestRecord{
+			result: &RecordResult{Record: 1, Key: "uuid:p1"},
+			patient: &models.Patient{
+				ID:          "uuid:p1",
+				InstanceID:  "uuid:p1",
+				Edits:       edits,
+				Antibiotics: []models.Antibiotic{{ID: "uuid:p1/Antibioticform[1]", ParentKey: "uuid:p1"}},
+				Specimens:   []models.Specimen{{ID: "uuid:p1/Specimens[1]", ParentKey: "uuid:p1", AntibioticSusceptibilityTestResults: "CIP S"}},
+			},
+		}
+	}
+	current := func() map[string]*models.Patient {
+		return map[string]*models.Patient{
+			"uuid:p1": {ID: "uuid:p1", Edits: "1", Excluded: true, ExclusionReason: "duplicate", DuplicateOf: "uuid:p0"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		merge   string
+		edits   string
+		want    string
+		written bool
+	}{
+		{name: "skip", merge: MergeSkip, edits: "2", want: RecordSkipped},
+		{name: "newer with an older edit", merge: MergeNewer, edits: "1", want: RecordSkipped},
+		{name: "newer with a newer edit", merge: MergeNewer, edits: "2", want: RecordUpdated, written: true},
+		{name: "overwrite", merge: MergeOverwrite, edits: "0", want: RecordUpdated, written: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newRecordingService(t)
+			run := &ingestRun{s: s, db: s.db, opts: ImportOptions{MergeStrategy: tt.merge}, result: &IngestResult{UploadResult: newUploadResult(false)}}
+			rec := newRecord(tt.edits)
+
+			if got := run.writeRecord(s.db, rec, current()); got != tt.want || rec.result.Status != tt.want {
+				t.Fatalf("writeRecord = %s (status %s), want %s", got, rec.result.Status, tt.want)
+			}
+			if !tt.written {
+				if len(db.statements) != 0 {
+					t.Errorf("skipped record sent %v", db.statements)
+				}
+				return
+			}
+
+			// The patient is updated, keeping its review, and the submitted
+			// children replace the stored ones
+			if !rec.patient.Excluded || rec.patient.DuplicateOf != "uuid:p0" {
+				t.Errorf("patient review = %v %q, want it kept", rec.patient.Excluded, rec.patient.DuplicateOf)
+			}
+			tables := make([]string, 0)
+			for _, statement := range db.Statements("UPDATE", "DELETE", "INSERT") {
+				// UPDATE "table" ..., DELETE FROM "table" ..., INSERT INTO "table" ...
+				fields := strings.Fields(statement)
+				table := fields[1]
+				if fields[0] != "UPDATE" {
+					table = fields[2]
+				}
+				tables = append(tables, fields[0]+" "+strings.Trim(table, `"`))
+			}
+			want := []string{
+				"UPDATE patients",
+				"DELETE susceptibility_results",
+				"DELETE specimens",
+				"DELETE optional_vars",
+				"DELETE indications",
+				"DELETE antibiotics",
+				"INSERT antibiotics",
+				"INSERT specimens",
+				"DELETE susceptibility_results",
+				"INSERT susceptibility_results",
+			}
+			if !reflect.DeepEqual(tables, want) {
+				t.Errorf("statements = %v, want %v", tables, want)
+			}
+		})
+	}
+}
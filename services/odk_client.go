@@ -0,0 +1,128 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"point-prevalence-survey/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ODKClient reads the submissions of one form from the OData API of an ODK
+// Central server
+type ODKClient struct {
+	baseURL   string
+	projectID string
+	formID    string
+	username  string
+	password  string
+	token     string
+	pageSize  int
+	http      *http.Client
+}
+
+// NewODKClient returns a client for the server and form in cfg
+func NewODKClient(cfg *config.Config) *ODKClient {
+	pageSize := cfg.ODKPageSize
+	if pageSize <= 0 {
+		pageSize = 250
+	}
+
+	return &ODKClient{
+		baseURL:   strings.TrimRight(cfg.ODKBaseURL, "/"),
+		projectID: cfg.ODKProjectID,
+		formID:    cfg.ODKFormID,
+		username:  cfg.ODKUsername,
+		password:  cfg.ODKPassword,
+		token:     cfg.ODKToken,
+		pageSize:  pageSize,
+		http:      &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// Configured reports whether a server, project and form are set
+func (c *ODKClient) Configured() bool {
+	return c.baseURL != "" && c.projectID != "" && c.formID != ""
+}
+
+// FormID returns the ID of the synced form
+func (c *ODKClient) FormID() string {
+	return c.formID
+}
+
+// ServiceURL returns the OData service document URL of the form
+func (c *ODKClient) ServiceURL() string {
+	return fmt.Sprintf("%s/v1/projects/%s/forms/%s.svc", c.baseURL, url.PathEscape(c.projectID), url.PathEscape(c.formID))
+}
+
+// odkPage is one page of the Submissions entity set
+type odkPage struct {
+	Value    []map[string]interface{} `json:"value"`
+	NextLink string                   `json:"@odata.nextLink"`
+}
+
+// Submissions pages through the submissions of the form with their repeat
+// groups expanded, calling fn with each page. When since is set only
+// submissions created or edited after it are fetched.
+func (c *ODKClient) Submissions(since *time.Time, fn func(submissions []map[string]interface{}) error) error {
+	query := url.Values{}
+	query.Set("$top", strconv.Itoa(c.pageSize))
+	query.Set("$expand", "*")
+	if since != nil {
+		ts := since.UTC().Format("2006-01-02T15:04:05.000Z")
+		query.Set("$filter", fmt.Sprintf("__system/submissionDate gt %s or __system/updatedAt gt %s", ts, ts))
+	}
+
+	next := c.ServiceURL() + "/Submissions?" + query.Encode()
+	for next != "" {
+		page, err := c.fetchPage(next)
+		if err != nil {
+			return err
+		}
+		if err := fn(page.Value); err != nil {
+			return err
+		}
+		next = page.NextLink
+	}
+
+	return nil
+}
+
+// fetchPage requests one page of submissions
+func (c *ODKClient) fetchPage(pageURL string) (*odkPage, error) {
+	req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building ODK request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error contacting ODK Central: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("ODK Central returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// Numbers are kept as written so integers are not turned into floats
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+
+	var page odkPage
+	if err := decoder.Decode(&page); err != nil {
+		return nil, fmt.Errorf("error reading ODK response: %v", err)
+	}
+	return &page, nil
+}
@@ -0,0 +1,509 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"point-prevalence-survey/config"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// JobEntityODKSync is the entity recorded on import jobs run by an ODK sync
+const JobEntityODKSync = "odk_sync"
+
+// Errors returned when starting an ODK sync
+var (
+	ErrSyncNotConfigured = errors.New("ODK sync is not configured")
+	ErrSyncRunning       = errors.New("an ODK sync is already running")
+)
+
+// odkSystemColumns maps the __system fields of an OData submission to the
+// column names of the ODK Central CSV export
+var odkSystemColumns = map[string]string{
+	"submissionDate":      "SubmissionDate",
+	"submitterId":         "SubmitterID",
+	"submitterName":       "SubmitterName",
+	"attachmentsPresent":  "AttachmentsPresent",
+	"attachmentsExpected": "AttachmentsExpected",
+	"status":              "Status",
+	"reviewState":         "ReviewState",
+	"deviceId":            "DeviceID",
+	"edits":               "Edits",
+	"formVersion":         "FormVersion",
+}
+
+// SyncOptions controls a single ODK sync run
+type SyncOptions struct {
+	// Full fetches every submission instead of only those since the last sync
+	Full        bool
+	TriggeredBy string
+	// Async runs the sync in the background and returns once its job is created
+	Async  bool
+	Import ImportOptions
+}
+
+// SyncResult is the outcome of an ODK sync
+type SyncResult struct {
+	JobID       uint          `json:"job_id"`
+	Since       *time.Time    `json:"since,omitempty"`
+	Watermark   *time.Time    `json:"watermark,omitempty"`
+	Submissions int           `json:"submissions"`
+	Tables      *BundleResult `json:"tables,omitempty"`
+}
+
+// ODKSyncService pulls submissions from ODK Central and imports them like an
+// uploaded bundle: the main form as patients and each repeat group as the
+// entity its name matches. Each run is recorded as an import job.
+type ODKSyncService struct {
+	db         *gorm.DB
+	client     *ODKClient
+	jobService *ImportJobService
+	running    sync.Mutex
+}
+
+var (
+	odkSyncService     *ODKSyncService
+	odkSyncServiceOnce sync.Once
+)
+
+// GetODKSyncService returns the shared sync service, starting the periodic
+// sync on first use when an interval is configured
+func GetODKSyncService() *ODKSyncService {
+	odkSyncServiceOnce.Do(func() {
+		cfg := config.LoadConfig()
+		odkSyncService = NewODKSyncService(NewODKClient(cfg))
+
+		if cfg.ODKSyncIntervalMinutes > 0 && odkSyncService.client.Configured() {
+			go odkSyncService.schedule(time.Duration(cfg.ODKSyncIntervalMinutes) * time.Minute)
+		}
+	})
+	return odkSyncService
+}
+
+// NewODKSyncService returns a sync service reading from client
+func NewODKSyncService(client *ODKClient) *ODKSyncService {
+	return &ODKSyncService{
+		db:         database.GetDB(),
+		client:     client,
+		jobService: GetImportJobService(),
+	}
+}
+
+// schedule runs an incremental sync every interval
+func (s *ODKSyncService) schedule(interval time.Duration) {
+	log.Printf("Syncing %s every %s", s.client.ServiceURL(), interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, _, err := s.Sync(SyncOptions{TriggeredBy: "scheduler"})
+		if err != nil && !errors.Is(err, ErrSyncRunning) {
+			log.Printf("Scheduled ODK sync failed: %v", err)
+		}
+	}
+}
+
+// Client returns the client the service syncs from
+func (s *ODKSyncService) Client() *ODKClient {
+	return s.client
+}
+
+// source identifies the synced form in sync state
+func (s *ODKSyncService) source() string {
+	return "odk:" + s.client.ServiceURL()
+}
+
+// State returns what is known about previous syncs of the form
+func (s *ODKSyncService) State() (*models.SyncState, error) {
+	state := models.SyncState{Source: s.source()}
+	if err := s.db.Where("source = ?", state.Source).FirstOrInit(&state).Error; err != nil {
+		return nil, fmt.Errorf("error loading sync state: %v", err)
+	}
+	return &state, nil
+}
+
+// Sync creates an import job and fetches and imports the submissions created
+// or edited since the last successful sync, merging with the "newer"
+// strategy unless another is given. Only one sync runs at a time.
+// With opts.Async the sync continues in the background and the result is nil.
+func (s *ODKSyncService) Sync(opts SyncOptions) (*models.ImportJob, *SyncResult, error) {
+	if !s.client.Configured() {
+		return nil, nil, ErrSyncNotConfigured
+	}
+	if !s.running.TryLock() {
+		return nil, nil, ErrSyncRunning
+	}
+
+	// Edited submissions replace the rows of their earlier versions
+	if opts.Import.MergeStrategy == "" {
+		opts.Import.MergeStrategy = MergeNewer
+	}
+
+	job, err := s.jobService.CreateJob(JobUpload{
+		Entity:     JobEntityODKSync,
+		Filename:   s.client.ServiceURL(),
+		UploadedBy: opts.TriggeredBy,
+		Async:      opts.Async,
+	}, opts.Import)
+	if err != nil {
+		s.running.Unlock()
+		return nil, nil, err
+	}
+
+	if opts.Async {
+		go func() {
+			defer s.running.Unlock()
+			s.run(job, opts)
+		}()
+		return job, nil, nil
+	}
+
+	defer s.running.Unlock()
+	result, err := s.run(job, opts)
+	return job, result, err
+}
+
+// run fetches the submissions for job and imports them
+func (s *ODKSyncService) run(job *models.ImportJob, opts SyncOptions) (*SyncResult, error) {
+	state, err := s.State()
+	if err != nil {
+		s.jobService.finishJob(job, nil, err)
+		return nil, err
+	}
+
+	result := &SyncResult{JobID: job.ID}
+	if !opts.Full {
+		result.Since = state.Watermark
+	}
+	result.Watermark = result.Since
+
+	importOpts := opts.Import
+	s.jobService.startJob(job, &importOpts)
+	log.Printf("Syncing submissions from %s (job %d)", s.client.ServiceURL(), job.ID)
+
+	tables := newODKTables(s.client.FormID())
+	err = s.client.Submissions(result.Since, func(submissions []map[string]interface{}) error {
+		for _, submission := range submissions {
+			tables.addSubmission(submission)
+			result.Submissions++
+			if t := submissionUpdatedAt(submission); t != nil && (result.Watermark == nil || t.After(*result.Watermark)) {
+				result.Watermark = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.jobService.finishJob(job, nil, err)
+		s.saveState(state, job, result, false)
+		return result, err
+	}
+
+	bundle := &BundleResult{
+		Files:   make([]BundleFileResult, 0),
+		Ignored: tables.ignoredGroups(),
+		DryRun:  importOpts.DryRun,
+	}
+	bundle, err = s.jobService.csvService.importEntitySources(tables.sources(), bundle, importOpts)
+
+	var totals *UploadResult
+	if bundle != nil {
+		for _, file := range bundle.Files {
+			s.jobService.saveRowErrors(job, file.File, file.Result)
+		}
+		totals = bundle.Totals()
+	}
+	s.jobService.finishJob(job, totals, err)
+
+	result.Tables = bundle
+	s.saveState(state, job, result, syncImported(job, bundle))
+	return result, err
+}
+
+// syncImported reports whether every table of a sync was imported, so the
+// watermark can move past its submissions. Row errors are kept with the job,
+// but a table that failed as a whole is fetched again by the next sync.
+func syncImported(job *models.ImportJob, bundle *BundleResult) bool {
+	if job.Status != models.ImportJobCompleted || bundle == nil {
+		return false
+	}
+	for _, file := range bundle.Files {
+		if file.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// saveState records the outcome of a sync. The watermark only moves forward
+// when the submissions were imported, so failed syncs are fetched again.
+func (s *ODKSyncService) saveState(state *models.SyncState, job *models.ImportJob, result *SyncResult, advance bool) {
+	state.LastRunAt = job.FinishedAt
+	state.LastStatus = job.Status
+	state.LastMessage = job.Message
+	state.LastImportID = &job.ID
+	state.Submissions = result.Submissions
+	if advance {
+		state.Watermark = result.Watermark
+	}
+
+	if err := s.db.Save(state).Error; err != nil {
+		log.Printf("Error saving sync state of %s: %v", state.Source, err)
+	}
+}
+
+// submissionUpdatedAt returns when a submission was last edited, or else
+// when it was submitted
+func submissionUpdatedAt(submission map[string]interface{}) *time.Time {
+	system, _ := submission["__system"].(map[string]interface{})
+	for _, field := range []string{"updatedAt", "submissionDate"} {
+		value, _ := system[field].(string)
+		if value == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// odkField is one flattened value of a submission
+type odkField struct {
+	name  string
+	value string
+}
+
+// odkTable collects the rows of one entity with the union of their columns
+type odkTable struct {
+	name    string
+	header  []string
+	columns map[string]int
+	records [][]string
+}
+
+func (t *odkTable) add(fields []odkField) {
+	record := make([]string, len(t.header))
+	for _, field := range fields {
+		i, ok := t.columns[field.name]
+		if !ok {
+			i = len(t.header)
+			t.columns[field.name] = i
+			t.header = append(t.header, field.name)
+			record = append(record, "")
+		}
+		record[i] = field.value
+	}
+	t.records = append(t.records, record)
+}
+
+// odkTables flattens OData submissions into the tables of an ODK Central CSV
+// export: one for the main form and one per repeat group, with group fields
+// named "group-field" and repeat rows keyed "<parent row key>/<path>[n]" as
+// in the export. Every child entity belongs to a patient, so the PARENT_KEY
+// of rows nested in another repeat is the submission key rather than the
+// key of the repeat row holding them.
+type odkTables struct {
+	formID  string
+	tables  map[string]*odkTable
+	ignored map[string]bool
+}
+
+func newODKTables(formID string) *odkTables {
+	return &odkTables{
+		formID:  formID,
+		tables:  make(map[string]*odkTable),
+		ignored: make(map[string]bool),
+	}
+}
+
+// table returns the table collecting rows of entity
+func (t *odkTables) table(entity, name string) *odkTable {
+	table, ok := t.tables[entity]
+	if !ok {
+		table = &odkTable{name: name, columns: make(map[string]int)}
+		t.tables[entity] = table
+	}
+	return table
+}
+
+// addSubmission adds a submission and its repeat group rows
+func (t *odkTables) addSubmission(submission map[string]interface{}) {
+	key, _ := submission["__id"].(string)
+	fields := []odkField{{name: "KEY", value: key}}
+
+	if system, ok := submission["__system"].(map[string]interface{}); ok {
+		for _, name := range sortedKeys(system) {
+			if column, ok := odkSystemColumns[name]; ok {
+				fields = append(fields, odkField{name: column, value: odkValue(system[name])})
+			}
+		}
+	}
+
+	fields = t.flatten(submission, nil, key, key, fields)
+	t.table(EntityPatients, t.formID).add(fields)
+}
+
+// flatten appends the fields of a group of the row keyed rowKey to fields,
+// adding the rows of any repeat groups it contains to their tables
+func (t *odkTables) flatten(group map[string]interface{}, path []string, submissionKey, rowKey string, fields []odkField) []odkField {
+	for _, name := range sortedKeys(group) {
+		// Metadata such as __id, __system and @odata links is not form data
+		if strings.HasPrefix(name, "__") || strings.Contains(name, "@odata") {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), name)
+
+		switch value := group[name].(type) {
+		case map[string]interface{}:
+			fields = t.flatten(value, fieldPath, submissionKey, rowKey, fields)
+		case []interface{}:
+			if !isRepeat(value) {
+				fields = append(fields, odkField{name: strings.Join(fieldPath, "-"), value: odkValue(value)})
+				continue
+			}
+			for i, item := range value {
+				if row, ok := item.(map[string]interface{}); ok {
+					key := fmt.Sprintf("%s/%s[%d]", rowKey, strings.Join(fieldPath, "/"), i+1)
+					t.addRepeatRow(name, row, submissionKey, key)
+				}
+			}
+		default:
+			fields = append(fields, odkField{name: strings.Join(fieldPath, "-"), value: odkValue(value)})
+		}
+	}
+	return fields
+}
+
+// addRepeatRow adds a row of a repeat group to the table of the entity the
+// group name matches. Groups that match no entity are ignored.
+func (t *odkTables) addRepeatRow(group string, row map[string]interface{}, submissionKey, key string) {
+	entity := ""
+	name := normalizeHeader(group)
+	for _, candidate := range bundleFileNames {
+		if strings.Contains(name, candidate.fragment) {
+			entity = candidate.entity
+			break
+		}
+	}
+
+	fields := []odkField{{name: "KEY", value: key}, {name: "PARENT_KEY", value: submissionKey}}
+	fields = t.flatten(row, nil, submissionKey, key, fields)
+
+	if entity == "" {
+		t.ignored[group] = true
+		return
+	}
+	t.table(entity, t.formID+"-"+group).add(fields)
+}
+
+// ignoredGroups lists the repeat groups that matched no entity
+func (t *odkTables) ignoredGroups() []string {
+	groups := make([]string, 0, len(t.ignored))
+	for group := range t.ignored {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// sources returns the collected tables as bundle sources by entity
+func (t *odkTables) sources() map[string]bundleSource {
+	sources := make(map[string]bundleSource, len(t.tables))
+	for entity, table := range t.tables {
+		table := table
+		sources[entity] = bundleSource{
+			name: table.name,
+			open: func() (rowReader, io.Closer, error) {
+				reader := &tableReader{header: table.header, records: table.records}
+				return reader, reader, nil
+			},
+		}
+	}
+	return sources
+}
+
+// tableReader serves a table held in memory as a rowReader, padding records
+// to the width of the header
+type tableReader struct {
+	header  []string
+	records [][]string
+	next    int
+	started bool
+}
+
+func (r *tableReader) Read() ([]string, error) {
+	if !r.started {
+		r.started = true
+		return r.header, nil
+	}
+	if r.next >= len(r.records) {
+		return nil, io.EOF
+	}
+
+	record := r.records[r.next]
+	r.next++
+	for len(record) < len(r.header) {
+		record = append(record, "")
+	}
+	return record, nil
+}
+
+func (r *tableReader) Close() error {
+	return nil
+}
+
+// isRepeat reports whether an array holds repeat group rows rather than
+// the values of a field such as geopoint coordinates
+func isRepeat(values []interface{}) bool {
+	for _, value := range values {
+		if _, ok := value.(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// odkValue formats a JSON value as it appears in a CSV export
+func odkValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, odkValue(item))
+		}
+		return strings.Join(parts, " ")
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// sortedKeys returns the keys of a JSON object in a stable order
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"point-prevalence-survey/config"
+	"point-prevalence-survey/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// odkStub serves the Submissions of one form in pages of one submission,
+// recording the query of each request
+type odkStub struct {
+	submissions []string
+	queries     []map[string]string
+	auth        []string
+}
+
+func (stub *odkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/projects/7/forms/pps.svc/Submissions" {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := map[string]string{}
+	for name := range r.URL.Query() {
+		query[name] = r.URL.Query().Get(name)
+	}
+	stub.queries = append(stub.queries, query)
+	stub.auth = append(stub.auth, r.Header.Get("Authorization"))
+
+	skip := 0
+	fmt.Sscan(query["$skip"], &skip)
+	next := ""
+	if skip+1 < len(stub.submissions) {
+		next = fmt.Sprintf(`,"@odata.nextLink":"http://%s%s?$skip=%d"`, r.Host, r.URL.Path, skip+1)
+	}
+	fmt.Fprintf(w, `{"value":[%s]%s}`, stub.submissions[skip], next)
+}
+
+func newODKStub(t *testing.T, submissions ...string) (*odkStub, *ODKClient) {
+	stub := &odkStub{submissions: submissions}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	client := NewODKClient(&config.Config{
+		ODKBaseURL:   server.URL + "/",
+		ODKProjectID: "7",
+		ODKFormID:    "pps",
+		ODKToken:     "secret",
+		ODKPageSize:  1,
+	})
+	return stub, client
+}
+
+const odkSubmission1 = `{
+	"__id": "uuid:p1",
+	"__system": {"submissionDate": "2024-05-01T10:00:00.000Z", "updatedAt": null, "edits": 0, "reviewState": "approved"},
+	"meta": {"instanceID": "uuid:p1"},
+	"Core_variables": {"facility": "F1", "age_years": 35, "location": [32.5, 0.3]},
+	"Antibioticform": [
+		{"__id": "a1", "antibiotic_inn_name": "Amoxicillin", "unit_dose": 500,
+		 "ab_details": [{"__id": "d1", "prescriber": "Doctor"}]},
+		{"__id": "a2", "antibiotic_inn_name": "Ceftriaxone", "unit_dose": 1}
+	],
+	"Followup": [{"__id": "f1", "note": "ignored"}],
+	"Antibioticform@odata.navigationLink": "Submissions('uuid:p1')/Antibioticform"
+}`
+
+const odkSubmission2 = `{
+	"__id": "uuid:p2",
+	"__system": {"submissionDate": "2024-05-02T10:00:00.000Z", "updatedAt": "2024-06-01T08:30:00.000Z", "edits": 1},
+	"Core_variables": {"facility": "F2", "age_years": 61},
+	"Antibioticform": []
+}`
+
+func TestODKClientSubmissions(t *testing.T) {
+	stub, client := newODKStub(t, odkSubmission1, odkSubmission2)
+
+	var keys []string
+	err := client.Submissions(nil, func(submissions []map[string]interface{}) error {
+		for _, submission := range submissions {
+			keys = append(keys, submission["__id"].(string))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Submissions: %v", err)
+	}
+
+	if want := []string{"uuid:p1", "uuid:p2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("submissions = %v, want %v", keys, want)
+	}
+	if len(stub.queries) != 2 {
+		t.Fatalf("requests = %d, want one per page", len(stub.queries))
+	}
+	first := stub.queries[0]
+	if first["$top"] != "1" || first["$expand"] != "*" {
+		t.Errorf("first page query = %v, want $top=1 and $expand=*", first)
+	}
+	if _, ok := first["$filter"]; ok {
+		t.Errorf("full sync sent $filter %q", first["$filter"])
+	}
+	if stub.queries[1]["$skip"] != "1" {
+		t.Errorf("second page query = %v, want the next link", stub.queries[1])
+	}
+	for _, auth := range stub.auth {
+		if auth != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the token", auth)
+		}
+	}
+}
+
+func TestODKClientSubmissionsSince(t *testing.T) {
+	stub, client := newODKStub(t, odkSubmission2)
+
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("EAT", 3*60*60))
+	if err := client.Submissions(&since, func([]map[string]interface{}) error { return nil }); err != nil {
+		t.Fatalf("Submissions: %v", err)
+	}
+
+	want := "__system/submissionDate gt 2024-05-01T09:00:00.000Z or __system/updatedAt gt 2024-05-01T09:00:00.000Z"
+	if got := stub.queries[0]["$filter"]; got != want {
+		t.Errorf("$filter = %q, want %q", got, want)
+	}
+}
+
+func TestODKClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Could not authenticate"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client := NewODKClient(&config.Config{ODKBaseURL: server.URL, ODKProjectID: "7", ODKFormID: "pps"})
+	err := client.Submissions(nil, func([]map[string]interface{}) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("error = %v, want the 401 response", err)
+	}
+}
+
+func TestODKTablesFlatten(t *testing.T) {
+	_, client := newODKStub(t, odkSubmission1, odkSubmission2)
+
+	tables := newODKTables(client.FormID())
+	var watermark *time.Time
+	err := client.Submissions(nil, func(submissions []map[string]interface{}) error {
+		for _, submission := range submissions {
+			tables.addSubmission(submission)
+			if t := submissionUpdatedAt(submission); t != nil && (watermark == nil || t.After(*watermark)) {
+				watermark = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Submissions: %v", err)
+	}
+
+	if want := time.Date(2024, 6, 1, 8, 30, 0, 0, time.UTC); watermark == nil || !watermark.Equal(want) {
+		t.Errorf("watermark = %v, want %v", watermark, want)
+	}
+	if want := []string{"Followup"}; !reflect.DeepEqual(tables.ignoredGroups(), want) {
+		t.Errorf("ignored groups = %v, want %v", tables.ignoredGroups(), want)
+	}
+
+	patients := readODKTable(t, tables, EntityPatients)
+	if len(patients) != 2 {
+		t.Fatalf("patients = %v, want 2 rows", patients)
+	}
+	p1 := patients[0]
+	for column, want := range map[string]string{
+		"KEY":                      "uuid:p1",
+		"SubmissionDate":           "2024-05-01T10:00:00.000Z",
+		"ReviewState":              "approved",
+		"Edits":                    "0",
+		"Core_variables-facility":  "F1",
+		"Core_variables-age_years": "35",
+		"Core_variables-location":  "32.5 0.3",
+		"meta-instanceID":          "uuid:p1",
+	} {
+		if p1[column] != want {
+			t.Errorf("patient column %s = %q, want %q", column, p1[column], want)
+		}
+	}
+	if patients[1]["Core_variables-facility"] != "F2" || patients[1]["meta-instanceID"] != "" {
+		t.Errorf("second patient = %v", patients[1])
+	}
+
+	antibiotics := readODKTable(t, tables, EntityAntibiotics)
+	if len(antibiotics) != 2 {
+		t.Fatalf("antibiotics = %v, want 2 rows", antibiotics)
+	}
+	for i, ab := range antibiotics {
+		if want := fmt.Sprintf("uuid:p1/Antibioticform[%d]", i+1); ab["KEY"] != want {
+			t.Errorf("antibiotic KEY = %q, want %q", ab["KEY"], want)
+		}
+		if ab["PARENT_KEY"] != "uuid:p1" {
+			t.Errorf("antibiotic PARENT_KEY = %q, want the submission key", ab["PARENT_KEY"])
+		}
+	}
+	if antibiotics[0]["unit_dose"] != "500" {
+		t.Errorf("unit_dose = %q, want 500", antibiotics[0]["unit_dose"])
+	}
+
+	// Rows of a repeat nested in another repeat belong to the patient
+	details := readODKTable(t, tables, EntityAntibioticDetails)
+	if len(details) != 1 {
+		t.Fatalf("antibiotic details = %v, want 1 row", details)
+	}
+	if details[0]["KEY"] != "uuid:p1/Antibioticform[1]/ab_details[1]" || details[0]["PARENT_KEY"] != "uuid:p1" {
+		t.Errorf("antibiotic details keys = %q, %q", details[0]["KEY"], details[0]["PARENT_KEY"])
+	}
+	if details[0]["prescriber"] != "Doctor" {
+		t.Errorf("prescriber = %q, want Doctor", details[0]["prescriber"])
+	}
+}
+
+// readODKTable reads the table of entity through its bundle source, as the
+// import does, returning each row by column name
+func readODKTable(t *testing.T, tables *odkTables, entity string) []map[string]string {
+	t.Helper()
+
+	source, ok := tables.sources()[entity]
+	if !ok {
+		t.Fatalf("no %s table", entity)
+	}
+	reader, closer, err := source.open()
+	if err != nil {
+		t.Fatalf("open %s: %v", entity, err)
+	}
+	defer closer.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		t.Fatalf("read %s header: %v", entity, err)
+	}
+
+	rows := make([]map[string]string, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatalf("read %s: %v", entity, err)
+		}
+		if len(record) != len(header) {
+			t.Fatalf("%s row has %d columns, header has %d", entity, len(record), len(header))
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestOdkValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{value: nil, want: ""},
+		{value: "text", want: "text"},
+		{value: json.Number("12"), want: "12"},
+		{value: 1.5, want: "1.5"},
+		{value: true, want: "true"},
+		{value: []interface{}{32.5, 0.3, nil}, want: "32.5 0.3 "},
+	}
+
+	for _, tt := range tests {
+		if got := odkValue(tt.value); got != tt.want {
+			t.Errorf("odkValue(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSyncImported(t *testing.T) {
+	imported := []BundleFileResult{
+		{File: "patients", Entity: EntityPatients, Result: &UploadResult{}},
+		{File: "antibiotics", Entity: EntityAntibiotics, Result: &UploadResult{Errors: []string{"Row 2: invalid date"}}},
+	}
+	failedTable := append(append([]BundleFileResult{}, imported...), BundleFileResult{
+		File: "specimens", Entity: EntitySpecimens, Error: "missing required columns: KEY",
+	})
+
+	tests := []struct {
+		name   string
+		status string
+		bundle *BundleResult
+		want   bool
+	}{
+		{name: "imported with row errors", status: models.ImportJobCompleted, bundle: &BundleResult{Files: imported}, want: true},
+		{name: "table failed", status: models.ImportJobCompleted, bundle: &BundleResult{Files: failedTable}},
+		{name: "job failed", status: models.ImportJobFailed, bundle: &BundleResult{Files: imported}},
+		{name: "nothing imported", status: models.ImportJobFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := syncImported(&models.ImportJob{Status: tt.status}, tt.bundle); got != tt.want {
+				t.Errorf("syncImported = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
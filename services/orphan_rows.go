@@ -0,0 +1,147 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"point-prevalence-survey/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// stageOrphan keeps a child row whose parent patient has not been imported
+// yet. A row staged again for the same key replaces the earlier one.
+func (run *importRun) stageOrphan(tx *gorm.DB, rec importRecord, batchResult *UploadResult) {
+	spec := run.spec
+	message := fmt.Sprintf("parent patient %s not found; %s %s staged until it is imported", rec.parentKey, spec.label, rec.key)
+
+	if !run.opts.DryRun {
+		if run.opts.ImportID != 0 {
+			setImportID(rec.model, run.opts.ImportID)
+		}
+
+		data, err := json.Marshal(rec.model)
+		if err != nil {
+			batchResult.rowError(rec.rowNum, rec.key, rec.record, RowError{
+				Code:    RowErrorDatabase,
+				Message: fmt.Sprintf("error staging %s %s: %v", spec.label, rec.key, err),
+			})
+			return
+		}
+
+		orphan := &models.OrphanRow{
+			Entity:    spec.entity,
+			Key:       rec.key,
+			ParentKey: rec.parentKey,
+			ImportID:  run.opts.ImportID,
+			Row:       rec.rowNum,
+			Data:      string(data),
+			Record:    rec.record,
+		}
+		if err := run.savepoint(tx, func() error {
+			if err := tx.Where("entity = ? AND key = ? AND resolved_at IS NULL", spec.entity, rec.key).
+				Delete(&models.OrphanRow{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(orphan).Error
+		}); err != nil {
+			batchResult.rowError(rec.rowNum, rec.key, rec.record, RowError{
+				Code:    RowErrorDatabase,
+				Message: fmt.Sprintf("error staging %s %s: %v", spec.label, rec.key, err),
+			})
+			return
+		}
+	}
+
+	batchResult.rowStaged(rec.rowNum, rec.key, message)
+	log.Printf("Staged %s %s: parent patient %s not found", spec.label, rec.key, rec.parentKey)
+}
+
+// resolveOrphans inserts the staged child rows of the patients in keys that
+// now exist. Rows that still fail keep their error and stay staged. In a dry
+// run the rows that would be linked are only counted.
+func (run *importRun) resolveOrphans(tx *gorm.DB, keys []string, batchResult *UploadResult) error {
+	var orphans []models.OrphanRow
+	if err := tx.Where("parent_key IN ? AND resolved_at IS NULL", keys).Order("id").Find(&orphans).Error; err != nil {
+		return fmt.Errorf("error loading staged rows: %v", err)
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	if run.opts.DryRun {
+		batchResult.LinkedRecords += len(orphans)
+		return nil
+	}
+
+	var found []string
+	if err := tx.Model(&models.Patient{}).Where("key IN ?", keys).Pluck("key", &found).Error; err != nil {
+		return fmt.Errorf("error checking patients of staged rows: %v", err)
+	}
+	patients := make(map[string]bool, len(found))
+	for _, key := range found {
+		patients[key] = true
+	}
+
+	for i := range orphans {
+		orphan := &orphans[i]
+		if !patients[orphan.ParentKey] {
+			continue
+		}
+
+		if err := run.savepoint(tx, func() error {
+			return linkOrphan(tx, orphan, run.opts.ImportID, run.s.QualityRules())
+		}); err != nil {
+			// The error is kept on the staged row, outside the rolled back savepoint
+			tx.Model(orphan).Update("error", err.Error())
+			log.Printf("Failed to link staged %s %s to patient %s: %v", orphan.Entity, orphan.Key, orphan.ParentKey, err)
+			continue
+		}
+		batchResult.LinkedRecords++
+	}
+
+	log.Printf("Linked %d staged child rows to imported patients", batchResult.LinkedRecords)
+	return nil
+}
+
+// linkOrphan inserts a staged row into its table and marks it resolved by
+// the import of its patient. Rows whose key has since been imported directly
+// are only marked resolved. Inserted rows are checked against rules.
+func linkOrphan(tx *gorm.DB, orphan *models.OrphanRow, resolvedBy uint, rules *QualityRules) error {
+	spec, ok := importSpecs[orphan.Entity]
+	if !ok {
+		return fmt.Errorf("unknown entity %q", orphan.Entity)
+	}
+
+	var count int64
+	if err := tx.Model(spec.model()).Where("key = ?", orphan.Key).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		model := spec.model()
+		if err := json.Unmarshal([]byte(orphan.Data), model); err != nil {
+			return fmt.Errorf("error reading staged %s %s: %v", spec.label, orphan.Key, err)
+		}
+		if orphan.ImportID != 0 {
+			setImportID(model, orphan.ImportID)
+		}
+		if err := tx.Create(model).Error; err != nil {
+			return fmt.Errorf("error creating %s %s: %v", spec.label, orphan.Key, err)
+		}
+		if spec.afterWrite != nil {
+			if err := spec.afterWrite(tx, model); err != nil {
+				return err
+			}
+		}
+		if err := rules.StoreFlags(tx, orphan.Entity, model, orphan.ImportID); err != nil {
+			return err
+		}
+	}
+
+	updates := map[string]interface{}{"resolved_at": time.Now(), "error": ""}
+	if resolvedBy != 0 {
+		updates["resolved_by_id"] = resolvedBy
+	}
+	return tx.Model(orphan).Updates(updates).Error
+}
@@ -0,0 +1,730 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"point-prevalence-survey/models"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Severities of data quality rules. Rows breaking a reject rule are not
+// imported; rows breaking a warn rule are imported and flagged.
+const (
+	SeverityReject = "reject"
+	SeverityWarn   = "warn"
+	SeverityOff    = "off"
+)
+
+// Checks a data quality rule can make
+const (
+	// CheckRequired flags an empty text or date field, or a zero number
+	CheckRequired = "required"
+	// CheckRange flags a number below min or above max
+	CheckRange = "range"
+	// CheckCompare flags a number or date that is not op the other field
+	CheckCompare = "compare"
+	// CheckAllowed flags a text field whose value is not one of values
+	CheckAllowed = "allowed"
+	// CheckCount flags a patient count field that differs from the number of
+	// child records in children
+	CheckCount = "count"
+)
+
+// RowErrorQualityRule marks a row that broke a data quality rule, as a row
+// error for reject rules and as a warning for warn rules
+const RowErrorQualityRule = "quality_rule"
+
+// ErrQualityRules is wrapped by errors in a data quality rule definition
+var ErrQualityRules = errors.New("invalid data quality rule")
+
+// QualityRule is a declarative plausibility check on one field of a record
+type QualityRule struct {
+	ID       string `json:"id"`
+	Entity   string `json:"entity"`
+	Field    string `json:"field"`
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	// Min and Max bound a range check; either may be left out
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Op and Other are the comparison (<, <=, >, >=, ==, !=) and the field
+	// compared with in a compare check
+	Op    string `json:"op,omitempty"`
+	Other string `json:"other,omitempty"`
+	// Values are the codes an allowed check accepts
+	Values []string `json:"values,omitempty"`
+	// Children is the child table counted by a count check
+	Children string `json:"children,omitempty"`
+	// Message replaces the generated description of a broken rule
+	Message string `json:"message,omitempty"`
+}
+
+// qualityRulesFile is the format of the QUALITY_RULES_FILE
+type qualityRulesFile struct {
+	Rules []QualityRule `json:"rules"`
+}
+
+// qualityModels are the records rules can check. Optional vars share their
+// patient's key, so flags could not tell them apart.
+var qualityModels = map[string]func() interface{}{
+	EntityPatients:          func() interface{} { return &models.Patient{} },
+	EntityAntibiotics:       func() interface{} { return &models.Antibiotic{} },
+	EntityAntibioticDetails: func() interface{} { return &models.AntibioticDetails{} },
+	EntityIndications:       func() interface{} { return &models.Indication{} },
+	EntitySpecimens:         func() interface{} { return &models.Specimen{} },
+}
+
+// qualityChildren are the child tables of a patient a count rule can count
+var qualityChildren = map[string]func() interface{}{
+	EntityAntibiotics:       func() interface{} { return &models.Antibiotic{} },
+	EntityAntibioticDetails: func() interface{} { return &models.AntibioticDetails{} },
+	EntityIndications:       func() interface{} { return &models.Indication{} },
+	EntityOptionalVars:      func() interface{} { return &models.OptionalVar{} },
+	EntitySpecimens:         func() interface{} { return &models.Specimen{} },
+}
+
+// compareOps describe each comparison for numbers and for dates
+var compareOps = map[string][2]string{
+	"<":  {"less than", "before"},
+	"<=": {"at most", "on or before"},
+	">":  {"greater than", "after"},
+	">=": {"at least", "on or after"},
+	"==": {"equal to", "the same as"},
+	"!=": {"different from", "different from"},
+}
+
+// DefaultQualityRules are the plausibility checks applied when no rules file
+// is configured
+func DefaultQualityRules() []QualityRule {
+	zero, maxAge, maxMonths, maxWeight := 0.0, 120.0, 24.0, 300.0
+	return []QualityRule{
+		{ID: "age_years_range", Entity: EntityPatients, Field: "age_years", Check: CheckRange, Min: &zero, Max: &maxAge, Severity: SeverityReject},
+		{ID: "age_months_range", Entity: EntityPatients, Field: "age_months", Check: CheckRange, Min: &zero, Max: &maxMonths, Severity: SeverityWarn},
+		{ID: "weight_range", Entity: EntityPatients, Field: "weight", Check: CheckRange, Min: &zero, Max: &maxWeight, Severity: SeverityWarn},
+		{ID: "admission_before_survey", Entity: EntityPatients, Field: "admission_date", Check: CheckCompare, Op: "<=", Other: "survey_date", Severity: SeverityWarn},
+		{ID: "eligible_within_total", Entity: EntityPatients, Field: "ward_eligible_patients", Check: CheckCompare, Op: "<=", Other: "ward_total_patients", Severity: SeverityWarn},
+		{ID: "antibiotic_count", Entity: EntityPatients, Field: "patient_number_antibiotics", Check: CheckCount, Children: EntityAntibiotics, Severity: SeverityWarn},
+		{ID: "unit_dose_positive", Entity: EntityAntibiotics, Field: "unit_dose", Check: CheckRange, Min: &zero, Severity: SeverityReject},
+		{ID: "antibiotic_start_before_survey", Entity: EntityAntibiotics, Field: "start_date_antibiotic", Check: CheckCompare, Op: "<=", Other: "survey_date", Severity: SeverityWarn},
+	}
+}
+
+// QualityRules is the rule set checked on every imported record
+type QualityRules struct {
+	rules []QualityRule
+	// fields maps the JSON names of each entity's fields to their index
+	fields map[string]map[string]int
+}
+
+// LoadQualityRules returns the default rules, with the rules in the file at
+// path, if any, added to them. A rule in the file replaces the default rule
+// with the same ID; set its severity to off to disable it.
+func LoadQualityRules(path string) (*QualityRules, error) {
+	rules := DefaultQualityRules()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading quality rules file: %v", err)
+		}
+
+		var file qualityRulesFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("error parsing quality rules file %s: %v", path, err)
+		}
+
+		for _, rule := range file.Rules {
+			replaced := false
+			for i := range rules {
+				if rules[i].ID == rule.ID {
+					rules[i], replaced = rule, true
+				}
+			}
+			if !replaced {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	return NewQualityRules(rules)
+}
+
+// NewQualityRules validates rules and returns them as a rule set
+func NewQualityRules(rules []QualityRule) (*QualityRules, error) {
+	q := &QualityRules{fields: make(map[string]map[string]int)}
+	for entity, model := range qualityModels {
+		t := reflect.TypeOf(model()).Elem()
+		fields := make(map[string]int)
+		for i := 0; i < t.NumField(); i++ {
+			fields[jsonName(t.Field(i))] = i
+		}
+		q.fields[entity] = fields
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if seen[rule.ID] {
+			return nil, fmt.Errorf("%w: rule %q is defined twice", ErrQualityRules, rule.ID)
+		}
+		seen[rule.ID] = true
+
+		if err := q.validate(rule); err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrQualityRules, rule.ID, err)
+		}
+		if rule.Severity != SeverityOff {
+			q.rules = append(q.rules, rule)
+		}
+	}
+	return q, nil
+}
+
+// validate checks that a rule names known fields of the right types
+func (q *QualityRules) validate(rule QualityRule) error {
+	if rule.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	switch rule.Severity {
+	case SeverityReject, SeverityWarn, SeverityOff:
+	default:
+		return fmt.Errorf("severity must be reject, warn or off")
+	}
+
+	model, ok := qualityModels[rule.Entity]
+	if !ok {
+		return fmt.Errorf("entity must be one of patients, antibiotics, antibiotic_details, indications or specimens")
+	}
+	kind, err := q.fieldKind(rule.Entity, model, rule.Field)
+	if err != nil {
+		return err
+	}
+
+	switch rule.Check {
+	case CheckRequired:
+	case CheckRange:
+		if kind != reflect.Float64 {
+			return fmt.Errorf("range checks need a number field")
+		}
+		if rule.Min == nil && rule.Max == nil {
+			return fmt.Errorf("range checks need a min or a max")
+		}
+	case CheckCompare:
+		if _, ok := compareOps[rule.Op]; !ok {
+			return fmt.Errorf("op must be one of <, <=, >, >=, == or !=")
+		}
+		// Child records are compared with their patient's fields when the
+		// field is not their own
+		otherKind, err := q.fieldKind(rule.Entity, model, rule.Other)
+		if err != nil && rule.Entity != EntityPatients {
+			otherKind, err = q.fieldKind(EntityPatients, qualityModels[EntityPatients], rule.Other)
+			if err == nil && rule.Severity == SeverityReject {
+				return fmt.Errorf("compare checks against a patient field can only warn, since the patient may be imported after the row")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if kind != otherKind || (kind != reflect.Float64 && kind != reflect.Struct) {
+			return fmt.Errorf("compare checks need two number fields or two date fields")
+		}
+	case CheckAllowed:
+		if kind != reflect.String || len(rule.Values) == 0 {
+			return fmt.Errorf("allowed checks need a text field and values")
+		}
+	case CheckCount:
+		if rule.Entity != EntityPatients || kind != reflect.Float64 {
+			return fmt.Errorf("count checks need a number field of patients")
+		}
+		if _, ok := qualityChildren[rule.Children]; !ok {
+			return fmt.Errorf("children must be one of antibiotics, antibiotic_details, indications, optional_vars or specimens")
+		}
+		if rule.Severity == SeverityReject {
+			return fmt.Errorf("count checks can only warn, since child rows may be imported after their patient")
+		}
+	default:
+		return fmt.Errorf("check must be one of required, range, compare, allowed or count")
+	}
+	return nil
+}
+
+// fieldKind returns the kind of a field: Float64 for numbers, Struct for
+// dates and String for text
+func (q *QualityRules) fieldKind(entity string, model func() interface{}, field string) (reflect.Kind, error) {
+	i, ok := q.fields[entity][field]
+	if !ok {
+		return reflect.Invalid, fmt.Errorf("%s has no field %q", entity, field)
+	}
+	switch t := reflect.TypeOf(model()).Elem().Field(i).Type; {
+	case t == reflect.TypeOf(time.Time{}):
+		return reflect.Struct, nil
+	case t.Kind() == reflect.String:
+		return reflect.String, nil
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64:
+		return reflect.Float64, nil
+	}
+	return reflect.Invalid, fmt.Errorf("field %q cannot be checked", field)
+}
+
+// Rules returns the active rules
+func (q *QualityRules) Rules() []QualityRule {
+	if q == nil {
+		return nil
+	}
+	return q.rules
+}
+
+// value returns a field of a record as a float64, time.Time or string
+func (q *QualityRules) value(entity string, model interface{}, field string) interface{} {
+	i, ok := q.fields[entity][field]
+	if !ok {
+		return nil
+	}
+	v := reflect.Indirect(reflect.ValueOf(model)).Field(i)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return v.Interface()
+}
+
+// blank reports whether a text or date value was left empty. Numbers are
+// never blank, since an empty number column is read as 0.
+func blank(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v) == ""
+	case time.Time:
+		return v.IsZero()
+	}
+	return value == nil
+}
+
+// formatValue writes a value the way it is shown in flag messages
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format("2006-01-02")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// compareValues reports whether a op b holds for two numbers or two dates
+func compareValues(a interface{}, op string, b interface{}) bool {
+	var cmp int
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			cmp = -1
+		case x > y:
+			cmp = 1
+		}
+	case time.Time:
+		cmp = x.Compare(b.(time.Time))
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "==":
+		return cmp == 0
+	}
+	return cmp != 0
+}
+
+// Check returns the flags of the rules a record breaks. Compare rules on a
+// child record may name a field of its patient, which is only checked when
+// patient is given. Count rules are checked only when the child records of
+// a patient are counted in children.
+func (q *QualityRules) Check(entity string, model interface{}, patient *models.Patient, children map[string]int) []models.QualityFlag {
+	if q == nil {
+		return nil
+	}
+
+	key, patientKey := recordKeys(model)
+	flags := make([]models.QualityFlag, 0)
+	for _, rule := range q.rules {
+		if rule.Entity != entity {
+			continue
+		}
+
+		value := q.value(entity, model, rule.Field)
+		message := ""
+		switch rule.Check {
+		case CheckRequired:
+			if blank(value) || value == 0.0 {
+				message = fmt.Sprintf("%s is missing", rule.Field)
+			}
+		case CheckRange:
+			number := value.(float64)
+			if rule.Min != nil && number < *rule.Min {
+				message = fmt.Sprintf("%s %s is below the minimum of %s", rule.Field, formatValue(number), formatValue(*rule.Min))
+			}
+			if rule.Max != nil && number > *rule.Max {
+				message = fmt.Sprintf("%s %s is above the maximum of %s", rule.Field, formatValue(number), formatValue(*rule.Max))
+			}
+		case CheckCompare:
+			other := q.value(entity, model, rule.Other)
+			if other == nil && patient != nil {
+				other = q.value(EntityPatients, patient, rule.Other)
+			}
+			if other == nil || blank(value) || blank(other) {
+				continue
+			}
+			if !compareValues(value, rule.Op, other) {
+				words := compareOps[rule.Op][0]
+				if _, ok := value.(time.Time); ok {
+					words = compareOps[rule.Op][1]
+				}
+				message = fmt.Sprintf("%s (%s) must be %s %s (%s)", rule.Field, formatValue(value), words, rule.Other, formatValue(other))
+			}
+		case CheckAllowed:
+			if blank(value) {
+				continue
+			}
+			allowed := false
+			for _, code := range rule.Values {
+				allowed = allowed || strings.EqualFold(code, value.(string))
+			}
+			if !allowed {
+				message = fmt.Sprintf("%s %q is not one of %s", rule.Field, value, strings.Join(rule.Values, ", "))
+			}
+		case CheckCount:
+			count, ok := children[rule.Children]
+			if !ok {
+				continue
+			}
+			if value.(float64) != float64(count) {
+				message = fmt.Sprintf("%s is %s but %d %s were recorded", rule.Field, formatValue(value), count, rule.Children)
+			}
+		}
+
+		if message == "" {
+			continue
+		}
+		if rule.Message != "" {
+			message = rule.Message
+		}
+		flags = append(flags, models.QualityFlag{
+			Entity:     entity,
+			RecordKey:  key,
+			PatientKey: patientKey,
+			Rule:       rule.ID,
+			Severity:   rule.Severity,
+			Field:      rule.Field,
+			Message:    message,
+		})
+	}
+	return flags
+}
+
+// recordKeys returns the key of a record and of the patient it belongs to
+func recordKeys(model interface{}) (key, patientKey string) {
+	if patient, ok := model.(*models.Patient); ok {
+		return patient.ID, patient.ID
+	}
+	v := reflect.Indirect(reflect.ValueOf(model))
+	key = v.FieldByName("ID").String()
+	if parent := v.FieldByName("ParentKey"); parent.IsValid() {
+		patientKey = parent.String()
+	}
+	return key, patientKey
+}
+
+// rowErrors splits the flags of a row into the errors rejecting it and the
+// warnings it is imported with
+func rowErrors(flags []models.QualityFlag, column func(field string) string) (errs, warnings []RowError) {
+	for _, flag := range flags {
+		rowErr := RowError{
+			Column:  column(flag.Field),
+			Code:    RowErrorQualityRule,
+			Message: fmt.Sprintf("%s: %s", flag.Rule, flag.Message),
+		}
+		if flag.Severity == SeverityReject {
+			errs = append(errs, rowErr)
+		} else {
+			warnings = append(warnings, rowErr)
+		}
+	}
+	return errs, warnings
+}
+
+// countRuleIDs returns the IDs of the count rules. Their flags depend on
+// every child record of a patient, so they are replaced by RefreshCounts
+// rather than with the flags of a single record.
+func (q *QualityRules) countRuleIDs() []string {
+	ids := make([]string, 0)
+	for _, rule := range q.rules {
+		if rule.Check == CheckCount {
+			ids = append(ids, rule.ID)
+		}
+	}
+	return ids
+}
+
+// exceptCounts scopes a query to the flags of rules other than count rules
+func (q *QualityRules) exceptCounts(db *gorm.DB) *gorm.DB {
+	if ids := q.countRuleIDs(); len(ids) > 0 {
+		return db.Where("rule NOT IN ?", ids)
+	}
+	return db
+}
+
+// StoreFlags replaces the flags of a written record with those of the rules
+// it breaks. Count rules are left to RefreshCounts.
+func (q *QualityRules) StoreFlags(tx *gorm.DB, entity string, model interface{}, importID uint) error {
+	if q == nil || qualityModels[entity] == nil {
+		return nil
+	}
+
+	var patient *models.Patient
+	if entity != EntityPatients {
+		_, patientKey := recordKeys(model)
+		var found models.Patient
+		if err := tx.Where("key = ?", patientKey).Limit(1).Find(&found).Error; err != nil {
+			return fmt.Errorf("error loading patient %s: %v", patientKey, err)
+		}
+		if found.ID != "" {
+			patient = &found
+		}
+	}
+
+	key, _ := recordKeys(model)
+	if err := tx.Scopes(q.exceptCounts).Where("entity = ? AND record_key = ?", entity, key).
+		Delete(&models.QualityFlag{}).Error; err != nil {
+		return fmt.Errorf("error replacing quality flags of %s %s: %v", entity, key, err)
+	}
+	return createFlags(tx, q.Check(entity, model, patient, nil), importID)
+}
+
+// RefreshCounts checks the count rules of the patients in keys against the
+// child records stored for them, replacing their count flags
+func (q *QualityRules) RefreshCounts(tx *gorm.DB, keys []string, importID uint) error {
+	if q == nil || len(keys) == 0 {
+		return nil
+	}
+	ids := q.countRuleIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var patients []models.Patient
+	if err := tx.Where("key IN ?", keys).Find(&patients).Error; err != nil {
+		return fmt.Errorf("error loading patients for quality checks: %v", err)
+	}
+
+	counts := make(map[string]map[string]int, len(patients))
+	for _, patient := range patients {
+		counts[patient.ID] = make(map[string]int)
+	}
+	for _, rule := range q.rules {
+		if rule.Check != CheckCount {
+			continue
+		}
+		var rows []struct {
+			ParentKey string
+			Count     int
+		}
+		err := tx.Model(qualityChildren[rule.Children]()).
+			Select("parent_key, COUNT(*) AS count").
+			Where("parent_key IN ?", keys).
+			Group("parent_key").
+			Scan(&rows).Error
+		if err != nil {
+			return fmt.Errorf("error counting %s for quality checks: %v", rule.Children, err)
+		}
+		for key := range counts {
+			counts[key][rule.Children] = 0
+		}
+		for _, row := range rows {
+			if _, ok := counts[row.ParentKey]; ok {
+				counts[row.ParentKey][rule.Children] = row.Count
+			}
+		}
+	}
+
+	if err := tx.Where("entity = ? AND record_key IN ? AND rule IN ?", EntityPatients, keys, ids).
+		Delete(&models.QualityFlag{}).Error; err != nil {
+		return fmt.Errorf("error replacing quality flags: %v", err)
+	}
+
+	flags := make([]models.QualityFlag, 0)
+	for i := range patients {
+		for _, flag := range q.Check(EntityPatients, &patients[i], nil, counts[patients[i].ID]) {
+			if isCountFlag(ids, flag.Rule) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return createFlags(tx, flags, importID)
+}
+
+// isCountFlag reports whether rule is one of the count rules in ids
+func isCountFlag(ids []string, rule string) bool {
+	for _, id := range ids {
+		if id == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// createFlags stores flags, tagged with the import that raised them
+func createFlags(tx *gorm.DB, flags []models.QualityFlag, importID uint) error {
+	if len(flags) == 0 {
+		return nil
+	}
+	if importID != 0 {
+		for i := range flags {
+			flags[i].ImportID = &importID
+		}
+	}
+	if err := tx.Create(&flags).Error; err != nil {
+		return fmt.Errorf("error storing quality flags: %v", err)
+	}
+	return nil
+}
+
+// FlagPatient replaces the flags of a patient written with its child records
+// in one go, such as a JSON submission
+func (q *QualityRules) FlagPatient(tx *gorm.DB, patient *models.Patient, importID uint) error {
+	if q == nil {
+		return nil
+	}
+
+	flags := q.Check(EntityPatients, patient, nil, nil)
+	for _, child := range patientChildren(patient, nil) {
+		flags = append(flags, q.Check(child.entity, child.model, patient, nil)...)
+	}
+
+	// Antibiotic details are not part of submissions and keep their flags
+	entities := []string{EntityPatients, EntityAntibiotics, EntityIndications, EntitySpecimens}
+	if err := tx.Scopes(q.exceptCounts).Where("patient_key = ? AND entity IN ?", patient.ID, entities).
+		Delete(&models.QualityFlag{}).Error; err != nil {
+		return fmt.Errorf("error replacing quality flags of patient %s: %v", patient.ID, err)
+	}
+	if err := createFlags(tx, flags, importID); err != nil {
+		return err
+	}
+	return q.RefreshCounts(tx, []string{patient.ID}, importID)
+}
+
+// QualityEvaluation counts the flags raised by re-checking stored records
+type QualityEvaluation struct {
+	Records int            `json:"records"`
+	Flags   int            `json:"flags"`
+	ByRule  map[string]int `json:"by_rule"`
+}
+
+// Evaluate re-checks every stored record against the rules, replacing all
+// flags. It is run after the rules change, since imports only check the
+// records they write.
+func (q *QualityRules) Evaluate(db *gorm.DB) (*QualityEvaluation, error) {
+	evaluation := &QualityEvaluation{ByRule: make(map[string]int)}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&models.QualityFlag{}).Error; err != nil {
+			return fmt.Errorf("error clearing quality flags: %v", err)
+		}
+
+		var patients []models.Patient
+		batch := tx.Preload("Antibiotics").Preload("Indications").Preload("Specimens").
+			FindInBatches(&patients, 500, func(batch *gorm.DB, _ int) error {
+				keys := make([]string, 0, len(patients))
+				for _, patient := range patients {
+					keys = append(keys, patient.ID)
+				}
+
+				// Antibiotic details are not an association of patients
+				var details []models.AntibioticDetails
+				if err := tx.Where("parent_key IN ?", keys).Find(&details).Error; err != nil {
+					return fmt.Errorf("error loading antibiotic details: %v", err)
+				}
+				detailsOf := make(map[string][]models.AntibioticDetails)
+				for _, detail := range details {
+					detailsOf[detail.ParentKey] = append(detailsOf[detail.ParentKey], detail)
+				}
+
+				flags := make([]models.QualityFlag, 0)
+				for i := range patients {
+					patient := &patients[i]
+					flags = append(flags, q.Check(EntityPatients, patient, nil, nil)...)
+					evaluation.Records++
+					for _, child := range patientChildren(patient, detailsOf[patient.ID]) {
+						flags = append(flags, q.Check(child.entity, child.model, patient, nil)...)
+						evaluation.Records++
+					}
+				}
+				if err := createFlags(tx, flags, 0); err != nil {
+					return err
+				}
+				return q.RefreshCounts(tx, keys, 0)
+			})
+		if batch.Error != nil {
+			return batch.Error
+		}
+
+		var counts []struct {
+			Rule  string
+			Count int
+		}
+		if err := tx.Model(&models.QualityFlag{}).Select("rule, COUNT(*) AS count").Group("rule").Scan(&counts).Error; err != nil {
+			return fmt.Errorf("error counting quality flags: %v", err)
+		}
+		for _, count := range counts {
+			evaluation.ByRule[count.Rule] = count.Count
+			evaluation.Flags += count.Count
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Re-checked %d records against %d quality rules: %d flags", evaluation.Records, len(q.Rules()), evaluation.Flags)
+	return evaluation, nil
+}
+
+// patientChild is a child record of a patient and its entity
+type patientChild struct {
+	entity string
+	model  interface{}
+}
+
+// patientChildren lists the loaded child records of a patient rules can check
+func patientChildren(patient *models.Patient, details []models.AntibioticDetails) []patientChild {
+	children := make([]patientChild, 0)
+	for i := range patient.Antibiotics {
+		children = append(children, patientChild{EntityAntibiotics, &patient.Antibiotics[i]})
+	}
+	for i := range details {
+		children = append(children, patientChild{EntityAntibioticDetails, &details[i]})
+	}
+	for i := range patient.Indications {
+		children = append(children, patientChild{EntityIndications, &patient.Indications[i]})
+	}
+	for i := range patient.Specimens {
+		children = append(children, patientChild{EntitySpecimens, &patient.Specimens[i]})
+	}
+	return children
+}
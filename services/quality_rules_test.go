@@ -0,0 +1,256 @@
+package services
+
+import (
+	"errors"
+	"point-prevalence-survey/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQualityRulesCheck(t *testing.T) {
+	ten, hundred := 10.0, 100.0
+	rules, err := NewQualityRules([]QualityRule{
+		{ID: "required_facility", Entity: EntityPatients, Field: "facility", Check: CheckRequired, Severity: SeverityReject},
+		{ID: "required_weight", Entity: EntityPatients, Field: "weight", Check: CheckRequired, Severity: SeverityWarn},
+		{ID: "age_range", Entity: EntityPatients, Field: "age_years", Check: CheckRange, Min: &ten, Max: &hundred, Severity: SeverityReject},
+		{ID: "admission_before_survey", Entity: EntityPatients, Field: "admission_date", Check: CheckCompare, Op: "<=", Other: "survey_date", Severity: SeverityWarn},
+		{ID: "eligible_within_total", Entity: EntityPatients, Field: "ward_eligible_patients", Check: CheckCompare, Op: "<=", Other: "ward_total_patients", Severity: SeverityWarn},
+		{ID: "gender_known", Entity: EntityPatients, Field: "gender", Check: CheckAllowed, Values: []string{"male", "female"}, Severity: SeverityWarn, Message: "gender must be male or female"},
+		{ID: "antibiotic_count", Entity: EntityPatients, Field: "patient_number_antibiotics", Check: CheckCount, Children: EntityAntibiotics, Severity: SeverityWarn},
+		{ID: "start_before_survey", Entity: EntityAntibiotics, Field: "start_date_antibiotic", Check: CheckCompare, Op: "<", Other: "survey_date", Severity: SeverityWarn},
+		{ID: "disabled", Entity: EntityPatients, Field: "region", Check: CheckRequired, Severity: SeverityOff},
+	})
+	if err != nil {
+		t.Fatalf("NewQualityRules: %v", err)
+	}
+
+	survey := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	valid := models.Patient{
+		ID:                       "uuid:1",
+		Facility:                 "F1",
+		Weight:                   70,
+		AgeYears:                 40,
+		SurveyDate:               survey,
+		AdmissionDate:            survey.AddDate(0, 0, -3),
+		WardTotalPatients:        10,
+		WardEligiblePatients:     8,
+		Gender:                   "Female",
+		PatientNumberAntibiotics: 2,
+	}
+
+	tests := []struct {
+		name     string
+		change   func(p *models.Patient)
+		children map[string]int
+		want     map[string]string
+	}{
+		{
+			name:     "valid patient",
+			change:   func(p *models.Patient) {},
+			children: map[string]int{EntityAntibiotics: 2},
+			want:     map[string]string{},
+		},
+		{
+			name:   "required text and number",
+			change: func(p *models.Patient) { p.Facility, p.Weight = " ", 0 },
+			want: map[string]string{
+				"required_facility": "facility is missing",
+				"required_weight":   "weight is missing",
+			},
+		},
+		{
+			name:   "below range",
+			change: func(p *models.Patient) { p.AgeYears = 5 },
+			want:   map[string]string{"age_range": "age_years 5 is below the minimum of 10"},
+		},
+		{
+			name:   "above range",
+			change: func(p *models.Patient) { p.AgeYears = 130 },
+			want:   map[string]string{"age_range": "age_years 130 is above the maximum of 100"},
+		},
+		{
+			name:   "dates compared",
+			change: func(p *models.Patient) { p.AdmissionDate = survey.AddDate(0, 0, 2) },
+			want: map[string]string{
+				"admission_before_survey": "admission_date (2024-05-03) must be on or before survey_date (2024-05-01)",
+			},
+		},
+		{
+			name:   "blank dates are not compared",
+			change: func(p *models.Patient) { p.AdmissionDate = time.Time{} },
+			want:   map[string]string{},
+		},
+		{
+			name:   "numbers compared",
+			change: func(p *models.Patient) { p.WardEligiblePatients = 12 },
+			want: map[string]string{
+				"eligible_within_total": "ward_eligible_patients (12) must be at most ward_total_patients (10)",
+			},
+		},
+		{
+			name:   "allowed values ignore case, with the rule's message",
+			change: func(p *models.Patient) { p.Gender = "other" },
+			want:   map[string]string{"gender_known": "gender must be male or female"},
+		},
+		{
+			name:     "count differs",
+			change:   func(p *models.Patient) {},
+			children: map[string]int{EntityAntibiotics: 1},
+			want:     map[string]string{"antibiotic_count": "patient_number_antibiotics is 2 but 1 antibiotics were recorded"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patient := valid
+			tt.change(&patient)
+
+			got := make(map[string]string)
+			for _, flag := range rules.Check(EntityPatients, &patient, nil, tt.children) {
+				got[flag.Rule] = flag.Message
+				if flag.RecordKey != "uuid:1" || flag.PatientKey != "uuid:1" || flag.Entity != EntityPatients {
+					t.Errorf("flag %s keys = %q, %q, %q", flag.Rule, flag.Entity, flag.RecordKey, flag.PatientKey)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("child compared with its patient", func(t *testing.T) {
+		antibiotic := &models.Antibiotic{ID: "ab-1", ParentKey: "uuid:1", StartDateAntibiotic: survey}
+		if flags := rules.Check(EntityAntibiotics, antibiotic, nil, nil); len(flags) != 0 {
+			t.Errorf("flags without the patient = %v, want none", flags)
+		}
+
+		flags := rules.Check(EntityAntibiotics, antibiotic, &valid, nil)
+		if len(flags) != 1 || flags[0].Rule != "start_before_survey" || flags[0].PatientKey != "uuid:1" {
+			t.Errorf("flags = %+v, want start_before_survey on patient uuid:1", flags)
+		}
+	})
+}
+
+func TestCompareValues(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		a    interface{}
+		op   string
+		b    interface{}
+		want bool
+	}{
+		{1.0, "<", 2.0, true},
+		{2.0, "<", 2.0, false},
+		{2.0, "<=", 2.0, true},
+		{3.0, ">", 2.0, true},
+		{2.0, ">=", 3.0, false},
+		{2.0, "==", 2.0, true},
+		{2.0, "!=", 2.0, false},
+		{day, "<", day.AddDate(0, 0, 1), true},
+		{day, ">=", day, true},
+		{day, "!=", day.AddDate(0, 0, 1), true},
+	}
+
+	for _, tt := range tests {
+		if got := compareValues(tt.a, tt.op, tt.b); got != tt.want {
+			t.Errorf("compareValues(%v %s %v) = %v, want %v", tt.a, tt.op, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNewQualityRulesValidation(t *testing.T) {
+	zero := 0.0
+	tests := []struct {
+		name string
+		rule QualityRule
+		want string
+	}{
+		{
+			name: "unknown entity",
+			rule: QualityRule{ID: "r", Entity: "wards", Field: "name", Check: CheckRequired, Severity: SeverityWarn},
+			want: "entity must be one of",
+		},
+		{
+			name: "unknown field",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "height", Check: CheckRequired, Severity: SeverityWarn},
+			want: `no field "height"`,
+		},
+		{
+			name: "unknown severity",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "facility", Check: CheckRequired, Severity: "error"},
+			want: "severity must be",
+		},
+		{
+			name: "range on text",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "facility", Check: CheckRange, Min: &zero, Severity: SeverityWarn},
+			want: "range checks need a number field",
+		},
+		{
+			name: "compare a date with a number",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "survey_date", Check: CheckCompare, Op: "<", Other: "age_years", Severity: SeverityWarn},
+			want: "two number fields or two date fields",
+		},
+		{
+			name: "compare with an unknown op",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "age_years", Check: CheckCompare, Op: "<>", Other: "age_months", Severity: SeverityWarn},
+			want: "op must be one of",
+		},
+		{
+			name: "reject against a patient field",
+			rule: QualityRule{ID: "r", Entity: EntityAntibiotics, Field: "start_date_antibiotic", Check: CheckCompare, Op: "<=", Other: "survey_date", Severity: SeverityReject},
+			want: "can only warn",
+		},
+		{
+			name: "reject on a count",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "patient_number_antibiotics", Check: CheckCount, Children: EntityAntibiotics, Severity: SeverityReject},
+			want: "can only warn",
+		},
+		{
+			name: "count of unknown children",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "patient_number_antibiotics", Check: CheckCount, Children: "wards", Severity: SeverityWarn},
+			want: "children must be one of",
+		},
+		{
+			name: "allowed without values",
+			rule: QualityRule{ID: "r", Entity: EntityPatients, Field: "gender", Check: CheckAllowed, Severity: SeverityWarn},
+			want: "allowed checks need a text field and values",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewQualityRules([]QualityRule{tt.rule})
+			if !errors.Is(err, ErrQualityRules) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewQualityRules(DefaultQualityRules()); err != nil {
+		t.Errorf("default rules: %v", err)
+	}
+
+	// Child records may be compared with a field of their patient by a warn rule
+	_, err := NewQualityRules([]QualityRule{{ID: "r", Entity: EntityIndications, Field: "start_date_treatment", Check: CheckCompare, Op: "<=", Other: "survey_date", Severity: SeverityWarn}})
+	if err != nil {
+		t.Errorf("indication compared with its patient: %v", err)
+	}
+}
+
+func TestRowErrors(t *testing.T) {
+	flags := []models.QualityFlag{
+		{Rule: "age_range", Severity: SeverityReject, Field: "age_years", Message: "too old"},
+		{Rule: "weight_range", Severity: SeverityWarn, Field: "weight", Message: "too heavy"},
+	}
+
+	errs, warnings := rowErrors(flags, func(field string) string { return "Core_variables-" + field })
+	want := RowError{Column: "Core_variables-age_years", Code: RowErrorQualityRule, Message: "age_range: too old"}
+	if len(errs) != 1 || !reflect.DeepEqual(errs[0], want) {
+		t.Errorf("errors = %+v, want %+v", errs, want)
+	}
+	if len(warnings) != 1 || warnings[0].Message != "weight_range: too heavy" {
+		t.Errorf("warnings = %+v", warnings)
+	}
+}
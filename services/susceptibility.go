@@ -0,0 +1,199 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"point-prevalence-survey/models"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Susceptibility interpretations stored on parsed results
+const (
+	InterpretationSusceptible  = "S"
+	InterpretationIntermediate = "I"
+	InterpretationResistant    = "R"
+)
+
+// RowWarningSusceptibility marks a part of the susceptibility test results
+// that could not be read as an antibiotic result
+const RowWarningSusceptibility = "unparsed_susceptibility"
+
+var interpretationValues = newVocabulary("susceptibility interpretation", map[string][]string{
+	InterpretationSusceptible:  {"sensitive", "susceptible", "sens", "sus"},
+	InterpretationIntermediate: {"intermediate", "int"},
+	InterpretationResistant:    {"resistant", "resistance", "res"},
+})
+
+var (
+	// susceptibilitySeparators split the free text into single results
+	susceptibilitySeparators = regexp.MustCompile(`[,;|\n\r]+`)
+	micPattern               = regexp.MustCompile(`(?i)\bMIC\s*[:=]?\s*(<=|>=|≤|≥|<|>|=)?\s*(\d+(?:\.\d+)?)\s*(?:mg/l|µg/ml|ug/ml|mcg/ml)?`)
+	zonePattern              = regexp.MustCompile(`(?i)\b(?:zone|disk|disc)\s*[:=]?\s*(\d+(?:\.\d+)?)\s*(?:mm\b)?|\b(\d+(?:\.\d+)?)\s*mm\b`)
+	// interpretationSuffix finds the interpretation written after the antibiotic
+	interpretationSuffix = regexp.MustCompile(`^(.*?)[\s:=\-]+([A-Za-z]+)$`)
+)
+
+// noSusceptibilityResults are values recorded when no test was done
+var noSusceptibilityResults = make(map[string]bool)
+
+func init() {
+	for _, value := range []string{"n/a", "none", "nil", "not done", "no growth", "not applicable"} {
+		noSusceptibilityResults[valueKey(value)] = true
+	}
+}
+
+// ParseSusceptibilityResults reads the free-text susceptibility test results
+// of a specimen into one result per organism and antibiotic. Results are
+// separated by commas, semicolons, bars or new lines and written as
+// "Ampicillin R", "CIP: S (MIC <=0.25)" or "Gentamicin S zone 21mm". A prefix
+// such as "E. coli: AMP R" sets the organism of the results that follow;
+// otherwise the specimen's microorganism is used. Parts that could not be read
+// are returned as unparsed.
+func ParseSusceptibilityResults(specimen *models.Specimen) ([]models.SusceptibilityResult, []string) {
+	results := make([]models.SusceptibilityResult, 0)
+	unparsed := make([]string, 0)
+
+	text := strings.TrimSpace(specimen.AntibioticSusceptibilityTestResults)
+	if text == "" || noSusceptibilityResults[valueKey(text)] {
+		return results, unparsed
+	}
+
+	organism := strings.TrimSpace(specimen.Microorganism)
+	for _, item := range susceptibilitySeparators.Split(text, -1) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		// "Organism: antibiotic result" starts the results of another organism
+		if prefix, rest, ok := strings.Cut(item, ":"); ok {
+			if result, ok := parseSusceptibilityItem(rest); ok && strings.TrimSpace(prefix) != "" {
+				organism = strings.TrimSpace(prefix)
+				result.Organism = organism
+				result.Raw = item
+				results = append(results, result)
+				continue
+			}
+		}
+
+		result, ok := parseSusceptibilityItem(item)
+		if !ok {
+			unparsed = append(unparsed, item)
+			continue
+		}
+		result.Organism = organism
+		result.Raw = item
+		results = append(results, result)
+	}
+
+	for i := range results {
+		results[i].SpecimenKey = specimen.ID
+		results[i].PatientKey = specimen.ParentKey
+	}
+	return results, unparsed
+}
+
+// parseSusceptibilityItem reads one antibiotic with its interpretation, MIC
+// or zone diameter. At least one of them must be present.
+func parseSusceptibilityItem(item string) (models.SusceptibilityResult, bool) {
+	var result models.SusceptibilityResult
+
+	if m := micPattern.FindStringSubmatch(item); m != nil {
+		if value, err := strconv.ParseFloat(m[2], 64); err == nil {
+			result.MIC = &value
+			result.MICComparator = strings.NewReplacer("≤", "<=", "≥", ">=").Replace(m[1])
+		}
+		item = strings.Replace(item, m[0], " ", 1)
+	}
+	if m := zonePattern.FindStringSubmatch(item); m != nil {
+		diameter := m[1]
+		if diameter == "" {
+			diameter = m[2]
+		}
+		if value, err := strconv.ParseFloat(diameter, 64); err == nil {
+			result.ZoneDiameter = &value
+		}
+		item = strings.Replace(item, m[0], " ", 1)
+	}
+
+	item = strings.TrimSpace(strings.NewReplacer("(", " ", ")", " ", "[", " ", "]", " ").Replace(item))
+	antibiotic := item
+	if m := interpretationSuffix.FindStringSubmatch(item); m != nil {
+		if code, ok := interpretationValues.codes[valueKey(m[2])]; ok {
+			result.Interpretation = code
+			antibiotic = m[1]
+		}
+	}
+
+	// A lone interpretation such as the "R" of "AMP: R" is not an antibiotic
+	result.Antibiotic = strings.TrimSpace(strings.Trim(antibiotic, " :=-"))
+	if _, isCode := interpretationValues.codes[valueKey(result.Antibiotic)]; result.Antibiotic == "" || isCode {
+		return result, false
+	}
+	if result.Interpretation == "" && result.MIC == nil && result.ZoneDiameter == nil {
+		return result, false
+	}
+	return result, true
+}
+
+// susceptibilityWarnings checks the susceptibility test results of a parsed
+// specimen row, recording the parts that could not be read as warnings
+func (r *csvRow) susceptibilityWarnings(specimen *models.Specimen) {
+	_, unparsed := ParseSusceptibilityResults(specimen)
+	for _, item := range unparsed {
+		r.warnings = append(r.warnings, RowError{
+			Column:  r.cols.Column("antibiotic_susceptibility_test_results"),
+			Code:    RowWarningSusceptibility,
+			Message: fmt.Sprintf("could not read susceptibility result %q; it is kept in the text but not in the structured results", item),
+		})
+	}
+}
+
+// replaceSusceptibilityResults stores the parsed results of a specimen that
+// was just written, replacing those of an earlier version of it. It returns
+// the number of results stored.
+func replaceSusceptibilityResults(tx *gorm.DB, specimen *models.Specimen) (int, error) {
+	if err := tx.Where("specimen_key = ?", specimen.ID).Delete(&models.SusceptibilityResult{}).Error; err != nil {
+		return 0, fmt.Errorf("error removing susceptibility results of specimen %s: %v", specimen.ID, err)
+	}
+
+	results, _ := ParseSusceptibilityResults(specimen)
+	if len(results) == 0 {
+		return 0, nil
+	}
+	if err := tx.Create(&results).Error; err != nil {
+		return 0, fmt.Errorf("error storing susceptibility results of specimen %s: %v", specimen.ID, err)
+	}
+	return len(results), nil
+}
+
+// RebuildSusceptibilityResults parses the susceptibility test results of
+// every stored specimen again, e.g. for specimens imported before results were
+// parsed. It returns the number of specimens and results.
+func RebuildSusceptibilityResults(db *gorm.DB) (int, int, error) {
+	specimens, total := 0, 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var batch []models.Specimen
+		return tx.Model(&models.Specimen{}).FindInBatches(&batch, 500, func(batchTx *gorm.DB, _ int) error {
+			for i := range batch {
+				stored, err := replaceSusceptibilityResults(tx, &batch[i])
+				if err != nil {
+					return err
+				}
+				total += stored
+			}
+			specimens += len(batch)
+			return nil
+		}).Error
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	log.Printf("Rebuilt %d susceptibility results from %d specimens", total, specimens)
+	return specimens, total, nil
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"point-prevalence-survey/models"
+	"reflect"
+	"testing"
+)
+
+func TestParseSusceptibilityResults(t *testing.T) {
+	measurement := func(v float64) *float64 { return &v }
+	result := func(organism, antibiotic, interpretation, raw string) models.SusceptibilityResult {
+		return models.SusceptibilityResult{
+			SpecimenKey:    "uuid:p1/Specimens[1]",
+			PatientKey:     "uuid:p1",
+			Organism:       organism,
+			Antibiotic:     antibiotic,
+			Interpretation: interpretation,
+			Raw:            raw,
+		}
+	}
+	withMIC := func(r models.SusceptibilityResult, comparator string, mic float64) models.SusceptibilityResult {
+		r.MICComparator, r.MIC = comparator, measurement(mic)
+		return r
+	}
+	withZone := func(r models.SusceptibilityResult, zone float64) models.SusceptibilityResult {
+		r.ZoneDiameter = measurement(zone)
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		text         string
+		want         []models.SusceptibilityResult
+		wantUnparsed []string
+	}{
+		{
+			name: "antibiotic code with a MIC",
+			text: "CIP: S (MIC <=0.25)",
+			want: []models.SusceptibilityResult{
+				withMIC(result("Escherichia coli", "CIP", "S", "CIP: S (MIC <=0.25)"), "<=", 0.25),
+			},
+		},
+		{
+			name: "organism prefix",
+			text: "E. coli: AMP R",
+			want: []models.SusceptibilityResult{result("E. coli", "AMP", "R", "E. coli: AMP R")},
+		},
+		{
+			name: "zone diameter",
+			text: "Gentamicin S zone 21mm",
+			want: []models.SusceptibilityResult{
+				withZone(result("Escherichia coli", "Gentamicin", "S", "Gentamicin S zone 21mm"), 21),
+			},
+		},
+		{
+			name: "organism prefix applies to the results that follow",
+			text: "E. coli: AMP R, CIP S; K. pneumoniae: MEM S (MIC 0.5 mg/L) | GEN I",
+			want: []models.SusceptibilityResult{
+				result("E. coli", "AMP", "R", "E. coli: AMP R"),
+				result("E. coli", "CIP", "S", "CIP S"),
+				withMIC(result("K. pneumoniae", "MEM", "S", "K. pneumoniae: MEM S (MIC 0.5 mg/L)"), "", 0.5),
+				result("K. pneumoniae", "GEN", "I", "GEN I"),
+			},
+		},
+		{
+			name: "interpretation words and separators",
+			text: "Ampicillin resistant\nCeftriaxone - Sensitive\nAMP: R",
+			want: []models.SusceptibilityResult{
+				result("Escherichia coli", "Ampicillin", "R", "Ampicillin resistant"),
+				result("Escherichia coli", "Ceftriaxone", "S", "Ceftriaxone - Sensitive"),
+				result("Escherichia coli", "AMP", "R", "AMP: R"),
+			},
+		},
+		{
+			name: "measurements without an interpretation",
+			text: "Vancomycin MIC: ≤2, Meropenem 25 mm",
+			want: []models.SusceptibilityResult{
+				withMIC(result("Escherichia coli", "Vancomycin", "", "Vancomycin MIC: ≤2"), "<=", 2),
+				withZone(result("Escherichia coli", "Meropenem", "", "Meropenem 25 mm"), 25),
+			},
+		},
+		{
+			name:         "unparsed parts are returned",
+			text:         "CIP S; pending; Ceftriaxone; R; see lab report",
+			want:         []models.SusceptibilityResult{result("Escherichia coli", "CIP", "S", "CIP S")},
+			wantUnparsed: []string{"pending", "Ceftriaxone", "R", "see lab report"},
+		},
+		{name: "empty", text: "  "},
+		{name: "not applicable", text: "N/A"},
+		{name: "not done", text: "Not done"},
+		{name: "none", text: "none"},
+		{name: "no growth", text: "No Growth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specimen := &models.Specimen{
+				ID:                                  "uuid:p1/Specimens[1]",
+				ParentKey:                           "uuid:p1",
+				Microorganism:                       "Escherichia coli",
+				AntibioticSusceptibilityTestResults: tt.text,
+			}
+
+			got, unparsed := ParseSusceptibilityResults(specimen)
+			want := tt.want
+			if want == nil {
+				want = []models.SusceptibilityResult{}
+			}
+			wantUnparsed := tt.wantUnparsed
+			if wantUnparsed == nil {
+				wantUnparsed = []string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("results = %+v, want %+v", got, want)
+			}
+			if !reflect.DeepEqual(unparsed, wantUnparsed) {
+				t.Errorf("unparsed = %q, want %q", unparsed, wantUnparsed)
+			}
+		})
+	}
+}
+
+func TestFormatSusceptibilityText(t *testing.T) {
+	specimen := &models.Specimen{
+		AntibioticSusceptibilityTestResults: "AMP R; E. coli: CIP S (MIC <=0.25), Gentamicin S zone 21mm; K. pneumoniae: MEM R",
+	}
+	results, unparsed := ParseSusceptibilityResults(specimen)
+	if len(unparsed) != 0 {
+		t.Fatalf("unparsed = %q", unparsed)
+	}
+
+	text := formatSusceptibilityText(results)
+	if want := "AMP R; E. coli: CIP S (MIC <=0.25), Gentamicin S (zone 21mm); K. pneumoniae: MEM R"; text != want {
+		t.Errorf("formatSusceptibilityText = %q, want %q", text, want)
+	}
+
+	// Parsing the text again gives the same results
+	again, _ := ParseSusceptibilityResults(&models.Specimen{AntibioticSusceptibilityTestResults: text})
+	for i := range again {
+		again[i].Raw = results[i].Raw
+	}
+	if !reflect.DeepEqual(again, results) {
+		t.Errorf("results after formatting = %+v, want %+v", again, results)
+	}
+}
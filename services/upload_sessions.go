@@ -0,0 +1,333 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"point-prevalence-survey/config"
+	"point-prevalence-survey/database"
+	"point-prevalence-survey/models"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Errors returned by resumable uploads
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadOffset          = errors.New("upload offset mismatch")
+	ErrUploadLength          = errors.New("chunk exceeds the upload length")
+	ErrUploadFinished        = errors.New("upload is no longer accepting chunks")
+)
+
+// UploadSessionService keeps resumable uploads in the import temp directory
+// until every chunk has arrived, then queues the file as an async import job
+type UploadSessionService struct {
+	db         *gorm.DB
+	jobService *ImportJobService
+	dir        string
+	ttl        time.Duration
+	// locks serialises chunks of the same session
+	locks sync.Map
+}
+
+func NewUploadSessionService() *UploadSessionService {
+	cfg := config.LoadConfig()
+
+	ttl := cfg.UploadSessionTTLHours
+	if ttl < 1 {
+		ttl = 24
+	}
+
+	return &UploadSessionService{
+		db:         database.GetDB(),
+		jobService: GetImportJobService(),
+		dir:        filepath.Join(cfg.ImportTempDir, "uploads"),
+		ttl:        time.Duration(ttl) * time.Hour,
+	}
+}
+
+// path returns where the received bytes of session id are stored
+func (s *UploadSessionService) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// lock locks session id and returns its unlock function
+func (s *UploadSessionService) lock(id string) func() {
+	mu, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Create starts a resumable upload of length bytes. The import options are
+// stored with the session and used once the file is complete.
+func (s *UploadSessionService) Create(upload JobUpload, length int64, opts ImportOptions) (*models.UploadSession, error) {
+	s.removeExpired()
+
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error storing import options: %v", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("error creating upload session: %v", err)
+	}
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating upload directory: %v", err)
+	}
+
+	session := &models.UploadSession{
+		ID:         hex.EncodeToString(id),
+		Entity:     upload.Entity,
+		Filename:   upload.Filename,
+		UploadedBy: upload.UploadedBy,
+		Length:     length,
+		Status:     models.UploadSessionUploading,
+		Force:      upload.Force,
+		Options:    string(options),
+		ExpiresAt:  time.Now().Add(s.ttl),
+	}
+
+	file, err := os.OpenFile(s.path(session.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating upload file: %v", err)
+	}
+	file.Close()
+
+	if err := s.db.Create(session).Error; err != nil {
+		os.Remove(s.path(session.ID))
+		return nil, fmt.Errorf("error creating upload session: %v", err)
+	}
+
+	return session, nil
+}
+
+// Get returns the upload session with id
+func (s *UploadSessionService) Get(id string) (*models.UploadSession, error) {
+	var session models.UploadSession
+	err := s.db.Where("id = ?", id).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching upload session: %v", err)
+	}
+	if session.Status == models.UploadSessionUploading && time.Now().After(session.ExpiresAt) {
+		return nil, ErrUploadSessionNotFound
+	}
+	return &session, nil
+}
+
+// Append writes chunk at offset, which must be the number of bytes received
+// so far. If the connection drops mid-chunk the bytes that arrived are kept,
+// so the client can ask for the offset and resume from there. The chunk that
+// completes the file queues its import; the returned session then carries
+// the import job id, or the reason the import could not be queued.
+func (s *UploadSessionService) Append(id string, offset int64, chunk io.Reader) (*models.UploadSession, error) {
+	unlock := s.lock(id)
+	defer unlock()
+
+	session, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := acceptsChunk(session, offset); err != nil {
+		return session, err
+	}
+
+	file, err := os.OpenFile(s.path(id), os.O_WRONLY, 0o600)
+	if err != nil {
+		return session, fmt.Errorf("error opening upload file: %v", err)
+	}
+	defer file.Close()
+
+	written, copyErr := writeChunk(file, offset, session.Length, chunk)
+	if errors.Is(copyErr, ErrUploadLength) {
+		return session, copyErr
+	}
+
+	if written > 0 {
+		session.Offset += written
+		session.ExpiresAt = time.Now().Add(s.ttl)
+		if err := s.db.Model(session).Select("upload_offset", "expires_at").Updates(session).Error; err != nil {
+			return session, fmt.Errorf("error updating upload session: %v", err)
+		}
+	}
+	if copyErr != nil {
+		return session, copyErr
+	}
+
+	if session.Offset == session.Length {
+		file.Close()
+		return session, s.complete(session)
+	}
+	return session, nil
+}
+
+// acceptsChunk checks that session is still receiving chunks and that offset
+// is the number of bytes received so far
+func acceptsChunk(session *models.UploadSession, offset int64) error {
+	if session.Status != models.UploadSessionUploading {
+		return ErrUploadFinished
+	}
+	if offset != session.Offset {
+		return fmt.Errorf("%w: the upload is at offset %d", ErrUploadOffset, session.Offset)
+	}
+	return nil
+}
+
+// writeChunk writes chunk to the upload file at offset and returns the bytes
+// written. A chunk running past length is removed again and rejected with
+// ErrUploadLength; otherwise the bytes that arrived before a read error are
+// kept.
+func writeChunk(file *os.File, offset, length int64, chunk io.Reader) (int64, error) {
+	// Drop anything written past the recorded offset by a chunk that failed
+	// before its offset was saved
+	if err := file.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("error writing upload file: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error writing upload file: %v", err)
+	}
+
+	remaining := length - offset
+	written, err := io.Copy(file, io.LimitReader(chunk, remaining))
+	if err == nil && written == remaining {
+		if n, _ := chunk.Read(make([]byte, 1)); n > 0 {
+			file.Truncate(offset)
+			return 0, fmt.Errorf("%w of %d bytes", ErrUploadLength, length)
+		}
+	}
+	return written, err
+}
+
+// complete queues the import of a fully received upload for the workers,
+// which remove the file once imported. If the queue is full the file is kept
+// and the session stays open, so a chunk sent at the final offset queues the
+// same import job again.
+func (s *UploadSessionService) complete(session *models.UploadSession) error {
+	path := s.path(session.ID)
+
+	var opts ImportOptions
+	job, err := s.job(session, path, &opts)
+	if err != nil {
+		os.Remove(path)
+		session.Status = models.UploadSessionFailed
+		session.Message = err.Error()
+		s.save(session)
+		s.locks.Delete(session.ID)
+		return err
+	}
+	session.ImportID = &job.ID
+
+	if err := s.jobService.queueFile(job, path, session.Length, opts); err != nil {
+		session.Message = fmt.Sprintf("%v, send an empty chunk at offset %d to queue the import again", err, session.Length)
+		s.save(session)
+		return err
+	}
+
+	session.Status = models.UploadSessionCompleted
+	session.Message = ""
+	s.save(session)
+	s.locks.Delete(session.ID)
+	return nil
+}
+
+// job returns the import job of a completed upload, reading the session's
+// import options into opts. The job is created by the first attempt to
+// queue the import and reused by later ones.
+func (s *UploadSessionService) job(session *models.UploadSession, path string, opts *ImportOptions) (*models.ImportJob, error) {
+	if err := json.Unmarshal([]byte(session.Options), opts); err != nil {
+		return nil, fmt.Errorf("error reading import options: %v", err)
+	}
+
+	if session.ImportID != nil {
+		var job models.ImportJob
+		if err := s.db.First(&job, *session.ImportID).Error; err != nil {
+			return nil, fmt.Errorf("error fetching import job: %v", err)
+		}
+		return &job, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening upload file: %v", err)
+	}
+	defer file.Close()
+
+	checksum, err := FileChecksum(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.jobService.CreateJob(JobUpload{
+		Entity:     session.Entity,
+		Filename:   session.Filename,
+		Checksum:   checksum,
+		UploadedBy: session.UploadedBy,
+		Async:      true,
+		Force:      session.Force,
+	}, *opts)
+}
+
+// save stores the outcome of a completed session, or why its import could
+// not be queued yet
+func (s *UploadSessionService) save(session *models.UploadSession) {
+	err := s.db.Model(session).Select("status", "import_id", "message").Updates(session).Error
+	if err != nil {
+		log.Printf("Error updating upload session %s: %v", session.ID, err)
+	}
+}
+
+// Cancel stops an unfinished upload and removes the bytes received so far
+func (s *UploadSessionService) Cancel(id string) error {
+	unlock := s.lock(id)
+	defer unlock()
+
+	session, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if session.Status != models.UploadSessionUploading {
+		return ErrUploadFinished
+	}
+
+	if err := s.db.Delete(session).Error; err != nil {
+		return fmt.Errorf("error deleting upload session: %v", err)
+	}
+	os.Remove(s.path(id))
+	s.locks.Delete(id)
+	return nil
+}
+
+// removeExpired deletes sessions whose last chunk is older than the TTL,
+// along with the files of unfinished ones
+func (s *UploadSessionService) removeExpired() {
+	var expired []models.UploadSession
+	if err := s.db.Where("expires_at < ?", time.Now()).Find(&expired).Error; err != nil {
+		log.Printf("Error finding expired upload sessions: %v", err)
+		return
+	}
+
+	for _, session := range expired {
+		if session.Status == models.UploadSessionUploading {
+			os.Remove(s.path(session.ID))
+			if session.ImportID != nil {
+				s.jobService.failUnqueuedJob(*session.ImportID)
+			}
+		}
+		if err := s.db.Delete(&session).Error; err != nil {
+			log.Printf("Error deleting upload session %s: %v", session.ID, err)
+		}
+		s.locks.Delete(session.ID)
+	}
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"point-prevalence-survey/models"
+	"strings"
+	"testing"
+)
+
+// droppedReader returns its data, then fails like a dropped connection
+type droppedReader struct {
+	data string
+}
+
+func (r *droppedReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWriteChunk(t *testing.T) {
+	const content = "KEY,facility\nuuid:1,F1\n"
+	length := int64(len(content))
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "upload"))
+	if err != nil {
+		t.Fatalf("create upload file: %v", err)
+	}
+	defer file.Close()
+
+	contents := func() string {
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatalf("read upload file: %v", err)
+		}
+		return string(data)
+	}
+
+	// First chunk
+	offset := int64(0)
+	written, err := writeChunk(file, offset, length, strings.NewReader(content[:5]))
+	if err != nil || written != 5 {
+		t.Fatalf("first chunk = %d, %v, want 5 bytes", written, err)
+	}
+	offset += written
+
+	// A dropped chunk keeps the bytes that arrived
+	written, err = writeChunk(file, offset, length, &droppedReader{data: content[5:9]})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || written != 4 {
+		t.Fatalf("dropped chunk = %d, %v, want 4 bytes and the read error", written, err)
+	}
+	offset += written
+
+	// Bytes past the recorded offset, left by a chunk whose offset was never
+	// saved, are overwritten by the resumed chunk
+	if _, err := file.WriteAt([]byte("stale bytes"), offset); err != nil {
+		t.Fatalf("write stale bytes: %v", err)
+	}
+	written, err = writeChunk(file, offset, length, strings.NewReader(content[9:12]))
+	if err != nil || written != 3 {
+		t.Fatalf("resumed chunk = %d, %v, want 3 bytes", written, err)
+	}
+	offset += written
+	if got := contents(); got != content[:offset] {
+		t.Fatalf("file after resuming = %q, want %q", got, content[:offset])
+	}
+
+	// A chunk running past the upload length is rejected and removed
+	written, err = writeChunk(file, offset, length, strings.NewReader(content[offset:]+"extra"))
+	if !errors.Is(err, ErrUploadLength) || written != 0 {
+		t.Fatalf("overflowing chunk = %d, %v, want ErrUploadLength", written, err)
+	}
+	if got := contents(); got != content[:offset] {
+		t.Fatalf("file after overflow = %q, want %q", got, content[:offset])
+	}
+
+	// Last chunk
+	written, err = writeChunk(file, offset, length, strings.NewReader(content[offset:]))
+	if err != nil || offset+written != length {
+		t.Fatalf("last chunk = %d, %v, want the rest of the file", written, err)
+	}
+	if got := contents(); got != content {
+		t.Fatalf("file = %q, want %q", got, content)
+	}
+
+	// An empty chunk at the final offset, which queues the import again,
+	// leaves the file alone
+	written, err = writeChunk(file, length, length, strings.NewReader(""))
+	if err != nil || written != 0 {
+		t.Fatalf("empty chunk = %d, %v, want nothing written", written, err)
+	}
+	if got := contents(); got != content {
+		t.Errorf("file after empty chunk = %q, want %q", got, content)
+	}
+}
+
+func TestAcceptsChunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		offset  int64
+		wantErr error
+	}{
+		{name: "next chunk", status: models.UploadSessionUploading, offset: 10},
+		{name: "offset behind", status: models.UploadSessionUploading, offset: 5, wantErr: ErrUploadOffset},
+		{name: "offset ahead", status: models.UploadSessionUploading, offset: 12, wantErr: ErrUploadOffset},
+		{name: "completed", status: models.UploadSessionCompleted, offset: 10, wantErr: ErrUploadFinished},
+		{name: "failed", status: models.UploadSessionFailed, offset: 10, wantErr: ErrUploadFinished},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &models.UploadSession{Status: tt.status, Offset: 10, Length: 20}
+			err := acceptsChunk(session, tt.offset)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("acceptsChunk(%d) = %v, want %v", tt.offset, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Canonical codes stored for categorical columns. The PPS indicators compare
+// against these, so every import path must store them rather than raw values.
+const (
+	CodeYes            = "yes"
+	CodeNo             = "no"
+	CodeUnknown        = "unknown"
+	CodePositive       = "positive"
+	CodeNegative       = "negative"
+	CodeMale           = "male"
+	CodeFemale         = "female"
+	CodeIV             = "iv"
+	CodeIM             = "im"
+	CodeOral           = "oral"
+	CodeAccess         = "access"
+	CodeWatch          = "watch"
+	CodeReserve        = "reserve"
+	CodeNotRecommended = "not_recommended"
+)
+
+// Vocabulary maps the raw values of a categorical column, as entered in ODK
+// or a spreadsheet, to canonical codes
+type Vocabulary struct {
+	Name     string
+	codes    map[string]string
+	prefixes []vocabularyPrefix
+}
+
+// vocabularyPrefix maps every value starting with prefix to code, e.g. the
+// "iv_bolus" and "iv_infusion" routes to "iv"
+type vocabularyPrefix struct {
+	prefix string
+	code   string
+}
+
+// newVocabulary builds a vocabulary from the synonyms of each code. The code
+// itself is always a synonym.
+func newVocabulary(name string, synonyms map[string][]string) *Vocabulary {
+	v := &Vocabulary{Name: name, codes: make(map[string]string)}
+	for code, values := range synonyms {
+		v.codes[valueKey(code)] = code
+		for _, value := range values {
+			v.codes[valueKey(value)] = code
+		}
+	}
+	return v
+}
+
+// withPrefixes adds prefix rules, checked in order after exact synonyms
+func (v *Vocabulary) withPrefixes(prefixes ...vocabularyPrefix) *Vocabulary {
+	v.prefixes = append(v.prefixes, prefixes...)
+	return v
+}
+
+// Normalize returns the canonical code for value. Values the vocabulary does
+// not know are trimmed and lowercased, so they at least compare consistently.
+func (v *Vocabulary) Normalize(value string) string {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return ""
+	}
+
+	key := valueKey(trimmed)
+	if code, ok := v.codes[key]; ok {
+		return code
+	}
+	for _, p := range v.prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.code
+		}
+	}
+	return strings.ToLower(trimmed)
+}
+
+// valueKey compares values ignoring case and punctuation, so "Yes", "YES "
+// and "y." match. Values made only of punctuation such as "+" are kept.
+func valueKey(value string) string {
+	if key := normalizeHeader(value); key != "" {
+		return key
+	}
+	return strings.TrimSpace(value)
+}
+
+var (
+	yesNoValues = newVocabulary("yes/no", map[string][]string{
+		CodeYes:     {"y", "1", "true", "t", "oui"},
+		CodeNo:      {"n", "0", "false", "f", "non"},
+		CodeUnknown: {"unk", "dk", "don't know", "do not know", "not known", "not sure"},
+	})
+	testResultValues = newVocabulary("test result", map[string][]string{
+		CodePositive: {"pos", "+", "reactive", "detected"},
+		CodeNegative: {"neg", "-", "non-reactive", "not detected"},
+		CodeUnknown:  {"unk", "dk", "don't know", "not known", "not done", "not tested"},
+	})
+	genderValues = newVocabulary("gender", map[string][]string{
+		CodeMale:    {"m", "man", "boy"},
+		CodeFemale:  {"f", "woman", "girl"},
+		CodeUnknown: {"unk", "not known"},
+	})
+	routeValues = newVocabulary("administration route", map[string][]string{
+		CodeIV:   {"i.v.", "intravenous", "intraveneous", "intra-venous"},
+		CodeIM:   {"i.m.", "intramuscular", "intra-muscular"},
+		CodeOral: {"po", "p.o.", "per os", "by mouth"},
+	}).withPrefixes(vocabularyPrefix{"iv", CodeIV}, vocabularyPrefix{"intraven", CodeIV})
+	awareValues = newVocabulary("AWaRe category", map[string][]string{
+		CodeAccess:         {"a"},
+		CodeWatch:          {"w"},
+		CodeReserve:        {"r"},
+		CodeNotRecommended: {"not recommended", "nr"},
+	})
+)
+
+// categoricalFields lists the vocabulary of every categorical column, by the
+// mapping field name, which is also the database column name
+var categoricalFields = map[string]*Vocabulary{
+	// Patients
+	"is_the_patient_an_infant":     yesNoValues,
+	"pre_term_birth":               yesNoValues,
+	"gender":                       genderValues,
+	"surgery_since_admission":      yesNoValues,
+	"urinary_catheter":             yesNoValues,
+	"peripheral_vascular_catheter": yesNoValues,
+	"central_vascular_catheter":    yesNoValues,
+	"intubation":                   yesNoValues,
+	"patient_on_antibiotic":        yesNoValues,
+	"malaria_status":               testResultValues,
+	"tuberculosis_status":          testResultValues,
+	"hiv_status":                   testResultValues,
+	"hiv_on_art":                   yesNoValues,
+	"diabetes":                     yesNoValues,
+	"hypertension":                 yesNoValues,
+	"hospitalization_90_days":      yesNoValues,
+
+	// Antibiotics
+	"antibiotic_written_in_inn":       yesNoValues,
+	"antibiotic_aware_classification": awareValues,
+	"administration_route":            routeValues,
+
+	// Antibiotic details and optional variables
+	"intraveno":             routeValues,
+	"intravenous_type":      routeValues,
+	"oral_switch":           yesNoValues,
+	"guideline":             yesNoValues,
+	"guidelines_compliance": yesNoValues,
+
+	// Indications
+	"reason_in_notes":      yesNoValues,
+	"culture_sample_taken": yesNoValues,
+
+	// Specimens
+	"culture_result": testResultValues,
+}
+
+// NormalizeValue returns the canonical code for a value of a categorical
+// field; values of other fields are returned unchanged
+func NormalizeValue(field, value string) string {
+	if vocabulary, ok := categoricalFields[field]; ok {
+		return vocabulary.Normalize(value)
+	}
+	return value
+}
+
+// NormalizeCodes rewrites the categorical columns of a model about to be
+// stored to their canonical codes, so records written through the API are
+// counted by the indicators like imported ones
+func NormalizeCodes(db *gorm.DB, model interface{}) error {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return fmt.Errorf("error reading model: %v", err)
+	}
+
+	value := reflect.ValueOf(model).Elem()
+	for _, field := range stmt.Schema.Fields {
+		if _, ok := categoricalFields[field.DBName]; !ok {
+			continue
+		}
+		raw, _ := field.ValueOf(context.Background(), value)
+		if text, ok := raw.(string); ok && text != "" {
+			if err := field.Set(context.Background(), value, NormalizeValue(field.DBName, text)); err != nil {
+				return fmt.Errorf("error setting %s: %v", field.DBName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ValueChange is a raw value of a column rewritten to its canonical code
+type ValueChange struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Rows   int64  `json:"rows"`
+}
+
+// NormalizeStoredValues rewrites the categorical columns of rows imported
+// before normalisation existed to their canonical codes. With dryRun the
+// changes are only reported.
+func NormalizeStoredValues(db *gorm.DB, dryRun bool) ([]ValueChange, error) {
+	changes := make([]ValueChange, 0)
+
+	fields := make([]string, 0, len(categoricalFields))
+	for field := range categoricalFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, table := range importTables {
+			stmt := &gorm.Statement{DB: tx}
+			if err := stmt.Parse(table.model); err != nil {
+				return fmt.Errorf("error reading %s model: %v", table.entity, err)
+			}
+			tableName := stmt.Schema.Table
+
+			for _, column := range fields {
+				if _, ok := stmt.Schema.FieldsByDBName[column]; !ok {
+					continue
+				}
+
+				var values []struct {
+					Value string
+					Total int64
+				}
+				err := tx.Model(table.model).
+					Select(column + " AS value, COUNT(*) AS total").
+					Where(column + " IS NOT NULL AND " + column + " <> ''").
+					Group(column).Scan(&values).Error
+				if err != nil {
+					return fmt.Errorf("error reading %s.%s: %v", tableName, column, err)
+				}
+
+				for _, value := range values {
+					canonical := NormalizeValue(column, value.Value)
+					if canonical == value.Value {
+						continue
+					}
+
+					change := ValueChange{Table: tableName, Column: column, From: value.Value, To: canonical, Rows: value.Total}
+					if !dryRun {
+						result := tx.Model(table.model).Where(column+" = ?", value.Value).Update(column, canonical)
+						if result.Error != nil {
+							return fmt.Errorf("error updating %s.%s: %v", tableName, column, result.Error)
+						}
+						change.Rows = result.RowsAffected
+					}
+					changes = append(changes, change)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Normalised %d distinct values of categorical columns", len(changes))
+	return changes, nil
+}
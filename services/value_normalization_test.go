@@ -0,0 +1,37 @@
+package services
+
+import (
+	"point-prevalence-survey/models"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/utils/tests"
+)
+
+func TestNormalizeCodes(t *testing.T) {
+	db, err := gorm.Open(tests.DummyDialector{}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+
+	optionalVar := &models.OptionalVar{
+		ID:                   "ov-1",
+		IntravenousType:      "Intravenous",
+		OralSwitch:           "Y",
+		GuidelinesCompliance: "",
+		TreatmentType:        "Empirical",
+	}
+	if err := NormalizeCodes(db, optionalVar); err != nil {
+		t.Fatalf("NormalizeCodes: %v", err)
+	}
+
+	if optionalVar.IntravenousType != CodeIV || optionalVar.OralSwitch != CodeYes {
+		t.Errorf("categorical values = %q, %q, want %q, %q", optionalVar.IntravenousType, optionalVar.OralSwitch, CodeIV, CodeYes)
+	}
+	if optionalVar.GuidelinesCompliance != "" {
+		t.Errorf("blank guidelines_compliance = %q, want it left blank", optionalVar.GuidelinesCompliance)
+	}
+	if optionalVar.TreatmentType != "Empirical" || optionalVar.ID != "ov-1" {
+		t.Errorf("other fields = %q, %q, want them unchanged", optionalVar.TreatmentType, optionalVar.ID)
+	}
+}
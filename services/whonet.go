@@ -0,0 +1,731 @@
+package services
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"point-prevalence-survey/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// JobEntityWhonet is the import job entity of WHONET result files
+const JobEntityWhonet = "whonet"
+
+// Row error codes of WHONET imports
+const (
+	RowErrorSpecimenNotFound = "specimen_not_found"
+	RowErrorPatientMismatch  = "patient_mismatch"
+)
+
+// RowWarningWhonetValue marks an antibiotic result of a WHONET file that could
+// not be read
+const RowWarningWhonetValue = "invalid_whonet_value"
+
+// whonetNoGrowth is the WHONET organism code for a culture without growth
+const whonetNoGrowth = "xxx"
+
+// whonetCode is a WHONET code with the name stored in the survey data and
+// other names it is written as
+type whonetCode struct {
+	code     string
+	name     string
+	synonyms []string
+}
+
+// whonetAntibiotics are the WHONET codes of antibiotics commonly tested
+var whonetAntibiotics = []whonetCode{
+	{"AMK", "Amikacin", []string{"AN", "AK"}},
+	{"AMC", "Amoxicillin-clavulanate", []string{"Amoxicillin/clavulanic acid", "Co-amoxiclav", "Augmentin", "AUG"}},
+	{"AMP", "Ampicillin", []string{"AM"}},
+	{"AMX", "Amoxicillin", []string{"AML"}},
+	{"ATM", "Aztreonam", []string{"AZT"}},
+	{"AZM", "Azithromycin", []string{"AZI"}},
+	{"CAZ", "Ceftazidime", nil},
+	{"CHL", "Chloramphenicol", nil},
+	{"CIP", "Ciprofloxacin", nil},
+	{"CLI", "Clindamycin", []string{"DA", "CC"}},
+	{"CLO", "Cloxacillin", nil},
+	{"COL", "Colistin", []string{"CT"}},
+	{"CRO", "Ceftriaxone", []string{"CTR"}},
+	{"CTX", "Cefotaxime", nil},
+	{"CXM", "Cefuroxime", []string{"CXA"}},
+	{"CZO", "Cefazolin", []string{"KZ"}},
+	{"DOX", "Doxycycline", []string{"DO"}},
+	{"ERY", "Erythromycin", nil},
+	{"ETP", "Ertapenem", nil},
+	{"FEP", "Cefepime", []string{"CPM"}},
+	{"FOS", "Fosfomycin", []string{"FOF"}},
+	{"FOX", "Cefoxitin", nil},
+	{"GEN", "Gentamicin", []string{"CN", "GM"}},
+	{"IPM", "Imipenem", []string{"IMP", "IMI"}},
+	{"LNZ", "Linezolid", []string{"LZD"}},
+	{"LVX", "Levofloxacin", []string{"LEV"}},
+	{"MEM", "Meropenem", []string{"MRP"}},
+	{"MFX", "Moxifloxacin", []string{"MXF"}},
+	{"NAL", "Nalidixic acid", nil},
+	{"NIT", "Nitrofurantoin", []string{"NF"}},
+	{"OXA", "Oxacillin", []string{"OX"}},
+	{"PEN", "Penicillin G", []string{"Penicillin", "Benzylpenicillin"}},
+	{"RIF", "Rifampicin", []string{"Rifampin", "RA", "RD"}},
+	{"SAM", "Ampicillin-sulbactam", []string{"Ampicillin/sulbactam"}},
+	{"SXT", "Co-trimoxazole", []string{"Trimethoprim-sulfamethoxazole", "Trimethoprim/sulfamethoxazole", "Cotrimoxazole", "Septrin", "Bactrim", "TMP-SMX"}},
+	{"TCY", "Tetracycline", []string{"TE"}},
+	{"TGC", "Tigecycline", nil},
+	{"TOB", "Tobramycin", []string{"TM", "NN"}},
+	{"TZP", "Piperacillin-tazobactam", []string{"Piperacillin/tazobactam", "Pip-tazo", "Tazocin", "PTZ"}},
+	{"VAN", "Vancomycin", []string{"VA"}},
+}
+
+// whonetOrganisms are the WHONET codes of organisms commonly isolated
+var whonetOrganisms = []whonetCode{
+	{"aba", "Acinetobacter baumannii", []string{"A. baumannii"}},
+	{"cal", "Candida albicans", []string{"C. albicans"}},
+	{"cfr", "Citrobacter freundii", []string{"C. freundii"}},
+	{"ecl", "Enterobacter cloacae", []string{"E. cloacae"}},
+	{"eco", "Escherichia coli", []string{"E. coli", "E coli"}},
+	{"efa", "Enterococcus faecalis", []string{"E. faecalis"}},
+	{"efm", "Enterococcus faecium", []string{"E. faecium"}},
+	{"hin", "Haemophilus influenzae", []string{"H. influenzae"}},
+	{"kox", "Klebsiella oxytoca", []string{"K. oxytoca"}},
+	{"kpn", "Klebsiella pneumoniae", []string{"K. pneumoniae", "Klebsiella"}},
+	{"pae", "Pseudomonas aeruginosa", []string{"P. aeruginosa", "Pseudomonas"}},
+	{"pmi", "Proteus mirabilis", []string{"P. mirabilis"}},
+	{"sau", "Staphylococcus aureus", []string{"S. aureus", "MRSA"}},
+	{"sma", "Serratia marcescens", []string{"S. marcescens"}},
+	{"spn", "Streptococcus pneumoniae", []string{"S. pneumoniae", "Pneumococcus"}},
+	{"spy", "Streptococcus pyogenes", []string{"S. pyogenes"}},
+	{"sty", "Salmonella Typhi", []string{"S. Typhi", "Salmonella typhi"}},
+}
+
+// whonetLookup finds WHONET codes by code or name, ignoring case and punctuation
+type whonetLookup struct {
+	byKey  map[string]whonetCode
+	byCode map[string]whonetCode
+}
+
+func newWhonetLookup(codes []whonetCode) *whonetLookup {
+	l := &whonetLookup{byKey: make(map[string]whonetCode), byCode: make(map[string]whonetCode)}
+	for _, c := range codes {
+		l.byCode[strings.ToLower(c.code)] = c
+		l.byKey[valueKey(c.name)] = c
+		for _, synonym := range c.synonyms {
+			l.byKey[valueKey(synonym)] = c
+		}
+	}
+	return l
+}
+
+// codeFor returns the WHONET code of a name written in the survey data
+func (l *whonetLookup) codeFor(name string) (string, bool) {
+	if c, ok := l.byKey[valueKey(name)]; ok {
+		return c.code, true
+	}
+	if c, ok := l.byCode[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return c.code, true
+	}
+	return "", false
+}
+
+// nameFor returns the name stored for a WHONET code, or the code itself
+func (l *whonetLookup) nameFor(code string) string {
+	if c, ok := l.byCode[strings.ToLower(strings.TrimSpace(code))]; ok {
+		return c.name
+	}
+	return strings.TrimSpace(code)
+}
+
+var (
+	whonetAntibioticCodes = newWhonetLookup(whonetAntibiotics)
+	whonetOrganismCodes   = newWhonetLookup(whonetOrganisms)
+)
+
+// whonetResultColumn matches antibiotic result columns such as AMP_ND10,
+// CIP_NM or GEN_EE: the antibiotic code, the guideline (N for CLSI, E for
+// EUCAST) and the method (D disk, M MIC, E Etest), optionally with the disk
+// potency
+var whonetResultColumn = regexp.MustCompile(`(?i)^([A-Z]{3})_([NE])([DME])(\d+(?:\.\d+)?)?$`)
+
+// whonetResultValue matches a result value: a measurement, an interpretation,
+// or both, e.g. "<=0.25", "22", "R" or "22 R"
+var whonetResultValue = regexp.MustCompile(`(?i)^(<=|>=|<|>|=)?\s*(\d+(?:\.\d+)?)?\s*([SIR])?$`)
+
+// whonetPhenotypes are WHONET's resistance phenotype fields, the name they
+// are stored as in the specimen's resistant phenotype and the word that
+// marks them there
+var whonetPhenotypes = []struct {
+	column  string
+	name    string
+	keyword string
+}{
+	{"ESBL", "ESBL", "esbl"},
+	{"MRSA", "MRSA", "mrsa"},
+	{"CARBAPENEM", "Carbapenemase", "carbapenem"},
+}
+
+// whonetPatientColumns are the demographic and specimen columns of an export,
+// in WHONET's field names
+var whonetPatientColumns = []string{
+	"PATIENT_ID", "SEX", "AGE", "DATE_ADMIS", "PAT_TYPE", "INSTITUT", "WARD", "REGION", "DISTRICT",
+	"SPEC_NUM", "SPEC_DATE", "SPEC_TYPE", "ORGANISM", "ESBL", "MRSA", "CARBAPENEM", "COMMENT",
+}
+
+// whonetIsolate is one row of a WHONET export: a specimen and one organism
+type whonetIsolate struct {
+	specimen *models.Specimen
+	organism string
+	results  []models.SusceptibilityResult
+}
+
+// ExportWhonet writes the specimens selected by query as a WHONET flat file,
+// with one row per specimen and organism and the patient's demographics.
+// Antibiotic results are written in WHONET result columns: MICs in CODE_NM,
+// zone diameters in CODE_ND, and results given only as S, I or R in CODE_ND.
+// Results of antibiotics without a WHONET code are added to COMMENT. It
+// returns the number of rows written.
+func ExportWhonet(db *gorm.DB, query *gorm.DB, w io.Writer, comma rune) (int, error) {
+	var specimens []models.Specimen
+	if err := query.Preload("SusceptibilityResults", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Order("key").Find(&specimens).Error; err != nil {
+		return 0, fmt.Errorf("error loading specimens: %v", err)
+	}
+
+	patientKeys := make([]string, 0, len(specimens))
+	for _, specimen := range specimens {
+		patientKeys = append(patientKeys, specimen.ParentKey)
+	}
+	var patients []models.Patient
+	if len(patientKeys) > 0 {
+		if err := db.Where("key IN ?", patientKeys).Find(&patients).Error; err != nil {
+			return 0, fmt.Errorf("error loading patients: %v", err)
+		}
+	}
+	patientsByKey := make(map[string]*models.Patient, len(patients))
+	for i := range patients {
+		patientsByKey[patients[i].ID] = &patients[i]
+	}
+
+	rows, err := writeWhonet(w, comma, specimens, patientsByKey)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Exported %d WHONET rows from %d specimens", rows, len(specimens))
+	return rows, nil
+}
+
+// writeWhonet writes specimens, with their loaded results, as WHONET rows
+func writeWhonet(w io.Writer, comma rune, specimens []models.Specimen, patientsByKey map[string]*models.Patient) (int, error) {
+	// Group results into isolates and collect the result columns in use
+	isolates := make([]whonetIsolate, 0, len(specimens))
+	columns := make(map[string]bool)
+	for i := range specimens {
+		specimen := &specimens[i]
+		byOrganism := make(map[string]int)
+		start := len(isolates)
+		for _, result := range specimen.SusceptibilityResults {
+			idx, ok := byOrganism[result.Organism]
+			if !ok {
+				idx = len(isolates)
+				byOrganism[result.Organism] = idx
+				isolates = append(isolates, whonetIsolate{specimen: specimen, organism: result.Organism})
+			}
+			isolates[idx].results = append(isolates[idx].results, result)
+			if column := whonetColumn(result); column != "" {
+				columns[column] = true
+			}
+		}
+		if len(isolates) == start {
+			isolates = append(isolates, whonetIsolate{specimen: specimen, organism: specimen.Microorganism})
+		}
+	}
+
+	resultColumns := make([]string, 0, len(columns))
+	for column := range columns {
+		resultColumns = append(resultColumns, column)
+	}
+	sort.Strings(resultColumns)
+
+	writer := csv.NewWriter(w)
+	writer.Comma = comma
+	if err := writer.Write(append(append([]string{}, whonetPatientColumns...), resultColumns...)); err != nil {
+		return 0, err
+	}
+
+	for _, isolate := range isolates {
+		row := whonetRow(isolate, patientsByKey[isolate.specimen.ParentKey], resultColumns)
+		if err := writer.Write(row); err != nil {
+			return 0, err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return 0, err
+	}
+	return len(isolates), nil
+}
+
+// whonetColumn returns the result column of a result, or "" if its
+// antibiotic has no WHONET code
+func whonetColumn(result models.SusceptibilityResult) string {
+	code, ok := whonetAntibioticCodes.codeFor(result.Antibiotic)
+	if !ok {
+		return ""
+	}
+	if result.MIC != nil {
+		return code + "_NM"
+	}
+	return code + "_ND"
+}
+
+// whonetRow builds the row of one isolate
+func whonetRow(isolate whonetIsolate, patient *models.Patient, resultColumns []string) []string {
+	specimen := isolate.specimen
+	values := make(map[string]string)
+
+	values["SPEC_NUM"] = specimen.ID
+	values["PATIENT_ID"] = specimen.ParentKey
+	values["SPEC_TYPE"] = specimen.SpecimenType
+	values["PAT_TYPE"] = "in"
+
+	switch {
+	case isolate.organism != "":
+		values["ORGANISM"] = isolate.organism
+		if code, ok := whonetOrganismCodes.codeFor(isolate.organism); ok {
+			values["ORGANISM"] = code
+		}
+	case specimen.CultureResult == CodeNegative:
+		values["ORGANISM"] = whonetNoGrowth
+	}
+
+	phenotype := strings.ToLower(specimen.ResistantPhenotype)
+	for _, p := range whonetPhenotypes {
+		if strings.Contains(phenotype, p.keyword) {
+			values[p.column] = "+"
+		}
+	}
+
+	comments := make([]string, 0)
+	if specimen.ResistantPhenotype != "" {
+		comments = append(comments, specimen.ResistantPhenotype)
+	}
+	for _, result := range isolate.results {
+		column := whonetColumn(result)
+		if column == "" {
+			comments = append(comments, formatSusceptibilityResult(result))
+			continue
+		}
+		values[column] = whonetValue(result)
+	}
+	values["COMMENT"] = strings.Join(comments, "; ")
+
+	if patient != nil {
+		switch patient.Gender {
+		case CodeMale:
+			values["SEX"] = "m"
+		case CodeFemale:
+			values["SEX"] = "f"
+		}
+		// WHONET reads ages without a unit as years and "6m" as months
+		if patient.IsThePatientAnInfant == CodeYes && patient.AgeMonths > 0 {
+			values["AGE"] = fmt.Sprintf("%dm", patient.AgeMonths)
+		} else if patient.AgeYears > 0 {
+			values["AGE"] = strconv.Itoa(patient.AgeYears)
+		}
+		if !patient.AdmissionDate.IsZero() {
+			values["DATE_ADMIS"] = patient.AdmissionDate.Format("2006-01-02")
+		}
+		if !patient.SurveyDate.IsZero() {
+			values["SPEC_DATE"] = patient.SurveyDate.Format("2006-01-02")
+		}
+		values["INSTITUT"] = patient.Facility
+		values["WARD"] = patient.WardName
+		values["REGION"] = patient.Region
+		values["DISTRICT"] = patient.District
+	}
+
+	row := make([]string, 0, len(whonetPatientColumns)+len(resultColumns))
+	for _, column := range whonetPatientColumns {
+		row = append(row, values[column])
+	}
+	for _, column := range resultColumns {
+		row = append(row, values[column])
+	}
+	return row
+}
+
+// whonetValue writes the measurement of a result followed by its
+// interpretation, e.g. "<=0.25 S", or either one alone
+func whonetValue(result models.SusceptibilityResult) string {
+	var value string
+	switch {
+	case result.MIC != nil:
+		value = result.MICComparator + strconv.FormatFloat(*result.MIC, 'f', -1, 64)
+	case result.ZoneDiameter != nil:
+		value = strconv.FormatFloat(*result.ZoneDiameter, 'f', -1, 64)
+	}
+	return strings.TrimSpace(value + " " + result.Interpretation)
+}
+
+// formatSusceptibilityResult writes a result the way ParseSusceptibilityResults
+// reads it, e.g. "Ciprofloxacin S (MIC <=0.25)"
+func formatSusceptibilityResult(result models.SusceptibilityResult) string {
+	text := result.Antibiotic
+	if result.Interpretation != "" {
+		text += " " + result.Interpretation
+	}
+	switch {
+	case result.MIC != nil:
+		text += fmt.Sprintf(" (MIC %s%s)", result.MICComparator, strconv.FormatFloat(*result.MIC, 'f', -1, 64))
+	case result.ZoneDiameter != nil:
+		text += fmt.Sprintf(" (zone %smm)", strconv.FormatFloat(*result.ZoneDiameter, 'f', -1, 64))
+	}
+	return text
+}
+
+// formatSusceptibilityText writes the results of a specimen as free text,
+// grouped by organism, so that parsing it gives the same results
+func formatSusceptibilityText(results []models.SusceptibilityResult) string {
+	organisms := make([]string, 0)
+	byOrganism := make(map[string][]string)
+	for _, result := range results {
+		if _, ok := byOrganism[result.Organism]; !ok {
+			organisms = append(organisms, result.Organism)
+		}
+		byOrganism[result.Organism] = append(byOrganism[result.Organism], formatSusceptibilityResult(result))
+	}
+
+	// Results without an organism come first, before any organism prefix
+	sort.SliceStable(organisms, func(i, j int) bool {
+		return organisms[i] == "" && organisms[j] != ""
+	})
+
+	groups := make([]string, 0, len(organisms))
+	for _, organism := range organisms {
+		group := strings.Join(byOrganism[organism], ", ")
+		if organism != "" {
+			group = organism + ": " + group
+		}
+		groups = append(groups, group)
+	}
+	return strings.Join(groups, "; ")
+}
+
+// ImportWhonet reads a WHONET result file and adds its organisms, antibiotic
+// results and resistance phenotypes to existing specimens, matched by
+// SPEC_NUM. Results for an organism replace the specimen's earlier results
+// for that organism. In a dry run the changes are rolled back.
+func (s *CSVService) ImportWhonet(file io.Reader, opts ImportOptions) (*UploadResult, error) {
+	opts, err := normalizeOptions(opts)
+	if err != nil {
+		return newUploadResult(false), err
+	}
+
+	reader, err := newWhonetReader(file)
+	if err != nil {
+		return newUploadResult(opts.DryRun), err
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return newUploadResult(opts.DryRun), fmt.Errorf("WHONET file must have a header row and at least one data row")
+	}
+	if err != nil {
+		return newUploadResult(opts.DryRun), fmt.Errorf("error reading WHONET file: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	if _, ok := columns["SPEC_NUM"]; !ok {
+		return newUploadResult(opts.DryRun), fmt.Errorf("%w: WHONET file has no SPEC_NUM column", ErrColumnMapping)
+	}
+
+	result := newUploadResult(opts.DryRun)
+	result.Header = header
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = s.batchSize
+	}
+
+	// Rows are written in batches of their own transaction, unless a dry run
+	// or atomic import needs the whole file in one to roll it back
+	readRows := func(db *gorm.DB) error {
+		batch := make([]whonetRecord, 0, opts.BatchSize)
+		rowNum := 1
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			rowNum++
+			result.TotalRecords++
+			result.ProcessedRecords++
+
+			batch = append(batch, whonetRecord{rowNum: rowNum, record: record, err: err})
+			if len(batch) >= opts.BatchSize {
+				s.writeWhonetBatch(db, header, columns, batch, opts, result)
+				batch = batch[:0]
+				if opts.Progress != nil {
+					opts.Progress(result)
+				}
+			}
+		}
+		if len(batch) > 0 {
+			s.writeWhonetBatch(db, header, columns, batch, opts, result)
+			if opts.Progress != nil {
+				opts.Progress(result)
+			}
+		}
+
+		if result.TotalRecords == 0 {
+			return fmt.Errorf("WHONET file must have a header row and at least one data row")
+		}
+		return nil
+	}
+
+	if !opts.DryRun && !opts.Atomic {
+		if err := readRows(s.db); err != nil {
+			return result, err
+		}
+		log.Printf("Imported WHONET file: %d specimens updated, %d rows skipped", result.UpdatedRecords, result.SkippedRecords)
+		return result, nil
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := readRows(tx); err != nil {
+			return err
+		}
+		if opts.DryRun || len(result.Errors) > 0 {
+			return errRollbackImport
+		}
+		return nil
+	})
+
+	if err == errRollbackImport {
+		if !opts.DryRun {
+			log.Printf("Rolled back WHONET import: %d rows failed", len(result.Errors))
+			result.RolledBack = true
+			result.SkippedRecords = result.TotalRecords
+			result.UpdatedRecords = 0
+		}
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	log.Printf("Imported WHONET file: %d specimens updated, %d rows skipped", result.UpdatedRecords, result.SkippedRecords)
+	return result, nil
+}
+
+// newWhonetReader returns a CSV reader for a WHONET file, which may be
+// separated by tabs, semicolons or commas
+func newWhonetReader(file io.Reader) (*csv.Reader, error) {
+	buffered := bufio.NewReader(file)
+	line, err := buffered.Peek(4096)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("error reading WHONET file: %v", err)
+	}
+	if i := strings.IndexByte(string(line), '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	comma := ','
+	best := strings.Count(string(line), ",")
+	for _, candidate := range []rune{'\t', ';'} {
+		if n := strings.Count(string(line), string(candidate)); n > best {
+			comma, best = candidate, n
+		}
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	return reader, nil
+}
+
+// whonetRecord is a row of a WHONET file waiting to be written, or the
+// error reading it
+type whonetRecord struct {
+	rowNum int
+	record []string
+	err    error
+}
+
+// writeWhonetBatch applies a batch of rows in a single transaction, adding
+// their outcomes to result once it commits. When db is already a transaction
+// the batch runs as a nested savepoint.
+func (s *CSVService) writeWhonetBatch(db *gorm.DB, header []string, columns map[string]int, batch []whonetRecord, opts ImportOptions, result *UploadResult) {
+	batchResult := &UploadResult{DryRun: result.DryRun}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range batch {
+			if row.err != nil {
+				batchResult.rowError(row.rowNum, "", row.record, RowError{Code: RowErrorMalformed, Message: fmt.Sprintf("malformed row: %v", row.err)})
+				continue
+			}
+			s.importWhonetRow(tx, header, columns, row.rowNum, row.record, opts, batchResult)
+		}
+		return nil
+	})
+
+	if err != nil {
+		for _, row := range batch {
+			result.rowError(row.rowNum, "", row.record, RowError{Code: RowErrorDatabase, Message: fmt.Sprintf("error writing batch: %v", err)})
+		}
+		return
+	}
+	result.merge(batchResult)
+}
+
+// importWhonetRow applies one isolate of a WHONET file to its specimen
+func (s *CSVService) importWhonetRow(tx *gorm.DB, header []string, columns map[string]int, rowNum int, record []string, opts ImportOptions, result *UploadResult) {
+	get := func(column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	key := get("SPEC_NUM")
+	if key == "" {
+		result.rowError(rowNum, "", record, RowError{Column: "SPEC_NUM", Code: RowErrorMissingKey, Message: "missing specimen number (SPEC_NUM)"})
+		return
+	}
+
+	var specimen models.Specimen
+	if err := tx.First(&specimen, "key = ?", key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			result.rowError(rowNum, key, record, RowError{
+				Column:  "SPEC_NUM",
+				Code:    RowErrorSpecimenNotFound,
+				Message: fmt.Sprintf("specimen %s not found; WHONET results can only be added to imported specimens", key),
+			})
+			return
+		}
+		result.rowError(rowNum, key, record, RowError{Code: RowErrorDatabase, Message: fmt.Sprintf("database error loading specimen %s: %v", key, err)})
+		return
+	}
+	if patientID := get("PATIENT_ID"); patientID != "" && patientID != specimen.ParentKey {
+		result.rowError(rowNum, key, record, RowError{
+			Column:  "PATIENT_ID",
+			Code:    RowErrorPatientMismatch,
+			Message: fmt.Sprintf("specimen %s belongs to patient %s, not %s", key, specimen.ParentKey, patientID),
+		})
+		return
+	}
+
+	organism := get("ORGANISM")
+	noGrowth := strings.EqualFold(organism, whonetNoGrowth)
+	if noGrowth {
+		organism = ""
+	} else if organism != "" {
+		organism = whonetOrganismCodes.nameFor(organism)
+	}
+
+	isolate := whonetResults(header, record, organism, rowNum, key, result)
+
+	// Results for this organism replace the earlier ones, other organisms are kept
+	existing, _ := ParseSusceptibilityResults(&specimen)
+	merged := make([]models.SusceptibilityResult, 0, len(existing)+len(isolate))
+	for _, r := range existing {
+		if !strings.EqualFold(r.Organism, organism) {
+			merged = append(merged, r)
+		}
+	}
+	merged = append(merged, isolate...)
+
+	switch {
+	case organism != "":
+		specimen.CultureResult = CodePositive
+		if specimen.Microorganism == "" {
+			specimen.Microorganism = organism
+		} else if !strings.Contains(strings.ToLower(specimen.Microorganism), strings.ToLower(organism)) {
+			specimen.Microorganism += ", " + organism
+		}
+	case noGrowth && len(merged) == 0:
+		specimen.CultureResult = CodeNegative
+	}
+
+	for _, p := range whonetPhenotypes {
+		flag := get(p.column)
+		if (testResultValues.Normalize(flag) == CodePositive || yesNoValues.Normalize(flag) == CodeYes) &&
+			!strings.Contains(strings.ToLower(specimen.ResistantPhenotype), p.keyword) {
+			if specimen.ResistantPhenotype != "" {
+				specimen.ResistantPhenotype += ", "
+			}
+			specimen.ResistantPhenotype += p.name
+		}
+	}
+
+	if len(isolate) > 0 || organism != "" {
+		specimen.AntibioticSusceptibilityTestResults = formatSusceptibilityText(merged)
+	}
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		// Updated specimens keep the import that created them
+		if err := tx.Omit("import_id").Save(&specimen).Error; err != nil {
+			return err
+		}
+		if _, err := replaceSusceptibilityResults(tx, &specimen); err != nil {
+			return err
+		}
+		return s.rules.StoreFlags(tx, EntitySpecimens, &specimen, opts.ImportID)
+	})
+	if err != nil {
+		result.rowError(rowNum, key, record, RowError{Code: RowErrorDatabase, Message: fmt.Sprintf("error updating specimen %s: %v", key, err)})
+		return
+	}
+
+	result.UpdatedRecords++
+}
+
+// whonetResults reads the antibiotic results of an isolate from the result
+// columns of its row, warning about values that cannot be read
+func whonetResults(header []string, record []string, organism string, rowNum int, key string, result *UploadResult) []models.SusceptibilityResult {
+	isolate := make([]models.SusceptibilityResult, 0)
+	for i, name := range header {
+		m := whonetResultColumn.FindStringSubmatch(strings.TrimSpace(name))
+		if m == nil || i >= len(record) || strings.TrimSpace(record[i]) == "" {
+			continue
+		}
+
+		value := strings.TrimSpace(record[i])
+		v := whonetResultValue.FindStringSubmatch(value)
+		if v == nil || (v[2] == "" && v[3] == "") {
+			result.rowWarning(rowNum, key, RowError{
+				Column:  name,
+				Code:    RowWarningWhonetValue,
+				Message: fmt.Sprintf("could not read result %q in column %s", value, name),
+			})
+			continue
+		}
+
+		r := models.SusceptibilityResult{
+			Organism:       organism,
+			Antibiotic:     whonetAntibioticCodes.nameFor(m[1]),
+			Interpretation: strings.ToUpper(v[3]),
+		}
+		if v[2] != "" {
+			measurement, _ := strconv.ParseFloat(v[2], 64)
+			if strings.EqualFold(m[3], "D") {
+				r.ZoneDiameter = &measurement
+			} else {
+				r.MIC = &measurement
+				r.MICComparator = strings.TrimPrefix(v[1], "=")
+			}
+		}
+		isolate = append(isolate, r)
+	}
+	return isolate
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"point-prevalence-survey/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewWhonetReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		comma rune
+	}{
+		{name: "tabs", input: "SPEC_NUM\tORGANISM\tAMP_ND10\nS1\teco\t6 R\n", comma: '\t'},
+		{name: "semicolons", input: "SPEC_NUM;ORGANISM;AMP_ND10\nS1;eco;6 R\n", comma: ';'},
+		{name: "commas", input: "SPEC_NUM,ORGANISM,AMP_ND10\nS1,eco,6 R\n", comma: ','},
+		{name: "header only", input: "SPEC_NUM;ORGANISM;AMP_ND10", comma: ';'},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := newWhonetReader(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("newWhonetReader: %v", err)
+			}
+			if reader.Comma != tt.comma {
+				t.Errorf("Comma = %q, want %q", reader.Comma, tt.comma)
+			}
+			header, err := reader.Read()
+			if err != nil || !reflect.DeepEqual(header, []string{"SPEC_NUM", "ORGANISM", "AMP_ND10"}) {
+				t.Errorf("header = %q, %v", header, err)
+			}
+		})
+	}
+
+	// Rows may be shorter or longer than the header
+	reader, err := newWhonetReader(strings.NewReader("SPEC_NUM,ORGANISM\nS1\nS2,eco,extra\n"))
+	if err != nil {
+		t.Fatalf("newWhonetReader: %v", err)
+	}
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+}
+
+func TestWhonetResultColumn(t *testing.T) {
+	tests := []struct {
+		column string
+		want   []string
+	}{
+		{column: "AMP_ND10", want: []string{"AMP", "N", "D", "10"}},
+		{column: "CIP_NM", want: []string{"CIP", "N", "M", ""}},
+		{column: "GEN_EE", want: []string{"GEN", "E", "E", ""}},
+		{column: "SXT_ND1.25", want: []string{"SXT", "N", "D", "1.25"}},
+		{column: "amp_nd10", want: []string{"amp", "n", "d", "10"}},
+		{column: "SPEC_NUM"},
+		{column: "AMPI_ND10"},
+		{column: "AMP_XD10"},
+		{column: "AMP_NX"},
+		{column: "AMP_ND10 R"},
+	}
+
+	for _, tt := range tests {
+		m := whonetResultColumn.FindStringSubmatch(tt.column)
+		var got []string
+		if m != nil {
+			got = m[1:]
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("whonetResultColumn(%q) = %q, want %q", tt.column, got, tt.want)
+		}
+	}
+}
+
+func TestWhonetResultValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "<=0.25", want: []string{"<=", "0.25", ""}},
+		{value: "22", want: []string{"", "22", ""}},
+		{value: "R", want: []string{"", "", "R"}},
+		{value: "22 R", want: []string{"", "22", "R"}},
+		{value: ">= 8 i", want: []string{">=", "8", "i"}},
+		{value: "=4S", want: []string{"=", "4", "S"}},
+		{value: "resistant"},
+		{value: "22 mm"},
+		{value: "R 22"},
+	}
+
+	for _, tt := range tests {
+		m := whonetResultValue.FindStringSubmatch(tt.value)
+		var got []string
+		if m != nil {
+			got = m[1:]
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("whonetResultValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	// An empty value matches but carries no result, and is skipped as blank
+	result := newUploadResult(false)
+	if isolate := whonetResults([]string{"AMP_ND10", "CIP_NM"}, []string{"", "<="}, "", 2, "S1", result); len(isolate) != 0 {
+		t.Errorf("whonetResults = %+v, want none", isolate)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0].Code != RowWarningWhonetValue || result.Warnings[0].Column != "CIP_NM" {
+		t.Errorf("warnings = %+v, want CIP_NM reported", result.Warnings)
+	}
+}
+
+func TestWhonetRoundTrip(t *testing.T) {
+	mic, zone, low := 0.25, 21.0, 8.0
+	specimens := []models.Specimen{
+		{
+			ID:                 "uuid:p1/Specimens[1]",
+			ParentKey:          "uuid:p1",
+			SpecimenType:       "Blood",
+			CultureResult:      CodePositive,
+			Microorganism:      "Escherichia coli, Staphylococcus aureus",
+			ResistantPhenotype: "ESBL",
+			SusceptibilityResults: []models.SusceptibilityResult{
+				{Organism: "Escherichia coli", Antibiotic: "Ciprofloxacin", Interpretation: "S", MICComparator: "<=", MIC: &mic},
+				{Organism: "Escherichia coli", Antibiotic: "Gentamicin", Interpretation: "S", ZoneDiameter: &zone},
+				{Organism: "Escherichia coli", Antibiotic: "Ampicillin", Interpretation: "R"},
+				{Organism: "Escherichia coli", Antibiotic: "Temocillin", Interpretation: "R"},
+				{Organism: "Staphylococcus aureus", Antibiotic: "Vancomycin", MICComparator: ">", MIC: &low},
+			},
+		},
+		{
+			ID:            "uuid:p2/Specimens[1]",
+			ParentKey:     "uuid:p2",
+			SpecimenType:  "Urine",
+			CultureResult: CodeNegative,
+		},
+	}
+	patients := map[string]*models.Patient{
+		"uuid:p1": {ID: "uuid:p1", Gender: CodeFemale, AgeYears: 42, Facility: "Mulago", WardName: "Medical"},
+	}
+
+	var buf bytes.Buffer
+	rows, err := writeWhonet(&buf, '\t', specimens, patients)
+	if err != nil {
+		t.Fatalf("writeWhonet: %v", err)
+	}
+	if rows != 3 {
+		t.Fatalf("rows = %d, want one per organism and the negative culture", rows)
+	}
+
+	reader, err := newWhonetReader(&buf)
+	if err != nil {
+		t.Fatalf("newWhonetReader: %v", err)
+	}
+	header, err := reader.Read()
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	type isolate struct {
+		values  map[string]string
+		results []models.SusceptibilityResult
+	}
+	isolates := make([]isolate, 0)
+	result := newUploadResult(false)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read row: %v", err)
+		}
+		values := make(map[string]string)
+		for _, column := range whonetPatientColumns {
+			values[column] = record[columns[column]]
+		}
+		organism := whonetOrganismCodes.nameFor(values["ORGANISM"])
+		isolates = append(isolates, isolate{values: values, results: whonetResults(header, record, organism, len(isolates)+2, values["SPEC_NUM"], result)})
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("warnings = %+v, want every exported result readable", result.Warnings)
+	}
+	if len(isolates) != 3 {
+		t.Fatalf("isolates = %d, want 3", len(isolates))
+	}
+
+	// Results with a WHONET code come back as they were exported
+	exported := specimens[0].SusceptibilityResults
+	if want := []models.SusceptibilityResult{exported[2], exported[0], exported[1]}; !reflect.DeepEqual(isolates[0].results, want) {
+		t.Errorf("E. coli results = %+v, want %+v", isolates[0].results, want)
+	}
+	if want := exported[4:]; !reflect.DeepEqual(isolates[1].results, want) {
+		t.Errorf("S. aureus results = %+v, want %+v", isolates[1].results, want)
+	}
+	if len(isolates[2].results) != 0 {
+		t.Errorf("negative culture results = %+v, want none", isolates[2].results)
+	}
+
+	first := isolates[0].values
+	for column, want := range map[string]string{
+		"SPEC_NUM":   "uuid:p1/Specimens[1]",
+		"PATIENT_ID": "uuid:p1",
+		"ORGANISM":   "eco",
+		"SEX":        "f",
+		"AGE":        "42",
+		"INSTITUT":   "Mulago",
+		"ESBL":       "+",
+		"COMMENT":    "ESBL; Temocillin R",
+	} {
+		if first[column] != want {
+			t.Errorf("%s = %q, want %q", column, first[column], want)
+		}
+	}
+	if got := isolates[1].values["ORGANISM"]; got != "sau" {
+		t.Errorf("second organism = %q, want sau", got)
+	}
+	if got := isolates[2].values; got["ORGANISM"] != whonetNoGrowth || got["SEX"] != "" {
+		t.Errorf("negative culture = %v, want organism xxx and no patient", got)
+	}
+}
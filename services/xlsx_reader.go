@@ -0,0 +1,406 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rowReader yields the records of a table one at a time; csv.Reader and
+// xlsxRowReader both satisfy it
+type rowReader interface {
+	Read() ([]string, error)
+}
+
+// xlsxWorkbook reads the sheets of an Excel workbook. Only what the importer
+// needs is supported: cell values as text, with date cells written as ISO
+// dates so they go through the same date parsing as CSV files.
+type xlsxWorkbook struct {
+	archive       *zip.Reader
+	sheets        []xlsxSheet
+	sharedStrings []string
+	dateStyles    map[int]bool
+}
+
+// xlsxSheet is a worksheet and the part of the package that holds it
+type xlsxSheet struct {
+	name string
+	path string
+}
+
+// openXLSX reads the workbook structure, shared strings and cell styles
+func openXLSX(r io.ReaderAt, size int64) (*xlsxWorkbook, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("error reading XLSX file: %v", err)
+	}
+
+	wb := &xlsxWorkbook{archive: archive, dateStyles: make(map[int]bool)}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := wb.decode("xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := wb.decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		targets[rel.ID] = target
+	}
+
+	for _, sheet := range workbook.Sheets {
+		if target, ok := targets[sheet.ID]; ok {
+			wb.sheets = append(wb.sheets, xlsxSheet{name: sheet.Name, path: target})
+		}
+	}
+	if len(wb.sheets) == 0 {
+		return nil, fmt.Errorf("XLSX file has no worksheets")
+	}
+
+	if wb.has("xl/sharedStrings.xml") {
+		if err := wb.readSharedStrings(); err != nil {
+			return nil, err
+		}
+	}
+	if wb.has("xl/styles.xml") {
+		if err := wb.readDateStyles(); err != nil {
+			return nil, err
+		}
+	}
+
+	return wb, nil
+}
+
+// has reports whether the package contains a part
+func (wb *xlsxWorkbook) has(name string) bool {
+	for _, f := range wb.archive.File {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// open opens a part of the package
+func (wb *xlsxWorkbook) open(name string) (io.ReadCloser, error) {
+	for _, f := range wb.archive.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, fmt.Errorf("XLSX file is missing %s", name)
+}
+
+// decode unmarshals a whole XML part
+func (wb *xlsxWorkbook) decode(name string, v interface{}) error {
+	rc, err := wb.open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	return nil
+}
+
+// xlsxRichText is a string item that may be split into formatted runs
+type xlsxRichText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var b strings.Builder
+	for _, run := range t.Runs {
+		b.WriteString(run.Text)
+	}
+	return b.String()
+}
+
+func (wb *xlsxWorkbook) readSharedStrings() error {
+	var sst struct {
+		Items []xlsxRichText `xml:"si"`
+	}
+	if err := wb.decode("xl/sharedStrings.xml", &sst); err != nil {
+		return err
+	}
+
+	wb.sharedStrings = make([]string, len(sst.Items))
+	for i, item := range sst.Items {
+		wb.sharedStrings[i] = item.String()
+	}
+	return nil
+}
+
+// readDateStyles records which cell styles display numbers as dates, since
+// XLSX stores dates as day serial numbers
+func (wb *xlsxWorkbook) readDateStyles() error {
+	var styles struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellXfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	if err := wb.decode("xl/styles.xml", &styles); err != nil {
+		return err
+	}
+
+	dateFormats := make(map[int]bool)
+	// Built-in date and time formats
+	for _, id := range []int{14, 15, 16, 17, 18, 19, 20, 21, 22, 45, 46, 47} {
+		dateFormats[id] = true
+	}
+	for _, format := range styles.NumFmts {
+		if isDateFormatCode(format.Code) {
+			dateFormats[format.ID] = true
+		}
+	}
+
+	for i, xf := range styles.CellXfs {
+		if dateFormats[xf.NumFmtID] {
+			wb.dateStyles[i] = true
+		}
+	}
+	return nil
+}
+
+// isDateFormatCode reports whether a custom number format displays a date,
+// ignoring quoted literals and colour or locale sections in brackets
+func isDateFormatCode(code string) bool {
+	inQuote, inBracket := false, false
+	for _, r := range strings.ToLower(code) {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '[':
+			inBracket = true
+		case r == ']':
+			inBracket = false
+		case inBracket:
+		case r == 'd' || r == 'm' || r == 'y':
+			return true
+		}
+	}
+	return false
+}
+
+// rows opens a streaming reader over the rows of a sheet
+func (wb *xlsxWorkbook) rows(sheet xlsxSheet) (*xlsxRowReader, error) {
+	rc, err := wb.open(sheet.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xlsxRowReader{wb: wb, rc: rc, decoder: xml.NewDecoder(rc)}, nil
+}
+
+// xlsxRowReader streams the rows of a worksheet as records. Blank rows are
+// skipped and rows are padded to the width of the first (header) row, since
+// XLSX does not store empty trailing cells.
+type xlsxRowReader struct {
+	wb      *xlsxWorkbook
+	rc      io.ReadCloser
+	decoder *xml.Decoder
+	width   int
+	done    bool
+}
+
+// xlsxCell is a <c> element of a worksheet
+type xlsxCell struct {
+	Ref       string       `xml:"r,attr"`
+	Type      string       `xml:"t,attr"`
+	Style     int          `xml:"s,attr"`
+	Value     string       `xml:"v"`
+	InlineStr xlsxRichText `xml:"is"`
+}
+
+// Read returns the next non-blank row
+func (r *xlsxRowReader) Read() ([]string, error) {
+	for !r.done {
+		token, err := r.decoder.Token()
+		if err == io.EOF {
+			r.done = true
+			break
+		}
+		if err != nil {
+			// The sheet cannot be read any further
+			r.done = true
+			return nil, fmt.Errorf("error reading worksheet: %v", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+
+		var row struct {
+			Cells []xlsxCell `xml:"c"`
+		}
+		if err := r.decoder.DecodeElement(&row, &start); err != nil {
+			r.done = true
+			return nil, fmt.Errorf("error reading worksheet row: %v", err)
+		}
+
+		record, blank, err := r.record(row.Cells)
+		if err != nil {
+			r.done = true
+			return nil, fmt.Errorf("error reading worksheet row: %v", err)
+		}
+		if blank {
+			continue
+		}
+
+		if r.width == 0 {
+			r.width = len(record)
+		}
+		for len(record) < r.width {
+			record = append(record, "")
+		}
+		return record, nil
+	}
+
+	return nil, io.EOF
+}
+
+// record converts the cells of a row to values placed by column reference.
+// Once the header row has set the width, cells to the right of it are
+// dropped, since they belong to no column.
+func (r *xlsxRowReader) record(cells []xlsxCell) ([]string, bool, error) {
+	record := make([]string, 0, len(cells))
+	blank := true
+
+	for i, cell := range cells {
+		col := i
+		if cell.Ref != "" {
+			c, err := columnIndex(cell.Ref)
+			if err != nil {
+				return nil, false, err
+			}
+			if c >= 0 {
+				col = c
+			}
+		}
+		if r.width > 0 && col >= r.width {
+			continue
+		}
+		for len(record) <= col {
+			record = append(record, "")
+		}
+
+		value := r.cellValue(cell)
+		if strings.TrimSpace(value) != "" {
+			blank = false
+		}
+		record[col] = value
+	}
+
+	return record, blank, nil
+}
+
+// cellValue returns the text of a cell
+func (r *xlsxRowReader) cellValue(cell xlsxCell) string {
+	switch cell.Type {
+	case "s":
+		i, err := strconv.Atoi(cell.Value)
+		if err != nil || i < 0 || i >= len(r.wb.sharedStrings) {
+			return ""
+		}
+		return r.wb.sharedStrings[i]
+	case "inlineStr":
+		return cell.InlineStr.String()
+	case "b":
+		if cell.Value == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "str", "e":
+		return cell.Value
+	}
+
+	if r.wb.dateStyles[cell.Style] && cell.Value != "" {
+		if serial, err := strconv.ParseFloat(cell.Value, 64); err == nil {
+			return excelSerialDate(serial)
+		}
+	}
+	return cell.Value
+}
+
+// Close releases the worksheet
+func (r *xlsxRowReader) Close() error {
+	return r.rc.Close()
+}
+
+// xlsxMaxColumns is the number of columns of a worksheet, A to XFD
+const xlsxMaxColumns = 16384
+
+// columnIndex converts the letters of a cell reference such as "AB12" to a
+// zero-based column index, or -1 when the reference has no letters.
+// References past XFD, the last column, are an error.
+func columnIndex(ref string) (int, error) {
+	col := 0
+	n := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		col = col*26 + int(c-'A'+1)
+		n++
+		if col > xlsxMaxColumns {
+			return 0, fmt.Errorf("cell reference %q is past the last column XFD", ref)
+		}
+	}
+	if n == 0 {
+		return -1, nil
+	}
+	return col - 1, nil
+}
+
+// excelSerialDate converts an Excel day serial (1900 date system) to the
+// "2006-01-02" or "2006-01-02 15:04:05" formats the date parser always accepts
+func excelSerialDate(serial float64) string {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	days := math.Floor(serial)
+	seconds := math.Round((serial - days) * 86400)
+	t := epoch.AddDate(0, 0, int(days)).Add(time.Duration(seconds) * time.Second)
+
+	if seconds == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildXLSX returns a workbook with one sheet holding rows, which are the
+// <row> elements of its sheetData
+func buildXLSX(t *testing.T, rows string) []byte {
+	t.Helper()
+
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+			<sheets><sheet name="patients" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships>
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst>
+			<si><t>KEY</t></si>
+			<si><t>facility</t></si>
+			<si><r><t>Mul</t></r><r><t>ago</t></r></si></sst>`,
+		"xl/styles.xml": `<styleSheet>
+			<numFmts><numFmt numFmtId="164" formatCode="dd/mm/yyyy"/><numFmt numFmtId="165" formatCode="0.00"/></numFmts>
+			<cellXfs><xf numFmtId="0"/><xf numFmtId="164"/><xf numFmtId="165"/><xf numFmtId="22"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>` + rows + `</sheetData></worksheet>`,
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range parts {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("close workbook: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// readXLSXRows reads every row of the only sheet of a workbook, returning
+// the error that stopped it, if any
+func readXLSXRows(t *testing.T, data []byte) ([][]string, error) {
+	t.Helper()
+
+	wb, err := openXLSX(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("openXLSX: %v", err)
+	}
+	reader, err := wb.rows(wb.sheets[0])
+	if err != nil {
+		t.Fatalf("rows: %v", err)
+	}
+	defer reader.Close()
+
+	records := make([][]string, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func TestXLSXRowReader(t *testing.T) {
+	data := buildXLSX(t, `
+		<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="inlineStr"><is><t>survey_date</t></is></c><c r="D1" t="str"><v>weight</v></c></row>
+		<row r="2"><c r="A2" t="inlineStr"><is><t>uuid:1</t></is></c><c r="B2" t="s"><v>2</v></c><c r="C2" s="1"><v>45413</v></c><c r="D2" s="2"><v>61.5</v></c></row>
+		<row r="3"><c r="A3"><v></v></c></row>
+		<row r="4"><c r="A4" t="str"><v>uuid:2</v></c><c r="C4" s="3"><v>45413.5</v></c><c r="F4" t="str"><v>past the header</v></c></row>
+		<row r="5"><c t="str"><v>uuid:3</v></c><c t="b"><v>1</v></c><c t="s"><v>99</v></c></row>`)
+
+	records, err := readXLSXRows(t, data)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	want := [][]string{
+		{"KEY", "facility", "survey_date", "weight"},
+		// Shared strings with rich text runs, date serials and plain numbers
+		{"uuid:1", "Mulago", "2024-05-01", "61.5"},
+		// The blank row is skipped, missing cells are padded and cells past
+		// the header are dropped
+		{"uuid:2", "", "2024-05-01 12:00:00", ""},
+		// Cells without references are placed in order; a shared string
+		// index past the table reads as blank
+		{"uuid:3", "TRUE", "", ""},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+}
+
+func TestXLSXRowReaderCellReferences(t *testing.T) {
+	tests := []struct {
+		name string
+		ref  string
+	}{
+		{name: "overflowing column", ref: "AAAAAAAAAAAAAAA1"},
+		{name: "past XFD", ref: "ZZZZZZZ1"},
+		{name: "one past XFD", ref: "XFE1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildXLSX(t, `
+				<row r="1"><c r="A1" t="str"><v>KEY</v></c></row>
+				<row r="2"><c r="`+tt.ref+`" t="str"><v>uuid:1</v></c></row>
+				<row r="3"><c r="A3" t="str"><v>uuid:2</v></c></row>`)
+
+			records, err := readXLSXRows(t, data)
+			if err == nil || !strings.Contains(err.Error(), "past the last column") {
+				t.Fatalf("error = %v, want the cell reference rejected", err)
+			}
+			if len(records) != 1 {
+				t.Errorf("records = %q, want only the header before the error", records)
+			}
+		})
+	}
+
+	// The last column is still read, into the header
+	data := buildXLSX(t, `<row r="1"><c r="A1" t="str"><v>KEY</v></c><c r="XFD1" t="str"><v>last</v></c></row>`)
+	records, err := readXLSXRows(t, data)
+	if err != nil || len(records) != 1 || len(records[0]) != xlsxMaxColumns || records[0][xlsxMaxColumns-1] != "last" {
+		t.Errorf("header with XFD: %d records, err %v", len(records), err)
+	}
+}
+
+func TestColumnIndex(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    int
+		wantErr bool
+	}{
+		{ref: "A1", want: 0},
+		{ref: "Z9", want: 25},
+		{ref: "AA10", want: 26},
+		{ref: "AB12", want: 27},
+		{ref: "XFD1048576", want: 16383},
+		{ref: "12", want: -1},
+		{ref: "XFE1", wantErr: true},
+		{ref: "AAAAAAAAAAAAAAA1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := columnIndex(tt.ref)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("columnIndex(%q) = %d, %v, want %d (error %v)", tt.ref, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExcelSerialDate(t *testing.T) {
+	tests := []struct {
+		serial float64
+		want   string
+	}{
+		{serial: 45413, want: "2024-05-01"},
+		{serial: 45413.25, want: "2024-05-01 06:00:00"},
+		{serial: 1, want: "1899-12-31"},
+		{serial: 61, want: "1900-03-01"},
+	}
+
+	for _, tt := range tests {
+		if got := excelSerialDate(tt.serial); got != tt.want {
+			t.Errorf("excelSerialDate(%v) = %q, want %q", tt.serial, got, tt.want)
+		}
+	}
+}
+
+func TestIsDateFormatCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{code: "dd/mm/yyyy", want: true},
+		{code: "yyyy-mm-dd hh:mm", want: true},
+		{code: "0.00", want: false},
+		{code: `0 "days"`, want: false},
+		{code: "[Red]0.00", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isDateFormatCode(tt.code); got != tt.want {
+			t.Errorf("isDateFormatCode(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}